@@ -0,0 +1,262 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// archiveDirectory stores the contents of a directory format dump into a
+// tar file named after the directory, then removes the directory. Having a
+// single file per dump avoids processing and uploading many small files.
+// The entries of the archive are under the name of the directory, extracting
+// it gives back the original directory.
+func archiveDirectory(dir string, mode os.FileMode) (string, error) {
+	dir = filepath.Clean(dir)
+	path := dir + ".tar"
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, modeOr(mode, 0600))
+	if err != nil {
+		return "", fmt.Errorf("could not create archive: %w", err)
+	}
+
+	if mode != 0 {
+		if err := f.Chmod(mode); err != nil {
+			f.Close()
+			return "", fmt.Errorf("could not chmod archive: %w", err)
+		}
+	}
+
+	tw := tar.NewWriter(f)
+	base := filepath.Dir(dir)
+
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+
+		// tar always uses slashes as path separator
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(tw, src)
+		return err
+	})
+
+	if err == nil {
+		err = tw.Close()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("could not archive %s: %w", dir, err)
+	}
+
+	l.Verboseln("removing source directory:", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return path, fmt.Errorf("could not remove %s: %w", dir, err)
+	}
+
+	return path, nil
+}
+
+// tarCompressors gives the external command used to compress dumps in the
+// tar format for each compression method, and the suffix it adds to their
+// name
+var tarCompressors = map[string]struct {
+	command string
+	suffix  string
+}{
+	"gzip": {"gzip", "gz"},
+	"lz4":  {"lz4", "lz4"},
+	"zstd": {"zstd", "zst"},
+}
+
+// compressTar compresses a dump in the tar format, which pg_dump cannot do,
+// by piping it through the external command of the compression method. A
+// level of -1 is the default level of the command. The compressed file
+// replaces the dump, its path is returned.
+func compressTar(path string, method string, level int, long bool, mode os.FileMode) (string, error) {
+	c, ok := tarCompressors[method]
+	if !ok {
+		return "", fmt.Errorf("unsupported compression method: %s", method)
+	}
+
+	args := []string{"-q", "-c"}
+	if method == "gzip" {
+		// gzip has no -q option, it is quiet by default
+		args = []string{"-c"}
+	}
+	if level > 0 {
+		if method == "zstd" && level > 19 {
+			args = append(args, "--ultra")
+		}
+		args = append(args, fmt.Sprintf("-%d", level))
+	}
+	if long && method == "zstd" {
+		args = append(args, "--long")
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open %s: %w", path, err)
+	}
+	defer src.Close()
+
+	dst := path + "." + c.suffix
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, modeOr(mode, 0600))
+	if err != nil {
+		return "", fmt.Errorf("could not create compressed file: %w", err)
+	}
+
+	if mode != 0 {
+		if err := f.Chmod(mode); err != nil {
+			f.Close()
+			os.Remove(dst)
+			return "", fmt.Errorf("could not chmod compressed file: %w", err)
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.command, args...)
+	cmd.Stdin = src
+	cmd.Stdout = f
+	cmd.Stderr = &stderr
+
+	l.Verboseln("running:", cmd)
+	err = cmd.Run()
+	if err != nil && stderr.Len() > 0 {
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(dst)
+		return "", fmt.Errorf("could not compress %s with %s: %w", path, c.command, err)
+	}
+
+	l.Verboseln("removing source file:", path)
+	if err := os.Remove(path); err != nil {
+		return dst, fmt.Errorf("could not remove %s: %w", path, err)
+	}
+
+	return dst, nil
+}
+
+// extractArchive extracts a tar archive produced by archiveDirectory into
+// the dest directory
+func extractArchive(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("could not read archive: %w", err)
+		}
+
+		// Refuse any entry that would be written outside of dest
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid path in archive: %s", hdr.Name)
+		}
+
+		target := filepath.Join(dest, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return fmt.Errorf("could not extract %s: %w", hdr.Name, err)
+			}
+
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestArchiveDirectory(t *testing.T) {
+	wd := t.TempDir()
+	dir := filepath.Join(wd, "db_2023-01-02T15:04:05Z.d")
+
+	files := map[string]string{
+		"toc.dat":   "toc contents",
+		"3001.dat":  "table data",
+		"sub/x.dat": "nested data",
+	}
+
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal("could not create test directory:", err)
+		}
+
+		if err := os.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatal("could not create test file:", err)
+		}
+	}
+
+	path, err := archiveDirectory(dir, 0600)
+	if err != nil {
+		t.Fatalf("archiveDirectory returned: %v", err)
+	}
+
+	if path != dir+".tar" {
+		t.Errorf("got archive %q, want %q", path, dir+".tar")
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected source directory to be removed, got %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("could not open archive: %v", err)
+	}
+	defer f.Close()
+
+	dest := t.TempDir()
+	if err := extractArchive(f, dest); err != nil {
+		t.Fatalf("extractArchive returned: %v", err)
+	}
+
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dest, filepath.Base(dir), filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("could not read extracted file %s: %v", name, err)
+			continue
+		}
+
+		if string(got) != want {
+			t.Errorf("got %q for %s, want %q", string(got), name, want)
+		}
+	}
+}
+
+func TestCompressTar(t *testing.T) {
+	var tests = []struct {
+		method string
+		level  int
+		long   bool
+		want   string
+	}{
+		{"gzip", -1, false, ".tar.gz"},
+		{"gzip", 9, false, ".tar.gz"},
+		{"zstd", 3, true, ".tar.zst"},
+		{"lz4", -1, false, ".tar.lz4"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if _, err := exec.LookPath(tarCompressors[st.method].command); err != nil {
+				t.Skipf("%s is not available", st.method)
+			}
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, "db_2023-05-02T10:00:00Z.tar")
+			if err := os.WriteFile(path, []byte("some tar contents\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := compressTar(path, st.method, st.level, st.long, 0640)
+			if err != nil {
+				t.Fatalf("compressTar() failed: %s", err)
+			}
+
+			if got != path[:len(path)-len(".tar")]+st.want {
+				t.Errorf("got %s, want a name ending with %s", got, st.want)
+			}
+
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("uncompressed dump was not removed")
+			}
+
+			if info, err := os.Stat(got); err != nil || info.Mode().Perm() != 0640 {
+				t.Errorf("unexpected compressed file: %v %v", info, err)
+			}
+
+			// The restore uncompresses the dump on the fly
+			r, cleanup, err := openRestoreInput(got, decryptParams{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "some tar contents\n" {
+				t.Errorf("got %q after uncompressing", data)
+			}
+		})
+	}
+}
+
+func TestDirArchiveCompress(t *testing.T) {
+	var tests = []struct {
+		method string
+		want   string
+	}{
+		{"none", ".d.tar"},
+		{"gzip", ".d.tar.gz"},
+		{"zstd", ".d.tar.zst"},
+		{"lz4", ".d.tar.lz4"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if c, ok := tarCompressors[st.method]; ok {
+				if _, err := exec.LookPath(c.command); err != nil {
+					t.Skipf("%s is not available", st.method)
+				}
+			}
+
+			wd := t.TempDir()
+			dir := filepath.Join(wd, "db_2023-01-02T15:04:05Z.d")
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "toc.dat"), []byte("toc contents"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := defaultOptions()
+			opts.Directory = wd
+			opts.DirArchive = true
+			opts.DirArchiveCompress = st.method
+
+			var wg sync.WaitGroup
+			files := make(chan sumFileJob)
+			ret := postProcessFiles(files, &wg, opts, time.Now())
+			files <- sumFileJob{Path: dir}
+			close(files)
+
+			if err := stopPostProcess(&wg, ret); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			entries, err := os.ReadDir(wd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Name() != filepath.Base(dir)+st.want[len(".d"):] {
+				t.Fatalf("got %v, want only a file ending with %s", entries, st.want)
+			}
+
+			// The restore extracts the archive back to the directory
+			path := filepath.Join(wd, entries[0].Name())
+			if f, ok := dumpSuffixFormat(st.want[1:]); !ok || f != 'd' {
+				t.Errorf("suffix %s is not recognized as a directory dump", st.want)
+			}
+
+			input, _, cleanup, err := restoreInput(&restoreDump{Path: path, Format: 'd'}, decryptParams{})
+			if err != nil {
+				t.Fatalf("restoreInput() failed: %s", err)
+			}
+			defer cleanup()
+
+			data, err := os.ReadFile(filepath.Join(input, "toc.dat"))
+			if err != nil || string(data) != "toc contents" {
+				t.Errorf("got %q and %v after extraction", data, err)
+			}
+		})
+	}
+}
@@ -30,12 +30,17 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/anmitsu/go-shlex"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/spf13/pflag"
 	"gopkg.in/ini.v1"
 )
@@ -47,54 +52,159 @@ var defaultCfg string
 
 // options struct holds command line and configuration file options
 type options struct {
-	NoConfigFile      bool
-	BinDirectory      string
-	Directory         string
-	Host              string
-	Port              int
-	Username          string
-	ConnDb            string
-	ExcludeDbs        []string
-	Dbnames           []string
-	WithTemplates     bool
-	Format            rune
-	DirJobs           int
-	CompressLevel     int
-	Jobs              int
-	PauseTimeout      int
-	PurgeInterval     time.Duration
-	PurgeKeep         int
-	SumAlgo           string
-	PreHook           string
-	PostHook          string
-	PgDumpOpts        []string
-	PerDbOpts         map[string]*dbOpts
-	CfgFile           string
-	TimeFormat        string
-	Verbose           bool
-	Quiet             bool
-	Encrypt           bool
-	EncryptKeepSrc    bool
-	CipherPassphrase  string
-	CipherPublicKey   string
-	CipherPrivateKey  string
-	Decrypt           bool
-	WithRolePasswords bool
-	DumpOnly          bool
-
-	Upload       string // values are none, b2, s3, sftp, gcs
-	UploadPrefix string
-	Download     string // values are none, b2, s3, sftp, gcs
-	ListRemote   string // values are none, b2, s3, sftp, gcs
-	PurgeRemote  bool
-	S3Region     string
-	S3Bucket     string
-	S3EndPoint   string
-	S3Profile    string
-	S3KeyID      string
-	S3Secret     string
-	S3ForcePath  bool
-	S3DisableTLS bool
+	NoConfigFile         bool
+	BinDirectory         string
+	PgDumpBinary         string
+	PgDumpallBinary      string
+	PgRestoreBinary      string
+	Directory            string
+	Host                 string
+	Port                 string
+	Username             string
+	Service              string
+	SSLMode              string
+	TargetSessionAttrs   string
+	SSLCert              string
+	SSLKey               string
+	SSLRootCert          string
+	ApplicationName      string
+	ConnDb               string
+	ExcludeDbs           []string
+	OwnedBy              []string
+	IncludeDbPattern     string
+	SkipUnavailable      bool
+	ExcludeDbPattern     string
+	Dbnames              []string
+	WithTemplates        bool
+	Format               rune
+	DirJobs              int
+	CompressLevel        int
+	CompressMethod       string
+	CompressLong         bool
+	Jobs                 int
+	MaxParallelWorkers   int
+	SkipUnchanged        bool
+	LogicalSlot          string
+	LogicalSlotKeep      bool
+	PauseTimeout         int
+	PauseReplication     bool
+	PauseRetryInterval   time.Duration
+	PauseTimeoutAction   string
+	MetadataQueryTimeout int
+	DumpTimeout          time.Duration
+	DumpLockTimeout      string
+	DumpStatementTimeout string
+	DumpRetries          int
+	StopOnError          bool
+	WriteMarkers         bool
+	LockWait             time.Duration
+	LockDirectory        string
+	Timeout              time.Duration
+	ProgressInterval     time.Duration
+	PurgeInterval        time.Duration
+	PurgeKeep            int
+	SumAlgo              string
+	SumAutoThreshold     int // MiB
+	ChecksumMode         string
+	VerifyDump           bool
+	PreHook              string
+	PostHook             string
+	PreHookOnError       string
+	PostHookOnError      string
+	PreDumpHook          string
+	PostDumpHook         string
+	PgDumpOpts           []string
+	PgOptions            string
+	DumpSections         []string
+	SchemaOnly           bool
+	DataOnly             bool
+	NoOwner              bool
+	NoPrivileges         bool
+	NoComments           bool
+	NoSync               bool
+	Clean                bool
+	IfExists             bool
+	Schemas              []string
+	ExcludedSchemas      []string
+	Tables               []string
+	ExcludedTables       []string
+	ExcludedTableData    []string
+	PerDbOpts            map[string]*dbOpts
+	CfgFile              string
+	CfgDirectory         string
+	TimeFormat           string
+	TimestampUTC         bool
+	FilenameTemplate     string
+	TimestampedSubdir    bool
+	Verbose              bool
+	Quiet                bool
+	LogFormat            string
+	LogLevel             string
+	LogFile              string
+	LogSyslog            bool
+	QuietOnSuccess       bool
+	MetricsFile          string
+	ResultJSON           string
+	NotifyWebhookURL     string
+	NotifyOn             string
+	Encrypt              bool
+	EncryptKeepSrc       bool
+	CipherPassphrase     string
+	CipherPassFile       string
+	CipherPublicKey      string
+	CipherPrivateKey     string
+	CipherArmor          bool
+	Decrypt              bool
+	DecryptDirectory     string
+	DecryptRemoveSrc     bool
+	Rekey                bool
+	RekeyRemote          string
+	NewCipherPassphrase  string
+	NewCipherPublicKey   string
+	Restore              bool
+	CheckConfig          bool
+	SelfTest             bool
+	RestoreTimestamp     string
+	Snapshot             string
+	RestoreJobs          int
+	RestoreCreate        bool
+	TestRestore          bool
+	TestRestoreFull      bool
+	TestRestoreDbname    string
+	WithRolePasswords    bool
+	DumpOnly             bool
+	SplitGlobals         bool
+	AlwaysDumpCreateDB   bool
+	SyncSnapshot         bool
+	DirArchive           bool
+	DirArchiveCompress   string
+	FileMode             os.FileMode
+
+	Upload            string // values are none, b2, s3, sftp, gcs
+	UploadPrefix      string
+	Download          string // values are none, b2, s3, sftp, gcs
+	ListRemote        string // values are none, b2, s3, sftp, gcs
+	ListLocal         bool
+	PurgeRemote       bool
+	VerifyUpload      bool
+	RemoveLocal       bool
+	CompressOnUpload  bool
+	S3Region          string
+	S3Bucket          string
+	S3EndPoint        string
+	S3Profile         string
+	S3KeyID           string
+	S3Secret          string
+	S3ForcePath       bool
+	S3DisableTLS      bool
+	S3SSE             string // values are empty, AES256 or aws:kms
+	S3KMSKeyID        string
+	S3StorageClass    string
+	S3RoleARN         string
+	S3RoleSessionName string
+	S3PartSize        int // MiB, 0 means the default of the SDK
+	S3Concurrency     int
+	S3Retries         int
 
 	B2Bucket                string
 	B2KeyID                 string
@@ -109,15 +219,23 @@ type options struct {
 	SFTPDirectory        string
 	SFTPIdentityFile     string // path to private key
 	SFTPIgnoreKnownHosts bool
+	SFTPKnownHosts       string
+	SFTPAddHostKey       bool
+	SFTPConnectTimeout   int // seconds
+	SFTPIOTimeout        int // seconds
 
 	GCSBucket          string
 	GCSEndPoint        string
 	GCSCredentialsFile string
+	GCSHMACKeyID       string
+	GCSHMACSecret      string
 
 	AzureContainer string
 	AzureAccount   string
 	AzureKey       string
 	AzureEndpoint  string
+
+	LocalDirectory string
 }
 
 func defaultOptions() options {
@@ -132,19 +250,37 @@ func defaultOptions() options {
 		Format:                  'c',
 		DirJobs:                 1,
 		CompressLevel:           -1,
+		CompressMethod:          "gzip",
+		DirArchiveCompress:      "none",
 		Jobs:                    1,
 		PauseTimeout:            3600,
+		PauseReplication:        true,
+		PauseRetryInterval:      10 * time.Second,
+		PauseTimeoutAction:      "fail",
+		MetadataQueryTimeout:    60,
 		PurgeInterval:           -30 * 24 * time.Hour,
 		PurgeKeep:               0,
 		SumAlgo:                 "none",
+		SumAutoThreshold:        1024,
+		ChecksumMode:            "per-file",
 		CfgFile:                 defaultCfgFile,
 		TimeFormat:              timeFormat,
 		WithRolePasswords:       true,
 		Upload:                  "none",
 		Download:                "none",
 		ListRemote:              "none",
+		RekeyRemote:             "none",
+		RestoreJobs:             1,
+		TestRestoreDbname:       "pg_back_test_restore",
+		LogFormat:               "text",
+		LogLevel:                "info",
+		NotifyOn:                "always",
+		PreHookOnError:          "abort",
+		PostHookOnError:         "abort",
 		AzureEndpoint:           "blob.core.windows.net",
 		B2ConcurrentConnections: 5,
+		SFTPConnectTimeout:      30,
+		SFTPIOTimeout:           300,
 	}
 }
 
@@ -208,6 +344,239 @@ func validatePurgeTimeLimitValue(i string) (time.Duration, error) {
 
 }
 
+// validateSessionTimeout checks a timeout set in the session of pg_dump,
+// empty means the setting of the server is kept
+func validateSessionTimeout(i string) error {
+	if i == "" {
+		return nil
+	}
+
+	_, err := validateTimeoutValue(i)
+	return err
+}
+
+// sessionTimeoutOptions returns the options of the session of pg_dump, as
+// given in PGOPTIONS, setting lock_timeout and statement_timeout, in
+// milliseconds. The values have been checked by validateSessionTimeout.
+func sessionTimeoutOptions(lockTimeout string, statementTimeout string) string {
+	options := make([]string, 0, 2)
+	for _, guc := range []struct{ name, value string }{
+		{"lock_timeout", lockTimeout},
+		{"statement_timeout", statementTimeout},
+	} {
+		if guc.value == "" {
+			continue
+		}
+
+		d, _ := validateTimeoutValue(guc.value)
+		options = append(options, fmt.Sprintf("-c %s=%d", guc.name, d.Milliseconds()))
+	}
+
+	return strings.Join(options, " ")
+}
+
+// validateTimeoutValue parses a duration used as a timeout. A plain number is
+// a number of seconds, otherwise units must be given
+func validateTimeoutValue(i string) (time.Duration, error) {
+	var d time.Duration
+
+	if secs, err := strconv.ParseInt(i, 10, 0); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else {
+		d, err = time.ParseDuration(i)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if d < 0 {
+		return 0, errors.New("timeout cannot be negative")
+	}
+
+	return d, nil
+}
+
+// validatePauseRetryInterval parses the interval between two attempts to
+// pause replication, which cannot be 0
+func validatePauseRetryInterval(s string) (time.Duration, error) {
+	d, err := validateTimeoutValue(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if d == 0 {
+		return 0, errors.New("interval must be greater than 0")
+	}
+
+	return d, nil
+}
+
+// sectionStrings returns the comma separated list of the key of a database
+// section, or the value of the global section when the key is not set
+func sectionStrings(s *ini.Section, key string, global []string) []string {
+	if !s.HasKey(key) {
+		return global
+	}
+
+	return s.Key(key).Strings(",")
+}
+
+// reSlotName matches the names PostgreSQL accepts for replication slots
+var reSlotName = regexp.MustCompile(`^[a-z0-9_]{1,63}$`)
+
+// validateSlotName checks the name of a replication slot, an empty name
+// means no slot
+func validateSlotName(name string) error {
+	if name != "" && !reSlotName.MatchString(name) {
+		return fmt.Errorf("slot names can only contain lower case letters, numbers and underscores, up to 63 characters")
+	}
+
+	return nil
+}
+
+// compressMethods are the compression methods of pg_dump --compress
+var compressMethods = []string{"gzip", "lz4", "zstd"}
+
+// validateCompressLevel checks the compression level against the range of
+// the compression method, -1 is the default level of the method. When the
+// method is not known yet, the widest range is allowed.
+func validateCompressLevel(method string, level int) error {
+	var max int
+	switch method {
+	case "gzip":
+		max = 9
+	case "lz4":
+		max = 12
+	default:
+		max = 22
+	}
+
+	if level < -1 || level > max {
+		if method == "" {
+			return fmt.Errorf("compression level must be in range 0..%d", max)
+		}
+		return fmt.Errorf("compression level must be in range 0..%d with %s", max, method)
+	}
+
+	return nil
+}
+
+// validateCompression checks the compression options once the command line
+// and the configuration file are merged
+func validateCompression(method string, level int, long bool, format rune) error {
+	if err := validateCompressLevel(method, level); err != nil {
+		return err
+	}
+
+	if long && method != "zstd" {
+		return fmt.Errorf("long-distance matching is only available with zstd compression")
+	}
+
+	// Compressed plain dumps are named with the .gz suffix, other methods
+	// would produce files that cannot be told apart
+	if format == 'p' && method != "gzip" && level != 0 {
+		return fmt.Errorf("compression method %s is not supported with the plain format", method)
+	}
+
+	return nil
+}
+
+// validateDumpSections checks the names of sections given to pg_dump
+// --section
+func validateDumpSections(sections []string) ([]string, error) {
+	res := make([]string, 0, len(sections))
+	for _, s := range sections {
+		if err := validateEnum(s, []string{"pre-data", "data", "post-data"}); err != nil {
+			return nil, err
+		}
+		res = append(res, strings.TrimSpace(strings.ToLower(s)))
+	}
+
+	return res, nil
+}
+
+// validateFileMode parses a file mode given in octal, like 0600. Only the
+// permission bits are allowed. An empty string gives 0, meaning the mode is
+// not set and files keep the permissions they are created with.
+func validateFileMode(s string) (os.FileMode, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+
+	mode, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not an octal number", s)
+	}
+
+	if mode > 0777 {
+		return 0, fmt.Errorf("%s is not a permission mode", s)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// dirMode computes the mode of a directory from the mode of files, adding
+// the execute bit where the read bit is set, so that the contents can be
+// accessed
+func dirMode(mode os.FileMode) os.FileMode {
+	return mode | (mode&0444)>>2
+}
+
+// modeOr gives the mode set with file_mode, or def when it is not set
+func modeOr(mode os.FileMode, def os.FileMode) os.FileMode {
+	if mode == 0 {
+		return def
+	}
+
+	return mode
+}
+
+// trimList removes the spaces around the values of a comma separated list
+func trimList(s string) string {
+	values := strings.Split(s, ",")
+	for i, v := range values {
+		values[i] = strings.TrimSpace(v)
+	}
+
+	return strings.Join(values, ",")
+}
+
+// validatePorts checks a comma separated list of port numbers, empty values
+// keep the default port of libpq
+func validatePorts(s string) error {
+	if s == "" {
+		return nil
+	}
+
+	for _, p := range strings.Split(s, ",") {
+		if p == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%s is not a valid port number", p)
+		}
+	}
+
+	return nil
+}
+
+// validateHostPorts checks that the lists of hosts and ports can be used
+// together: libpq wants one port for all hosts or one port per host
+func validateHostPorts(host string, port string) error {
+	ports := strings.Split(port, ",")
+	if port == "" || len(ports) == 1 {
+		return nil
+	}
+
+	if hosts := strings.Split(host, ","); len(hosts) != len(ports) {
+		return fmt.Errorf("got %d ports for %d hosts, give one port for all hosts or one port per host", len(ports), len(hosts))
+	}
+
+	return nil
+}
+
 func validateYesNoOption(s string) (bool, error) {
 	ls := strings.TrimSpace(strings.ToLower(s))
 	if ls == "y" || ls == "yes" {
@@ -221,6 +590,94 @@ func validateYesNoOption(s string) (bool, error) {
 	return false, fmt.Errorf("value must be \"yes\" or \"no\"")
 }
 
+// validateS3SSE checks the server side encryption method for S3 and returns
+// it spelled the way the AWS API expects it. A KMS key ID only makes sense
+// with aws:kms.
+func validateS3SSE(sse string, kmsKeyID string) (string, error) {
+	switch strings.TrimSpace(strings.ToLower(sse)) {
+	case "":
+		sse = ""
+	case "aes256":
+		sse = "AES256"
+	case "aws:kms":
+		return "aws:kms", nil
+	default:
+		return sse, fmt.Errorf("value not found in [AES256 aws:kms]")
+	}
+
+	if kmsKeyID != "" {
+		return sse, fmt.Errorf("a KMS key ID can only be used with aws:kms")
+	}
+
+	return sse, nil
+}
+
+// validateS3StorageClass checks the storage class against the ones known by
+// the AWS SDK, empty means the default class of the bucket
+func validateS3StorageClass(class string) (string, error) {
+	class = strings.TrimSpace(strings.ToUpper(class))
+	if class == "" {
+		return "", nil
+	}
+
+	for _, v := range s3.StorageClass_Values() {
+		if v == class {
+			return class, nil
+		}
+	}
+
+	return class, fmt.Errorf("value not found in %v", s3.StorageClass_Values())
+}
+
+// validateS3PartSize checks the size in MiB of the parts of multipart
+// uploads, S3 refuses parts smaller than 5MiB. 0 keeps the default.
+func validateS3PartSize(size int) error {
+	if size != 0 && int64(size)*1024*1024 < s3manager.MinUploadPartSize {
+		return fmt.Errorf("parts must be at least %dMiB", s3manager.MinUploadPartSize/1024/1024)
+	}
+
+	return nil
+}
+
+// uploadTargets splits the comma separated list of remote locations of the
+// upload option, "none" gives an empty list
+func uploadTargets(upload string) []string {
+	targets := make([]string, 0)
+	for _, t := range strings.Split(upload, ",") {
+		t = strings.TrimSpace(strings.ToLower(t))
+		if t == "none" {
+			continue
+		}
+		targets = append(targets, t)
+	}
+
+	return targets
+}
+
+// validateUpload checks the list of remote locations to upload to, each one
+// can only be given once and "none" cannot be mixed with the others
+func validateUpload(upload string, candidates []string) error {
+	values := strings.Split(upload, ",")
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if err := validateEnum(v, candidates); err != nil {
+			return err
+		}
+
+		v = strings.TrimSpace(strings.ToLower(v))
+		if v == "none" && len(values) > 1 {
+			return fmt.Errorf("none cannot be used with other values")
+		}
+
+		if seen[v] {
+			return fmt.Errorf("%s is given more than once", v)
+		}
+		seen[v] = true
+	}
+
+	return nil
+}
+
 func validateEnum(s string, candidates []string) error {
 	found := false
 	ls := strings.TrimSpace(strings.ToLower(s))
@@ -251,7 +708,7 @@ func validateDirectory(s string) error {
 }
 
 func parseCli(args []string) (options, []string, error) {
-	var format, purgeKeep, purgeInterval string
+	var format, purgeKeep, purgeInterval, fileMode, dumpTimeout, lockWait, runTimeout, progressInterval, pauseRetryInterval string
 
 	opts := defaultOptions()
 	pce := &parseCliResult{}
@@ -263,43 +720,129 @@ func parseCli(args []string) (options, []string, error) {
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		pflag.CommandLine.SortFlags = false
 		pflag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExit status:\n")
+		fmt.Fprintf(os.Stderr, "  0  success\n")
+		fmt.Fprintf(os.Stderr, "  1  failure, nothing dumped: configuration or connection error,\n")
+		fmt.Fprintf(os.Stderr, "     all databases failed, ...\n")
+		fmt.Fprintf(os.Stderr, "  2  some databases could not be dumped\n")
+		fmt.Fprintf(os.Stderr, "  3  dumps are done but checksum, encryption, upload or purge failed\n")
+		fmt.Fprintf(os.Stderr, "  4  interrupted by a signal or the --timeout\n")
 	}
 
-	pflag.BoolVar(&opts.NoConfigFile, "no-config-file", false, "skip reading config file\n")
+	pflag.BoolVar(&opts.NoConfigFile, "no-config-file", false, "skip reading config file")
+	pflag.BoolVar(&opts.CheckConfig, "check-config", false, "check the configuration and exit without connecting to PostgreSQL\nor any remote location")
+	pflag.BoolVar(&opts.SelfTest, "self-test", false, "check the backup directory, the PostgreSQL tools, the connection\nand the remote locations, then exit without dumping\n")
 	pflag.StringVarP(&opts.BinDirectory, "bin-directory", "B", "", "PostgreSQL binaries directory. Empty to search $PATH")
+	pflag.StringVar(&opts.PgDumpBinary, "pg-dump-binary", "", "name or path of the pg_dump executable, instead of pg_dump")
+	pflag.StringVar(&opts.PgDumpallBinary, "pg-dumpall-binary", "", "name or path of the pg_dumpall executable, instead of pg_dumpall")
+	pflag.StringVar(&opts.PgRestoreBinary, "pg-restore-binary", "", "name or path of the pg_restore executable, instead of pg_restore")
 	pflag.StringVarP(&opts.Directory, "backup-directory", "b", "/var/backups/postgresql", "store dump files there")
 	pflag.StringVarP(&opts.CfgFile, "config", "c", defaultCfgFile, "alternate config file")
+	pflag.StringVar(&opts.CfgDirectory, "config-dir", "", "also load the *.conf files of this directory, in the order of their\nnames, each overriding the previous ones and the config file")
 	pflag.StringSliceVarP(&opts.ExcludeDbs, "exclude-dbs", "D", []string{}, "list of databases to exclude")
+	pflag.StringSliceVar(&opts.OwnedBy, "owned-by", []string{}, "only dump the databases owned by these roles")
+	pflag.StringVar(&opts.IncludeDbPattern, "include-db-pattern", "", "only dump databases with a name matching this PostgreSQL regular\nexpression, filtered by the server")
+	pflag.StringVar(&opts.ExcludeDbPattern, "exclude-db-pattern", "", "do not dump databases with a name matching this PostgreSQL regular\nexpression, filtered by the server")
+	pflag.BoolVar(&opts.SkipUnavailable, "skip-unavailable-dbs", false, "skip the databases that cannot be connected to instead of failing\ntheir dump")
 	pflag.BoolVarP(&opts.WithTemplates, "with-templates", "t", false, "include templates")
 	WithoutTemplates := pflag.Bool("without-templates", false, "force exclude templates")
 	pflag.BoolVar(&opts.WithRolePasswords, "with-role-passwords", true, "dump globals with role passwords")
 	WithoutRolePasswords := pflag.Bool("without-role-passwords", false, "do not dump passwords of roles")
 	pflag.BoolVar(&opts.DumpOnly, "dump-only", false, "only dump databases, excluding configuration and globals")
+	pflag.BoolVar(&opts.SplitGlobals, "split-globals", false, "dump roles and tablespaces to separate files instead of one file of globals")
+	pflag.BoolVar(&opts.AlwaysDumpCreateDB, "always-dump-createdb", false, "write the creation, ACL and configuration of the databases to\ncreatedb.sql files, even with pg_dump 11 and newer")
+	pauseReplication := pflag.String("pause-replication", "yes", "pause replication on standby servers while dumping")
 	pflag.IntVarP(&opts.PauseTimeout, "pause-timeout", "T", 3600, "abort if replication cannot be paused after this number\nof seconds")
+	pflag.StringVar(&pauseRetryInterval, "pause-retry-interval", "10", "try to pause replication again at this interval, in seconds or\nwith units \"ms\", \"s\" or \"m\"")
+	pflag.StringVar(&opts.PauseTimeoutAction, "pause-timeout-action", "fail", "what to do when replication cannot be paused in time: fail the\nrun, or continue dumping without pausing")
+	pflag.IntVar(&opts.MetadataQueryTimeout, "metadata-query-timeout", 60, "abort queries gathering ACL, settings and configuration after\nthis number of seconds, 0 to disable")
+	pflag.StringVar(&dumpTimeout, "dump-timeout", "0", "stop pg_dump when the dump of a database lasts longer than this\nduration, in seconds or with units \"s\", \"m\" or \"h\", 0 to disable")
+	pflag.StringVar(&opts.DumpLockTimeout, "dump-lock-timeout", "", "set lock_timeout in the session of pg_dump, in seconds or with\nunits \"ms\", \"s\", \"m\" or \"h\", empty to keep the setting of the server")
+	pflag.StringVar(&opts.DumpStatementTimeout, "dump-statement-timeout", "", "set statement_timeout in the session of pg_dump, in seconds or\nwith units, empty to keep the setting of the server")
+	pflag.IntVar(&opts.DumpRetries, "dump-retries", 0, "retry the dump of a database this many times when pg_dump fails\nwith an error that looks transient")
+	pflag.BoolVar(&opts.StopOnError, "stop-on-error", false, "stop dumping the other databases when the dump of a database fails")
+	pflag.BoolVar(&opts.WriteMarkers, "write-markers", false, "create a file suffixed with .writing next to a dump while pg_dump runs")
+	pflag.StringVar(&runTimeout, "timeout", "0", "stop the whole run when it lasts longer than this duration, in seconds\nor with units \"s\", \"m\" or \"h\", 0 to disable")
+	pflag.StringVar(&progressInterval, "progress-interval", "0", "log the progress of dumps and transfers at this interval, in seconds\nor with units \"s\", \"m\" or \"h\", 0 to disable")
+	pflag.StringVar(&opts.LockDirectory, "lock-directory", "", "create the lock files of the databases in this directory instead of\nthe backup directory")
+	pflag.StringVar(&lockWait, "lock-wait", "0", "wait up to this duration for the lock of a database held by another\npg_back, in seconds or with units \"s\", \"m\" or \"h\"")
 	pflag.IntVarP(&opts.Jobs, "jobs", "j", 1, "dump this many databases concurrently")
+	pflag.IntVar(&opts.MaxParallelWorkers, "max-parallel-workers", 0, "maximum number of pg_dump processes running at the same time, parallel\njobs of directory dumps included, 0 for no limit")
+	pflag.BoolVar(&opts.SkipUnchanged, "skip-unchanged", false, "do not dump databases whose size and statistics did not change since\ntheir previous dump")
+	pflag.StringVar(&opts.LogicalSlot, "logical-slot", "", "create a logical replication slot with this name and dump the data\nat the point where it starts, requires PostgreSQL 10 or newer")
+	pflag.BoolVar(&opts.LogicalSlotKeep, "logical-slot-keep", false, "keep the logical replication slot after the dump instead of using a\ntemporary slot")
+	pflag.BoolVar(&opts.SyncSnapshot, "sync-snapshot", false, "export a snapshot of each database before dumping, so that dumps\nare taken as close as possible to the same point in time")
 	pflag.StringVarP(&format, "format", "F", "custom", "database dump format: plain, custom, tar or directory")
+	pflag.StringSliceVar(&opts.DumpSections, "dump-section", []string{}, "only dump these sections: pre-data, data or post-data")
+	pflag.BoolVar(&opts.SchemaOnly, "schema-only", false, "only dump the schema, no data")
+	pflag.BoolVar(&opts.DataOnly, "data-only", false, "only dump the data, not the schema")
+	pflag.BoolVar(&opts.NoOwner, "no-owner", false, "do not output commands to set ownership of objects")
+	pflag.BoolVar(&opts.NoPrivileges, "no-privileges", false, "do not dump privileges (grant/revoke)")
+	pflag.BoolVar(&opts.NoComments, "no-comments", false, "do not dump comments")
+	pflag.BoolVar(&opts.NoSync, "no-sync", false, "do not let pg_dump wait for the files to be written safely to disk")
+	pflag.BoolVar(&opts.Clean, "clean", false, "drop objects before creating them in plain format dumps")
+	pflag.BoolVar(&opts.IfExists, "if-exists", false, "drop objects with IF EXISTS, along with --clean")
+	pflag.StringArrayVar(&opts.Schemas, "schema", []string{}, "only dump schemas matching this pattern, can be repeated")
+	pflag.StringArrayVar(&opts.ExcludedSchemas, "exclude-schema", []string{}, "do not dump schemas matching this pattern, can be repeated")
+	pflag.StringArrayVar(&opts.Tables, "table", []string{}, "only dump tables matching this pattern, can be repeated")
+	pflag.StringArrayVar(&opts.ExcludedTables, "exclude-table", []string{}, "do not dump tables matching this pattern, can be repeated")
+	pflag.StringArrayVar(&opts.ExcludedTableData, "exclude-table-data", []string{}, "do not dump the data of tables matching this pattern, can be repeated")
 	pflag.IntVarP(&opts.DirJobs, "parallel-backup-jobs", "J", 1, "number of parallel jobs to dumps when using directory format")
+	pflag.BoolVar(&opts.DirArchive, "dir-archive", false, "store dumps in the directory format in a single tar file")
+	pflag.StringVar(&opts.DirArchiveCompress, "dir-archive-compress", "none", "compress the tar file of directory dumps: none, gzip, lz4 or zstd")
+	pflag.BoolVar(&opts.TimestampedSubdir, "timestamped-subdir", false, "store the files of each run in a subdirectory named after its\ntimestamp, purged as a whole")
+	pflag.StringVar(&opts.FilenameTemplate, "filename-template", "", "Go template of the path of the produced files relative to the backup\ndirectory, e.g. {{.DBName}}/{{.Time.Format \"2006/01\"}}/{{.DBName}}_{{.Timestamp}}.{{.Suffix}}")
+	pflag.StringVar(&fileMode, "file-mode", "", "permissions of the produced files, in octal. Directories get\nthe execute bit where the read bit is set")
 	pflag.IntVarP(&opts.CompressLevel, "compress", "Z", -1, "compression level for compressed formats")
-	pflag.StringVarP(&opts.SumAlgo, "checksum-algo", "S", "none", "signature algorithm: none sha1 sha224 sha256 sha384 sha512")
+	pflag.StringVar(&opts.CompressMethod, "compress-method", "gzip", "compression method of pg_dump: gzip, lz4 or zstd, lz4 and zstd\nrequire pg_dump 16 or newer")
+	pflag.BoolVar(&opts.CompressLong, "compress-long", false, "enable long-distance matching of zstd")
+	pflag.StringVarP(&opts.SumAlgo, "checksum-algo", "S", "none", "signature algorithm: none auto sha1 sha224 sha256 sha384 sha512\nblake2b-256 blake2b-512 xxh64 xxh3")
+	pflag.IntVar(&opts.SumAutoThreshold, "checksum-auto-threshold", 1024, "size in MiB above which the auto checksum algorithm uses xxh3\ninstead of sha256")
+	pflag.StringVar(&opts.ChecksumMode, "checksum-mode", "per-file", "write a checksum file per file (per-file) or one for the whole\nrun (combined)")
+	verifyDump := pflag.String("verify-dump", "no", "read the files back after computing their checksum and compare\nthe result")
 	pflag.StringVarP(&purgeInterval, "purge-older-than", "P", "30", "purge backups older than this duration in days\nuse an interval with units \"s\" (seconds), \"m\" (minutes) or \"h\" (hours)\nfor less than a day.")
 	pflag.StringVarP(&purgeKeep, "purge-min-keep", "K", "0", "minimum number of dumps to keep when purging or 'all' to keep\neverything")
 	pflag.StringVar(&opts.PreHook, "pre-backup-hook", "", "command to run before taking dumps")
-	pflag.StringVar(&opts.PostHook, "post-backup-hook", "", "command to run after taking dumps\n")
+	pflag.StringVar(&opts.PostHook, "post-backup-hook", "", "command to run after taking dumps")
+	pflag.StringVar(&opts.PreHookOnError, "pre-backup-hook-on-error", "abort", "what to do when the pre-backup hook fails: abort or continue")
+	pflag.StringVar(&opts.PostHookOnError, "post-backup-hook-on-error", "abort", "what to do when the post-backup hook fails: abort or continue")
+	pflag.StringVar(&opts.PreDumpHook, "pre-dump-hook", "", "command to run before the dump of each database")
+	pflag.StringVar(&opts.PostDumpHook, "post-dump-hook", "", "command to run after the dump of each database\n")
 
 	pflag.BoolVar(&opts.Encrypt, "encrypt", false, "encrypt the dumps")
 	NoEncrypt := pflag.Bool("no-encrypt", false, "do not encrypt the dumps")
 	pflag.BoolVar(&opts.EncryptKeepSrc, "encrypt-keep-src", false, "keep original files when encrypting")
 	NoEncryptKeepSrc := pflag.Bool("no-encrypt-keep-src", false, "do not keep original files when encrypting")
+	pflag.BoolVar(&opts.CipherArmor, "cipher-armor", false, "write encrypted files as ASCII armored (PEM) text instead of binary")
 	pflag.BoolVar(&opts.Decrypt, "decrypt", false, "decrypt files in the backup directory instead of dumping. DBNAMEs become\nglobs to select files")
+	pflag.StringVar(&opts.DecryptDirectory, "decrypt-directory", "", "write decrypted files in this directory instead of next to the\nencrypted ones")
+	pflag.BoolVar(&opts.DecryptRemoveSrc, "decrypt-remove-src", false, "remove encrypted files once successfully decrypted")
+	pflag.BoolVar(&opts.Rekey, "rekey", false, "encrypt again the encrypted files in the backup directory with\n--new-cipher-pass or --new-cipher-public-key instead of dumping.\nDBNAMEs become globs to select files")
+	pflag.StringVar(&opts.NewCipherPassphrase, "new-cipher-pass", "", "new cipher passphrase to encrypt files with --rekey, the\nPGBK_NEW_CIPHER_PASS environment variable can be used instead")
+	pflag.StringVar(&opts.NewCipherPublicKey, "new-cipher-public-key", "", "new AGE public key to encrypt files with --rekey")
+	pflag.StringVar(&opts.RekeyRemote, "rekey-remote", "none", "with --rekey, encrypt again the files of this remote location (s3, gcs,\nsftp, azure, ...) instead of the backup directory")
+	pflag.BoolVar(&opts.Restore, "restore", false, "restore the last dump of each DBNAME instead of dumping")
+	pflag.StringVar(&opts.RestoreTimestamp, "restore-timestamp", "", "restore the dump taken at this timestamp instead of the last one")
+	pflag.StringVar(&opts.Snapshot, "snapshot", "", "download or restore all the files of the run taken at this timestamp")
+	pflag.IntVar(&opts.RestoreJobs, "restore-jobs", 1, "number of parallel jobs of pg_restore for custom and directory formats")
+	pflag.BoolVar(&opts.RestoreCreate, "create", false, "create the database before restoring it")
+	pflag.BoolVar(&opts.TestRestore, "test-restore", false, "check that the last dump of each DBNAME, or the dumps given by path, can be\nrestored with pg_restore --list instead of dumping")
+	pflag.BoolVar(&opts.TestRestoreFull, "test-restore-full", false, "with --test-restore, restore the dumps into a throwaway database")
+	pflag.StringVar(&opts.TestRestoreDbname, "test-restore-dbname", "pg_back_test_restore", "name of the throwaway database created and dropped by --test-restore-full\n")
 	pflag.StringVar(&opts.CipherPassphrase, "cipher-pass", "", "cipher passphrase for encryption and decryption\n")
+	pflag.StringVar(&opts.CipherPassFile, "cipher-pass-file", "", "read the cipher passphrase from this file\n")
 	pflag.StringVar(&opts.CipherPublicKey, "cipher-public-key", "", "AGE public key for encryption; in Bech32 encoding starting with 'age1'\n")
 	pflag.StringVar(&opts.CipherPrivateKey, "cipher-private-key", "", "AGE private key for decryption; in Bech32 encoding starting with 'AGE-SECRET-KEY-1'\n")
 
-	pflag.StringVar(&opts.Upload, "upload", "none", "upload produced files to target (s3, gcs,..) use \"none\" to override\nconfiguration file and disable upload")
+	pflag.StringVar(&opts.Upload, "upload", "none", "upload produced files to target (s3, gcs,..), a comma separated list\nuploads to all of them, use \"none\" to override configuration file\nand disable upload")
 	pflag.StringVar(&opts.UploadPrefix, "upload-prefix", "", "add this prefix to uploaded files, similar to a target directory")
 	pflag.StringVar(&opts.Download, "download", "none", "download files from target (s3, gcs,..) instead of dumping. DBNAMEs become\nglobs to select files")
 	pflag.StringVar(&opts.ListRemote, "list-remote", "none", "list the remote files on s3, gcs, sftp, azure instead of dumping. DBNAMEs become\nglobs to select files")
+	pflag.BoolVar(&opts.ListLocal, "list-local", false, "list the dumps of the backup directory, grouped by run, instead of\ndumping. DBNAMEs become globs to select databases")
 	purgeRemote := pflag.String("purge-remote", "no", "purge the file on remote location after upload, with the same rules\nas the local directory")
+	verifyUpload := pflag.String("verify-upload", "no", "download uploaded files back and compare their checksum with the local\nfile")
+	removeLocal := pflag.String("remove-local-after-upload", "no", "remove the local files once uploaded to all the locations")
+	compressOnUpload := pflag.String("compress-on-upload", "no", "gzip the files that are not already compressed when uploading them,\nadding .gz to their name")
 
 	pflag.StringVar(&opts.B2Bucket, "b2-bucket", "", "B2 bucket")
 	pflag.StringVar(&opts.B2KeyID, "b2-key-id", "", "B2 access key ID")
@@ -315,6 +858,14 @@ func parseCli(args []string) (options, []string, error) {
 	pflag.StringVar(&opts.S3EndPoint, "s3-endpoint", "", "S3 endpoint URI")
 	S3ForcePath := pflag.String("s3-force-path", "no", "force path style addressing instead of virtual hosted bucket\naddressing")
 	S3UseTLS := pflag.String("s3-tls", "yes", "enable or disable TLS on requests")
+	pflag.StringVar(&opts.S3SSE, "s3-sse", "", "server side encryption of uploaded files: AES256 or aws:kms")
+	pflag.StringVar(&opts.S3KMSKeyID, "s3-sse-kms-key-id", "", "AWS KMS key ID to use with aws:kms server side encryption")
+	pflag.StringVar(&opts.S3RoleARN, "s3-role-arn", "", "ARN of an AWS role to assume with the other credentials")
+	pflag.StringVar(&opts.S3RoleSessionName, "s3-role-session-name", "", "session name when assuming a role, default is pg_back")
+	pflag.StringVar(&opts.S3StorageClass, "s3-storage-class", "", "storage class of uploaded files, e.g. STANDARD_IA or GLACIER_IR")
+	pflag.IntVar(&opts.S3PartSize, "s3-upload-part-size", 0, "size in MiB of the parts of multipart uploads, at least 5")
+	pflag.IntVar(&opts.S3Concurrency, "s3-upload-concurrency", 0, "number of parts uploaded in parallel")
+	pflag.IntVar(&opts.S3Retries, "s3-upload-retries", 0, "upload a file again this many times when its upload fails")
 
 	pflag.StringVar(&opts.SFTPHost, "sftp-host", "", "Remote hostname for SFTP")
 	pflag.StringVar(&opts.SFTPPort, "sftp-port", "", "Remote port for SFTP")
@@ -323,24 +874,47 @@ func parseCli(args []string) (options, []string, error) {
 	pflag.StringVar(&opts.SFTPDirectory, "sftp-directory", "", "Target directory on the remote host")
 	pflag.StringVar(&opts.SFTPIdentityFile, "sftp-identity", "", "Path to a private key")
 	SFTPIgnoreHostKey := pflag.String("sftp-ignore-hostkey", "no", "Check the target host key against local known hosts")
+	pflag.StringVar(&opts.SFTPKnownHosts, "sftp-known-hosts", "", "Path to the known_hosts file to check the host key against")
+	SFTPAddHostKey := pflag.String("sftp-add-host-key", "no", "Add the host key to the known_hosts file when the host is unknown")
+	pflag.IntVar(&opts.SFTPConnectTimeout, "sftp-connect-timeout", 30, "Timeout in seconds to connect to the SFTP host, 0 to wait forever")
+	pflag.IntVar(&opts.SFTPIOTimeout, "sftp-io-timeout", 300, "Abort a transfer when no data could be sent or received for this\nnumber of seconds, 0 to wait forever")
 
 	pflag.StringVar(&opts.GCSBucket, "gcs-bucket", "", "GCS bucket name")
 	pflag.StringVar(&opts.GCSEndPoint, "gcs-endpoint", "", "GCS endpoint URL")
 	pflag.StringVar(&opts.GCSCredentialsFile, "gcs-keyfile", "", "path to the GCS credentials file")
+	pflag.StringVar(&opts.GCSHMACKeyID, "gcs-hmac-key-id", "", "GCS HMAC access key ID, to use the S3 compatible API")
+	pflag.StringVar(&opts.GCSHMACSecret, "gcs-hmac-secret", "", "GCS HMAC secret")
 
 	pflag.StringVar(&opts.AzureContainer, "azure-container", "", "Azure Blob Container")
 	pflag.StringVar(&opts.AzureAccount, "azure-account", "", "Azure Blob Storage account")
 	pflag.StringVar(&opts.AzureKey, "azure-key", "", "Azure Blob Storage shared key")
 	pflag.StringVar(&opts.AzureEndpoint, "azure-endpoint", "blob.core.windows.net", "Azure Blob Storage endpoint")
+	pflag.StringVar(&opts.LocalDirectory, "local-directory", "", "Target directory when uploading to local, e.g. a mounted NFS share")
 
-	pflag.StringVarP(&opts.Host, "host", "h", "", "database server host or socket directory")
-	pflag.IntVarP(&opts.Port, "port", "p", 0, "database server port number")
+	pflag.StringVarP(&opts.Host, "host", "h", "", "database server host or socket directory, a comma separated list\nto try many hosts")
+	pflag.StringVarP(&opts.Port, "port", "p", "", "database server port number, a comma separated list gives the port\nof each host")
 	pflag.StringVarP(&opts.Username, "username", "U", "", "connect as specified database user")
+	pflag.StringVar(&opts.Service, "service", "", "connection service name from the pg_service.conf file")
+	pflag.StringVar(&opts.SSLMode, "sslmode", "", "SSL mode of the connection: disable, allow, prefer, require,\nverify-ca or verify-full")
+	pflag.StringVar(&opts.TargetSessionAttrs, "target-session-attrs", "", "properties the server must have to be chosen among many hosts:\nany, read-write, read-only, primary, standby or prefer-standby")
+	pflag.StringVar(&opts.SSLCert, "sslcert", "", "path to the SSL client certificate")
+	pflag.StringVar(&opts.SSLKey, "sslkey", "", "path to the secret key of the SSL client certificate")
+	pflag.StringVar(&opts.SSLRootCert, "sslrootcert", "", "path to the SSL certificate authority certificates")
+	pflag.StringVar(&opts.ApplicationName, "application-name", "", "application_name of the connections, pg_back by default")
 	pflag.StringVarP(&opts.ConnDb, "dbname", "d", "", "connect to database name\n")
 	pflag.StringVar(&pce.LegacyConfig, "convert-legacy-config", "", "convert a pg_back v1 configuration file")
 	pflag.BoolVar(&pce.ShowConfig, "print-default-config", false, "print the default configuration\n")
 	pflag.BoolVarP(&opts.Quiet, "quiet", "q", false, "quiet mode")
-	pflag.BoolVarP(&opts.Verbose, "verbose", "v", false, "verbose mode\n")
+	pflag.BoolVarP(&opts.Verbose, "verbose", "v", false, "verbose mode")
+	pflag.StringVar(&opts.MetricsFile, "metrics-file", "", "write metrics of the run to this file, for the textfile collector of node_exporter")
+	pflag.StringVar(&opts.ResultJSON, "result-json", "", "write the result of the run as JSON to this file, - for stdout")
+	pflag.StringVar(&opts.NotifyWebhookURL, "notify-webhook-url", "", "POST a JSON summary of the run to this URL")
+	pflag.StringVar(&opts.NotifyOn, "notify-on", "always", "when to notify the webhook: always or failure")
+	pflag.StringVar(&opts.LogFormat, "log-format", "text", "format of log messages: text or json")
+	pflag.StringVar(&opts.LogLevel, "log-level", "info", "minimum level of log messages: debug, info, warn or error")
+	pflag.StringVar(&opts.LogFile, "log-file", "", "also append log messages to this file")
+	pflag.BoolVar(&opts.LogSyslog, "log-syslog", false, "also send log messages to syslog")
+	pflag.BoolVar(&opts.QuietOnSuccess, "quiet-on-success", false, "only output messages on stderr when the run fails\n")
 	pflag.BoolVarP(&pce.ShowHelp, "help", "?", false, "print usage")
 	pflag.BoolVarP(&pce.ShowVersion, "version", "V", false, "print version")
 
@@ -427,24 +1001,174 @@ func parseCli(args []string) (options, []string, error) {
 	}
 	opts.PurgeInterval = interval
 
-	if opts.CompressLevel < -1 || opts.CompressLevel > 9 {
-		return opts, changed, fmt.Errorf("compression level must be in range 0..9")
+	mode, err := validateFileMode(fileMode)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --file-mode: %s", err)
+	}
+	opts.FileMode = mode
+
+	if opts.FilenameTemplate != "" {
+		if _, err := newNameTemplate(opts.FilenameTemplate); err != nil {
+			return opts, changed, fmt.Errorf("invalid value for --filename-template: %s", err)
+		}
+	}
+
+	if err := validateEnum(opts.CompressMethod, compressMethods); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --compress-method: %s", err)
+	}
+	opts.CompressMethod = strings.TrimSpace(strings.ToLower(opts.CompressMethod))
+
+	// The compression method may come from the configuration file, in
+	// this case the level is checked against the method after merging
+	method := ""
+	if slices.Contains(changed, "compress-method") {
+		method = opts.CompressMethod
+	}
+	if err := validateCompressLevel(method, opts.CompressLevel); err != nil {
+		return opts, changed, err
 	}
 
 	if opts.Jobs < 1 {
 		return opts, changed, fmt.Errorf("concurrent jobs (-j) cannot be less than 1")
 	}
 
+	if opts.MaxParallelWorkers < 0 {
+		return opts, changed, fmt.Errorf("maximum parallel workers cannot be negative")
+	}
+
+	if err := validateSlotName(opts.LogicalSlot); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --logical-slot: %s", err)
+	}
+
+	if opts.MetadataQueryTimeout < 0 {
+		return opts, changed, fmt.Errorf("metadata query timeout cannot be negative")
+	}
+
+	timeout, err := validateTimeoutValue(dumpTimeout)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --dump-timeout: %s", err)
+	}
+	opts.DumpTimeout = timeout
+
+	if err := validateSessionTimeout(opts.DumpLockTimeout); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --dump-lock-timeout: %s", err)
+	}
+
+	if err := validateSessionTimeout(opts.DumpStatementTimeout); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --dump-statement-timeout: %s", err)
+	}
+
+	if opts.DumpRetries < 0 {
+		return opts, changed, fmt.Errorf("dump retries cannot be negative")
+	}
+
+	wait, err := validateTimeoutValue(lockWait)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --lock-wait: %s", err)
+	}
+	opts.LockWait = wait
+
+	limit, err := validateTimeoutValue(runTimeout)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --timeout: %s", err)
+	}
+	opts.Timeout = limit
+
+	every, err := validateTimeoutValue(progressInterval)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --progress-interval: %s", err)
+	}
+	opts.ProgressInterval = every
+
+	retry, err := validatePauseRetryInterval(pauseRetryInterval)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --pause-retry-interval: %s", err)
+	}
+	opts.PauseRetryInterval = retry
+
+	if err := validateEnum(opts.PauseTimeoutAction, []string{"fail", "continue"}); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --pause-timeout-action: %s", err)
+	}
+	opts.PauseTimeoutAction = strings.TrimSpace(strings.ToLower(opts.PauseTimeoutAction))
+
 	if err := validateDumpFormat(format); err != nil {
 		return opts, changed, err
 	}
 
 	opts.Format = []rune(format)[0]
 
+	opts.DumpSections, err = validateDumpSections(opts.DumpSections)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --dump-section: %s", err)
+	}
+
+	if opts.SchemaOnly && opts.DataOnly {
+		return opts, changed, fmt.Errorf("--schema-only and --data-only cannot be used together")
+	}
+
+	if err := validateEnum(opts.SumAlgo, sumAlgos); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --checksum-algo: %s", err)
+	}
+	opts.SumAlgo = strings.TrimSpace(strings.ToLower(opts.SumAlgo))
+
+	if opts.SumAutoThreshold < 0 {
+		return opts, changed, fmt.Errorf("checksum auto threshold cannot be negative")
+	}
+
+	if err := validateEnum(opts.ChecksumMode, []string{"per-file", "combined"}); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --checksum-mode: %s", err)
+	}
+	opts.ChecksumMode = strings.TrimSpace(strings.ToLower(opts.ChecksumMode))
+
+	if err := validateEnum(opts.DirArchiveCompress, append([]string{"none"}, compressMethods...)); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --dir-archive-compress: %s", err)
+	}
+	opts.DirArchiveCompress = strings.TrimSpace(strings.ToLower(opts.DirArchiveCompress))
+
 	if opts.Encrypt && opts.Decrypt {
 		return opts, changed, fmt.Errorf("options --encrypt and --decrypt are mutually exclusive")
 	}
 
+	if opts.Restore && opts.Decrypt {
+		return opts, changed, fmt.Errorf("options --restore and --decrypt are mutually exclusive")
+	}
+
+	if opts.DecryptDirectory != "" && !opts.Decrypt {
+		return opts, changed, fmt.Errorf("option --decrypt-directory requires --decrypt")
+	}
+
+	if opts.DecryptRemoveSrc && !opts.Decrypt {
+		return opts, changed, fmt.Errorf("option --decrypt-remove-src requires --decrypt")
+	}
+
+	if opts.Rekey && (opts.Encrypt || opts.Decrypt || opts.Restore) {
+		return opts, changed, fmt.Errorf("option --rekey cannot be used with --encrypt, --decrypt or --restore")
+	}
+
+	if opts.TestRestore && (opts.Restore || opts.Decrypt || opts.Rekey) {
+		return opts, changed, fmt.Errorf("option --test-restore cannot be used with --restore, --decrypt or --rekey")
+	}
+
+	if opts.TestRestoreFull && !opts.TestRestore {
+		return opts, changed, fmt.Errorf("option --test-restore-full requires --test-restore")
+	}
+
+	if opts.TestRestoreDbname == "" {
+		return opts, changed, fmt.Errorf("the name of the test restore database cannot be empty")
+	}
+
+	if (opts.NewCipherPassphrase != "" || opts.NewCipherPublicKey != "") && !opts.Rekey {
+		return opts, changed, fmt.Errorf("options --new-cipher-pass and --new-cipher-public-key require --rekey")
+	}
+
+	if opts.NewCipherPassphrase != "" && opts.NewCipherPublicKey != "" {
+		return opts, changed, fmt.Errorf("only one of --new-cipher-pass or --new-cipher-public-key allowed")
+	}
+
+	if opts.RestoreJobs < 1 {
+		return opts, changed, fmt.Errorf("restore jobs cannot be less than 1")
+	}
+
 	if opts.CipherPassphrase != "" && opts.CipherPublicKey != "" {
 		return opts, changed, fmt.Errorf("only one of --cipher-pass or --cipher-public-key allowed")
 	}
@@ -453,15 +1177,63 @@ func parseCli(args []string) (options, []string, error) {
 		return opts, changed, fmt.Errorf("only one of --cipher-pass or --cipher-private-key allowed")
 	}
 
+	if opts.CipherPassFile != "" && (opts.CipherPassphrase != "" || opts.CipherPublicKey != "" || opts.CipherPrivateKey != "") {
+		return opts, changed, fmt.Errorf("--cipher-pass-file cannot be used with --cipher-pass, --cipher-public-key or --cipher-private-key")
+	}
+
 	if opts.BinDirectory != "" {
 		if err := validateDirectory(opts.BinDirectory); err != nil {
 			return opts, changed, fmt.Errorf("bin directory (-B) must be an existing directory")
 		}
 	}
 
+	if err := validateEnum(opts.LogFormat, []string{"text", "json"}); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --log-format: %s", err)
+	}
+	opts.LogFormat = strings.TrimSpace(strings.ToLower(opts.LogFormat))
+
+	if err := validateEnum(opts.LogLevel, []string{"debug", "info", "warn", "error"}); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --log-level: %s", err)
+	}
+	opts.LogLevel = strings.TrimSpace(strings.ToLower(opts.LogLevel))
+
+	if err := validateEnum(opts.NotifyOn, []string{"always", "failure"}); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --notify-on: %s", err)
+	}
+	opts.NotifyOn = strings.TrimSpace(strings.ToLower(opts.NotifyOn))
+
+	if err := validateEnum(opts.PreHookOnError, hookOnErrorValues); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --pre-backup-hook-on-error: %s", err)
+	}
+	opts.PreHookOnError = strings.TrimSpace(strings.ToLower(opts.PreHookOnError))
+
+	if err := validateEnum(opts.PostHookOnError, hookOnErrorValues); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --post-backup-hook-on-error: %s", err)
+	}
+	opts.PostHookOnError = strings.TrimSpace(strings.ToLower(opts.PostHookOnError))
+
+	if opts.SSLMode != "" {
+		if err := validateEnum(opts.SSLMode, sslModes); err != nil {
+			return opts, changed, fmt.Errorf("invalid value for --sslmode: %s", err)
+		}
+		opts.SSLMode = strings.TrimSpace(strings.ToLower(opts.SSLMode))
+	}
+
+	if opts.TargetSessionAttrs != "" {
+		if err := validateEnum(opts.TargetSessionAttrs, targetSessionAttrs); err != nil {
+			return opts, changed, fmt.Errorf("invalid value for --target-session-attrs: %s", err)
+		}
+		opts.TargetSessionAttrs = strings.TrimSpace(strings.ToLower(opts.TargetSessionAttrs))
+	}
+
+	opts.Host, opts.Port = trimList(opts.Host), trimList(opts.Port)
+	if err := validatePorts(opts.Port); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --port: %s", err)
+	}
+
 	// Validate upload and download options
-	stores := []string{"none", "b2", "s3", "sftp", "gcs", "azure"}
-	if err := validateEnum(opts.Upload, stores); err != nil {
+	stores := []string{"none", "b2", "s3", "sftp", "gcs", "azure", "local"}
+	if err := validateUpload(opts.Upload, stores); err != nil {
 		return opts, changed, fmt.Errorf("invalid value for --upload: %s", err)
 	}
 
@@ -473,12 +1245,55 @@ func parseCli(args []string) (options, []string, error) {
 		return opts, changed, fmt.Errorf("invalid value for --list-remote: %s", err)
 	}
 
+	if err := validateEnum(opts.RekeyRemote, stores); err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --rekey-remote: %s", err)
+	}
+
+	if opts.RekeyRemote != "none" && !opts.Rekey {
+		return opts, changed, fmt.Errorf("option --rekey-remote requires --rekey")
+	}
+
+	if opts.Snapshot != "" {
+		if !opts.Restore && opts.Download == "none" {
+			return opts, changed, fmt.Errorf("option --snapshot requires --restore or --download")
+		}
+
+		if opts.RestoreTimestamp != "" {
+			return opts, changed, fmt.Errorf("options --snapshot and --restore-timestamp are mutually exclusive")
+		}
+	}
+
 	opts.PurgeRemote, err = validateYesNoOption(*purgeRemote)
 	if err != nil {
 		return opts, changed, fmt.Errorf("invalid value for --purge-remote: %s", err)
 	}
 
-	for _, o := range []string{opts.Upload, opts.Download, opts.ListRemote} {
+	opts.VerifyUpload, err = validateYesNoOption(*verifyUpload)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --verify-upload: %s", err)
+	}
+
+	opts.RemoveLocal, err = validateYesNoOption(*removeLocal)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --remove-local-after-upload: %s", err)
+	}
+
+	opts.CompressOnUpload, err = validateYesNoOption(*compressOnUpload)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --compress-on-upload: %s", err)
+	}
+
+	opts.VerifyDump, err = validateYesNoOption(*verifyDump)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --verify-dump: %s", err)
+	}
+
+	opts.PauseReplication, err = validateYesNoOption(*pauseReplication)
+	if err != nil {
+		return opts, changed, fmt.Errorf("invalid value for --pause-replication: %s", err)
+	}
+
+	for _, o := range append(uploadTargets(opts.Upload), opts.Download, opts.ListRemote, opts.RekeyRemote) {
 		switch o {
 		case "b2":
 			opts.B2ForcePath, err = validateYesNoOption(*B2ForcePath)
@@ -505,34 +1320,98 @@ func parseCli(args []string) (options, []string, error) {
 			}
 			opts.S3DisableTLS = !S3WithTLS
 
-		case "sftp":
-			opts.SFTPIgnoreKnownHosts, err = validateYesNoOption(*SFTPIgnoreHostKey)
+			opts.S3StorageClass, err = validateS3StorageClass(opts.S3StorageClass)
 			if err != nil {
-				return opts, changed, fmt.Errorf("invalid value for --sftp-ignore-hostkey: %s", err)
+				return opts, changed, fmt.Errorf("invalid value for --s3-storage-class: %s", err)
 			}
-		}
+
+			if err := validateS3PartSize(opts.S3PartSize); err != nil {
+				return opts, changed, fmt.Errorf("invalid value for --s3-upload-part-size: %s", err)
+			}
+
+			if opts.S3Concurrency < 0 {
+				return opts, changed, fmt.Errorf("invalid value for --s3-upload-concurrency: must be positive")
+			}
+
+			if opts.S3Retries < 0 {
+				return opts, changed, fmt.Errorf("invalid value for --s3-upload-retries: must be positive")
+			}
+
+		case "sftp":
+			opts.SFTPIgnoreKnownHosts, err = validateYesNoOption(*SFTPIgnoreHostKey)
+			if err != nil {
+				return opts, changed, fmt.Errorf("invalid value for --sftp-ignore-hostkey: %s", err)
+			}
+
+			opts.SFTPAddHostKey, err = validateYesNoOption(*SFTPAddHostKey)
+			if err != nil {
+				return opts, changed, fmt.Errorf("invalid value for --sftp-add-host-key: %s", err)
+			}
+
+			if opts.SFTPConnectTimeout < 0 {
+				return opts, changed, fmt.Errorf("sftp connect timeout cannot be negative")
+			}
+
+			if opts.SFTPIOTimeout < 0 {
+				return opts, changed, fmt.Errorf("sftp I/O timeout cannot be negative")
+			}
+		}
 	}
 
 	return opts, changed, nil
 }
 
+// validateTimestampFormat checks that a custom timestamp format is a Go time
+// layout usable in the names of the files: a date formatted with it must
+// parse back to the same date, to the second, and it must not contain dots,
+// which separate the timestamp from the extension, or path separators
+func validateTimestampFormat(layout string) error {
+	forbidden := "./\\"
+	if runtime.GOOS == "windows" {
+		forbidden += ":"
+	}
+
+	if strings.ContainsAny(layout, forbidden) {
+		return fmt.Errorf("must not contain any of %q", forbidden)
+	}
+
+	sample := time.Date(2023, 11, 22, 21, 43, 54, 0, time.Local)
+	date, err := time.ParseInLocation(layout, sample.Format(layout), time.Local)
+	if err != nil {
+		return fmt.Errorf("could not parse a formatted date back: %w", err)
+	}
+
+	if !date.Equal(sample) {
+		return fmt.Errorf("a formatted date does not parse back to the same date, got %s for %s", date, sample)
+	}
+
+	return nil
+}
+
 func validateConfigurationFile(cfg *ini.File) error {
 	s, _ := cfg.GetSection(ini.DefaultSection)
 
 	known_globals := []string{
-		"bin_directory", "backup_directory", "timestamp_format", "host", "port", "user",
-		"dbname", "exclude_dbs", "include_dbs", "with_templates", "format",
-		"parallel_backup_jobs", "compress_level", "jobs", "pause_timeout",
-		"purge_older_than", "purge_min_keep", "checksum_algorithm", "pre_backup_hook",
-		"post_backup_hook", "encrypt", "cipher_pass", "cipher_public_key", "cipher_private_key",
-		"encrypt_keep_source", "upload", "purge_remote",
-		"b2_bucket", "b2_key_id", "b2_app_key", "b2_force_path",
+		"bin_directory", "pg_dump_binary", "pg_dumpall_binary", "pg_restore_binary", "backup_directory", "timestamp_format", "timestamp_utc", "timestamped_subdir", "filename_template", "secrets_file", "log_format", "log_level", "log_file", "log_syslog", "quiet_on_success", "metrics_file", "result_json", "notify_webhook_url", "notify_on", "host", "port", "user",
+		"service", "sslmode", "target_session_attrs", "sslcert", "sslkey", "sslrootcert", "application_name", "dbname", "exclude_dbs", "include_dbs", "owned_by", "include_db_pattern", "exclude_db_pattern", "skip_unavailable_dbs", "with_templates", "format",
+		"parallel_backup_jobs", "compress_level", "compress_method", "compress_long", "jobs", "max_parallel_workers", "pause_timeout", "pause_replication", "pause_retry_interval", "pause_timeout_action", "metadata_query_timeout",
+		"dump_timeout", "dump_lock_timeout", "dump_statement_timeout", "dump_retries", "stop_on_error", "write_markers", "lock_wait", "lock_directory", "timeout", "progress_interval",
+		"purge_older_than", "purge_min_keep", "checksum_algorithm", "checksum_auto_threshold", "checksum_mode", "verify_dump", "pre_backup_hook",
+		"post_backup_hook", "pre_backup_hook_on_error", "post_backup_hook_on_error",
+		"pre_dump_hook", "post_dump_hook", "encrypt", "cipher_pass", "cipher_pass_file", "cipher_public_key", "cipher_private_key",
+		"encrypt_keep_source", "cipher_armor", "upload", "purge_remote", "verify_upload", "remove_local_after_upload", "compress_on_upload",
+		"b2_bucket", "b2_key_id", "b2_app_key", "b2_app_key_file", "b2_force_path",
 		"b2_concurrent_connections", "s3_region", "s3_bucket", "s3_endpoint",
-		"s3_profile", "s3_key_id", "s3_secret", "s3_force_path", "s3_tls", "sftp_host",
-		"sftp_port", "sftp_user", "sftp_password", "sftp_directory", "sftp_identity",
-		"sftp_ignore_hostkey", "gcs_bucket", "gcs_endpoint", "gcs_keyfile",
-		"azure_container", "azure_account", "azure_key", "azure_endpoint", "pg_dump_options",
-		"dump_role_passwords", "dump_only", "upload_prefix",
+		"s3_profile", "s3_key_id", "s3_secret", "s3_secret_file", "s3_force_path", "s3_tls", "s3_sse",
+		"s3_sse_kms_key_id", "s3_storage_class", "s3_role_arn",
+		"s3_role_session_name", "s3_upload_part_size", "s3_upload_concurrency", "s3_upload_retries", "sftp_host",
+		"sftp_port", "sftp_user", "sftp_password", "sftp_password_file", "sftp_directory", "sftp_identity",
+		"sftp_ignore_hostkey", "sftp_known_hosts", "sftp_add_host_key", "sftp_connect_timeout", "sftp_io_timeout", "gcs_bucket", "gcs_endpoint", "gcs_keyfile",
+		"gcs_hmac_key_id", "gcs_hmac_secret",
+		"azure_container", "azure_account", "azure_key", "azure_key_file", "azure_endpoint", "local_directory", "pg_dump_options", "dump_pg_options", "dump_section", "schema_only", "data_only", "no_owner", "no_privileges", "no_comments", "no_sync", "clean", "if_exists",
+		"schemas", "exclude_schemas", "tables", "exclude_tables", "exclude_table_data",
+		"dump_role_passwords", "dump_only", "split_globals", "always_dump_createdb", "upload_prefix",
+		"sync_snapshot", "skip_unchanged", "logical_slot", "logical_slot_keep", "dir_archive", "dir_archive_compress", "file_mode",
 	}
 
 gkLoop:
@@ -548,9 +1427,11 @@ gkLoop:
 
 	subs := cfg.Sections()
 	knonw_perdb := []string{
-		"format", "parallel_backup_jobs", "compress_level", "checksum_algorithm",
+		"format", "parallel_backup_jobs", "compress_level", "compress_method", "compress_long", "checksum_algorithm",
 		"purge_older_than", "purge_min_keep", "schemas", "exclude_schemas", "tables",
-		"exclude_tables", "pg_dump_options", "with_blobs", "user",
+		"exclude_tables", "exclude_table_data", "pg_dump_options", "dump_pg_options", "with_blobs", "user", "dump_section",
+		"schema_only", "data_only", "no_owner", "no_privileges", "no_comments", "no_sync", "clean", "if_exists",
+		"pre_dump_hook", "post_dump_hook", "logical_slot",
 	}
 
 	for _, sub := range subs {
@@ -573,8 +1454,158 @@ gkLoop:
 	return nil
 }
 
-func loadConfigurationFile(path string) (options, error) {
-	var format, purgeKeep, purgeInterval string
+// envExpandedKeys are the keys of the configuration whose values can
+// reference environment variables: connection parameters, credentials and
+// remote locations. Other values, hooks for example, keep their $ for the
+// shell.
+var envExpandedKeys = []string{
+	"host", "port", "user", "dbname", "service", "sslcert", "sslkey", "sslrootcert",
+	"cipher_pass", "cipher_pass_file", "cipher_public_key", "cipher_private_key",
+	"s3_region", "s3_bucket", "s3_endpoint", "s3_profile", "s3_key_id", "s3_secret", "s3_secret_file",
+	"s3_role_arn", "s3_sse_kms_key_id",
+	"b2_bucket", "b2_key_id", "b2_app_key", "b2_app_key_file",
+	"gcs_bucket", "gcs_endpoint", "gcs_keyfile", "gcs_hmac_key_id", "gcs_hmac_secret",
+	"azure_container", "azure_account", "azure_key", "azure_key_file", "azure_endpoint",
+	"sftp_host", "sftp_port", "sftp_user", "sftp_password", "sftp_password_file", "sftp_directory", "sftp_identity",
+	"notify_webhook_url",
+}
+
+// expandConfigEnv replaces references to environment variables, written
+// $VAR or ${VAR}, in the values of the keys listed in envExpandedKeys, so that
+// secrets can be kept out of the file. A literal $ is written $$ in those
+// values.
+func expandConfigEnv(cfg *ini.File) {
+	for _, section := range cfg.Sections() {
+		for _, key := range section.Keys() {
+			value := key.Value()
+			if !strings.Contains(value, "$") || !slices.Contains(envExpandedKeys, key.Name()) {
+				continue
+			}
+
+			key.SetValue(os.Expand(value, func(name string) string {
+				if name == "$" {
+					return "$"
+				}
+
+				v, ok := os.LookupEnv(name)
+				if !ok {
+					l.Warnf("environment variable %s used by %s in the configuration is not set", name, key.Name())
+				}
+				return v
+			}))
+		}
+	}
+}
+
+// appendSecretsFile loads a second configuration file, meant to store
+// credentials with stricter permissions than the main file, its keys
+// overriding the ones of cfg
+func appendSecretsFile(cfg *ini.File, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("could not load secrets file: %w", err)
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0004 != 0 {
+		l.Warnf("secrets file %s is readable by everyone, restrict its permissions", path)
+	}
+
+	secrets, err := ini.Load(path)
+	if err != nil {
+		return fmt.Errorf("could not load secrets file: %w", err)
+	}
+
+	if err := validateConfigurationFile(secrets); err != nil {
+		return fmt.Errorf("could not validate %s: %w", path, err)
+	}
+
+	if secrets.Section(ini.DefaultSection).HasKey("secrets_file") {
+		return fmt.Errorf("secrets_file cannot be set in the secrets file %s", path)
+	}
+
+	return cfg.Append(path)
+}
+
+// configDirFiles lists the configuration files of a directory, the ones
+// ending with .conf, sorted by name
+func configDirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read configuration directory: %w", err)
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".conf" {
+			continue
+		}
+		files = append(files, filepath.Join(dir, e.Name()))
+	}
+
+	// ReadDir returns the entries sorted by filename
+	return files, nil
+}
+
+// appendConfigFile loads a configuration file of the configuration
+// directory, its keys overriding the ones of cfg. Sections with the same
+// name are merged.
+func appendConfigFile(cfg *ini.File, path string) error {
+	other, err := ini.Load(path)
+	if err != nil {
+		return fmt.Errorf("Could load configuration file: %v", err)
+	}
+
+	if err := validateConfigurationFile(other); err != nil {
+		return fmt.Errorf("could not validate %s: %w", path, err)
+	}
+
+	return cfg.Append(path)
+}
+
+// readSecretFile reads a passphrase, password or key from the first line of
+// a file, without the end of line
+func readSecretFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read secret file: %w", err)
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0004 != 0 {
+		l.Warnf("secret file %s is readable by everyone, restrict its permissions", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read secret file: %w", err)
+	}
+
+	line, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimRight(line, "\r"), nil
+}
+
+// configSecret returns the value of a secret of the configuration, either
+// given directly by key or read from the file given by key_file, like the
+// ones mounted by Docker or Kubernetes
+func configSecret(s *ini.Section, key string) (string, error) {
+	path := s.Key(key + "_file").String()
+	if path == "" {
+		return s.Key(key).String(), nil
+	}
+
+	if s.Key(key).String() != "" {
+		return "", fmt.Errorf("only one of %s or %s_file allowed", key, key)
+	}
+
+	secret, err := readSecretFile(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid value for %s_file: %w", key, err)
+	}
+
+	return secret, nil
+}
+
+func loadConfigurationFile(path string, dir string) (options, error) {
+	var format, purgeKeep, purgeInterval, fileMode, dumpTimeout, lockWait, runTimeout, progressInterval, pauseRetryInterval string
 
 	opts := defaultOptions()
 
@@ -583,56 +1614,149 @@ func loadConfigurationFile(path string) (options, error) {
 		if path == defaultCfgFile && errors.Is(err, os.ErrNotExist) {
 			// Fallback on defaults when the default configuration does not exist
 			l.Verbosef("default configuration file %s does not exist, skipping\n", defaultCfgFile)
-			return opts, nil
+			if dir == "" {
+				return opts, nil
+			}
+			cfg = ini.Empty()
+		} else {
+			return opts, fmt.Errorf("Could load configuration file: %v", err)
+		}
+	} else if err := validateConfigurationFile(cfg); err != nil {
+		return opts, fmt.Errorf("could not validate %s: %w", path, err)
+	}
+
+	// Files of the configuration directory override the main file, and
+	// each other in the order of their names
+	if dir != "" {
+		files, err := configDirFiles(dir)
+		if err != nil {
+			return opts, err
 		}
 
-		return opts, fmt.Errorf("Could load configuration file: %v", err)
+		for _, f := range files {
+			l.Verbosef("loading configuration file %s\n", f)
+			if err := appendConfigFile(cfg, f); err != nil {
+				return opts, err
+			}
+		}
 	}
 
-	if err := validateConfigurationFile(cfg); err != nil {
-		return opts, fmt.Errorf("could not validate %s: %w", path, err)
+	// Values of the secrets file override the ones of the main file
+	if secrets := cfg.Section(ini.DefaultSection).Key("secrets_file").String(); secrets != "" {
+		if err := appendSecretsFile(cfg, secrets); err != nil {
+			return opts, err
+		}
 	}
 
+	expandConfigEnv(cfg)
+
 	s, _ := cfg.GetSection(ini.DefaultSection)
 
 	// Read all configuration parameters ensuring the destination
 	// struct member has the same default value as the commandline
 	// flags
 	opts.BinDirectory = s.Key("bin_directory").MustString("")
+	opts.PgDumpBinary = s.Key("pg_dump_binary").MustString("")
+	opts.PgDumpallBinary = s.Key("pg_dumpall_binary").MustString("")
+	opts.PgRestoreBinary = s.Key("pg_restore_binary").MustString("")
 	opts.Directory = s.Key("backup_directory").MustString("/var/backups/postgresql")
 	timeFormat := s.Key("timestamp_format").MustString("rfc3339")
+	opts.TimestampUTC = s.Key("timestamp_utc").MustBool(false)
+	opts.TimestampedSubdir = s.Key("timestamped_subdir").MustBool(false)
+	opts.FilenameTemplate = s.Key("filename_template").MustString("")
+	opts.LogFormat = s.Key("log_format").MustString("text")
+	opts.LogLevel = s.Key("log_level").MustString("info")
+	opts.LogFile = s.Key("log_file").MustString("")
+	opts.LogSyslog = s.Key("log_syslog").MustBool(false)
+	opts.QuietOnSuccess = s.Key("quiet_on_success").MustBool(false)
+	opts.MetricsFile = s.Key("metrics_file").MustString("")
+	opts.ResultJSON = s.Key("result_json").MustString("")
+	opts.NotifyWebhookURL = s.Key("notify_webhook_url").MustString("")
+	opts.NotifyOn = s.Key("notify_on").MustString("always")
 	opts.Host = s.Key("host").MustString("")
-	opts.Port = s.Key("port").MustInt(0)
+	opts.Port = s.Key("port").MustString("")
 	opts.Username = s.Key("user").MustString("")
+	opts.Service = s.Key("service").MustString("")
+	opts.SSLMode = s.Key("sslmode").MustString("")
+	opts.TargetSessionAttrs = s.Key("target_session_attrs").MustString("")
+	opts.SSLCert = s.Key("sslcert").MustString("")
+	opts.SSLKey = s.Key("sslkey").MustString("")
+	opts.SSLRootCert = s.Key("sslrootcert").MustString("")
+	opts.ApplicationName = s.Key("application_name").MustString("")
 	opts.ConnDb = s.Key("dbname").MustString("")
 	opts.ExcludeDbs = s.Key("exclude_dbs").Strings(",")
+	opts.OwnedBy = s.Key("owned_by").Strings(",")
+	opts.IncludeDbPattern = s.Key("include_db_pattern").MustString("")
+	opts.ExcludeDbPattern = s.Key("exclude_db_pattern").MustString("")
+	opts.SkipUnavailable = s.Key("skip_unavailable_dbs").MustBool(false)
 	opts.Dbnames = s.Key("include_dbs").Strings(",")
 	opts.WithTemplates = s.Key("with_templates").MustBool(false)
 	opts.WithRolePasswords = s.Key("dump_role_passwords").MustBool(true)
 	opts.DumpOnly = s.Key("dump_only").MustBool(false)
+	opts.SplitGlobals = s.Key("split_globals").MustBool(false)
+	opts.AlwaysDumpCreateDB = s.Key("always_dump_createdb").MustBool(false)
 	format = s.Key("format").MustString("custom")
 	opts.DirJobs = s.Key("parallel_backup_jobs").MustInt(1)
+	opts.DirArchive = s.Key("dir_archive").MustBool(false)
+	opts.DirArchiveCompress = s.Key("dir_archive_compress").MustString("none")
+	fileMode = s.Key("file_mode").MustString("")
 	opts.CompressLevel = s.Key("compress_level").MustInt(-1)
+	opts.CompressMethod = s.Key("compress_method").MustString("gzip")
+	opts.CompressLong = s.Key("compress_long").MustBool(false)
 	opts.Jobs = s.Key("jobs").MustInt(1)
+	opts.MaxParallelWorkers = s.Key("max_parallel_workers").MustInt(0)
+	opts.SyncSnapshot = s.Key("sync_snapshot").MustBool(false)
+	opts.SkipUnchanged = s.Key("skip_unchanged").MustBool(false)
+	opts.LogicalSlot = s.Key("logical_slot").String()
+	opts.LogicalSlotKeep = s.Key("logical_slot_keep").MustBool(false)
 	opts.PauseTimeout = s.Key("pause_timeout").MustInt(3600)
+	opts.PauseReplication = s.Key("pause_replication").MustBool(true)
+	pauseRetryInterval = s.Key("pause_retry_interval").MustString("10")
+	opts.PauseTimeoutAction = s.Key("pause_timeout_action").MustString("fail")
+	opts.MetadataQueryTimeout = s.Key("metadata_query_timeout").MustInt(60)
+	dumpTimeout = s.Key("dump_timeout").MustString("0")
+	opts.DumpLockTimeout = s.Key("dump_lock_timeout").MustString("")
+	opts.DumpStatementTimeout = s.Key("dump_statement_timeout").MustString("")
+	opts.DumpRetries = s.Key("dump_retries").MustInt(0)
+	opts.StopOnError = s.Key("stop_on_error").MustBool(false)
+	opts.WriteMarkers = s.Key("write_markers").MustBool(false)
+	lockWait = s.Key("lock_wait").MustString("0")
+	opts.LockDirectory = s.Key("lock_directory").String()
+	runTimeout = s.Key("timeout").MustString("0")
+	progressInterval = s.Key("progress_interval").MustString("0")
 	purgeInterval = s.Key("purge_older_than").MustString("30")
 	purgeKeep = s.Key("purge_min_keep").MustString("0")
 	opts.SumAlgo = s.Key("checksum_algorithm").MustString("none")
+	opts.SumAutoThreshold = s.Key("checksum_auto_threshold").MustInt(1024)
+	opts.ChecksumMode = s.Key("checksum_mode").MustString("per-file")
+	opts.VerifyDump = s.Key("verify_dump").MustBool(false)
 	opts.PreHook = s.Key("pre_backup_hook").MustString("")
 	opts.PostHook = s.Key("post_backup_hook").MustString("")
+	opts.PreHookOnError = s.Key("pre_backup_hook_on_error").MustString("abort")
+	opts.PostHookOnError = s.Key("post_backup_hook_on_error").MustString("abort")
+	opts.PreDumpHook = s.Key("pre_dump_hook").MustString("")
+	opts.PostDumpHook = s.Key("post_dump_hook").MustString("")
 	opts.Encrypt = s.Key("encrypt").MustBool(false)
 	opts.CipherPassphrase = s.Key("cipher_pass").MustString("")
+	opts.CipherPassFile = s.Key("cipher_pass_file").MustString("")
 	opts.CipherPublicKey = s.Key("cipher_public_key").MustString("")
 	opts.CipherPrivateKey = s.Key("cipher_private_key").MustString("")
 	opts.EncryptKeepSrc = s.Key("encrypt_keep_source").MustBool(false)
+	opts.CipherArmor = s.Key("cipher_armor").MustBool(false)
 
 	opts.Upload = s.Key("upload").MustString("none")
 	opts.UploadPrefix = s.Key("upload_prefix").MustString("")
 	opts.PurgeRemote = s.Key("purge_remote").MustBool(false)
+	opts.VerifyUpload = s.Key("verify_upload").MustBool(false)
+	opts.RemoveLocal = s.Key("remove_local_after_upload").MustBool(false)
+	opts.CompressOnUpload = s.Key("compress_on_upload").MustBool(false)
 
 	opts.B2Bucket = s.Key("b2_bucket").MustString("")
 	opts.B2KeyID = s.Key("b2_key_id").MustString("")
-	opts.B2AppKey = s.Key("b2_app_key").MustString("")
+	opts.B2AppKey, err = configSecret(s, "b2_app_key")
+	if err != nil {
+		return opts, err
+	}
 	opts.B2ForcePath = s.Key("b2_force_path").MustBool(false)
 	opts.B2ConcurrentConnections = s.Key("b2_concurrent_connections").MustInt(5)
 
@@ -641,26 +1765,50 @@ func loadConfigurationFile(path string) (options, error) {
 	opts.S3EndPoint = s.Key("s3_endpoint").MustString("")
 	opts.S3Profile = s.Key("s3_profile").MustString("")
 	opts.S3KeyID = s.Key("s3_key_id").MustString("")
-	opts.S3Secret = s.Key("s3_secret").MustString("")
+	opts.S3Secret, err = configSecret(s, "s3_secret")
+	if err != nil {
+		return opts, err
+	}
 	opts.S3ForcePath = s.Key("s3_force_path").MustBool(false)
 	opts.S3DisableTLS = !s.Key("s3_tls").MustBool(true)
+	opts.S3SSE = s.Key("s3_sse").MustString("")
+	opts.S3KMSKeyID = s.Key("s3_sse_kms_key_id").MustString("")
+	opts.S3StorageClass = s.Key("s3_storage_class").MustString("")
+	opts.S3RoleARN = s.Key("s3_role_arn").MustString("")
+	opts.S3RoleSessionName = s.Key("s3_role_session_name").MustString("")
+	opts.S3PartSize = s.Key("s3_upload_part_size").MustInt(0)
+	opts.S3Concurrency = s.Key("s3_upload_concurrency").MustInt(0)
+	opts.S3Retries = s.Key("s3_upload_retries").MustInt(0)
 
 	opts.SFTPHost = s.Key("sftp_host").MustString("")
 	opts.SFTPPort = s.Key("sftp_port").MustString("")
 	opts.SFTPUsername = s.Key("sftp_user").MustString("")
-	opts.SFTPPassword = s.Key("sftp_password").MustString("")
+	opts.SFTPPassword, err = configSecret(s, "sftp_password")
+	if err != nil {
+		return opts, err
+	}
 	opts.SFTPDirectory = s.Key("sftp_directory").MustString("")
 	opts.SFTPIdentityFile = s.Key("sftp_identity").MustString("")
 	opts.SFTPIgnoreKnownHosts = s.Key("sftp_ignore_hostkey").MustBool(false)
+	opts.SFTPKnownHosts = s.Key("sftp_known_hosts").MustString("")
+	opts.SFTPAddHostKey = s.Key("sftp_add_host_key").MustBool(false)
+	opts.SFTPConnectTimeout = s.Key("sftp_connect_timeout").MustInt(30)
+	opts.SFTPIOTimeout = s.Key("sftp_io_timeout").MustInt(300)
 
 	opts.GCSBucket = s.Key("gcs_bucket").MustString("")
 	opts.GCSEndPoint = s.Key("gcs_endpoint").MustString("")
 	opts.GCSCredentialsFile = s.Key("gcs_keyfile").MustString("")
+	opts.GCSHMACKeyID = s.Key("gcs_hmac_key_id").MustString("")
+	opts.GCSHMACSecret = s.Key("gcs_hmac_secret").MustString("")
 
 	opts.AzureContainer = s.Key("azure_container").MustString("")
 	opts.AzureAccount = s.Key("azure_account").MustString("")
-	opts.AzureKey = s.Key("azure_key").MustString("")
+	opts.AzureKey, err = configSecret(s, "azure_key")
+	if err != nil {
+		return opts, err
+	}
 	opts.AzureEndpoint = s.Key("azure_endpoint").MustString("blob.core.windows.net")
+	opts.LocalDirectory = s.Key("local_directory").MustString("")
 
 	// Validate purge keep and time limit
 	keep, err := validatePurgeKeepValue(purgeKeep)
@@ -675,19 +1823,114 @@ func loadConfigurationFile(path string) (options, error) {
 	}
 	opts.PurgeInterval = interval
 
-	if opts.CompressLevel < -1 || opts.CompressLevel > 9 {
-		return opts, fmt.Errorf("compression level must be in range 0..9")
+	mode, err := validateFileMode(fileMode)
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for file_mode: %s", err)
+	}
+	opts.FileMode = mode
+
+	if opts.FilenameTemplate != "" {
+		if _, err := newNameTemplate(opts.FilenameTemplate); err != nil {
+			return opts, fmt.Errorf("invalid value for filename_template: %s", err)
+		}
+	}
+
+	if err := validateEnum(opts.CompressMethod, compressMethods); err != nil {
+		return opts, fmt.Errorf("invalid value for compress_method: %s", err)
+	}
+	opts.CompressMethod = strings.TrimSpace(strings.ToLower(opts.CompressMethod))
+
+	if err := validateCompressLevel(opts.CompressMethod, opts.CompressLevel); err != nil {
+		return opts, err
 	}
 
 	if opts.Jobs < 1 {
 		return opts, fmt.Errorf("jobs cannot be less than 1")
 	}
 
+	if opts.MaxParallelWorkers < 0 {
+		return opts, fmt.Errorf("max_parallel_workers cannot be negative")
+	}
+
+	if err := validateSlotName(opts.LogicalSlot); err != nil {
+		return opts, fmt.Errorf("invalid value for logical_slot: %s", err)
+	}
+
+	if opts.MetadataQueryTimeout < 0 {
+		return opts, fmt.Errorf("metadata_query_timeout cannot be negative")
+	}
+
+	timeout, err := validateTimeoutValue(dumpTimeout)
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for dump_timeout: %s", err)
+	}
+	opts.DumpTimeout = timeout
+
+	if err := validateSessionTimeout(opts.DumpLockTimeout); err != nil {
+		return opts, fmt.Errorf("invalid value for dump_lock_timeout: %s", err)
+	}
+
+	if err := validateSessionTimeout(opts.DumpStatementTimeout); err != nil {
+		return opts, fmt.Errorf("invalid value for dump_statement_timeout: %s", err)
+	}
+
+	if opts.DumpRetries < 0 {
+		return opts, fmt.Errorf("dump_retries cannot be negative")
+	}
+
+	wait, err := validateTimeoutValue(lockWait)
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for lock_wait: %s", err)
+	}
+	opts.LockWait = wait
+
+	limit, err := validateTimeoutValue(runTimeout)
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for timeout: %s", err)
+	}
+	opts.Timeout = limit
+
+	every, err := validateTimeoutValue(progressInterval)
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for progress_interval: %s", err)
+	}
+	opts.ProgressInterval = every
+
+	retry, err := validatePauseRetryInterval(pauseRetryInterval)
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for pause_retry_interval: %s", err)
+	}
+	opts.PauseRetryInterval = retry
+
+	if err := validateEnum(opts.PauseTimeoutAction, []string{"fail", "continue"}); err != nil {
+		return opts, fmt.Errorf("invalid value for pause_timeout_action: %s", err)
+	}
+	opts.PauseTimeoutAction = strings.TrimSpace(strings.ToLower(opts.PauseTimeoutAction))
+
 	if err := validateDumpFormat(format); err != nil {
 		return opts, err
 	}
 	opts.Format = []rune(format)[0]
 
+	if err := validateEnum(opts.SumAlgo, sumAlgos); err != nil {
+		return opts, fmt.Errorf("invalid value for checksum_algorithm: %s", err)
+	}
+	opts.SumAlgo = strings.TrimSpace(strings.ToLower(opts.SumAlgo))
+
+	if opts.SumAutoThreshold < 0 {
+		return opts, fmt.Errorf("checksum_auto_threshold cannot be negative")
+	}
+
+	if err := validateEnum(opts.ChecksumMode, []string{"per-file", "combined"}); err != nil {
+		return opts, fmt.Errorf("invalid value for checksum_mode: %s", err)
+	}
+	opts.ChecksumMode = strings.TrimSpace(strings.ToLower(opts.ChecksumMode))
+
+	if err := validateEnum(opts.DirArchiveCompress, append([]string{"none"}, compressMethods...)); err != nil {
+		return opts, fmt.Errorf("invalid value for dir_archive_compress: %s", err)
+	}
+	opts.DirArchiveCompress = strings.TrimSpace(strings.ToLower(opts.DirArchiveCompress))
+
 	if opts.BinDirectory != "" {
 		if err := validateDirectory(opts.BinDirectory); err != nil {
 			return opts, fmt.Errorf("bin_directory must be an existing directory")
@@ -698,16 +1941,85 @@ func loadConfigurationFile(path string) (options, error) {
 		return opts, fmt.Errorf("b2 concurrent connections must be more than 0 (current %d)", opts.B2ConcurrentConnections)
 	}
 
+	if opts.SFTPConnectTimeout < 0 {
+		return opts, fmt.Errorf("sftp_connect_timeout cannot be negative")
+	}
+
+	if opts.SFTPIOTimeout < 0 {
+		return opts, fmt.Errorf("sftp_io_timeout cannot be negative")
+	}
+
+	if err := validateEnum(opts.LogFormat, []string{"text", "json"}); err != nil {
+		return opts, fmt.Errorf("invalid value for log_format: %s", err)
+	}
+	opts.LogFormat = strings.TrimSpace(strings.ToLower(opts.LogFormat))
+
+	if err := validateEnum(opts.LogLevel, []string{"debug", "info", "warn", "error"}); err != nil {
+		return opts, fmt.Errorf("invalid value for log_level: %s", err)
+	}
+	opts.LogLevel = strings.TrimSpace(strings.ToLower(opts.LogLevel))
+
+	if err := validateEnum(opts.NotifyOn, []string{"always", "failure"}); err != nil {
+		return opts, fmt.Errorf("invalid value for notify_on: %s", err)
+	}
+	opts.NotifyOn = strings.TrimSpace(strings.ToLower(opts.NotifyOn))
+
+	if err := validateEnum(opts.PreHookOnError, hookOnErrorValues); err != nil {
+		return opts, fmt.Errorf("invalid value for pre_backup_hook_on_error: %s", err)
+	}
+	opts.PreHookOnError = strings.TrimSpace(strings.ToLower(opts.PreHookOnError))
+
+	if err := validateEnum(opts.PostHookOnError, hookOnErrorValues); err != nil {
+		return opts, fmt.Errorf("invalid value for post_backup_hook_on_error: %s", err)
+	}
+	opts.PostHookOnError = strings.TrimSpace(strings.ToLower(opts.PostHookOnError))
+
+	if opts.SSLMode != "" {
+		if err := validateEnum(opts.SSLMode, sslModes); err != nil {
+			return opts, fmt.Errorf("invalid value for sslmode: %s", err)
+		}
+		opts.SSLMode = strings.TrimSpace(strings.ToLower(opts.SSLMode))
+	}
+
+	if opts.TargetSessionAttrs != "" {
+		if err := validateEnum(opts.TargetSessionAttrs, targetSessionAttrs); err != nil {
+			return opts, fmt.Errorf("invalid value for target_session_attrs: %s", err)
+		}
+		opts.TargetSessionAttrs = strings.TrimSpace(strings.ToLower(opts.TargetSessionAttrs))
+	}
+
+	opts.Host, opts.Port = trimList(opts.Host), trimList(opts.Port)
+	if err := validatePorts(opts.Port); err != nil {
+		return opts, fmt.Errorf("invalid value for port: %s", err)
+	}
+
 	// Validate upload option
-	stores := []string{"none", "b2", "s3", "sftp", "gcs", "azure"}
-	if err := validateEnum(opts.Upload, stores); err != nil {
+	stores := []string{"none", "b2", "s3", "sftp", "gcs", "azure", "local"}
+	if err := validateUpload(opts.Upload, stores); err != nil {
 		return opts, fmt.Errorf("invalid value for upload: %s", err)
 	}
 
+	opts.S3StorageClass, err = validateS3StorageClass(opts.S3StorageClass)
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for s3_storage_class: %s", err)
+	}
+
+	if err := validateS3PartSize(opts.S3PartSize); err != nil {
+		return opts, fmt.Errorf("invalid value for s3_upload_part_size: %s", err)
+	}
+
+	if opts.S3Concurrency < 0 {
+		return opts, fmt.Errorf("invalid value for s3_upload_concurrency: must be positive")
+	}
+
+	if opts.S3Retries < 0 {
+		return opts, fmt.Errorf("invalid value for s3_upload_retries: must be positive")
+	}
+
 	// Validate the value of the timestamp format. Force the use of legacy
-	// on windows to avoid failure when creating filenames with the
-	// timestamp
-	if runtime.GOOS == "windows" {
+	// on windows instead of rfc3339 to avoid failure when creating
+	// filenames with the timestamp
+	if runtime.GOOS == "windows" && timeFormat == "rfc3339" {
 		timeFormat = "legacy"
 	}
 
@@ -715,8 +2027,12 @@ func loadConfigurationFile(path string) (options, error) {
 	case "legacy":
 		opts.TimeFormat = "2006-01-02_15-04-05"
 	case "rfc3339":
+		opts.TimeFormat = time.RFC3339
 	default:
-		return opts, fmt.Errorf("unknown timestamp format: %s", timeFormat)
+		if err := validateTimestampFormat(timeFormat); err != nil {
+			return opts, fmt.Errorf("unknown timestamp format: %s: %w", timeFormat, err)
+		}
+		opts.TimeFormat = timeFormat
 	}
 
 	// Parse the pg_dump options as a list of args
@@ -725,6 +2041,30 @@ func loadConfigurationFile(path string) (options, error) {
 		return opts, fmt.Errorf("unable to parse pg_dump_options: %w", err)
 	}
 	opts.PgDumpOpts = words
+	opts.PgOptions = s.Key("dump_pg_options").MustString("")
+
+	opts.DumpSections, err = validateDumpSections(s.Key("dump_section").Strings(","))
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for dump_section: %s", err)
+	}
+
+	opts.SchemaOnly = s.Key("schema_only").MustBool(false)
+	opts.DataOnly = s.Key("data_only").MustBool(false)
+	if opts.SchemaOnly && opts.DataOnly {
+		return opts, fmt.Errorf("schema_only and data_only cannot be used together")
+	}
+
+	opts.NoOwner = s.Key("no_owner").MustBool(false)
+	opts.NoPrivileges = s.Key("no_privileges").MustBool(false)
+	opts.NoComments = s.Key("no_comments").MustBool(false)
+	opts.NoSync = s.Key("no_sync").MustBool(false)
+	opts.Clean = s.Key("clean").MustBool(false)
+	opts.IfExists = s.Key("if_exists").MustBool(false)
+	opts.Schemas = s.Key("schemas").Strings(",")
+	opts.ExcludedSchemas = s.Key("exclude_schemas").Strings(",")
+	opts.Tables = s.Key("tables").Strings(",")
+	opts.ExcludedTables = s.Key("exclude_tables").Strings(",")
+	opts.ExcludedTableData = s.Key("exclude_table_data").Strings(",")
 
 	// Process all sections with database specific configuration,
 	// fallback on the values of the global section
@@ -738,14 +2078,22 @@ func loadConfigurationFile(path string) (options, error) {
 
 		var dbFormat, dbPurgeInterval, dbPurgeKeep string
 
-		o := dbOpts{}
+		o := dbOpts{SectionKeys: s.KeyStrings()}
 		dbFormat = s.Key("format").MustString(format)
 		o.Jobs = s.Key("parallel_backup_jobs").MustInt(opts.DirJobs)
 		o.CompressLevel = s.Key("compress_level").MustInt(opts.CompressLevel)
+		o.CompressMethod = s.Key("compress_method").MustString(opts.CompressMethod)
+		o.CompressLong = s.Key("compress_long").MustBool(opts.CompressLong)
 		o.SumAlgo = s.Key("checksum_algorithm").MustString(opts.SumAlgo)
 		dbPurgeInterval = s.Key("purge_older_than").MustString(purgeInterval)
 		dbPurgeKeep = s.Key("purge_min_keep").MustString(purgeKeep)
 		o.Username = s.Key("user").MustString(opts.Username)
+		o.PreDumpHook = s.Key("pre_dump_hook").MustString(opts.PreDumpHook)
+		o.PostDumpHook = s.Key("post_dump_hook").MustString(opts.PostDumpHook)
+		o.LogicalSlot = s.Key("logical_slot").MustString(opts.LogicalSlot)
+		if err := validateSlotName(o.LogicalSlot); err != nil {
+			return opts, fmt.Errorf("invalid value for logical_slot in section %s: %s", s.Name(), err)
+		}
 
 		// Validate purge keep and time limit
 		keep, err := validatePurgeKeepValue(dbPurgeKeep)
@@ -760,8 +2108,13 @@ func loadConfigurationFile(path string) (options, error) {
 		}
 		o.PurgeInterval = interval
 
-		if o.CompressLevel < -1 || o.CompressLevel > 9 {
-			return opts, fmt.Errorf("compression level must be in range 0..9")
+		if err := validateEnum(o.CompressMethod, compressMethods); err != nil {
+			return opts, fmt.Errorf("invalid value for compress_method in section %s: %s", s.Name(), err)
+		}
+		o.CompressMethod = strings.TrimSpace(strings.ToLower(o.CompressMethod))
+
+		if err := validateCompressLevel(o.CompressMethod, o.CompressLevel); err != nil {
+			return opts, fmt.Errorf("invalid compression in section %s: %s", s.Name(), err)
 		}
 
 		if err := validateDumpFormat(dbFormat); err != nil {
@@ -769,10 +2122,18 @@ func loadConfigurationFile(path string) (options, error) {
 		}
 		o.Format = []rune(dbFormat)[0]
 
-		o.Schemas = s.Key("schemas").Strings(",")
-		o.ExcludedSchemas = s.Key("exclude_schemas").Strings(",")
-		o.Tables = s.Key("tables").Strings(",")
-		o.ExcludedTables = s.Key("exclude_tables").Strings(",")
+		if err := validateEnum(o.SumAlgo, sumAlgos); err != nil {
+			return opts, fmt.Errorf("invalid value for checksum_algorithm in section %s: %s", s.Name(), err)
+		}
+		o.SumAlgo = strings.TrimSpace(strings.ToLower(o.SumAlgo))
+
+		// Lists of schemas and tables given in the section replace
+		// the ones of the global section
+		o.Schemas = sectionStrings(s, "schemas", opts.Schemas)
+		o.ExcludedSchemas = sectionStrings(s, "exclude_schemas", opts.ExcludedSchemas)
+		o.Tables = sectionStrings(s, "tables", opts.Tables)
+		o.ExcludedTables = sectionStrings(s, "exclude_tables", opts.ExcludedTables)
+		o.ExcludedTableData = sectionStrings(s, "exclude_table_data", opts.ExcludedTableData)
 
 		if s.HasKey("pg_dump_options") {
 			words, err := shlex.Split(s.Key("pg_dump_options").String(), true)
@@ -783,6 +2144,29 @@ func loadConfigurationFile(path string) (options, error) {
 		} else {
 			o.PgDumpOpts = opts.PgDumpOpts
 		}
+		o.PgOptions = s.Key("dump_pg_options").MustString(opts.PgOptions)
+
+		if s.HasKey("dump_section") {
+			o.Sections, err = validateDumpSections(s.Key("dump_section").Strings(","))
+			if err != nil {
+				return opts, fmt.Errorf("invalid value for dump_section for %s: %s", s.Name(), err)
+			}
+		} else {
+			o.Sections = opts.DumpSections
+		}
+
+		o.SchemaOnly = s.Key("schema_only").MustBool(opts.SchemaOnly)
+		o.DataOnly = s.Key("data_only").MustBool(opts.DataOnly)
+		if o.SchemaOnly && o.DataOnly {
+			return opts, fmt.Errorf("schema_only and data_only cannot be used together for %s", s.Name())
+		}
+
+		o.NoOwner = s.Key("no_owner").MustBool(opts.NoOwner)
+		o.NoPrivileges = s.Key("no_privileges").MustBool(opts.NoPrivileges)
+		o.NoComments = s.Key("no_comments").MustBool(opts.NoComments)
+		o.NoSync = s.Key("no_sync").MustBool(opts.NoSync)
+		o.Clean = s.Key("clean").MustBool(opts.Clean)
+		o.IfExists = s.Key("if_exists").MustBool(opts.IfExists)
 
 		if s.HasKey("with_blobs") {
 			if wb, err := s.Key("with_blobs").Bool(); err != nil {
@@ -800,6 +2184,122 @@ func loadConfigurationFile(path string) (options, error) {
 	return opts, nil
 }
 
+// checkOptions runs the checks involving several options, once the command
+// line and the configuration file are merged. All problems are reported at
+// once.
+func checkOptions(opts *options) error {
+	var errs []error
+
+	if err := ensureCipherParamsPresent(opts); err != nil {
+		errs = append(errs, fmt.Errorf("required cipher parameters not present: %w", err))
+	}
+
+	// The host and port can come from the command line and the
+	// configuration file
+	if err := validateHostPorts(opts.Host, opts.Port); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Timestamps given on the command line may use the timestamp format
+	// of the configuration file, the caller has set it
+	if opts.RestoreTimestamp != "" {
+		if _, ok := parseDumpTimestamp(opts.RestoreTimestamp); !ok {
+			errs = append(errs, fmt.Errorf("invalid value for --restore-timestamp: %s", opts.RestoreTimestamp))
+		}
+	}
+
+	if opts.Snapshot != "" {
+		if _, ok := parseDumpTimestamp(opts.Snapshot); !ok {
+			errs = append(errs, fmt.Errorf("invalid value for --snapshot: %s", opts.Snapshot))
+		}
+	}
+
+	uses := func(target string) bool {
+		return slices.Contains(uploadTargets(opts.Upload), target) || opts.Download == target || opts.ListRemote == target ||
+			opts.RekeyRemote == target
+	}
+
+	if uses("s3") && opts.S3Bucket == "" {
+		errs = append(errs, fmt.Errorf("a bucket is mandatory with s3"))
+	}
+
+	// The encryption method and the KMS key can come from the command
+	// line and the configuration file, check them together
+	if sse, err := validateS3SSE(opts.S3SSE, opts.S3KMSKeyID); err != nil {
+		errs = append(errs, fmt.Errorf("invalid value for --s3-sse: %s", err))
+	} else {
+		opts.S3SSE = sse
+	}
+
+	if uses("b2") && opts.B2Bucket == "" {
+		errs = append(errs, fmt.Errorf("a bucket is mandatory with B2"))
+	}
+
+	if uses("gcs") && opts.GCSBucket == "" {
+		errs = append(errs, fmt.Errorf("a bucket is mandatory with gcs"))
+	}
+
+	if opts.GCSHMACKeyID != "" && opts.GCSHMACSecret == "" {
+		errs = append(errs, fmt.Errorf("a secret is mandatory with a GCS HMAC key ID"))
+	}
+
+	if uses("azure") && opts.AzureContainer == "" {
+		errs = append(errs, fmt.Errorf("a container is mandatory with azure"))
+	}
+
+	if uses("local") && opts.LocalDirectory == "" {
+		errs = append(errs, fmt.Errorf("a directory is mandatory with local"))
+	}
+
+	if opts.TimestampedSubdir && opts.FilenameTemplate != "" {
+		errs = append(errs, fmt.Errorf("timestamped subdirectories and a filename template cannot be used together"))
+	}
+
+	// Runs are purged as a whole, the dump of an unchanged database
+	// could be removed while the next runs still use it
+	if opts.TimestampedSubdir && opts.SkipUnchanged {
+		errs = append(errs, fmt.Errorf("skipping unchanged databases cannot be used with timestamped subdirectories"))
+	}
+
+	if opts.RemoveLocal && len(uploadTargets(opts.Upload)) == 0 {
+		errs = append(errs, fmt.Errorf("removing local files after upload requires an upload location"))
+	}
+
+	// The compression level and method can come from the command line and
+	// the configuration file, check them together
+	if err := validateCompression(opts.CompressMethod, opts.CompressLevel, opts.CompressLong, opts.Format); err != nil {
+		errs = append(errs, err)
+	}
+	for name, dbo := range opts.PerDbOpts {
+		if err := validateCompression(dbo.CompressMethod, dbo.CompressLevel, dbo.CompressLong, dbo.Format); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// connParams returns the connection keywords given with their own option, to
+// be added to the connection string with prepareConnInfo
+func connParams(opts options) map[string]string {
+	return map[string]string{
+		"service":              opts.Service,
+		"sslmode":              opts.SSLMode,
+		"target_session_attrs": opts.TargetSessionAttrs,
+		"sslcert":              opts.SSLCert,
+		"sslkey":               opts.SSLKey,
+		"sslrootcert":          opts.SSLRootCert,
+		"application_name":     opts.ApplicationName,
+	}
+}
+
+// setInSection tells if key is given in the section of the database in the
+// configuration file. Options from the command line do not override such
+// keys.
+func (o *dbOpts) setInSection(key string) bool {
+	return slices.Contains(o.SectionKeys, key)
+}
+
 func mergeCliAndConfigOptions(cliOpts options, configOpts options, onCli []string) options {
 	opts := configOpts
 
@@ -807,12 +2307,44 @@ func mergeCliAndConfigOptions(cliOpts options, configOpts options, onCli []strin
 	// database options
 	for _, o := range onCli {
 		switch o {
+		case "log-format":
+			opts.LogFormat = cliOpts.LogFormat
+		case "log-level":
+			opts.LogLevel = cliOpts.LogLevel
+		case "log-file":
+			opts.LogFile = cliOpts.LogFile
+		case "log-syslog":
+			opts.LogSyslog = cliOpts.LogSyslog
+		case "quiet-on-success":
+			opts.QuietOnSuccess = cliOpts.QuietOnSuccess
+		case "metrics-file":
+			opts.MetricsFile = cliOpts.MetricsFile
+		case "result-json":
+			opts.ResultJSON = cliOpts.ResultJSON
+		case "notify-webhook-url":
+			opts.NotifyWebhookURL = cliOpts.NotifyWebhookURL
+		case "notify-on":
+			opts.NotifyOn = cliOpts.NotifyOn
 		case "bin-directory":
 			opts.BinDirectory = cliOpts.BinDirectory
+		case "pg-dump-binary":
+			opts.PgDumpBinary = cliOpts.PgDumpBinary
+		case "pg-dumpall-binary":
+			opts.PgDumpallBinary = cliOpts.PgDumpallBinary
+		case "pg-restore-binary":
+			opts.PgRestoreBinary = cliOpts.PgRestoreBinary
 		case "backup-directory":
 			opts.Directory = cliOpts.Directory
 		case "exclude-dbs":
 			opts.ExcludeDbs = cliOpts.ExcludeDbs
+		case "owned-by":
+			opts.OwnedBy = cliOpts.OwnedBy
+		case "include-db-pattern":
+			opts.IncludeDbPattern = cliOpts.IncludeDbPattern
+		case "exclude-db-pattern":
+			opts.ExcludeDbPattern = cliOpts.ExcludeDbPattern
+		case "skip-unavailable-dbs":
+			opts.SkipUnavailable = cliOpts.SkipUnavailable
 		case "include-dbs":
 			opts.Dbnames = cliOpts.Dbnames
 		case "with-templates":
@@ -821,10 +2353,67 @@ func mergeCliAndConfigOptions(cliOpts options, configOpts options, onCli []strin
 			opts.WithRolePasswords = cliOpts.WithRolePasswords
 		case "dump-only":
 			opts.DumpOnly = cliOpts.DumpOnly
+		case "split-globals":
+			opts.SplitGlobals = cliOpts.SplitGlobals
+		case "always-dump-createdb":
+			opts.AlwaysDumpCreateDB = cliOpts.AlwaysDumpCreateDB
+		case "logical-slot":
+			for _, dbo := range opts.PerDbOpts {
+				if !dbo.setInSection("logical_slot") {
+					dbo.LogicalSlot = cliOpts.LogicalSlot
+				}
+			}
+			opts.LogicalSlot = cliOpts.LogicalSlot
+		case "logical-slot-keep":
+			opts.LogicalSlotKeep = cliOpts.LogicalSlotKeep
+		case "skip-unchanged":
+			opts.SkipUnchanged = cliOpts.SkipUnchanged
+		case "sync-snapshot":
+			opts.SyncSnapshot = cliOpts.SyncSnapshot
+		case "dir-archive":
+			opts.DirArchive = cliOpts.DirArchive
+		case "dir-archive-compress":
+			opts.DirArchiveCompress = cliOpts.DirArchiveCompress
+		case "timestamped-subdir":
+			opts.TimestampedSubdir = cliOpts.TimestampedSubdir
+		case "filename-template":
+			opts.FilenameTemplate = cliOpts.FilenameTemplate
+		case "file-mode":
+			opts.FileMode = cliOpts.FileMode
 		case "pause-timeout":
 			opts.PauseTimeout = cliOpts.PauseTimeout
+		case "pause-retry-interval":
+			opts.PauseRetryInterval = cliOpts.PauseRetryInterval
+		case "pause-timeout-action":
+			opts.PauseTimeoutAction = cliOpts.PauseTimeoutAction
+		case "pause-replication":
+			opts.PauseReplication = cliOpts.PauseReplication
+		case "metadata-query-timeout":
+			opts.MetadataQueryTimeout = cliOpts.MetadataQueryTimeout
+		case "dump-timeout":
+			opts.DumpTimeout = cliOpts.DumpTimeout
+		case "dump-lock-timeout":
+			opts.DumpLockTimeout = cliOpts.DumpLockTimeout
+		case "dump-statement-timeout":
+			opts.DumpStatementTimeout = cliOpts.DumpStatementTimeout
+		case "dump-retries":
+			opts.DumpRetries = cliOpts.DumpRetries
+		case "stop-on-error":
+			opts.StopOnError = cliOpts.StopOnError
+		case "write-markers":
+			opts.WriteMarkers = cliOpts.WriteMarkers
+		case "lock-wait":
+			opts.LockWait = cliOpts.LockWait
+		case "lock-directory":
+			opts.LockDirectory = cliOpts.LockDirectory
+		case "timeout":
+			opts.Timeout = cliOpts.Timeout
+		case "progress-interval":
+			opts.ProgressInterval = cliOpts.ProgressInterval
 		case "jobs":
 			opts.Jobs = cliOpts.Jobs
+		case "max-parallel-workers":
+			opts.MaxParallelWorkers = cliOpts.MaxParallelWorkers
 		case "format":
 			opts.Format = cliOpts.Format
 			for _, dbo := range opts.PerDbOpts {
@@ -840,6 +2429,102 @@ func mergeCliAndConfigOptions(cliOpts options, configOpts options, onCli []strin
 			for _, dbo := range opts.PerDbOpts {
 				dbo.CompressLevel = cliOpts.CompressLevel
 			}
+		case "compress-method":
+			opts.CompressMethod = cliOpts.CompressMethod
+			for _, dbo := range opts.PerDbOpts {
+				dbo.CompressMethod = cliOpts.CompressMethod
+			}
+		case "compress-long":
+			opts.CompressLong = cliOpts.CompressLong
+			for _, dbo := range opts.PerDbOpts {
+				dbo.CompressLong = cliOpts.CompressLong
+			}
+		case "dump-section":
+			opts.DumpSections = cliOpts.DumpSections
+			for _, dbo := range opts.PerDbOpts {
+				dbo.Sections = cliOpts.DumpSections
+			}
+		case "schema-only":
+			opts.SchemaOnly = cliOpts.SchemaOnly
+			for _, dbo := range opts.PerDbOpts {
+				dbo.SchemaOnly = cliOpts.SchemaOnly
+			}
+		case "data-only":
+			opts.DataOnly = cliOpts.DataOnly
+			for _, dbo := range opts.PerDbOpts {
+				dbo.DataOnly = cliOpts.DataOnly
+			}
+		case "no-owner":
+			opts.NoOwner = cliOpts.NoOwner
+			for _, dbo := range opts.PerDbOpts {
+				dbo.NoOwner = cliOpts.NoOwner
+			}
+		case "no-privileges":
+			opts.NoPrivileges = cliOpts.NoPrivileges
+			for _, dbo := range opts.PerDbOpts {
+				dbo.NoPrivileges = cliOpts.NoPrivileges
+			}
+		case "schema":
+			for _, dbo := range opts.PerDbOpts {
+				if !dbo.setInSection("schemas") {
+					dbo.Schemas = cliOpts.Schemas
+				}
+			}
+			opts.Schemas = cliOpts.Schemas
+		case "exclude-schema":
+			for _, dbo := range opts.PerDbOpts {
+				if !dbo.setInSection("exclude_schemas") {
+					dbo.ExcludedSchemas = cliOpts.ExcludedSchemas
+				}
+			}
+			opts.ExcludedSchemas = cliOpts.ExcludedSchemas
+		case "table":
+			for _, dbo := range opts.PerDbOpts {
+				if !dbo.setInSection("tables") {
+					dbo.Tables = cliOpts.Tables
+				}
+			}
+			opts.Tables = cliOpts.Tables
+		case "exclude-table":
+			for _, dbo := range opts.PerDbOpts {
+				if !dbo.setInSection("exclude_tables") {
+					dbo.ExcludedTables = cliOpts.ExcludedTables
+				}
+			}
+			opts.ExcludedTables = cliOpts.ExcludedTables
+		case "exclude-table-data":
+			for _, dbo := range opts.PerDbOpts {
+				if !dbo.setInSection("exclude_table_data") {
+					dbo.ExcludedTableData = cliOpts.ExcludedTableData
+				}
+			}
+			opts.ExcludedTableData = cliOpts.ExcludedTableData
+		case "no-comments":
+			opts.NoComments = cliOpts.NoComments
+			for _, dbo := range opts.PerDbOpts {
+				dbo.NoComments = cliOpts.NoComments
+			}
+		case "no-sync":
+			opts.NoSync = cliOpts.NoSync
+			for _, dbo := range opts.PerDbOpts {
+				dbo.NoSync = cliOpts.NoSync
+			}
+		case "clean":
+			opts.Clean = cliOpts.Clean
+			for _, dbo := range opts.PerDbOpts {
+				dbo.Clean = cliOpts.Clean
+			}
+		case "if-exists":
+			opts.IfExists = cliOpts.IfExists
+			for _, dbo := range opts.PerDbOpts {
+				dbo.IfExists = cliOpts.IfExists
+			}
+		case "checksum-auto-threshold":
+			opts.SumAutoThreshold = cliOpts.SumAutoThreshold
+		case "checksum-mode":
+			opts.ChecksumMode = cliOpts.ChecksumMode
+		case "verify-dump":
+			opts.VerifyDump = cliOpts.VerifyDump
 		case "checksum-algo":
 			opts.SumAlgo = cliOpts.SumAlgo
 			for _, dbo := range opts.PerDbOpts {
@@ -859,18 +2544,62 @@ func mergeCliAndConfigOptions(cliOpts options, configOpts options, onCli []strin
 			opts.PreHook = cliOpts.PreHook
 		case "post-backup-hook":
 			opts.PostHook = cliOpts.PostHook
+		case "pre-backup-hook-on-error":
+			opts.PreHookOnError = cliOpts.PreHookOnError
+		case "post-backup-hook-on-error":
+			opts.PostHookOnError = cliOpts.PostHookOnError
+		case "pre-dump-hook":
+			opts.PreDumpHook = cliOpts.PreDumpHook
+		case "post-dump-hook":
+			opts.PostDumpHook = cliOpts.PostDumpHook
 		case "encrypt":
 			opts.Encrypt = cliOpts.Encrypt
 		case "encrypt-keep-src":
 			opts.EncryptKeepSrc = cliOpts.EncryptKeepSrc
 		case "cipher-pass":
 			opts.CipherPassphrase = cliOpts.CipherPassphrase
+		case "cipher-pass-file":
+			// The file replaces a passphrase of the configuration file
+			opts.CipherPassFile = cliOpts.CipherPassFile
+			opts.CipherPassphrase = ""
 		case "cipher-public-key":
 			opts.CipherPublicKey = cliOpts.CipherPublicKey
 		case "cipher-private-key":
 			opts.CipherPrivateKey = cliOpts.CipherPrivateKey
+		case "cipher-armor":
+			opts.CipherArmor = cliOpts.CipherArmor
 		case "decrypt":
 			opts.Decrypt = cliOpts.Decrypt
+		case "decrypt-directory":
+			opts.DecryptDirectory = cliOpts.DecryptDirectory
+		case "decrypt-remove-src":
+			opts.DecryptRemoveSrc = cliOpts.DecryptRemoveSrc
+		case "rekey":
+			opts.Rekey = cliOpts.Rekey
+		case "new-cipher-pass":
+			opts.NewCipherPassphrase = cliOpts.NewCipherPassphrase
+		case "new-cipher-public-key":
+			opts.NewCipherPublicKey = cliOpts.NewCipherPublicKey
+		case "restore":
+			opts.Restore = cliOpts.Restore
+		case "check-config":
+			opts.CheckConfig = cliOpts.CheckConfig
+		case "self-test":
+			opts.SelfTest = cliOpts.SelfTest
+		case "restore-timestamp":
+			opts.RestoreTimestamp = cliOpts.RestoreTimestamp
+		case "snapshot":
+			opts.Snapshot = cliOpts.Snapshot
+		case "restore-jobs":
+			opts.RestoreJobs = cliOpts.RestoreJobs
+		case "create":
+			opts.RestoreCreate = cliOpts.RestoreCreate
+		case "test-restore":
+			opts.TestRestore = cliOpts.TestRestore
+		case "test-restore-full":
+			opts.TestRestoreFull = cliOpts.TestRestoreFull
+		case "test-restore-dbname":
+			opts.TestRestoreDbname = cliOpts.TestRestoreDbname
 
 		case "upload":
 			opts.Upload = cliOpts.Upload
@@ -880,8 +2609,18 @@ func mergeCliAndConfigOptions(cliOpts options, configOpts options, onCli []strin
 			opts.Download = cliOpts.Download
 		case "list-remote":
 			opts.ListRemote = cliOpts.ListRemote
+		case "rekey-remote":
+			opts.RekeyRemote = cliOpts.RekeyRemote
+		case "list-local":
+			opts.ListLocal = cliOpts.ListLocal
 		case "purge-remote":
 			opts.PurgeRemote = cliOpts.PurgeRemote
+		case "verify-upload":
+			opts.VerifyUpload = cliOpts.VerifyUpload
+		case "remove-local-after-upload":
+			opts.RemoveLocal = cliOpts.RemoveLocal
+		case "compress-on-upload":
+			opts.CompressOnUpload = cliOpts.CompressOnUpload
 
 		case "b2-bucket":
 			opts.B2Bucket = cliOpts.B2Bucket
@@ -910,6 +2649,22 @@ func mergeCliAndConfigOptions(cliOpts options, configOpts options, onCli []strin
 			opts.S3ForcePath = cliOpts.S3ForcePath
 		case "s3-tls":
 			opts.S3DisableTLS = cliOpts.S3DisableTLS
+		case "s3-sse":
+			opts.S3SSE = cliOpts.S3SSE
+		case "s3-sse-kms-key-id":
+			opts.S3KMSKeyID = cliOpts.S3KMSKeyID
+		case "s3-storage-class":
+			opts.S3StorageClass = cliOpts.S3StorageClass
+		case "s3-role-arn":
+			opts.S3RoleARN = cliOpts.S3RoleARN
+		case "s3-upload-part-size":
+			opts.S3PartSize = cliOpts.S3PartSize
+		case "s3-upload-concurrency":
+			opts.S3Concurrency = cliOpts.S3Concurrency
+		case "s3-upload-retries":
+			opts.S3Retries = cliOpts.S3Retries
+		case "s3-role-session-name":
+			opts.S3RoleSessionName = cliOpts.S3RoleSessionName
 
 		case "sftp-host":
 			opts.SFTPHost = cliOpts.SFTPHost
@@ -925,6 +2680,14 @@ func mergeCliAndConfigOptions(cliOpts options, configOpts options, onCli []strin
 			opts.SFTPIdentityFile = cliOpts.SFTPIdentityFile
 		case "sftp-ignore-hostkey":
 			opts.SFTPIgnoreKnownHosts = cliOpts.SFTPIgnoreKnownHosts
+		case "sftp-known-hosts":
+			opts.SFTPKnownHosts = cliOpts.SFTPKnownHosts
+		case "sftp-add-host-key":
+			opts.SFTPAddHostKey = cliOpts.SFTPAddHostKey
+		case "sftp-connect-timeout":
+			opts.SFTPConnectTimeout = cliOpts.SFTPConnectTimeout
+		case "sftp-io-timeout":
+			opts.SFTPIOTimeout = cliOpts.SFTPIOTimeout
 
 		case "gcs-bucket":
 			opts.GCSBucket = cliOpts.GCSBucket
@@ -932,6 +2695,10 @@ func mergeCliAndConfigOptions(cliOpts options, configOpts options, onCli []strin
 			opts.GCSEndPoint = cliOpts.GCSEndPoint
 		case "gcs-keyfile":
 			opts.GCSCredentialsFile = cliOpts.GCSCredentialsFile
+		case "gcs-hmac-key-id":
+			opts.GCSHMACKeyID = cliOpts.GCSHMACKeyID
+		case "gcs-hmac-secret":
+			opts.GCSHMACSecret = cliOpts.GCSHMACSecret
 
 		case "azure-container":
 			opts.AzureContainer = cliOpts.AzureContainer
@@ -942,12 +2709,29 @@ func mergeCliAndConfigOptions(cliOpts options, configOpts options, onCli []strin
 		case "azure-endpoint":
 			opts.AzureEndpoint = cliOpts.AzureEndpoint
 
+		case "local-directory":
+			opts.LocalDirectory = cliOpts.LocalDirectory
+
 		case "host":
 			opts.Host = cliOpts.Host
 		case "port":
 			opts.Port = cliOpts.Port
 		case "username":
 			opts.Username = cliOpts.Username
+		case "service":
+			opts.Service = cliOpts.Service
+		case "sslmode":
+			opts.SSLMode = cliOpts.SSLMode
+		case "target-session-attrs":
+			opts.TargetSessionAttrs = cliOpts.TargetSessionAttrs
+		case "sslcert":
+			opts.SSLCert = cliOpts.SSLCert
+		case "sslkey":
+			opts.SSLKey = cliOpts.SSLKey
+		case "sslrootcert":
+			opts.SSLRootCert = cliOpts.SSLRootCert
+		case "application-name":
+			opts.ApplicationName = cliOpts.ApplicationName
 		case "dbname":
 			opts.ConnDb = cliOpts.ConnDb
 		}
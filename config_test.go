@@ -30,7 +30,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -151,6 +153,81 @@ func TestValidateYesNoOption(t *testing.T) {
 	}
 }
 
+func TestValidateUpload(t *testing.T) {
+	stores := []string{"none", "s3", "sftp", "local"}
+	var tests = []struct {
+		give      string
+		want      []string
+		wantError bool
+	}{
+		{"none", []string{}, false},
+		{"s3", []string{"s3"}, false},
+		{"s3,sftp", []string{"s3", "sftp"}, false},
+		{" S3 , local", []string{"s3", "local"}, false},
+		{"s3,s3", nil, true},
+		{"none,s3", nil, true},
+		{"s3,", nil, true},
+		{"s3,gcs", nil, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := validateUpload(st.give, stores)
+			if st.wantError {
+				if err == nil {
+					t.Errorf("expected an error with %q", st.give)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if diff := cmp.Diff(st.want, uploadTargets(st.give)); diff != "" {
+				t.Errorf("uploadTargets() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidateHostPorts(t *testing.T) {
+	var tests = []struct {
+		host      string
+		port      string
+		wantError bool
+	}{
+		{"", "", false},
+		{"localhost", "5432", false},
+		{"db1,db2", "5432", false},
+		{"db1,db2,::1", "5432,,5434", false},
+		{"db1,db2", "5432,5433,5434", true},
+		{"db1", "5432,5433", true},
+		{"db1", "port", true},
+		{"db1", "70000", true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := validatePorts(st.port)
+			if err == nil {
+				err = validateHostPorts(st.host, st.port)
+			}
+
+			if st.wantError && err == nil {
+				t.Errorf("expected an error with host %q and port %q", st.host, st.port)
+			}
+			if !st.wantError && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+
+	if got := trimList(" db1 , db2"); got != "db1,db2" {
+		t.Errorf("got %q, want %q", got, "db1,db2")
+	}
+}
+
 func TestValidateEnum(t *testing.T) {
 	var tests = []struct {
 		give      string
@@ -175,6 +252,97 @@ func TestValidateEnum(t *testing.T) {
 	}
 }
 
+func TestValidateS3SSE(t *testing.T) {
+	var tests = []struct {
+		sse       string
+		keyID     string
+		want      string
+		wantError bool
+	}{
+		{"", "", "", false},
+		{"aes256", "", "AES256", false},
+		{"AES256", "", "AES256", false},
+		{"aws:kms", "", "aws:kms", false},
+		{"aws:kms", "mykey", "aws:kms", false},
+		{"AES256", "mykey", "AES256", true},
+		{"", "mykey", "", true},
+		{"rot13", "", "rot13", true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := validateS3SSE(st.sse, st.keyID)
+			if err == nil && st.wantError {
+				t.Errorf("excepted an error got nil")
+			}
+
+			if err != nil && !st.wantError {
+				t.Errorf("did not expect an error, got %s", err)
+			}
+
+			if got != st.want {
+				t.Errorf("got %q, want %q", got, st.want)
+			}
+		})
+	}
+}
+
+func TestValidateS3PartSize(t *testing.T) {
+	var tests = []struct {
+		give      int
+		wantError bool
+	}{
+		{0, false},
+		{5, false},
+		{64, false},
+		{4, true},
+		{-1, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := validateS3PartSize(st.give)
+			if err == nil && st.wantError {
+				t.Errorf("excepted an error got nil")
+			}
+
+			if err != nil && !st.wantError {
+				t.Errorf("did not expect an error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestValidateS3StorageClass(t *testing.T) {
+	var tests = []struct {
+		give      string
+		want      string
+		wantError bool
+	}{
+		{"", "", false},
+		{"STANDARD_IA", "STANDARD_IA", false},
+		{"glacier_ir", "GLACIER_IR", false},
+		{"COLD", "COLD", true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := validateS3StorageClass(st.give)
+			if err == nil && st.wantError {
+				t.Errorf("excepted an error got nil")
+			}
+
+			if err != nil && !st.wantError {
+				t.Errorf("did not expect an error, got %s", err)
+			}
+
+			if got != st.want {
+				t.Errorf("got %q, want %q", got, st.want)
+			}
+		})
+	}
+}
+
 func TestDefaultOptions(t *testing.T) {
 	timeFormat := time.RFC3339
 	if runtime.GOOS == "windows" {
@@ -186,11 +354,17 @@ func TestDefaultOptions(t *testing.T) {
 		Format:                  'c',
 		DirJobs:                 1,
 		CompressLevel:           -1,
+		CompressMethod:          "gzip",
 		Jobs:                    1,
 		PauseTimeout:            3600,
+		PauseReplication:        true,
+		PauseRetryInterval:      10 * time.Second,
+		PauseTimeoutAction:      "fail",
+		MetadataQueryTimeout:    60,
 		PurgeInterval:           -30 * 24 * time.Hour,
 		PurgeKeep:               0,
 		SumAlgo:                 "none",
+		ChecksumMode:            "per-file",
 		CfgFile:                 "/etc/pg_back/pg_back.conf",
 		TimeFormat:              timeFormat,
 		WithRolePasswords:       true,
@@ -199,6 +373,18 @@ func TestDefaultOptions(t *testing.T) {
 		ListRemote:              "none",
 		AzureEndpoint:           "blob.core.windows.net",
 		B2ConcurrentConnections: 5,
+		SFTPConnectTimeout:      30,
+		SFTPIOTimeout:           300,
+		RestoreJobs:             1,
+		RekeyRemote:             "none",
+		DirArchiveCompress:      "none",
+		SumAutoThreshold:        1024,
+		TestRestoreDbname:       "pg_back_test_restore",
+		LogFormat:               "text",
+		LogLevel:                "info",
+		NotifyOn:                "always",
+		PreHookOnError:          "abort",
+		PostHookOnError:         "abort",
 	}
 
 	got := defaultOptions()
@@ -232,11 +418,17 @@ func TestParseCli(t *testing.T) {
 					Format:                  'c',
 					DirJobs:                 1,
 					CompressLevel:           2,
+					CompressMethod:          "gzip",
 					Jobs:                    1,
 					PauseTimeout:            3600,
+					PauseReplication:        true,
+					PauseRetryInterval:      10 * time.Second,
+					PauseTimeoutAction:      "fail",
+					MetadataQueryTimeout:    60,
 					PurgeInterval:           -30 * 24 * time.Hour,
 					PurgeKeep:               0,
 					SumAlgo:                 "none",
+					ChecksumMode:            "per-file",
 					CfgFile:                 "/etc/pg_back/pg_back.conf",
 					TimeFormat:              timeFormat,
 					WithRolePasswords:       true,
@@ -245,6 +437,18 @@ func TestParseCli(t *testing.T) {
 					ListRemote:              "none",
 					AzureEndpoint:           "blob.core.windows.net",
 					B2ConcurrentConnections: 5,
+					SFTPConnectTimeout:      30,
+					SFTPIOTimeout:           300,
+					RestoreJobs:             1,
+					RekeyRemote:             "none",
+					DirArchiveCompress:      "none",
+					SumAutoThreshold:        1024,
+					TestRestoreDbname:       "pg_back_test_restore",
+					LogFormat:               "text",
+					LogLevel:                "info",
+					NotifyOn:                "always",
+					PreHookOnError:          "abort",
+					PostHookOnError:         "abort",
 				},
 				false,
 				false,
@@ -259,11 +463,17 @@ func TestParseCli(t *testing.T) {
 					Format:                  'c',
 					DirJobs:                 1,
 					CompressLevel:           -1,
+					CompressMethod:          "gzip",
 					Jobs:                    1,
 					PauseTimeout:            3600,
+					PauseReplication:        true,
+					PauseRetryInterval:      10 * time.Second,
+					PauseTimeoutAction:      "fail",
+					MetadataQueryTimeout:    60,
 					PurgeInterval:           -30 * 24 * time.Hour,
 					PurgeKeep:               0,
 					SumAlgo:                 "none",
+					ChecksumMode:            "per-file",
 					CfgFile:                 "/etc/pg_back/pg_back.conf",
 					TimeFormat:              timeFormat,
 					WithRolePasswords:       true,
@@ -272,6 +482,18 @@ func TestParseCli(t *testing.T) {
 					ListRemote:              "none",
 					AzureEndpoint:           "blob.core.windows.net",
 					B2ConcurrentConnections: 5,
+					SFTPConnectTimeout:      30,
+					SFTPIOTimeout:           300,
+					RestoreJobs:             1,
+					RekeyRemote:             "none",
+					DirArchiveCompress:      "none",
+					SumAutoThreshold:        1024,
+					TestRestoreDbname:       "pg_back_test_restore",
+					LogFormat:               "text",
+					LogLevel:                "info",
+					NotifyOn:                "always",
+					PreHookOnError:          "abort",
+					PostHookOnError:         "abort",
 				},
 				false,
 				false,
@@ -309,11 +531,17 @@ func TestParseCli(t *testing.T) {
 					Format:                  'c',
 					DirJobs:                 1,
 					CompressLevel:           -1,
+					CompressMethod:          "gzip",
 					Jobs:                    1,
 					PauseTimeout:            3600,
+					PauseReplication:        true,
+					PauseRetryInterval:      10 * time.Second,
+					PauseTimeoutAction:      "fail",
+					MetadataQueryTimeout:    60,
 					PurgeInterval:           -30 * 24 * time.Hour,
 					PurgeKeep:               0,
 					SumAlgo:                 "none",
+					ChecksumMode:            "per-file",
 					CfgFile:                 "/etc/pg_back/pg_back.conf",
 					TimeFormat:              timeFormat,
 					Encrypt:                 true,
@@ -324,10 +552,22 @@ func TestParseCli(t *testing.T) {
 					ListRemote:              "none",
 					AzureEndpoint:           "blob.core.windows.net",
 					B2ConcurrentConnections: 5,
+					SFTPConnectTimeout:      30,
+					SFTPIOTimeout:           300,
+					RestoreJobs:             1,
+					RekeyRemote:             "none",
+					DirArchiveCompress:      "none",
+					SumAutoThreshold:        1024,
+					TestRestoreDbname:       "pg_back_test_restore",
+					LogFormat:               "text",
+					LogLevel:                "info",
+					NotifyOn:                "always",
+					PreHookOnError:          "abort",
+					PostHookOnError:         "abort",
 				},
 				false,
 				false,
-				"invalid value for --upload: value not found in [none b2 s3 sftp gcs azure]",
+				"invalid value for --upload: value not found in [none b2 s3 sftp gcs azure local]",
 				"",
 			},
 			{
@@ -337,11 +577,17 @@ func TestParseCli(t *testing.T) {
 					Format:                  'c',
 					DirJobs:                 1,
 					CompressLevel:           -1,
+					CompressMethod:          "gzip",
 					Jobs:                    1,
 					PauseTimeout:            3600,
+					PauseReplication:        true,
+					PauseRetryInterval:      10 * time.Second,
+					PauseTimeoutAction:      "fail",
+					MetadataQueryTimeout:    60,
 					PurgeInterval:           -30 * 24 * time.Hour,
 					PurgeKeep:               0,
 					SumAlgo:                 "none",
+					ChecksumMode:            "per-file",
 					CfgFile:                 "/etc/pg_back/pg_back.conf",
 					TimeFormat:              timeFormat,
 					Encrypt:                 true,
@@ -352,10 +598,22 @@ func TestParseCli(t *testing.T) {
 					ListRemote:              "none",
 					AzureEndpoint:           "blob.core.windows.net",
 					B2ConcurrentConnections: 5,
+					SFTPConnectTimeout:      30,
+					SFTPIOTimeout:           300,
+					RestoreJobs:             1,
+					RekeyRemote:             "none",
+					DirArchiveCompress:      "none",
+					SumAutoThreshold:        1024,
+					TestRestoreDbname:       "pg_back_test_restore",
+					LogFormat:               "text",
+					LogLevel:                "info",
+					NotifyOn:                "always",
+					PreHookOnError:          "abort",
+					PostHookOnError:         "abort",
 				},
 				false,
 				false,
-				"invalid value for --download: value not found in [none b2 s3 sftp gcs azure]",
+				"invalid value for --download: value not found in [none b2 s3 sftp gcs azure local]",
 				"",
 			},
 			{
@@ -373,11 +631,17 @@ func TestParseCli(t *testing.T) {
 					Format:                  'c',
 					DirJobs:                 1,
 					CompressLevel:           -1,
+					CompressMethod:          "gzip",
 					Jobs:                    1,
 					PauseTimeout:            3600,
+					PauseReplication:        true,
+					PauseRetryInterval:      10 * time.Second,
+					PauseTimeoutAction:      "fail",
+					MetadataQueryTimeout:    60,
 					PurgeInterval:           -30 * 24 * time.Hour,
 					PurgeKeep:               0,
 					SumAlgo:                 "none",
+					ChecksumMode:            "per-file",
 					CfgFile:                 "/etc/pg_back/pg_back.conf",
 					TimeFormat:              timeFormat,
 					Decrypt:                 false,
@@ -388,6 +652,18 @@ func TestParseCli(t *testing.T) {
 					ListRemote:              "none",
 					AzureEndpoint:           "blob.core.windows.net",
 					B2ConcurrentConnections: 5,
+					SFTPConnectTimeout:      30,
+					SFTPIOTimeout:           300,
+					RestoreJobs:             1,
+					RekeyRemote:             "none",
+					DirArchiveCompress:      "none",
+					SumAutoThreshold:        1024,
+					TestRestoreDbname:       "pg_back_test_restore",
+					LogFormat:               "text",
+					LogLevel:                "info",
+					NotifyOn:                "always",
+					PreHookOnError:          "abort",
+					PostHookOnError:         "abort",
 				},
 				false,
 				false,
@@ -401,11 +677,17 @@ func TestParseCli(t *testing.T) {
 					Format:                  'c',
 					DirJobs:                 1,
 					CompressLevel:           -1,
+					CompressMethod:          "gzip",
 					Jobs:                    1,
 					PauseTimeout:            3600,
+					PauseReplication:        true,
+					PauseRetryInterval:      10 * time.Second,
+					PauseTimeoutAction:      "fail",
+					MetadataQueryTimeout:    60,
 					PurgeInterval:           -30 * 24 * time.Hour,
 					PurgeKeep:               0,
 					SumAlgo:                 "none",
+					ChecksumMode:            "per-file",
 					CfgFile:                 "/etc/pg_back/pg_back.conf",
 					TimeFormat:              timeFormat,
 					Decrypt:                 false,
@@ -416,6 +698,18 @@ func TestParseCli(t *testing.T) {
 					ListRemote:              "none",
 					AzureEndpoint:           "blob.core.windows.net",
 					B2ConcurrentConnections: 5,
+					SFTPConnectTimeout:      30,
+					SFTPIOTimeout:           300,
+					RestoreJobs:             1,
+					RekeyRemote:             "none",
+					DirArchiveCompress:      "none",
+					SumAutoThreshold:        1024,
+					TestRestoreDbname:       "pg_back_test_restore",
+					LogFormat:               "text",
+					LogLevel:                "info",
+					NotifyOn:                "always",
+					PreHookOnError:          "abort",
+					PostHookOnError:         "abort",
 				},
 				false,
 				false,
@@ -429,11 +723,17 @@ func TestParseCli(t *testing.T) {
 					Format:                  'c',
 					DirJobs:                 1,
 					CompressLevel:           -1,
+					CompressMethod:          "gzip",
 					Jobs:                    1,
 					PauseTimeout:            3600,
+					PauseReplication:        true,
+					PauseRetryInterval:      10 * time.Second,
+					PauseTimeoutAction:      "fail",
+					MetadataQueryTimeout:    60,
 					PurgeInterval:           -30 * 24 * time.Hour,
 					PurgeKeep:               0,
 					SumAlgo:                 "none",
+					ChecksumMode:            "per-file",
 					CfgFile:                 "/etc/pg_back/pg_back.conf",
 					TimeFormat:              timeFormat,
 					Decrypt:                 false,
@@ -444,6 +744,18 @@ func TestParseCli(t *testing.T) {
 					ListRemote:              "none",
 					AzureEndpoint:           "blob.core.windows.net",
 					B2ConcurrentConnections: 5,
+					SFTPConnectTimeout:      30,
+					SFTPIOTimeout:           300,
+					RestoreJobs:             1,
+					RekeyRemote:             "none",
+					DirArchiveCompress:      "none",
+					SumAutoThreshold:        1024,
+					TestRestoreDbname:       "pg_back_test_restore",
+					LogFormat:               "text",
+					LogLevel:                "info",
+					NotifyOn:                "always",
+					PreHookOnError:          "abort",
+					PostHookOnError:         "abort",
 				},
 				false,
 				false,
@@ -542,15 +854,21 @@ func TestLoadConfigurationFile(t *testing.T) {
 			false,
 			options{
 				Directory:               "test",
-				Port:                    5433,
+				Port:                    "5433",
 				Format:                  'c',
 				DirJobs:                 1,
 				CompressLevel:           -1,
+				CompressMethod:          "gzip",
 				Jobs:                    1,
 				PauseTimeout:            3600,
+				PauseReplication:        true,
+				PauseRetryInterval:      10 * time.Second,
+				PauseTimeoutAction:      "fail",
+				MetadataQueryTimeout:    60,
 				PurgeInterval:           -30 * 24 * time.Hour,
 				PurgeKeep:               0,
 				SumAlgo:                 "none",
+				ChecksumMode:            "per-file",
 				CfgFile:                 "/etc/pg_back/pg_back.conf",
 				TimeFormat:              timeFormat,
 				WithRolePasswords:       true,
@@ -559,6 +877,18 @@ func TestLoadConfigurationFile(t *testing.T) {
 				ListRemote:              "none",
 				AzureEndpoint:           "blob.core.windows.net",
 				B2ConcurrentConnections: 5,
+				SFTPConnectTimeout:      30,
+				SFTPIOTimeout:           300,
+				RestoreJobs:             1,
+				RekeyRemote:             "none",
+				DirArchiveCompress:      "none",
+				SumAutoThreshold:        1024,
+				TestRestoreDbname:       "pg_back_test_restore",
+				LogFormat:               "text",
+				LogLevel:                "info",
+				NotifyOn:                "always",
+				PreHookOnError:          "abort",
+				PostHookOnError:         "abort",
 			},
 		},
 		{ // ensure comma separated lists work
@@ -570,11 +900,17 @@ func TestLoadConfigurationFile(t *testing.T) {
 				Format:                  'c',
 				DirJobs:                 1,
 				CompressLevel:           9,
+				CompressMethod:          "gzip",
 				Jobs:                    1,
 				PauseTimeout:            3600,
+				PauseReplication:        true,
+				PauseRetryInterval:      10 * time.Second,
+				PauseTimeoutAction:      "fail",
+				MetadataQueryTimeout:    60,
 				PurgeInterval:           -30 * 24 * time.Hour,
 				PurgeKeep:               0,
 				SumAlgo:                 "none",
+				ChecksumMode:            "per-file",
 				CfgFile:                 "/etc/pg_back/pg_back.conf",
 				TimeFormat:              timeFormat,
 				WithRolePasswords:       true,
@@ -583,6 +919,18 @@ func TestLoadConfigurationFile(t *testing.T) {
 				ListRemote:              "none",
 				AzureEndpoint:           "blob.core.windows.net",
 				B2ConcurrentConnections: 5,
+				SFTPConnectTimeout:      30,
+				SFTPIOTimeout:           300,
+				RestoreJobs:             1,
+				RekeyRemote:             "none",
+				DirArchiveCompress:      "none",
+				SumAutoThreshold:        1024,
+				TestRestoreDbname:       "pg_back_test_restore",
+				LogFormat:               "text",
+				LogLevel:                "info",
+				NotifyOn:                "always",
+				PreHookOnError:          "abort",
+				PostHookOnError:         "abort",
 			},
 		},
 		{
@@ -593,11 +941,17 @@ func TestLoadConfigurationFile(t *testing.T) {
 				Format:                  'c',
 				DirJobs:                 1,
 				CompressLevel:           -1,
+				CompressMethod:          "gzip",
 				Jobs:                    1,
 				PauseTimeout:            3600,
+				PauseReplication:        true,
+				PauseRetryInterval:      10 * time.Second,
+				PauseTimeoutAction:      "fail",
+				MetadataQueryTimeout:    60,
 				PurgeInterval:           -30 * 24 * time.Hour,
 				PurgeKeep:               0,
 				SumAlgo:                 "none",
+				ChecksumMode:            "per-file",
 				CfgFile:                 "/etc/pg_back/pg_back.conf",
 				TimeFormat:              timeFormat,
 				WithRolePasswords:       true,
@@ -606,6 +960,18 @@ func TestLoadConfigurationFile(t *testing.T) {
 				ListRemote:              "none",
 				AzureEndpoint:           "blob.core.windows.net",
 				B2ConcurrentConnections: 5,
+				SFTPConnectTimeout:      30,
+				SFTPIOTimeout:           300,
+				RestoreJobs:             1,
+				RekeyRemote:             "none",
+				DirArchiveCompress:      "none",
+				SumAutoThreshold:        1024,
+				TestRestoreDbname:       "pg_back_test_restore",
+				LogFormat:               "text",
+				LogLevel:                "info",
+				NotifyOn:                "always",
+				PreHookOnError:          "abort",
+				PostHookOnError:         "abort",
 			},
 		},
 		{
@@ -616,11 +982,17 @@ func TestLoadConfigurationFile(t *testing.T) {
 				Format:                  'c',
 				DirJobs:                 1,
 				CompressLevel:           -1,
+				CompressMethod:          "gzip",
 				Jobs:                    1,
 				PauseTimeout:            3600,
+				PauseReplication:        true,
+				PauseRetryInterval:      10 * time.Second,
+				PauseTimeoutAction:      "fail",
+				MetadataQueryTimeout:    60,
 				PurgeInterval:           -30 * 24 * time.Hour,
 				PurgeKeep:               0,
 				SumAlgo:                 "none",
+				ChecksumMode:            "per-file",
 				CfgFile:                 "/etc/pg_back/pg_back.conf",
 				TimeFormat:              "2006-01-02_15-04-05",
 				WithRolePasswords:       true,
@@ -629,8 +1001,66 @@ func TestLoadConfigurationFile(t *testing.T) {
 				ListRemote:              "none",
 				AzureEndpoint:           "blob.core.windows.net",
 				B2ConcurrentConnections: 5,
+				SFTPConnectTimeout:      30,
+				SFTPIOTimeout:           300,
+				RestoreJobs:             1,
+				RekeyRemote:             "none",
+				DirArchiveCompress:      "none",
+				SumAutoThreshold:        1024,
+				TestRestoreDbname:       "pg_back_test_restore",
+				LogFormat:               "text",
+				LogLevel:                "info",
+				NotifyOn:                "always",
+				PreHookOnError:          "abort",
+				PostHookOnError:         "abort",
+			},
+		},
+		{
+			[]string{"timestamp_format = 20060102T150405Z"},
+			false,
+			options{
+				Directory:               "/var/backups/postgresql",
+				Format:                  'c',
+				DirJobs:                 1,
+				CompressLevel:           -1,
+				CompressMethod:          "gzip",
+				Jobs:                    1,
+				PauseTimeout:            3600,
+				PauseReplication:        true,
+				PauseRetryInterval:      10 * time.Second,
+				PauseTimeoutAction:      "fail",
+				MetadataQueryTimeout:    60,
+				PurgeInterval:           -30 * 24 * time.Hour,
+				PurgeKeep:               0,
+				SumAlgo:                 "none",
+				ChecksumMode:            "per-file",
+				CfgFile:                 "/etc/pg_back/pg_back.conf",
+				TimeFormat:              "20060102T150405Z",
+				WithRolePasswords:       true,
+				Upload:                  "none",
+				Download:                "none",
+				ListRemote:              "none",
+				AzureEndpoint:           "blob.core.windows.net",
+				B2ConcurrentConnections: 5,
+				SFTPConnectTimeout:      30,
+				SFTPIOTimeout:           300,
+				RestoreJobs:             1,
+				RekeyRemote:             "none",
+				DirArchiveCompress:      "none",
+				SumAutoThreshold:        1024,
+				TestRestoreDbname:       "pg_back_test_restore",
+				LogFormat:               "text",
+				LogLevel:                "info",
+				NotifyOn:                "always",
+				PreHookOnError:          "abort",
+				PostHookOnError:         "abort",
 			},
 		},
+		{
+			[]string{"timestamp_format = 2006-01-02"},
+			true,
+			defaultOptions(),
+		},
 		{
 			[]string{"timestamp_format = wrong"},
 			true,
@@ -653,27 +1083,35 @@ func TestLoadConfigurationFile(t *testing.T) {
 			},
 			false,
 			options{
-				Directory:     "test",
-				Format:        'c',
-				DirJobs:       1,
-				CompressLevel: -1,
-				Jobs:          1,
-				PauseTimeout:  3600,
-				PurgeInterval: -30 * 24 * time.Hour,
-				PurgeKeep:     0,
-				SumAlgo:       "none",
-				CfgFile:       "/etc/pg_back/pg_back.conf",
-				TimeFormat:    timeFormat,
-				PgDumpOpts:    []string{"-O", "-x"},
+				Directory:            "test",
+				Format:               'c',
+				DirJobs:              1,
+				CompressLevel:        -1,
+				CompressMethod:       "gzip",
+				Jobs:                 1,
+				PauseTimeout:         3600,
+				PauseReplication:     true,
+				PauseRetryInterval:   10 * time.Second,
+				PauseTimeoutAction:   "fail",
+				MetadataQueryTimeout: 60,
+				PurgeInterval:        -30 * 24 * time.Hour,
+				PurgeKeep:            0,
+				SumAlgo:              "none",
+				ChecksumMode:         "per-file",
+				CfgFile:              "/etc/pg_back/pg_back.conf",
+				TimeFormat:           timeFormat,
+				PgDumpOpts:           []string{"-O", "-x"},
 				PerDbOpts: map[string]*dbOpts{"db": &dbOpts{
-					Format:        'c',
-					SumAlgo:       "none",
-					Jobs:          2,
-					CompressLevel: 2,
-					PurgeInterval: -15 * 24 * time.Hour,
-					PurgeKeep:     0,
-					PgDumpOpts:    []string{"-O", "-x"},
-					WithBlobs:     1,
+					Format:         'c',
+					SumAlgo:        "none",
+					Jobs:           2,
+					CompressLevel:  2,
+					CompressMethod: "gzip",
+					PurgeInterval:  -15 * 24 * time.Hour,
+					PurgeKeep:      0,
+					PgDumpOpts:     []string{"-O", "-x"},
+					WithBlobs:      1,
+					SectionKeys:    []string{"purge_older_than", "parallel_backup_jobs", "with_blobs", "compress_level"},
 				}},
 				WithRolePasswords:       true,
 				Upload:                  "none",
@@ -681,6 +1119,18 @@ func TestLoadConfigurationFile(t *testing.T) {
 				ListRemote:              "none",
 				AzureEndpoint:           "blob.core.windows.net",
 				B2ConcurrentConnections: 5,
+				SFTPConnectTimeout:      30,
+				SFTPIOTimeout:           300,
+				RestoreJobs:             1,
+				RekeyRemote:             "none",
+				DirArchiveCompress:      "none",
+				SumAutoThreshold:        1024,
+				TestRestoreDbname:       "pg_back_test_restore",
+				LogFormat:               "text",
+				LogLevel:                "info",
+				NotifyOn:                "always",
+				PreHookOnError:          "abort",
+				PostHookOnError:         "abort",
 			},
 		},
 		{
@@ -697,27 +1147,35 @@ func TestLoadConfigurationFile(t *testing.T) {
 			},
 			false,
 			options{
-				Directory:     "test",
-				Format:        'c',
-				DirJobs:       1,
-				CompressLevel: 3,
-				Jobs:          1,
-				PauseTimeout:  3600,
-				PurgeInterval: -30 * 24 * time.Hour,
-				PurgeKeep:     0,
-				SumAlgo:       "none",
-				CfgFile:       "/etc/pg_back/pg_back.conf",
-				TimeFormat:    timeFormat,
-				PgDumpOpts:    []string{"-O", "-x"},
+				Directory:            "test",
+				Format:               'c',
+				DirJobs:              1,
+				CompressLevel:        3,
+				CompressMethod:       "gzip",
+				Jobs:                 1,
+				PauseTimeout:         3600,
+				PauseReplication:     true,
+				PauseRetryInterval:   10 * time.Second,
+				PauseTimeoutAction:   "fail",
+				MetadataQueryTimeout: 60,
+				PurgeInterval:        -30 * 24 * time.Hour,
+				PurgeKeep:            0,
+				SumAlgo:              "none",
+				ChecksumMode:         "per-file",
+				CfgFile:              "/etc/pg_back/pg_back.conf",
+				TimeFormat:           timeFormat,
+				PgDumpOpts:           []string{"-O", "-x"},
 				PerDbOpts: map[string]*dbOpts{"db": &dbOpts{
-					Format:        'c',
-					SumAlgo:       "none",
-					CompressLevel: 3,
-					Jobs:          2,
-					PurgeInterval: -15 * 24 * time.Hour,
-					PurgeKeep:     0,
-					PgDumpOpts:    []string{},
-					WithBlobs:     2,
+					Format:         'c',
+					SumAlgo:        "none",
+					CompressLevel:  3,
+					CompressMethod: "gzip",
+					Jobs:           2,
+					PurgeInterval:  -15 * 24 * time.Hour,
+					PurgeKeep:      0,
+					PgDumpOpts:     []string{},
+					WithBlobs:      2,
+					SectionKeys:    []string{"purge_older_than", "parallel_backup_jobs", "pg_dump_options", "with_blobs"},
 				}},
 				WithRolePasswords:       false,
 				Upload:                  "none",
@@ -725,6 +1183,18 @@ func TestLoadConfigurationFile(t *testing.T) {
 				ListRemote:              "none",
 				AzureEndpoint:           "blob.core.windows.net",
 				B2ConcurrentConnections: 5,
+				SFTPConnectTimeout:      30,
+				SFTPIOTimeout:           300,
+				RestoreJobs:             1,
+				RekeyRemote:             "none",
+				DirArchiveCompress:      "none",
+				SumAutoThreshold:        1024,
+				TestRestoreDbname:       "pg_back_test_restore",
+				LogFormat:               "text",
+				LogLevel:                "info",
+				NotifyOn:                "always",
+				PreHookOnError:          "abort",
+				PostHookOnError:         "abort",
 			},
 		},
 		{
@@ -754,7 +1224,7 @@ func TestLoadConfigurationFile(t *testing.T) {
 			}
 
 			var got options
-			got, err = loadConfigurationFile(f.Name())
+			got, err = loadConfigurationFile(f.Name(), "")
 			if err != nil && !st.fail {
 				t.Errorf("expected an error: %s", err)
 			}
@@ -775,7 +1245,7 @@ func TestMergeCliAndConfigoptions(t *testing.T) {
 		BinDirectory:            "/bin",
 		Directory:               "test",
 		Host:                    "localhost",
-		Port:                    5433,
+		Port:                    "5433",
 		Username:                "test",
 		ConnDb:                  "postgres",
 		ExcludeDbs:              []string{"a", "b"},
@@ -784,11 +1254,17 @@ func TestMergeCliAndConfigoptions(t *testing.T) {
 		Format:                  'd',
 		DirJobs:                 2,
 		CompressLevel:           4,
+		CompressMethod:          "gzip",
 		Jobs:                    4,
 		PauseTimeout:            60,
+		PauseReplication:        true,
+		PauseRetryInterval:      10 * time.Second,
+		PauseTimeoutAction:      "fail",
+		MetadataQueryTimeout:    60,
 		PurgeInterval:           -7 * 24 * time.Hour,
 		PurgeKeep:               5,
 		SumAlgo:                 "sha256",
+		ChecksumMode:            "per-file",
 		PreHook:                 "touch /tmp/pre-hook",
 		PostHook:                "touch /tmp/post-hook",
 		CfgFile:                 "/etc/pg_back/pg_back.conf",
@@ -799,6 +1275,18 @@ func TestMergeCliAndConfigoptions(t *testing.T) {
 		ListRemote:              "none",
 		AzureEndpoint:           "blob.core.windows.net",
 		B2ConcurrentConnections: 5,
+		SFTPConnectTimeout:      30,
+		SFTPIOTimeout:           300,
+		RestoreJobs:             1,
+		RekeyRemote:             "none",
+		DirArchiveCompress:      "none",
+		SumAutoThreshold:        1024,
+		TestRestoreDbname:       "pg_back_test_restore",
+		LogFormat:               "text",
+		LogLevel:                "info",
+		NotifyOn:                "always",
+		PreHookOnError:          "abort",
+		PostHookOnError:         "abort",
 	}
 
 	cliOptList := []string{
@@ -870,3 +1358,622 @@ func TestValidateConfigurationFile(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateFileMode(t *testing.T) {
+	var tests = []struct {
+		input string
+		want  os.FileMode
+		fails bool
+	}{
+		{"", 0, false},
+		{"0600", 0600, false},
+		{"640", 0640, false},
+		{" 0644 ", 0644, false},
+		{"0800", 0, true},
+		{"01777", 0, true},
+		{"rw-------", 0, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := validateFileMode(st.input)
+			if st.fails {
+				if err == nil {
+					t.Errorf("expected an error for %q", st.input)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if got != st.want {
+				t.Errorf("got %o, want %o", got, st.want)
+			}
+		})
+	}
+
+	if m := dirMode(0640); m != 0750 {
+		t.Errorf("got %o, want 0750", m)
+	}
+}
+
+func TestValidateCompressLevel(t *testing.T) {
+	var tests = []struct {
+		method string
+		level  int
+		fails  bool
+	}{
+		{"gzip", -1, false},
+		{"gzip", 9, false},
+		{"gzip", 10, true},
+		{"gzip", -2, true},
+		{"lz4", 12, false},
+		{"lz4", 13, true},
+		{"zstd", 0, false},
+		{"zstd", 22, false},
+		{"zstd", 23, true},
+		{"", 22, false},
+		{"", 23, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := validateCompressLevel(st.method, st.level)
+			if st.fails && err == nil {
+				t.Errorf("expected an error with level %d of %q", st.level, st.method)
+			}
+			if !st.fails && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	var tests = []struct {
+		method string
+		level  int
+		long   bool
+		format rune
+		fails  bool
+	}{
+		{"zstd", 19, true, 'c', false},
+		{"gzip", 5, true, 'c', true},
+		{"zstd", 9, false, 'p', true},
+		{"zstd", 0, false, 'p', false},
+		{"gzip", 9, false, 'p', false},
+		{"gzip", 19, false, 'd', true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := validateCompression(st.method, st.level, st.long, st.format)
+			if st.fails && err == nil {
+				t.Errorf("expected an error")
+			}
+			if !st.fails && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+
+	// A level given on the command line is checked against the method
+	// of the configuration file after merging
+	opts := defaultOptions()
+	opts.CompressLevel = 19
+	if err := checkOptions(&opts); err == nil {
+		t.Errorf("expected an error with level 19 of gzip")
+	}
+	opts.CompressMethod = "zstd"
+	if err := checkOptions(&opts); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestValidateSlotName(t *testing.T) {
+	for _, name := range []string{"", "pg_back", "slot_1"} {
+		if err := validateSlotName(name); err != nil {
+			t.Errorf("unexpected error for %q: %s", name, err)
+		}
+	}
+
+	for _, name := range []string{"Slot", "my-slot", "a\"b", strings.Repeat("a", 64)} {
+		if err := validateSlotName(name); err == nil {
+			t.Errorf("expected an error for %q", name)
+		}
+	}
+}
+
+func TestValidateDumpSections(t *testing.T) {
+	got, err := validateDumpSections([]string{"Pre-Data", " post-data"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if diff := cmp.Diff([]string{"pre-data", "post-data"}, got); diff != "" {
+		t.Errorf("validateDumpSections() mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := validateDumpSections([]string{"data", "indexes"}); err == nil {
+		t.Errorf("expected an error with an unknown section")
+	}
+}
+
+func TestValidateTimeoutValue(t *testing.T) {
+	var tests = []struct {
+		give      string
+		want      time.Duration
+		wantError bool
+	}{
+		{"0", 0, false},
+		{"90", 90 * time.Second, false}, // no unit means seconds
+		{"2h", 2 * time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"-1", 0, true},
+		{"-5m", 0, true},
+		{"", 0, true},
+		{"soon", 0, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := validateTimeoutValue(st.give)
+			if err == nil && st.wantError {
+				t.Errorf("excepted an error got nil")
+			} else if err != nil && !st.wantError {
+				t.Errorf("did not want an error, got %s", err)
+			}
+			if got != st.want {
+				t.Errorf("got %v, want %v", got, st.want)
+			}
+		})
+	}
+}
+
+func TestValidatePauseRetryInterval(t *testing.T) {
+	var tests = []struct {
+		give      string
+		want      time.Duration
+		wantError bool
+	}{
+		{"10", 10 * time.Second, false},
+		{"500ms", 500 * time.Millisecond, false},
+		{"0", 0, true},
+		{"0s", 0, true},
+		{"-1", 0, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := validatePauseRetryInterval(st.give)
+			if err == nil && st.wantError {
+				t.Errorf("excepted an error got nil")
+			} else if err != nil && !st.wantError {
+				t.Errorf("did not want an error, got %s", err)
+			}
+			if got != st.want {
+				t.Errorf("got %v, want %v", got, st.want)
+			}
+		})
+	}
+}
+
+func TestExpandConfigEnv(t *testing.T) {
+	t.Setenv("PGBK_TEST_SECRET", "s3cr3t")
+	t.Setenv("PGBK_TEST_USER", "backup")
+
+	input := "s3_secret = ${PGBK_TEST_SECRET}\n" +
+		"sftp_password = pa$$word\n" +
+		"user = $PGBK_TEST_USER\n" +
+		"host = /tmp\n" +
+		"post_backup_hook = echo $PGBK_TEST_USER $$\n" +
+		"filename_template = {{.DBName}}_$PGBK_TEST_USER\n" +
+		"[db]\n" +
+		"user = ${PGBK_TEST_USER}_db\n"
+
+	cfg, err := ini.Load([]byte(input))
+	if err != nil {
+		t.Fatalf("failed to load input: %s", err)
+	}
+
+	expandConfigEnv(cfg)
+
+	var tests = []struct {
+		section string
+		key     string
+		want    string
+	}{
+		{ini.DefaultSection, "s3_secret", "s3cr3t"},
+		{ini.DefaultSection, "sftp_password", "pa$word"},
+		{ini.DefaultSection, "user", "backup"},
+		{ini.DefaultSection, "host", "/tmp"},
+		{ini.DefaultSection, "post_backup_hook", "echo $PGBK_TEST_USER $$"},
+		{ini.DefaultSection, "filename_template", "{{.DBName}}_$PGBK_TEST_USER"},
+		{"db", "user", "backup_db"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := cfg.Section(st.section).Key(st.key).String()
+			if got != st.want {
+				t.Errorf("got %q, want %q", got, st.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigurationFileSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "pg_back.conf")
+
+	secrets := map[string]string{
+		"s3":    "s3cr3t\n",
+		"sftp":  "sftpp4ss\r\n",
+		"azure": "azk3y",
+		"b2":    "b2k3y\nonly the first line is read\n",
+	}
+	for name, content := range secrets {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content := fmt.Sprintf("s3_secret_file = %s\nsftp_password_file = %s\nazure_key_file = %s\nb2_app_key_file = %s\n",
+		filepath.Join(dir, "s3"), filepath.Join(dir, "sftp"), filepath.Join(dir, "azure"), filepath.Join(dir, "b2"))
+	if err := os.WriteFile(cfg, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := loadConfigurationFile(cfg, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got := []string{opts.S3Secret, opts.SFTPPassword, opts.AzureKey, opts.B2AppKey}
+	want := []string{"s3cr3t", "sftpp4ss", "azk3y", "b2k3y"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("secrets mismatch (-want +got):\n%s", diff)
+	}
+
+	// The value and the file cannot be both given
+	if err := os.WriteFile(cfg, []byte(content+"s3_secret = other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigurationFile(cfg, ""); err == nil {
+		t.Errorf("expected an error with both s3_secret and s3_secret_file")
+	}
+
+	// A missing file is an error
+	if err := os.WriteFile(cfg, []byte("s3_secret_file = "+filepath.Join(dir, "missing")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigurationFile(cfg, ""); err == nil {
+		t.Errorf("expected an error with a missing secret file")
+	}
+}
+
+func TestLoadConfigurationFileDirectory(t *testing.T) {
+	dir := t.TempDir()
+	confd := filepath.Join(dir, "conf.d")
+	main := filepath.Join(dir, "pg_back.conf")
+
+	if err := os.Mkdir(confd, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		main:                                  "backup_directory = /base\nport = 5433\n[db]\nuser = app\nformat = plain\n",
+		filepath.Join(confd, "10-site.conf"):  "backup_directory = /site\njobs = 2\n[db]\nformat = directory\n",
+		filepath.Join(confd, "20-local.conf"): "jobs = 4\n[other]\nuser = other\n",
+		filepath.Join(confd, "README"):        "not a configuration file\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts, err := loadConfigurationFile(main, confd)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if opts.Directory != "/site" || opts.Port != "5433" || opts.Jobs != 4 {
+		t.Errorf("got backup_directory %q, port %s, jobs %d, want /site, 5433, 4", opts.Directory, opts.Port, opts.Jobs)
+	}
+
+	if o, ok := opts.PerDbOpts["db"]; !ok || o.Username != "app" || o.Format != 'd' {
+		t.Errorf("sections of the same database are not merged: %+v", o)
+	}
+
+	if o, ok := opts.PerDbOpts["other"]; !ok || o.Username != "other" {
+		t.Errorf("section of the configuration directory is lost")
+	}
+
+	// The directory works without the main file when it is the default one
+	defaultCfgFile = filepath.Join(dir, "missing.conf")
+	defer func() { defaultCfgFile = "/etc/pg_back/pg_back.conf" }()
+	opts, err = loadConfigurationFile(defaultCfgFile, confd)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if opts.Directory != "/site" {
+		t.Errorf("got backup_directory %q, want /site", opts.Directory)
+	}
+
+	// Unknown keys are refused in the files of the directory
+	if err := os.WriteFile(filepath.Join(confd, "30-bad.conf"), []byte("wrong = fails\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigurationFile(main, confd); err == nil {
+		t.Errorf("expected an error with an unknown key in the configuration directory")
+	}
+
+	if _, err := loadConfigurationFile(main, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error with a missing configuration directory")
+	}
+}
+
+func TestLoadConfigurationFileSecrets(t *testing.T) {
+	dir := t.TempDir()
+	secrets := filepath.Join(dir, "secrets.conf")
+	main := filepath.Join(dir, "pg_back.conf")
+
+	if err := os.WriteFile(main, []byte("s3_bucket = backups\ns3_secret = changeme\nsecrets_file = "+secrets+"\n[db]\nuser = app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(secrets, []byte("s3_secret = s3cr3t\nazure_key = azk3y\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := loadConfigurationFile(main, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if opts.S3Bucket != "backups" {
+		t.Errorf("got s3_bucket %q, want %q", opts.S3Bucket, "backups")
+	}
+	if opts.S3Secret != "s3cr3t" {
+		t.Errorf("got s3_secret %q, want %q", opts.S3Secret, "s3cr3t")
+	}
+	if opts.AzureKey != "azk3y" {
+		t.Errorf("got azure_key %q, want %q", opts.AzureKey, "azk3y")
+	}
+	if o, ok := opts.PerDbOpts["db"]; !ok || o.Username != "app" {
+		t.Errorf("per database options of the main file are lost")
+	}
+
+	// Unknown keys are not allowed in the secrets file either
+	if err := os.WriteFile(secrets, []byte("s3_secret = s3cr3t\nwrong = fails\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigurationFile(main, ""); err == nil {
+		t.Errorf("expected an error with an unknown key in the secrets file")
+	}
+
+	// A missing secrets file is an error
+	os.Remove(secrets)
+	if _, err := loadConfigurationFile(main, ""); err == nil {
+		t.Errorf("expected an error with a missing secrets file")
+	}
+}
+
+func TestSchemaTableFilters(t *testing.T) {
+	dir := t.TempDir()
+	cfg := filepath.Join(dir, "pg_back.conf")
+
+	if err := os.WriteFile(cfg, []byte("exclude_tables = log_*\n[db]\nuser = app\n[other]\nexclude_tables = audit\nexclude_table_data = queue\n[same]\nexclude_tables = log_*\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := loadConfigurationFile(cfg, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Sections without their own list use the global one
+	if diff := cmp.Diff([]string{"log_*"}, opts.PerDbOpts["db"].ExcludedTables); diff != "" {
+		t.Errorf("exclude_tables of db mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"audit"}, opts.PerDbOpts["other"].ExcludedTables); diff != "" {
+		t.Errorf("exclude_tables of other mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"queue"}, opts.PerDbOpts["other"].ExcludedTableData); diff != "" {
+		t.Errorf("exclude_table_data of other mismatch (-want +got):\n%s", diff)
+	}
+
+	// The command line replaces the global list, sections keep theirs
+	cliOpts := defaultOptions()
+	cliOpts.ExcludedTables = []string{"tmp_*", "cache"}
+	cliOpts.Schemas = []string{"public"}
+
+	got := mergeCliAndConfigOptions(cliOpts, opts, []string{"exclude-table", "schema"})
+	if diff := cmp.Diff(cliOpts.ExcludedTables, got.ExcludedTables); diff != "" {
+		t.Errorf("global exclude_tables mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(cliOpts.ExcludedTables, got.PerDbOpts["db"].ExcludedTables); diff != "" {
+		t.Errorf("exclude_tables of db mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"audit"}, got.PerDbOpts["other"].ExcludedTables); diff != "" {
+		t.Errorf("exclude_tables of other mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"public"}, got.PerDbOpts["other"].Schemas); diff != "" {
+		t.Errorf("schemas of other mismatch (-want +got):\n%s", diff)
+	}
+
+	// A section giving the same list as the global section keeps it
+	if diff := cmp.Diff([]string{"log_*"}, got.PerDbOpts["same"].ExcludedTables); diff != "" {
+		t.Errorf("exclude_tables of same mismatch (-want +got):\n%s", diff)
+	}
+
+	dbo := defaultDbOpts(got)
+	if diff := cmp.Diff([]string{"public"}, dbo.Schemas); diff != "" {
+		t.Errorf("default schemas mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCheckOptions(t *testing.T) {
+	t.Setenv("PGBK_CIPHER_PASS", "")
+
+	opts := defaultOptions()
+	if err := checkOptions(&opts); err != nil {
+		t.Errorf("unexpected error with default options: %s", err)
+	}
+
+	opts = defaultOptions()
+	opts.Upload = "s3"
+	opts.ListRemote = "azure"
+	opts.Encrypt = true
+	opts.TimestampedSubdir = true
+	opts.FilenameTemplate = "{{.DBName}}_{{.Timestamp}}.{{.Suffix}}"
+	opts.SkipUnchanged = true
+	opts.GCSHMACKeyID = "GOOG1E"
+
+	err := checkOptions(&opts)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	// All problems are reported
+	for _, want := range []string{"cipher", "bucket is mandatory with s3", "container is mandatory with azure",
+		"timestamped subdirectories and a filename template", "skipping unchanged databases",
+		"secret is mandatory with a GCS HMAC key ID"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+}
+
+func TestCheckOptionsS3SSE(t *testing.T) {
+	t.Setenv("PGBK_CIPHER_PASS", "")
+
+	// The KMS key and the method can come from the command line and the
+	// configuration file, they are checked once merged
+	var tests = []struct {
+		sse   string
+		keyID string
+		want  string
+		fails bool
+	}{
+		{"", "", "", false},
+		{"aes256", "", "AES256", false},
+		{"aws:kms", "mykey", "aws:kms", false},
+		{"", "mykey", "", true},
+		{"AES256", "mykey", "AES256", true},
+		{"wrong", "", "wrong", true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			opts := defaultOptions()
+			opts.S3SSE = st.sse
+			opts.S3KMSKeyID = st.keyID
+
+			err := checkOptions(&opts)
+			if st.fails && err == nil {
+				t.Errorf("expected an error")
+			}
+			if !st.fails {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				if opts.S3SSE != st.want {
+					t.Errorf("got %q, want %q", opts.S3SSE, st.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckOptionsGCSHMAC(t *testing.T) {
+	t.Setenv("PGBK_CIPHER_PASS", "")
+
+	var tests = []struct {
+		keyID  string
+		secret string
+		fails  bool
+	}{
+		{"", "", false},
+		{"GOOG1E", "s3cr3t", false},
+		{"GOOG1E", "", true},
+		{"", "s3cr3t", false},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			opts := defaultOptions()
+			opts.GCSHMACKeyID = st.keyID
+			opts.GCSHMACSecret = st.secret
+
+			err := checkOptions(&opts)
+			if st.fails && err == nil {
+				t.Errorf("expected an error")
+			}
+			if !st.fails && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestValidateTimestampFormat(t *testing.T) {
+	var tests = []struct {
+		layout string
+		fails  bool
+	}{
+		{"2006-01-02_15-04-05", false},
+		{"20060102T150405Z", false},
+		{"2006-01-02T15-04-05Z0700", false},
+		{"2006-01-02", true},
+		{"2006-01-02T15:04:05.000", true},
+		{"2006/01/02T150405", true},
+		{"wrong", true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			err := validateTimestampFormat(st.layout)
+			if st.fails && err == nil {
+				t.Errorf("expected an error for %q", st.layout)
+			}
+			if !st.fails && err != nil {
+				t.Errorf("unexpected error for %q: %s", st.layout, err)
+			}
+		})
+	}
+}
+
+func TestSessionTimeoutOptions(t *testing.T) {
+	var tests = []struct {
+		lock      string
+		statement string
+		want      string
+	}{
+		{"", "", ""},
+		{"10", "", "-c lock_timeout=10000"},
+		{"500ms", "0", "-c lock_timeout=500 -c statement_timeout=0"},
+		{"", "1h", "-c statement_timeout=3600000"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if got := sessionTimeoutOptions(st.lock, st.statement); got != st.want {
+				t.Errorf("got %q, want %q", got, st.want)
+			}
+		})
+	}
+
+	for _, v := range []string{"", "0", "30s"} {
+		if err := validateSessionTimeout(v); err != nil {
+			t.Errorf("unexpected error for %q: %s", v, err)
+		}
+	}
+	for _, v := range []string{"-1", "soon"} {
+		if err := validateSessionTimeout(v); err == nil {
+			t.Errorf("expected an error for %q", v)
+		}
+	}
+}
@@ -28,6 +28,7 @@ package main
 import (
 	"fmt"
 	"net/url"
+	"os"
 	"sort"
 	"strings"
 	"unicode"
@@ -110,6 +111,17 @@ func (c *ConnInfo) Del(keyword string) *ConnInfo {
 	return newC
 }
 
+// AddOptions returns a pointer to a full copy of the conninfo with options,
+// the command line options sent to the server like PGOPTIONS, appended to
+// the ones already there
+func (c *ConnInfo) AddOptions(options string) *ConnInfo {
+	if cur := c.Infos["options"]; cur != "" {
+		options = cur + " " + options
+	}
+
+	return c.Set("options", options)
+}
+
 // MakeEnv return the conninfo as a list of "key=value" environment variables
 // that the libpq understands, as stated in the documentation of PostgreSQL 14
 func (c *ConnInfo) MakeEnv() []string {
@@ -513,10 +525,20 @@ func makeUrlConnInfo(infos map[string]string) string {
 	return u.String()
 }
 
+// sslModes are the values accepted by libpq for the sslmode keyword
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// targetSessionAttrs are the values accepted by libpq for the
+// target_session_attrs keyword
+var targetSessionAttrs = []string{"any", "read-write", "read-only", "primary", "standby", "prefer-standby"}
+
 // prepareConnInfo returns a connexion string computed from the input
 // values. When the dbname is already a connection string or a postgresql://
-// URI, it only add the application_name keyword if not set.
-func prepareConnInfo(host string, port int, username string, dbname string) (*ConnInfo, error) {
+// URI, it only add the application_name keyword if not set. The non empty
+// params, like service or sslmode, are added when not already in the
+// connection string. A service is used as a base, libpq gives precedence to
+// the other keywords over the values of the service file.
+func prepareConnInfo(host string, port string, username string, dbname string, params map[string]string) (*ConnInfo, error) {
 	var (
 		conninfo *ConnInfo
 		err      error
@@ -542,8 +564,8 @@ func prepareConnInfo(host string, port int, username string, dbname string) (*Co
 			conninfo.Infos["host"] = host
 		}
 
-		if port != 0 {
-			conninfo.Infos["port"] = fmt.Sprintf("%v", port)
+		if port != "" {
+			conninfo.Infos["port"] = port
 		}
 
 		if username != "" {
@@ -555,10 +577,24 @@ func prepareConnInfo(host string, port int, username string, dbname string) (*Co
 		}
 	}
 
+	// Keywords given in the connection string win over the options
+	for k, v := range params {
+		if _, ok := conninfo.Infos[k]; !ok && v != "" {
+			conninfo.Infos[k] = v
+		}
+	}
+
 	if _, ok := conninfo.Infos["application_name"]; !ok {
 		l.Verboseln("using pg_back as application_name")
 		conninfo.Infos["application_name"] = "pg_back"
 	}
 
+	// Avoid waiting forever on an unreachable server, libpq waits
+	// indefinitely by default
+	if _, ok := conninfo.Infos["connect_timeout"]; !ok && os.Getenv("PGCONNECT_TIMEOUT") == "" {
+		l.Verboseln("using a connect_timeout of 10 seconds")
+		conninfo.Infos["connect_timeout"] = "10"
+	}
+
 	return conninfo, nil
 }
@@ -244,26 +244,41 @@ func TestMakeUrlConnInfo(t *testing.T) {
 func TestPrepareConnInfo(t *testing.T) {
 	var tests = []struct {
 		host     string
-		port     int
+		port     string
 		username string
 		dbname   string
+		params   map[string]string
 		want     string
 	}{
-		{"/tmp", 0, "", "", "application_name=pg_back host=/tmp"},
-		{"localhost", 5432, "postgres", "postgres", "application_name=pg_back dbname=postgres host=localhost port=5432 user=postgres"},
-		{"localhost", 0, "postgres", "postgres", "application_name=pg_back dbname=postgres host=localhost user=postgres"},
-		{"localhost", 5432, "", "postgres", "application_name=pg_back dbname=postgres host=localhost port=5432"},
-		{"localhost", 5432, "postgres", "", "application_name=pg_back host=localhost port=5432 user=postgres"},
-		{"localhost", 0, "postgres", "", "application_name=pg_back host=localhost user=postgres"},
-		{"", 0, "postgres", "", "application_name=pg_back user=postgres"},
-		{"localhost", 0, "postgres", "host=/tmp port=5432", "application_name=pg_back host=/tmp port=5432"},
-		{"", 0, "", "host=/tmp port=5433 application_name=other", "application_name=other host=/tmp port=5433"},
-		{"", 0, "", "postgresql:///db?host=/tmp", "postgresql:///db?application_name=pg_back&host=%2Ftmp"},
+		{"/tmp", "", "", "", nil, "application_name=pg_back connect_timeout=10 host=/tmp"},
+		{"localhost", "5432", "postgres", "postgres", nil, "application_name=pg_back connect_timeout=10 dbname=postgres host=localhost port=5432 user=postgres"},
+		{"localhost", "", "postgres", "postgres", nil, "application_name=pg_back connect_timeout=10 dbname=postgres host=localhost user=postgres"},
+		{"localhost", "5432", "", "postgres", nil, "application_name=pg_back connect_timeout=10 dbname=postgres host=localhost port=5432"},
+		{"localhost", "5432", "postgres", "", nil, "application_name=pg_back connect_timeout=10 host=localhost port=5432 user=postgres"},
+		{"localhost", "", "postgres", "", nil, "application_name=pg_back connect_timeout=10 host=localhost user=postgres"},
+		{"", "", "postgres", "", nil, "application_name=pg_back connect_timeout=10 user=postgres"},
+		{"localhost", "", "postgres", "host=/tmp port=5432", nil, "application_name=pg_back connect_timeout=10 host=/tmp port=5432"},
+		{"", "", "", "host=/tmp port=5433 application_name=other", nil, "application_name=other connect_timeout=10 host=/tmp port=5433"},
+		{"", "", "", "host=/tmp connect_timeout=3", nil, "application_name=pg_back connect_timeout=3 host=/tmp"},
+		{"", "", "", "postgresql:///db?host=/tmp", nil, "postgresql:///db?application_name=pg_back&connect_timeout=10&host=%2Ftmp"},
+		{"", "", "", "", map[string]string{"service": "mysvc"}, "application_name=pg_back connect_timeout=10 service=mysvc"},
+		{"localhost", "5433", "postgres", "db", map[string]string{"service": "mysvc"}, "application_name=pg_back connect_timeout=10 dbname=db host=localhost port=5433 service=mysvc user=postgres"},
+		{"", "", "", "host=/tmp service=other", map[string]string{"service": "mysvc"}, "application_name=pg_back connect_timeout=10 host=/tmp service=other"},
+		{"", "", "", "postgresql:///db", map[string]string{"service": "mysvc"}, "postgresql:///db?application_name=pg_back&connect_timeout=10&service=mysvc"},
+		{"localhost", "", "", "", map[string]string{"sslmode": "verify-full", "sslcert": "/etc/pg/client.crt", "sslkey": "/etc/pg/client.key", "sslrootcert": ""}, "application_name=pg_back connect_timeout=10 host=localhost sslcert=/etc/pg/client.crt sslkey=/etc/pg/client.key sslmode=verify-full"},
+		{"", "", "", "host=/tmp sslmode=disable", map[string]string{"sslmode": "require"}, "application_name=pg_back connect_timeout=10 host=/tmp sslmode=disable"},
+		{"/tmp", "", "", "", map[string]string{"application_name": "pg_back-nightly"}, "application_name=pg_back-nightly connect_timeout=10 host=/tmp"},
+		{"", "", "", "host=/tmp application_name=other", map[string]string{"application_name": "pg_back-nightly"}, "application_name=other connect_timeout=10 host=/tmp"},
+		{"db1,db2,::1", "5432,5433,5434", "", "", map[string]string{"target_session_attrs": "read-write"}, "application_name=pg_back connect_timeout=10 host=db1,db2,::1 port=5432,5433,5434 target_session_attrs=read-write"},
+		{"db1,db2", "5433", "", "", map[string]string{"target_session_attrs": ""}, "application_name=pg_back connect_timeout=10 host=db1,db2 port=5433"},
 	}
 
+	// The default connect_timeout is not set when given in the environment
+	t.Setenv("PGCONNECT_TIMEOUT", "")
+
 	for i, subt := range tests {
 		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
-			res, _ := prepareConnInfo(subt.host, subt.port, subt.username, subt.dbname)
+			res, _ := prepareConnInfo(subt.host, subt.port, subt.username, subt.dbname, subt.params)
 			if res.String() != subt.want {
 				t.Errorf("got '%s', want '%s'", res, subt.want)
 			}
@@ -370,3 +385,43 @@ func TestConnInfoDel(t *testing.T) {
 		})
 	}
 }
+
+func TestConnInfoAddOptions(t *testing.T) {
+	var tests = []struct {
+		input   *ConnInfo
+		options string
+		want    *ConnInfo
+	}{
+		{
+			&ConnInfo{
+				Kind:  CI_KEYVAL,
+				Infos: map[string]string{"host": "localhost", "dbname": "db"},
+			},
+			"-c statement_timeout=0",
+			&ConnInfo{
+				Kind:  CI_KEYVAL,
+				Infos: map[string]string{"host": "localhost", "dbname": "db", "options": "-c statement_timeout=0"},
+			},
+		},
+		{
+			&ConnInfo{
+				Kind:  CI_URI,
+				Infos: map[string]string{"host": "localhost", "options": "-c work_mem=64MB"},
+			},
+			"-c lock_timeout=10s",
+			&ConnInfo{
+				Kind:  CI_URI,
+				Infos: map[string]string{"host": "localhost", "options": "-c work_mem=64MB -c lock_timeout=10s"},
+			},
+		},
+	}
+
+	for i, subt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := subt.input.AddOptions(subt.options)
+			if diff := cmp.Diff(subt.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("*ConnInfo.AddOptions() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
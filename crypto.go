@@ -26,48 +26,59 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"filippo.io/age"
+	"filippo.io/age/armor"
 )
 
 func ageEncrypt(src io.Reader, dst io.Writer, params encryptParams) error {
 	if params.PublicKey != "" {
-		return ageEncryptPublicKey(src, dst, params.PublicKey)
+		return ageEncryptPublicKey(src, dst, params.PublicKey, params.Armor)
 	}
 
 	if params.Passphrase != "" {
-		return ageEncryptPassphrase(src, dst, params.Passphrase)
+		return ageEncryptPassphrase(src, dst, params.Passphrase, params.Armor)
 	}
 
 	return fmt.Errorf("Unexpected condition: no public key or passphrase")
 }
 
-func ageEncryptPassphrase(src io.Reader, dst io.Writer, passphrase string) error {
+func ageEncryptPassphrase(src io.Reader, dst io.Writer, passphrase string, armored bool) error {
 	// Age encrypt to a recipient, Scrypt allow to create a key from a passphrase
 	recipient, err := age.NewScryptRecipient(passphrase)
 	if err != nil {
 		return fmt.Errorf("failed to create recipient from passphrase: %w", err)
 	}
 
-	return ageEncryptInternal(src, dst, recipient)
+	return ageEncryptInternal(src, dst, recipient, armored)
 }
 
-func ageEncryptPublicKey(src io.Reader, dst io.Writer, publicKey string) error {
+func ageEncryptPublicKey(src io.Reader, dst io.Writer, publicKey string, armored bool) error {
 	recipient, err := age.ParseX25519Recipient(publicKey)
 	if err != nil {
 		return fmt.Errorf("failed to create recipient from public key: %w", err)
 	}
 
-	return ageEncryptInternal(src, dst, recipient)
+	return ageEncryptInternal(src, dst, recipient, armored)
 }
 
-func ageEncryptInternal(src io.Reader, dst io.Writer, recipient age.Recipient) error {
+// ageEncryptInternal encrypts src to dst for the recipient. When armored is
+// true, the output is ASCII, PEM encoded, for the storage or transports that
+// do not accept binary data.
+func ageEncryptInternal(src io.Reader, dst io.Writer, recipient age.Recipient, armored bool) error {
+	var a io.WriteCloser
+	if armored {
+		a = armor.NewWriter(dst)
+		dst = a
+	}
+
 	w, err := age.Encrypt(dst, recipient)
 	if err != nil {
 		return fmt.Errorf("failed to create encrypted file: %w", err)
@@ -77,8 +88,17 @@ func ageEncryptInternal(src io.Reader, dst io.Writer, recipient age.Recipient) e
 		return fmt.Errorf("failed to write to encrypted file: %w", err)
 	}
 
-	// It is mandatory to Close the writer from age so that it flushes its data
-	w.Close()
+	// It is mandatory to Close the writer from age so that it flushes its
+	// data, then the armor writer to write the footer
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write to encrypted file: %w", err)
+	}
+
+	if a != nil {
+		if err := a.Close(); err != nil {
+			return fmt.Errorf("failed to write to encrypted file: %w", err)
+		}
+	}
 
 	return nil
 }
@@ -113,7 +133,19 @@ func ageDecryptPassphrase(src io.Reader, dst io.Writer, passphrase string) error
 	return ageDecryptInternal(src, dst, identity)
 }
 
+// ageDecryptInternal decrypts src to dst with the identity. Armored files are
+// detected by their PEM header, so that both kinds of files can be read
+// whatever the options used to encrypt them.
 func ageDecryptInternal(src io.Reader, dst io.Writer, identity age.Identity) error {
+	br := bufio.NewReaderSize(src, 4096)
+	src = br
+
+	// The armor allows some blank lines before the header
+	start, _ := br.Peek(br.Size())
+	if bytes.HasPrefix(bytes.TrimLeft(start, " \t\r\n"), []byte(armor.Header)) {
+		src = armor.NewReader(br)
+	}
+
 	r, err := age.Decrypt(src, identity)
 	if err != nil {
 		var badpass *age.NoIdentityMatchError
@@ -223,7 +255,8 @@ func encryptFile(path string, params encryptParams, keep bool) ([]string, error)
 	return encrypted, nil
 }
 
-func decryptFile(path string, params decryptParams) error {
+// decryptFile decrypts the file at path to dstFile
+func decryptFile(path string, dstFile string, params decryptParams) error {
 	l.Infoln("decrypting", path)
 
 	src, err := os.Open(path)
@@ -233,7 +266,6 @@ func decryptFile(path string, params decryptParams) error {
 
 	defer src.Close()
 
-	dstFile := strings.TrimSuffix(path, ".age")
 	dst, err := os.Create(dstFile)
 	if err != nil {
 		return err
@@ -247,5 +279,62 @@ func decryptFile(path string, params decryptParams) error {
 		return fmt.Errorf("could not decrypt %s: %s", path, err)
 	}
 
+	if err := dst.Close(); err != nil {
+		os.Remove(dstFile)
+		return fmt.Errorf("could not write %s: %s", dstFile, err)
+	}
+
+	return nil
+}
+
+// rekeyFile decrypts an encrypted file and encrypts it again with new
+// parameters. The decrypted data only goes through memory, and the file is
+// replaced once its new version is complete.
+func rekeyFile(path string, dec decryptParams, enc encryptParams) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", path, err)
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat %s: %w", path, err)
+	}
+
+	dst, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file for %s: %w", path, err)
+	}
+	tmpPath := dst.Name()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(ageDecrypt(src, pw, dec))
+	}()
+
+	if err := ageEncrypt(pr, dst, enc); err != nil {
+		pr.CloseWithError(err)
+		dst.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not rekey %s: %w", path, err)
+	}
+
+	if err := dst.Chmod(info.Mode().Perm()); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not chmod %s: %w", tmpPath, err)
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not close %s: %w", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not replace %s: %w", path, err)
+	}
+
 	return nil
 }
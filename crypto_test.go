@@ -28,6 +28,9 @@ package main
 import (
 	"bytes"
 	b64 "encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -95,7 +98,7 @@ func TestAgeEncryptPassphrase_EmptyPassphrase_Failure(t *testing.T) {
 	reader := strings.NewReader(content)
 	writer := &bytes.Buffer{}
 
-	err := ageEncryptPassphrase(reader, writer, "")
+	err := ageEncryptPassphrase(reader, writer, "", false)
 	if err == nil {
 		t.Errorf("Expected empty passphrase to fail")
 	}
@@ -258,3 +261,99 @@ func TestAgeEncrypt_WrongPassphrase_Loopback_Failure(t *testing.T) {
 		t.Fatalf("Decryption should have failed")
 	}
 }
+
+func TestRekeyFile_PassphraseToPublicKey_Success(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db_2023-01-02T03:04:05Z.dump.age")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ageEncrypt(strings.NewReader(TEST_PLAINTEXT_FILE), f, encryptParams{Passphrase: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// A wrong passphrase leaves the file untouched
+	if err := rekeyFile(path, decryptParams{Passphrase: "wrong"}, encryptParams{PublicKey: TEST_PUBLIC_KEY}); err == nil {
+		t.Errorf("Expected wrong passphrase to fail")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("Expected the temporary file to be removed, got %v", entries)
+	}
+
+	if err := rekeyFile(path, decryptParams{Passphrase: "old"}, encryptParams{PublicKey: TEST_PUBLIC_KEY}); err != nil {
+		t.Fatalf("Expected rekey to succeed: %s", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640, got %o", info.Mode().Perm())
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	writer := &bytes.Buffer{}
+	if err := ageDecrypt(src, writer, decryptParams{PrivateKey: TEST_PRIVATE_KEY}); err != nil {
+		t.Fatalf("Expected decryption with the new key to succeed: %s", err)
+	}
+	if writer.String() != TEST_PLAINTEXT_FILE {
+		t.Errorf("Expected %q, got %q", TEST_PLAINTEXT_FILE, writer.String())
+	}
+}
+
+func TestAgeEncrypt_Armor_Loopback_Success(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	var tests = []struct {
+		params encryptParams
+		prefix string
+	}{
+		{encryptParams{PublicKey: identity.Recipient().String(), Armor: true}, "\n\r\n"},
+		{encryptParams{Passphrase: "secret", Armor: true}, ""},
+		{encryptParams{PublicKey: identity.Recipient().String()}, ""},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			content := strings.Repeat("to be encrypted\n", 1000)
+			writer := &bytes.Buffer{}
+
+			if err := ageEncrypt(strings.NewReader(content), writer, st.params); err != nil {
+				t.Fatalf("Unexpected error when encrypting: %v", err)
+			}
+
+			ciphertext := writer.String()
+			armored := strings.HasPrefix(ciphertext, "-----BEGIN AGE ENCRYPTED FILE-----\n") &&
+				strings.HasSuffix(ciphertext, "-----END AGE ENCRYPTED FILE-----\n")
+			if armored != st.params.Armor {
+				t.Errorf("got armored output %v, want %v", armored, st.params.Armor)
+			}
+
+			// Decryption detects the armor, even after some
+			// whitespace
+			writer = &bytes.Buffer{}
+			params := decryptParams{PrivateKey: identity.String(), Passphrase: st.params.Passphrase}
+			if st.params.Passphrase != "" {
+				params.PrivateKey = ""
+			}
+			if err := ageDecrypt(strings.NewReader(st.prefix+ciphertext), writer, params); err != nil {
+				t.Fatalf("Unexpected error when decrypting: %v", err)
+			}
+
+			if writer.String() != content {
+				t.Errorf("decrypted content does not match the original")
+			}
+		})
+	}
+}
@@ -32,10 +32,83 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/zeebo/xxh3"
+	"golang.org/x/crypto/blake2b"
 )
 
+// sumAlgos lists the values accepted for the checksum algorithm
+var sumAlgos = []string{"none", "auto", "sha1", "sha224", "sha256", "sha384", "sha512", "blake2b-256", "blake2b-512", "xxh64", "xxh3"}
+
+// sumAlgoForSize gives the algorithm chosen by the "auto" checksum algorithm
+// for size bytes: the fast xxh3 above threshold MiB, sha256 otherwise
+func sumAlgoForSize(size int64, threshold int) string {
+	if size > int64(threshold)*1024*1024 {
+		return "xxh3"
+	}
+
+	return "sha256"
+}
+
+// resolveSumAlgo returns the checksum algorithm to use for the files at
+// paths. Unless algo is "auto", it is algo itself, otherwise it depends on
+// the total size of the files, so that the choice is the same for all the
+// files of a directory dump. The chosen algorithm names the checksum file or
+// manifest, which tells verification which algorithm to use.
+func resolveSumAlgo(algo string, threshold int, paths ...string) string {
+	if algo != "auto" {
+		return algo
+	}
+
+	var total int64
+	for _, p := range paths {
+		size, err := pathSize(p)
+		if err != nil {
+			l.Warnf("could not get size of %s: %s", p, err)
+		}
+		total += size
+	}
+
+	return sumAlgoForSize(total, threshold)
+}
+
+// newHash returns the hash function of the checksum algorithm. The xxhash
+// functions are much faster but are not cryptographic hashes, they only
+// detect accidental corruption.
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "sha1":
+		return sha1.New(), nil
+	case "sha224":
+		return sha256.New224(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "blake2b-256":
+		return blake2b.New256(nil)
+	case "blake2b-512":
+		return blake2b.New512(nil)
+	case "xxh64":
+		return xxhash.New(), nil
+	case "xxh3":
+		return xxh3.New(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported hash algorithm: %s", algo)
+}
+
 func computeChecksum(path string, h hash.Hash) (string, error) {
 	h.Reset()
 
@@ -51,24 +124,14 @@ func computeChecksum(path string, h hash.Hash) (string, error) {
 	return string(h.Sum(nil)), nil
 }
 
-func checksumFile(path string, algo string) (string, error) {
-	var h hash.Hash
-
-	switch algo {
-	case "none":
+func checksumFile(path string, algo string, mode os.FileMode) (string, error) {
+	if algo == "none" {
 		return "", nil
-	case "sha1":
-		h = sha1.New()
-	case "sha224":
-		h = sha256.New224()
-	case "sha256":
-		h = sha256.New()
-	case "sha384":
-		h = sha512.New384()
-	case "sha512":
-		h = sha512.New()
-	default:
-		return "", fmt.Errorf("unsupported hash algorithm: %s", algo)
+	}
+
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
 	}
 
 	i, err := os.Stat(path)
@@ -78,13 +141,21 @@ func checksumFile(path string, algo string) (string, error) {
 
 	sumFile := fmt.Sprintf("%s.%s", path, algo)
 	l.Verbosef("create checksum file: %s", sumFile)
-	o, err := os.Create(sumFile)
+	o, err := os.OpenFile(sumFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, modeOr(mode, 0666))
 	if err != nil {
 		l.Errorln(err)
 		return "", err
 	}
 	defer o.Close()
 
+	// The umask may have removed permissions, and the file may already
+	// exist
+	if mode != 0 {
+		if err := o.Chmod(mode); err != nil {
+			return "", err
+		}
+	}
+
 	if i.IsDir() {
 		l.Verboseln("dump is a directory, checksumming all file inside")
 		err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
@@ -117,35 +188,31 @@ func checksumFile(path string, algo string) (string, error) {
 	return sumFile, nil
 }
 
-func checksumFileList(paths []string, algo string, sumFilePrefix string) (string, error) {
-	var h hash.Hash
-
-	switch algo {
-	case "none":
+func checksumFileList(paths []string, algo string, sumFilePrefix string, mode os.FileMode) (string, error) {
+	if algo == "none" {
 		return "", nil
-	case "sha1":
-		h = sha1.New()
-	case "sha224":
-		h = sha256.New224()
-	case "sha256":
-		h = sha256.New()
-	case "sha384":
-		h = sha512.New384()
-	case "sha512":
-		h = sha512.New()
-	default:
-		return "", fmt.Errorf("unsupported hash algorithm: %s", algo)
+	}
+
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
 	}
 
 	sumPath := fmt.Sprintf("%s.%s", sumFilePrefix, algo)
 	l.Verbosef("create or use checksum file: %s", sumPath)
-	o, err := os.OpenFile(sumPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	o, err := os.OpenFile(sumPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, modeOr(mode, 0666))
 	if err != nil {
 		return "", fmt.Errorf("could not open %s: %w", sumPath, err)
 	}
 
 	defer o.Close()
 
+	if mode != 0 {
+		if err := o.Chmod(mode); err != nil {
+			return "", fmt.Errorf("could not chmod %s: %w", sumPath, err)
+		}
+	}
+
 	failed := false
 	for _, path := range paths {
 		l.Verboseln("computing checksum of:", path)
@@ -165,3 +232,269 @@ func checksumFileList(paths []string, algo string, sumFilePrefix string) (string
 
 	return sumPath, nil
 }
+
+// sumManifest collects the checksums of all the files of a run into a single
+// file per algorithm, named checksums_<date>.<algo>, instead of one checksum
+// file per dump. Paths are relative to the manifest so that it can be
+// checked from its directory.
+type sumManifest struct {
+	mu         sync.Mutex
+	directory  string
+	timeFormat string
+	when       time.Time
+	mode       os.FileMode
+	files      map[string]string
+}
+
+func newSumManifest(directory string, timeFormat string, when time.Time, mode os.FileMode) *sumManifest {
+	return &sumManifest{
+		directory:  directory,
+		timeFormat: timeFormat,
+		when:       when,
+		mode:       mode,
+		files:      make(map[string]string),
+	}
+}
+
+// add computes the checksum of the file, or of all files in a directory, and
+// appends the result to the manifest of the algorithm
+func (m *sumManifest) add(path string, algo string) error {
+	if algo == "none" {
+		return nil
+	}
+
+	h, err := newHash(algo)
+	if err != nil {
+		return err
+	}
+
+	sumPath := m.path(algo)
+
+	// Compute the checksums before taking the lock, only writing to the
+	// manifest is serialized
+	lines := make([]string, 0, 1)
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		l.Verboseln("computing checksum of:", p)
+		r, err := computeChecksum(p, h)
+		if err != nil {
+			return fmt.Errorf("could not checksum %s: %w", p, err)
+		}
+
+		rel, err := filepath.Rel(filepath.Dir(sumPath), p)
+		if err != nil {
+			rel = p
+		}
+
+		lines = append(lines, fmt.Sprintf("%x  %s\n", r, filepath.ToSlash(rel)))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[algo]; !ok {
+		if err := os.MkdirAll(filepath.Dir(sumPath), 0700); err != nil {
+			return err
+		}
+		l.Verbosef("create checksum file: %s", sumPath)
+		m.files[algo] = sumPath
+	}
+
+	o, err := os.OpenFile(sumPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, modeOr(m.mode, 0666))
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", sumPath, err)
+	}
+	defer o.Close()
+
+	if m.mode != 0 {
+		if err := o.Chmod(m.mode); err != nil {
+			return fmt.Errorf("could not chmod %s: %w", sumPath, err)
+		}
+	}
+
+	for _, line := range lines {
+		if _, err := io.WriteString(o, line); err != nil {
+			return fmt.Errorf("could not write to %s: %w", sumPath, err)
+		}
+	}
+
+	return nil
+}
+
+// path returns the path of the manifest of the algorithm
+func (m *sumManifest) path(algo string) string {
+	return formatDumpPath(m.directory, m.timeFormat, algo, "checksums", m.when, 0)
+}
+
+// paths returns the manifests written so far
+func (m *sumManifest) paths() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	paths := make([]string, 0, len(m.files))
+	for _, p := range m.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// updateChecksumFiles computes again the checksums of the changed files in
+// all the checksum files of dir listing them, per file or combined. changed
+// maps the path of the files, as listed, to the file to read to compute the
+// checksum
+func updateChecksumFiles(dir string, changed map[string]string) error {
+	if len(changed) == 0 {
+		return nil
+	}
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		algo := strings.TrimPrefix(filepath.Ext(path), ".")
+		if algo == "none" || !slices.Contains(sumAlgos, algo) {
+			return nil
+		}
+
+		return updateChecksumFile(path, algo, changed)
+	})
+}
+
+// updateChecksumFile rewrites the lines of the checksum file sumPath whose
+// file is in changed, the paths are either the ones of the dumps or relative
+// to the checksum file
+func updateChecksumFile(sumPath string, algo string, changed map[string]string) error {
+	data, err := os.ReadFile(sumPath)
+	if err != nil {
+		return err
+	}
+
+	h, err := newHash(algo)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	updated := false
+	for i, line := range lines {
+		// Lines are "<sum>  <path>" or "<sum> *<path>"
+		sum, rest, found := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		if !found || len(rest) < 2 {
+			continue
+		}
+		name := rest[1:]
+
+		path, ok := changed[filepath.Clean(filepath.FromSlash(name))]
+		if !ok {
+			path, ok = changed[filepath.Join(filepath.Dir(sumPath), filepath.FromSlash(name))]
+			if !ok {
+				continue
+			}
+		}
+
+		r, err := computeChecksum(path, h)
+		if err != nil {
+			return fmt.Errorf("could not checksum %s: %w", path, err)
+		}
+
+		l.Verboseln("updating checksum of", path, "in", sumPath)
+		lines[i] = strings.Replace(line, sum, fmt.Sprintf("%x", r), 1)
+		updated = true
+	}
+
+	if !updated {
+		return nil
+	}
+
+	info, err := os.Stat(sumPath)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := sumPath + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strings.Join(lines, "")), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("could not write %s: %w", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, sumPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not replace %s: %w", sumPath, err)
+	}
+
+	return nil
+}
+
+// verifyChecksumFile reads again the files of the checksum file sumPath that
+// are path or inside path, when it is a directory, and compares their
+// checksum with the one written. The paths are either the ones of the dumps
+// or relative to the checksum file.
+func verifyChecksumFile(sumPath string, algo string, path string) error {
+	data, err := os.ReadFile(sumPath)
+	if err != nil {
+		return err
+	}
+
+	h, err := newHash(algo)
+	if err != nil {
+		return err
+	}
+
+	path = filepath.Clean(path)
+	inPath := func(p string) bool {
+		return p == path || strings.HasPrefix(p, path+string(filepath.Separator))
+	}
+
+	checked := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		// Lines are "<sum>  <path>" or "<sum> *<path>"
+		sum, rest, found := strings.Cut(line, " ")
+		if !found || len(rest) < 2 {
+			continue
+		}
+
+		name := filepath.FromSlash(rest[1:])
+
+		p := filepath.Clean(name)
+		if !inPath(p) {
+			p = filepath.Join(filepath.Dir(sumPath), name)
+			if !inPath(p) {
+				continue
+			}
+		}
+
+		l.Verboseln("verifying checksum of:", p)
+		r, err := computeChecksum(p, h)
+		if err != nil {
+			return fmt.Errorf("could not checksum %s: %w", p, err)
+		}
+
+		if fmt.Sprintf("%x", r) != sum {
+			return fmt.Errorf("checksum of %s does not match the one in %s", p, sumPath)
+		}
+		checked++
+	}
+
+	if checked == 0 {
+		return fmt.Errorf("no checksum of %s found in %s", path, sumPath)
+	}
+
+	return nil
+}
@@ -33,7 +33,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestChecksumFile(t *testing.T) {
@@ -77,18 +79,18 @@ func TestChecksumFile(t *testing.T) {
 	}
 
 	// bad algo
-	if _, err := checksumFile("", "none"); err != nil {
+	if _, err := checksumFile("", "none", 0600); err != nil {
 		t.Errorf("expected <nil>, got %q\n", err)
 	}
 
-	if _, err := checksumFile("", "other"); err == nil {
+	if _, err := checksumFile("", "other", 0600); err == nil {
 		t.Errorf("expected err, got <nil>\n")
 	}
 
 	// test each algo with the file
 	for i, st := range tests {
 		t.Run(fmt.Sprintf("f%v", i), func(t *testing.T) {
-			if _, err := checksumFile("test", st.algo); err != nil {
+			if _, err := checksumFile("test", st.algo, 0600); err != nil {
 				t.Errorf("checksumFile returned: %v", err)
 			}
 
@@ -111,12 +113,12 @@ func TestChecksumFile(t *testing.T) {
 	// bad files
 	var e *os.PathError
 	l.logger.SetOutput(ioutil.Discard)
-	if _, err := checksumFile("", "sha1"); !errors.As(err, &e) {
+	if _, err := checksumFile("", "sha1", 0600); !errors.As(err, &e) {
 		t.Errorf("expected an *os.PathError, got %q\n", err)
 	}
 
 	os.Chmod("test.sha1", 0444)
-	if _, err := checksumFile("test", "sha1"); !errors.As(err, &e) {
+	if _, err := checksumFile("test", "sha1", 0600); !errors.As(err, &e) {
 		t.Errorf("expected an *os.PathError, got %q\n", err)
 	}
 	os.Chmod("test.sha1", 0644)
@@ -138,7 +140,7 @@ func TestChecksumFile(t *testing.T) {
 	// test each algo with the directory
 	for i, st := range tests {
 		t.Run(fmt.Sprintf("d%v", i), func(t *testing.T) {
-			if _, err := checksumFile("test.d", st.algo); err != nil {
+			if _, err := checksumFile("test.d", st.algo, 0600); err != nil {
 				t.Errorf("checksumFile returned: %v", err)
 			}
 
@@ -166,3 +168,299 @@ func TestChecksumFile(t *testing.T) {
 		})
 	}
 }
+
+func TestChecksumFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not supported on windows")
+	}
+
+	var tests = []struct {
+		mode os.FileMode
+		want os.FileMode
+	}{
+		// Permissions are kept when file_mode is not set
+		{0, 0644},
+		{0640, 0640},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			dump := filepath.Join(t.TempDir(), "db.dump")
+			if err := os.WriteFile(dump, []byte("data"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(dump+".sha256", nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dump+".sha256", 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			p, err := checksumFile(dump, "sha256", st.mode)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if info, err := os.Stat(p); err != nil || info.Mode().Perm() != st.want {
+				t.Errorf("got %v and %v, want mode %o", info, err, st.want)
+			}
+		})
+	}
+}
+
+func TestNewHash(t *testing.T) {
+	// Checksums of the empty input
+	var tests = []struct {
+		algo string
+		want string
+	}{
+		{"sha1", "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		{"blake2b-256", "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{"xxh64", "ef46db3751d8e999"},
+		{"xxh3", "2d06800538d394c2"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			h, err := newHash(st.algo)
+			if err != nil {
+				t.Fatalf("newHash returned: %v", err)
+			}
+
+			if got := fmt.Sprintf("%x", h.Sum(nil)); got != st.want {
+				t.Errorf("got %s, want %s", got, st.want)
+			}
+		})
+	}
+
+	if h, err := newHash("blake2b-512"); err != nil || h.Size() != 64 {
+		t.Errorf("expected a 64 bytes hash for blake2b-512, got error: %v", err)
+	}
+
+	if _, err := newHash("md5"); err == nil {
+		t.Errorf("expected err, got <nil>")
+	}
+}
+
+func TestResolveSumAlgo(t *testing.T) {
+	dir := t.TempDir()
+
+	small := filepath.Join(dir, "small.dump")
+	if err := os.WriteFile(small, make([]byte, 1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	large := filepath.Join(dir, "large.dump")
+	if err := os.WriteFile(large, make([]byte, 1024*1024+1), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The files of a directory dump add up
+	dirDump := filepath.Join(dir, "db.d")
+	if err := os.Mkdir(dirDump, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"toc.dat", "3000.dat"} {
+		if err := os.WriteFile(filepath.Join(dirDump, name), make([]byte, 512*1024+1), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		algo      string
+		threshold int
+		paths     []string
+		want      string
+	}{
+		{"sha512", 1, []string{large}, "sha512"},
+		{"none", 1, []string{large}, "none"},
+		{"auto", 1, []string{small}, "sha256"},
+		{"auto", 1, []string{large}, "xxh3"},
+		{"auto", 2, []string{large}, "sha256"},
+		{"auto", 0, []string{small}, "xxh3"},
+		{"auto", 1, []string{dirDump}, "xxh3"},
+		{"auto", 1, []string{small, small}, "sha256"},
+		{"auto", 1, []string{filepath.Join(dir, "missing")}, "sha256"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if got := resolveSumAlgo(st.algo, st.threshold, st.paths...); got != st.want {
+				t.Errorf("got %s, want %s", got, st.want)
+			}
+		})
+	}
+}
+
+func TestSumManifest(t *testing.T) {
+	dir := t.TempDir()
+	when := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	files := []string{
+		filepath.Join(dir, "db1", "db1.dump"),
+		filepath.Join(dir, "db2", "db2.d", "toc.dat"),
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte("abdc\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := newSumManifest(filepath.Join(dir, "{dbname}"), time.RFC3339, when, 0600)
+	if err := m.add(files[0], "sha256"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := m.add(filepath.Join(dir, "db2", "db2.d"), "sha256"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := m.add(files[0], "none"); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	paths := m.paths()
+	want := filepath.Join(dir, "checksums", "checksums_2023-05-01T10:00:00Z.sha256")
+	if len(paths) != 1 || paths[0] != want {
+		t.Fatalf("got %v, want [%s]", paths, want)
+	}
+
+	b, err := os.ReadFile(want)
+	if err != nil {
+		t.Fatal("could not read manifest:", err)
+	}
+
+	h, _ := newHash("sha256")
+	h.Write([]byte("abdc\n"))
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+
+	expected := fmt.Sprintf("%s  ../db1/db1.dump\n%s  ../db2/db2.d/toc.dat\n", sum, sum)
+	if string(b) != expected {
+		t.Errorf("got %q, want %q", string(b), expected)
+	}
+}
+
+func TestUpdateChecksumFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	dump := filepath.Join(dir, "db", "db_2023-01-02T03:04:05Z.dump.age")
+	other := filepath.Join(dir, "db", "db_2023-01-01T03:04:05Z.dump.age")
+	if err := os.MkdirAll(filepath.Dir(dump), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{dump, other} {
+		if err := os.WriteFile(p, []byte("old"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sidecar, err := checksumFileList([]string{dump}, "sha256", dump, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := newSumManifest(dir, time.RFC3339, time.Now(), 0600)
+	for _, p := range []string{dump, other} {
+		if err := manifest.add(p, "sha256"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, _ := os.ReadFile(manifest.paths()[0])
+
+	if err := os.WriteFile(dump, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := updateChecksumFiles(dir, map[string]string{dump: dump}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// sha256 of "new"
+	want := "11507a0e2f5e69d5dfa40a62a1bd7b6ee57e6bcd85c67c9b8431b36fff21c437"
+	for _, p := range []string{sidecar, manifest.paths()[0]} {
+		got, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(got), want) {
+			t.Errorf("checksum of %s was not updated in %s:\n%s", dump, p, got)
+		}
+	}
+
+	// The other lines are kept as is
+	after, _ := os.ReadFile(manifest.paths()[0])
+	if strings.Split(string(before), "\n")[1] != strings.Split(string(after), "\n")[1] {
+		t.Errorf("unchanged file got a new checksum:\n%s\n%s", before, after)
+	}
+}
+
+func TestVerifyChecksumFile(t *testing.T) {
+	dir := t.TempDir()
+
+	dump := filepath.Join(dir, "db_2023-01-02T03:04:05Z.dump")
+	dirDump := filepath.Join(dir, "db_2023-01-02T03:04:05Z.d")
+	if err := os.MkdirAll(dirDump, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{dump, filepath.Join(dirDump, "toc.dat"), filepath.Join(dirDump, "1.dat")} {
+		if err := os.WriteFile(p, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sidecar, err := checksumFile(dump, "sha256", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirSidecar, err := checksumFile(dirDump, "sha256", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := newSumManifest(dir, time.RFC3339, time.Now(), 0600)
+	for _, p := range []string{dump, dirDump} {
+		if err := manifest.add(p, "sha256"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		sumPath string
+		path    string
+	}{
+		{sidecar, dump},
+		{dirSidecar, dirDump},
+		{manifest.paths()[0], dump},
+		{manifest.paths()[0], dirDump},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if err := verifyChecksumFile(st.sumPath, "sha256", st.path); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+
+	// Corrupt the files after their checksum was written
+	if err := os.WriteFile(dump, []byte("atad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dirDump, "1.dat"), []byte("atad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("corrupt %v", i), func(t *testing.T) {
+			if err := verifyChecksumFile(st.sumPath, "sha256", st.path); err == nil {
+				t.Errorf("expected an error on a corrupted file")
+			}
+		})
+	}
+
+	// A file missing from the checksum file is an error
+	if err := verifyChecksumFile(sidecar, "sha256", dirDump); err == nil {
+		t.Errorf("expected an error when the file is not in the checksum file")
+	}
+}
@@ -31,9 +31,12 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
-func hookCommand(cmd string, logPrefix string) error {
+// hookCommand runs the command, logging its output with the prefix. The
+// optional env is added to the environment of the command.
+func hookCommand(cmd string, logPrefix string, env ...string) error {
 	if cmd == "" {
 		return fmt.Errorf("unable to run an empty command")
 	}
@@ -49,6 +52,9 @@ func hookCommand(cmd string, logPrefix string) error {
 
 	l.Verboseln("running:", prog, args)
 	c := exec.Command(prog, args...)
+	if len(env) > 0 {
+		c.Env = append(os.Environ(), env...)
+	}
 	stdoutStderr, err := c.CombinedOutput()
 	if err != nil {
 		for _, line := range strings.Split(string(stdoutStderr), "\n") {
@@ -68,23 +74,49 @@ func hookCommand(cmd string, logPrefix string) error {
 	return nil
 }
 
-func preBackupHook(cmd string) error {
-	if cmd != "" {
-		l.Infoln("running pre-backup command:", cmd)
-		if err := hookCommand(cmd, "pre-backup:"); err != nil {
-			l.Fatalln("hook command failed:", err)
-			return err
-		}
+// hookRunEnv returns the environment variables describing the run, given to
+// all hook commands
+func hookRunEnv(opts options, when time.Time) []string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		l.Warnln("could not get hostname:", err)
+	}
+
+	return []string{
+		"PGBK_BACKUP_DIR=" + opts.Directory,
+		"PGBK_TIMESTAMP=" + when.Format(opts.TimeFormat),
+		"PGBK_HOSTNAME=" + hostname,
 	}
-	return nil
 }
 
-func postBackupHook(cmd string) {
-	if cmd != "" {
-		l.Infoln("running post-backup command:", cmd)
-		if err := hookCommand(cmd, "post-backup:"); err != nil {
-			l.Fatalln("hook command failed:", err)
-			os.Exit(1)
+// hookOnErrorValues are the possible actions when a backup hook fails
+var hookOnErrorValues = []string{"abort", "continue"}
+
+// runBackupHook runs a pre or post backup hook command. The error of the
+// command is returned when onError is "abort", with "continue" it is only
+// logged.
+func runBackupHook(name string, cmd string, onError string, env []string) error {
+	if cmd == "" {
+		return nil
+	}
+
+	l.Infof("running %s command: %s\n", name, cmd)
+	if err := hookCommand(cmd, name+":", env...); err != nil {
+		if onError == "continue" {
+			l.Warnf("%s hook command failed, continuing: %s\n", name, err)
+			return nil
 		}
+
+		return fmt.Errorf("%s hook command failed: %w", name, err)
 	}
+
+	return nil
+}
+
+func preBackupHook(cmd string, onError string, env ...string) error {
+	return runBackupHook("pre-backup", cmd, onError, env)
+}
+
+func postBackupHook(cmd string, onError string, env ...string) error {
+	return runBackupHook("post-backup", cmd, onError, env)
 }
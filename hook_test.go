@@ -31,10 +31,10 @@ import (
 	"bytes"
 	"fmt"
 	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHookCommand(t *testing.T) {
@@ -72,22 +72,39 @@ func TestHookCommand(t *testing.T) {
 	}
 }
 
+func TestHookCommandEnv(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l.logger.SetOutput(buf)
+	defer l.logger.SetOutput(os.Stderr)
+
+	env := hookRunEnv(options{Directory: "/backups", TimeFormat: "2006"}, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err := hookCommand("sh -c 'echo $PGBK_BACKUP_DIR $PGBK_TIMESTAMP $PGBK_DBNAME'", "test:", append(env, "PGBK_DBNAME=db")...); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "INFO: test: /backups 2024 db\n") {
+		t.Errorf("unexpected output of hook: %q", buf.String())
+	}
+}
+
 func TestPreBackupHook(t *testing.T) {
 	var tests = []struct {
-		cmd   string
-		re    string
-		fails bool
+		cmd     string
+		onError string
+		re      string
+		fails   bool
 	}{
-		{"echo 'a'", `\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} INFO: running pre-backup command: echo 'a'\n\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} INFO: pre-backup: a\n$`, false},
-		{"", "", false},
-		{"/nothingBLA a", `\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} INFO: running pre-backup command: /nothingBLA a\n\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} FATAL: .*/nothingBLA.*\n$`, true},
+		{"echo 'a'", "abort", `\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} INFO: running pre-backup command: echo 'a'\n\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} INFO: pre-backup: a\n$`, false},
+		{"", "abort", "", false},
+		{"/nothingBLA a", "abort", `\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} INFO: running pre-backup command: /nothingBLA a\n$`, true},
+		{"/nothingBLA a", "continue", `\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} INFO: running pre-backup command: /nothingBLA a\n\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} WARN: pre-backup hook command failed, continuing: .*/nothingBLA.*\n$`, false},
 	}
 	for i, subt := range tests {
 		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
 			buf := new(bytes.Buffer)
 			l.logger.SetOutput(buf)
 
-			if err := preBackupHook(subt.cmd); err != nil {
+			if err := preBackupHook(subt.cmd, subt.onError); err != nil {
 				if !subt.fails {
 					t.Errorf("function test must not fail, got error: %q\n", err)
 				}
@@ -112,23 +129,36 @@ func TestPreBackupHook(t *testing.T) {
 
 func TestPostBackupHook(t *testing.T) {
 	t.Run("0", func(t *testing.T) {
-		if os.Getenv("_TEST_HOOK") == "1" {
-			postBackupHook("false")
-			return
-		}
-		cmd := exec.Command(os.Args[0], "-test.run=TestPostBackupHook")
-		cmd.Env = append(os.Environ(), "_TEST_HOOK=1")
-		err := cmd.Run()
-		if e, ok := err.(*exec.ExitError); ok && !e.Success() {
-			return
+		buf := new(bytes.Buffer)
+		l.logger.SetOutput(buf)
+		defer l.logger.SetOutput(os.Stderr)
+
+		if err := postBackupHook("false", "abort"); err == nil {
+			t.Errorf("expected an error from a failing hook")
 		}
-		t.Fatalf("process ran with err %v, want exit status 1", err)
 	})
 
 	t.Run("1", func(t *testing.T) {
 		buf := new(bytes.Buffer)
 		l.logger.SetOutput(buf)
-		postBackupHook("")
+		defer l.logger.SetOutput(os.Stderr)
+
+		if err := postBackupHook("false", "continue"); err != nil {
+			t.Errorf("expected no error with continue, got %s", err)
+		}
+		if !strings.Contains(buf.String(), "WARN: post-backup hook command failed") {
+			t.Errorf("expected a warning, got %q", buf.String())
+		}
+	})
+
+	t.Run("2", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		l.logger.SetOutput(buf)
+		defer l.logger.SetOutput(os.Stderr)
+
+		if err := postBackupHook("", "abort"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
 		lines := buf.String()
 		if len(lines) != 0 {
 			t.Errorf("did not expect any output, got %q\n", lines)
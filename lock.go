@@ -41,7 +41,9 @@ func lockPath(path string) (*os.File, bool, error) {
 		return nil, false, err
 	}
 
-	f, err := os.Create(path)
+	// Do not truncate the file before holding the lock, it contains
+	// information on the process holding it
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, false, err
 	}
@@ -57,6 +59,10 @@ func lockPath(path string) (*os.File, bool, error) {
 		}
 	}
 
+	if err := writeLockInfo(f); err != nil {
+		l.Warnf("could not write owner information to %s: %s", path, err)
+	}
+
 	return f, true, nil
 }
 
@@ -27,11 +27,14 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLockPath(t *testing.T) {
@@ -102,3 +105,72 @@ func TestUnlockPath(t *testing.T) {
 		t.Errorf("got <nil> instead of \"bad file descriptor\" error")
 	}
 }
+
+func TestLockInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+
+	f, locked, err := lockPath(path)
+	if err != nil || !locked {
+		t.Fatalf("could not lock %s: %v", path, err)
+	}
+	defer unlockPath(f)
+
+	pid, started, err := readLockInfo(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if pid != os.Getpid() {
+		t.Errorf("got pid %d, want %d", pid, os.Getpid())
+	}
+
+	if time.Since(started) > time.Minute {
+		t.Errorf("unexpected start time %s", started)
+	}
+
+	// A failed attempt must not erase the information of the holder
+	if runtime.GOOS != "windows" {
+		f1, _, _ := lockPath(path)
+		f1.Close()
+		if got, _, _ := readLockInfo(path); got != pid {
+			t.Errorf("lock information was lost after a failed lock attempt")
+		}
+	}
+
+	if err := os.WriteFile(path+".bad", []byte("garbage\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readLockInfo(path + ".bad"); err == nil {
+		t.Errorf("expected an error on a file without lock information")
+	}
+}
+
+func TestLockPathWait(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+
+	f, err := lockPathWait(path, 0)
+	if err != nil {
+		t.Fatalf("could not lock %s: %s", path, err)
+	}
+
+	// Without waiting, the error tells who holds the lock
+	_, err = lockPathWait(path, 0)
+	if err == nil {
+		t.Fatalf("expected an error on a locked path")
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("process %d", os.Getpid())) {
+		t.Errorf("error does not mention the holder: %s", err)
+	}
+
+	// The lock is acquired when released while waiting
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlockPath(f)
+	}()
+
+	f1, err := lockPathWait(path, 5*time.Second)
+	if err != nil {
+		t.Fatalf("expected the lock after waiting, got %s", err)
+	}
+	unlockPath(f1)
+}
@@ -34,7 +34,9 @@ import (
 )
 
 // lockPath on windows just creates a file without locking, it only tests if
-// the file exist to consider it locked
+// the file exist to consider it locked. Since the file stays when the process
+// dies, a lock file referencing a process that does not exist anymore is
+// considered stale and removed.
 func lockPath(path string) (*os.File, bool, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return nil, false, err
@@ -45,7 +47,20 @@ func lockPath(path string) (*os.File, bool, error) {
 		if info.IsDir() {
 			return nil, false, &os.PathError{Op: "stat", Path: path, Err: fmt.Errorf("unexpected directory")}
 		}
-		return nil, false, err
+
+		pid, _, rerr := readLockInfo(path)
+		if rerr != nil || pid == 0 {
+			return nil, false, nil
+		}
+
+		if _, ferr := os.FindProcess(pid); ferr == nil {
+			return nil, false, nil
+		}
+
+		l.Warnf("removing stale lock file %s of process %d", path, pid)
+		if err := os.Remove(path); err != nil {
+			return nil, false, err
+		}
 	}
 
 	l.Verboseln("creating lock file", path)
@@ -53,6 +68,11 @@ func lockPath(path string) (*os.File, bool, error) {
 	if err != nil {
 		return nil, false, err
 	}
+
+	if err := writeLockInfo(f); err != nil {
+		l.Warnf("could not write owner information to %s: %s", path, err)
+	}
+
 	return f, true, nil
 }
 
@@ -0,0 +1,125 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeLockInfo stores the PID of the current process and the time the lock
+// was taken in the lock file, to tell who holds the lock when it cannot be
+// acquired
+func writeLockInfo(f *os.File) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err := f.WriteAt([]byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), time.Now().Format(time.RFC3339))), 0); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// readLockInfo returns the PID and start time written in a lock file by
+// writeLockInfo
+func readLockInfo(path string) (int, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() && len(lines) < 2 {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if len(lines) < 2 {
+		return 0, time.Time{}, fmt.Errorf("no owner information in %s", path)
+	}
+
+	pid, err := strconv.Atoi(lines[0])
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid pid in %s: %w", path, err)
+	}
+
+	started, err := time.Parse(time.RFC3339, lines[1])
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid start time in %s: %w", path, err)
+	}
+
+	return pid, started, nil
+}
+
+// lockPathWait tries to lock path like lockPath, retrying until the lock is
+// acquired or wait has elapsed. When the lock could not be acquired, the
+// returned error tells which process holds it.
+func lockPathWait(path string, wait time.Duration) (*os.File, error) {
+	deadline := time.Now().Add(wait)
+
+	for {
+		f, locked, err := lockPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to lock %s: %w", path, err)
+		}
+
+		if locked {
+			return f, nil
+		}
+
+		if f != nil {
+			f.Close()
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+
+		if remaining > time.Second {
+			remaining = time.Second
+		}
+		time.Sleep(remaining)
+	}
+
+	pid, started, err := readLockInfo(path)
+	if err != nil {
+		l.Verboseln("could not read owner of lock:", err)
+		return nil, fmt.Errorf("%s is locked by another process", path)
+	}
+
+	return nil, fmt.Errorf("%s is locked by process %d since %s", path, pid, started.Format(time.RFC3339))
+}
@@ -26,16 +26,125 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+// logFormatter writes a message of the given level using the logger. The
+// database is empty when the message is not about a specific database.
+type logFormatter func(logger *log.Logger, level string, database string, msg string)
+
+// textFormatter outputs human readable lines, with the level as prefix
+func textFormatter(logger *log.Logger, level string, database string, msg string) {
+	if database != "" {
+		msg = fmt.Sprintf("[%s] %s", database, msg)
+	}
+
+	logger.SetPrefix(level + ": ")
+	logger.Print(msg)
+}
+
+// jsonFormatter outputs one JSON object per message, suitable for log
+// ingestion tools
+func jsonFormatter(logger *log.Logger, level string, database string, msg string) {
+	entry := struct {
+		Time     string `json:"time"`
+		Level    string `json:"level"`
+		Msg      string `json:"msg"`
+		Database string `json:"database,omitempty"`
+	}{
+		Time:     time.Now().Format(time.RFC3339Nano),
+		Level:    strings.ToLower(level),
+		Msg:      strings.TrimSuffix(msg, "\n"),
+		Database: database,
+	}
+
+	// Marshaling a struct of strings cannot fail
+	b, _ := json.Marshal(entry)
+
+	logger.SetPrefix("")
+	logger.Print(string(b))
+}
+
+// heldWriter keeps in memory what is written until it is either flushed to
+// the underlying writer or discarded
+type heldWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (h *heldWriter) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.buf.Write(p)
+}
+
+func (h *heldWriter) release(flush bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	defer h.buf.Reset()
+	if flush {
+		_, err := h.w.Write(h.buf.Bytes())
+		return err
+	}
+
+	return nil
+}
+
+// syslogWriter sends messages to syslog with a priority, as done by
+// *syslog.Writer
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+	Crit(m string) error
+}
+
+// sendSyslog sends msg to syslog with the priority matching the level of the
+// message
+func sendSyslog(w syslogWriter, level string, msg string) error {
+	switch level {
+	case "DEBUG":
+		return w.Debug(msg)
+	case "INFO":
+		return w.Info(msg)
+	case "WARN":
+		return w.Warning(msg)
+	case "ERROR":
+		return w.Err(msg)
+	default:
+		return w.Crit(msg)
+	}
+}
+
 // LevelLog custom type to allow a verbose mode and handling of levels
 // with a prefix
 type LevelLog struct {
-	logger  *log.Logger
-	verbose bool
-	quiet   bool
+	logger    *log.Logger
+	verbose   bool
+	quiet     bool
+	errorOnly bool
+	formatter logFormatter
+	database  string
+
+	// Where the messages go: stderr, possibly held in memory, and the
+	// additional outputs, log file and syslog. Syslog gets each message
+	// separately to know its priority
+	stderr  io.Writer
+	held    *heldWriter
+	outputs []io.Writer
+	syslog  syslogWriter
 }
 
 var l = NewLevelLog()
@@ -43,9 +152,11 @@ var l = NewLevelLog()
 // NewLevelLog setups a logger with the proper configuration for the underlying log
 func NewLevelLog() *LevelLog {
 	return &LevelLog{
-		logger:  log.New(os.Stderr, "", log.LstdFlags|log.Lmsgprefix),
-		verbose: false,
-		quiet:   false,
+		logger:    log.New(os.Stderr, "", log.LstdFlags|log.Lmsgprefix),
+		verbose:   false,
+		quiet:     false,
+		formatter: textFormatter,
+		stderr:    os.Stderr,
 	}
 }
 
@@ -65,70 +176,196 @@ func (l *LevelLog) SetVerbosity(verbose bool, quiet bool) {
 	}
 }
 
+// SetLevel sets the minimum level of the messages to output: debug, info,
+// warn or error
+func (l *LevelLog) SetLevel(level string) error {
+	switch level {
+	case "debug":
+		l.quiet = false
+		l.errorOnly = false
+		l.SetVerbosity(true, false)
+	case "info":
+		l.quiet = false
+		l.errorOnly = false
+		l.SetVerbosity(false, false)
+	case "warn":
+		l.errorOnly = false
+		l.SetVerbosity(false, true)
+	case "error":
+		l.errorOnly = true
+		l.SetVerbosity(false, true)
+	default:
+		return fmt.Errorf("unknown log level: %s", level)
+	}
+
+	return nil
+}
+
+// SetOutputs sends messages to a file opened in append mode and/or to syslog,
+// in addition to stderr
+func (l *LevelLog) SetOutputs(path string, useSyslog bool) error {
+	writers := make([]io.Writer, 0, 2)
+
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("could not open log file: %w", err)
+		}
+		writers = append(writers, f)
+	}
+
+	if useSyslog {
+		w, err := newSyslogWriter()
+		if err != nil {
+			return fmt.Errorf("could not connect to syslog: %w", err)
+		}
+		l.syslog = w
+	}
+
+	l.outputs = writers
+	l.setOutput()
+
+	return nil
+}
+
+// HoldOutput keeps the messages meant for stderr in memory, until
+// ReleaseOutput is called. The log file and syslog still get them as they
+// come.
+func (l *LevelLog) HoldOutput() {
+	if l.held != nil {
+		return
+	}
+
+	l.held = &heldWriter{w: l.stderr}
+	l.setOutput()
+}
+
+// ReleaseOutput writes the messages held in memory to stderr when flush is
+// true, or discards them, then sends the next messages to stderr directly
+func (l *LevelLog) ReleaseOutput(flush bool) error {
+	if l.held == nil {
+		return nil
+	}
+
+	err := l.held.release(flush)
+	l.held = nil
+	l.setOutput()
+
+	return err
+}
+
+func (l *LevelLog) setOutput() {
+	var w io.Writer = l.stderr
+	if l.held != nil {
+		w = l.held
+	}
+
+	if len(l.outputs) == 0 {
+		l.logger.SetOutput(w)
+		return
+	}
+
+	l.logger.SetOutput(io.MultiWriter(append([]io.Writer{w}, l.outputs...)...))
+}
+
+// SetFormat chooses how messages are output, either "text" or "json"
+func (l *LevelLog) SetFormat(format string) error {
+	switch format {
+	case "text":
+		l.formatter = textFormatter
+		flags := log.LstdFlags | log.Lmsgprefix
+		if l.verbose {
+			flags |= log.Lmicroseconds
+		}
+		l.logger.SetFlags(flags)
+	case "json":
+		// The time is part of the JSON object
+		l.formatter = jsonFormatter
+		l.logger.SetFlags(0)
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	return nil
+}
+
+// ForDatabase returns a logger sharing the output and settings of l that
+// marks its messages as related to the database dbname
+func (l *LevelLog) ForDatabase(dbname string) *LevelLog {
+	n := *l
+	n.database = dbname
+	return &n
+}
+
+func (l *LevelLog) output(level string, msg string) {
+	l.formatter(l.logger, level, l.database, msg)
+
+	if l.syslog != nil {
+		// syslog timestamps the messages itself
+		var buf bytes.Buffer
+		l.formatter(log.New(&buf, "", 0), level, l.database, msg)
+		sendSyslog(l.syslog, level, buf.String())
+	}
+}
+
 // Verbosef prints with log.Printf a message with DEBUG: prefix using log.Printf, only when verbose mode is true
 func (l *LevelLog) Verbosef(format string, v ...interface{}) {
 	if l.verbose {
-		l.logger.SetPrefix("DEBUG: ")
-		l.logger.Printf(format, v...)
+		l.output("DEBUG", fmt.Sprintf(format, v...))
 	}
 }
 
 // Verboseln prints a message with DEBUG: prefix using log.Println, only when verbose mode is true
 func (l *LevelLog) Verboseln(v ...interface{}) {
 	if l.verbose {
-		l.logger.SetPrefix("DEBUG: ")
-		l.logger.Println(v...)
+		l.output("DEBUG", fmt.Sprintln(v...))
 	}
 }
 
 // Infof prints a message with INFO: prefix using log.Printf
 func (l *LevelLog) Infof(format string, v ...interface{}) {
 	if !l.quiet {
-		l.logger.SetPrefix("INFO: ")
-		l.logger.Printf(format, v...)
+		l.output("INFO", fmt.Sprintf(format, v...))
 	}
 }
 
 // Infoln prints a message with INFO: prefix using log.Println
 func (l *LevelLog) Infoln(v ...interface{}) {
 	if !l.quiet {
-		l.logger.SetPrefix("INFO: ")
-		l.logger.Println(v...)
+		l.output("INFO", fmt.Sprintln(v...))
 	}
 }
 
 // Warnf prints a message with WARN: prefix using log.Printf
 func (l *LevelLog) Warnf(format string, v ...interface{}) {
-	l.logger.SetPrefix("WARN: ")
-	l.logger.Printf(format, v...)
+	if !l.errorOnly {
+		l.output("WARN", fmt.Sprintf(format, v...))
+	}
 }
 
 // Warnln prints a message with WARN: prefix using log.Println
 func (l *LevelLog) Warnln(v ...interface{}) {
-	l.logger.SetPrefix("WARN: ")
-	l.logger.Println(v...)
+	if !l.errorOnly {
+		l.output("WARN", fmt.Sprintln(v...))
+	}
 }
 
 // Errorf prints a message with ERROR: prefix using log.Printf
 func (l *LevelLog) Errorf(format string, v ...interface{}) {
-	l.logger.SetPrefix("ERROR: ")
-	l.logger.Printf(format, v...)
+	l.output("ERROR", fmt.Sprintf(format, v...))
 }
 
 // Errorln prints a message with ERROR: prefix using log.Println
 func (l *LevelLog) Errorln(v ...interface{}) {
-	l.logger.SetPrefix("ERROR: ")
-	l.logger.Println(v...)
+	l.output("ERROR", fmt.Sprintln(v...))
 }
 
 // Fatalf prints a message with FATAL: prefix using log.Printf
 func (l *LevelLog) Fatalf(format string, v ...interface{}) {
-	l.logger.SetPrefix("FATAL: ")
-	l.logger.Printf(format, v...)
+	l.output("FATAL", fmt.Sprintf(format, v...))
 }
 
 // Fatalln prints a message with FATAL: prefix using log.Println
 func (l *LevelLog) Fatalln(v ...interface{}) {
-	l.logger.SetPrefix("FATAL: ")
-	l.logger.Println(v...)
+	l.output("FATAL", fmt.Sprintln(v...))
 }
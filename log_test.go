@@ -27,10 +27,18 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestLevelLogSetVerbose(t *testing.T) {
@@ -263,3 +271,244 @@ func TestLevelLogQuiet(t *testing.T) {
 		t.Errorf("log function Infoln has printed data when it should not")
 	}
 }
+
+func TestLevelLogForDatabase(t *testing.T) {
+	l := NewLevelLog()
+
+	buf := new(bytes.Buffer)
+	l.logger.SetOutput(buf)
+
+	l.ForDatabase("b1").Infof("%s\n", "test")
+	line := strings.TrimSuffix(buf.String(), "\n")
+
+	re := `^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} INFO: \[b1\] test$`
+	matched, err := regexp.MatchString(re, line)
+	if err != nil {
+		t.Fatal("pattern did not compile:", err)
+	}
+	if !matched {
+		t.Errorf("log output should match %q is %q", re, line)
+	}
+}
+
+func TestLevelLogJSON(t *testing.T) {
+	var tests = []struct {
+		database string
+		level    string
+		message  string
+	}{
+		{"", "info", "test"},
+		{"b1", "error", "some \"quoted\" text"},
+	}
+
+	l := NewLevelLog()
+	if err := l.SetFormat("json"); err != nil {
+		t.Fatalf("SetFormat returned: %s", err)
+	}
+
+	for i, subt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			l.logger.SetOutput(buf)
+
+			dl := l
+			if subt.database != "" {
+				dl = l.ForDatabase(subt.database)
+			}
+
+			if subt.level == "info" {
+				dl.Infoln(subt.message)
+			} else {
+				dl.Errorf("%s\n", subt.message)
+			}
+
+			var got map[string]string
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("output is not JSON: %s: %q", err, buf.String())
+			}
+
+			if _, err := time.Parse(time.RFC3339Nano, got["time"]); err != nil {
+				t.Errorf("invalid time: %s", err)
+			}
+
+			if got["level"] != subt.level {
+				t.Errorf("got level %q, want %q", got["level"], subt.level)
+			}
+
+			if got["msg"] != subt.message {
+				t.Errorf("got msg %q, want %q", got["msg"], subt.message)
+			}
+
+			if got["database"] != subt.database {
+				t.Errorf("got database %q, want %q", got["database"], subt.database)
+			}
+		})
+	}
+
+	if err := l.SetFormat("xml"); err == nil {
+		t.Errorf("expected an error on unknown format, got nil")
+	}
+}
+
+func TestLevelLogSetLevel(t *testing.T) {
+	var tests = []struct {
+		level string
+		want  string
+	}{
+		{"debug", "DEBUG INFO WARN ERROR "},
+		{"info", "INFO WARN ERROR "},
+		{"warn", "WARN ERROR "},
+		{"error", "ERROR "},
+	}
+
+	for i, subt := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			l := NewLevelLog()
+			buf := new(bytes.Buffer)
+			l.logger.SetOutput(buf)
+			if err := l.SetLevel(subt.level); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			l.logger.SetFlags(log.Lmsgprefix)
+
+			l.Verboseln("x")
+			l.Infoln("x")
+			l.Warnln("x")
+			l.Errorln("x")
+
+			got := strings.ReplaceAll(buf.String(), ": x\n", " ")
+			if got != subt.want {
+				t.Errorf("got %q, want %q", got, subt.want)
+			}
+		})
+	}
+
+	if err := NewLevelLog().SetLevel("trace"); err == nil {
+		t.Errorf("expected an error with an unknown level")
+	}
+}
+
+func TestLevelLogSetOutputs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pg_back.log")
+
+	l := NewLevelLog()
+	if err := l.SetOutputs(path, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	l.Infoln("first")
+
+	// The file is opened in append mode
+	l = NewLevelLog()
+	if err := l.SetOutputs(path, false); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	l.Infoln("second")
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("could not read log file:", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "INFO: first") || !strings.HasSuffix(lines[1], "INFO: second") {
+		t.Errorf("unexpected contents of the log file: %q", string(b))
+	}
+}
+
+// fakeSyslog records the priority and the contents of the messages
+type fakeSyslog struct {
+	got []string
+}
+
+func (f *fakeSyslog) add(prio string, m string) error {
+	f.got = append(f.got, prio+" "+m)
+	return nil
+}
+
+func (f *fakeSyslog) Debug(m string) error   { return f.add("debug", m) }
+func (f *fakeSyslog) Info(m string) error    { return f.add("info", m) }
+func (f *fakeSyslog) Warning(m string) error { return f.add("warning", m) }
+func (f *fakeSyslog) Err(m string) error     { return f.add("err", m) }
+func (f *fakeSyslog) Crit(m string) error    { return f.add("crit", m) }
+
+func TestLevelLogSyslog(t *testing.T) {
+	sl := &fakeSyslog{}
+
+	l := NewLevelLog()
+	l.stderr = new(bytes.Buffer)
+	l.setOutput()
+	l.syslog = sl
+	l.SetVerbosity(true, false)
+
+	l.Verboseln("one")
+	l.Infoln("two")
+	l.ForDatabase("b1").Warnln("three")
+	l.Errorln("four")
+	l.Fatalln("five")
+
+	want := []string{
+		"debug DEBUG: one\n",
+		"info INFO: two\n",
+		"warning WARN: [b1] three\n",
+		"err ERROR: four\n",
+		"crit FATAL: five\n",
+	}
+	if diff := cmp.Diff(want, sl.got); diff != "" {
+		t.Errorf("syslog mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLevelLogHoldOutput(t *testing.T) {
+	var tests = []struct {
+		flush bool
+		want  []string
+	}{
+		{false, []string{}},
+		{true, []string{"INFO: first", "WARN: [b1] second"}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			stderr := new(bytes.Buffer)
+			file := new(bytes.Buffer)
+
+			l := NewLevelLog()
+			l.stderr = stderr
+			l.outputs = []io.Writer{file}
+			l.HoldOutput()
+
+			l.Infoln("first")
+			l.ForDatabase("b1").Warnln("second")
+
+			if stderr.Len() > 0 {
+				t.Errorf("messages output before release: %q", stderr.String())
+			}
+			if n := strings.Count(file.String(), "\n"); n != 2 {
+				t.Errorf("got %d messages in the additional output, want 2", n)
+			}
+
+			if err := l.ReleaseOutput(st.flush); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			got := make([]string, 0)
+			for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+				if _, msg, found := strings.Cut(line, " "); found {
+					// remove the date and time
+					_, msg, _ = strings.Cut(msg, " ")
+					got = append(got, msg)
+				}
+			}
+			if diff := cmp.Diff(st.want, got); diff != "" {
+				t.Errorf("ReleaseOutput() mismatch (-want +got):\n%s", diff)
+			}
+
+			// Once released, messages go to stderr directly
+			stderr.Reset()
+			l.Errorln("third")
+			if !strings.Contains(stderr.String(), "ERROR: third") {
+				t.Errorf("message not output after release: %q", stderr.String())
+			}
+		})
+	}
+}
@@ -26,20 +26,117 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var version = "2.6.0"
 var binDir string
 
+// binNames overrides the executable of a PostgreSQL tool, by name of the
+// tool, e.g. pg_dump-16 for pg_dump
+var binNames = map[string]string{}
+
+// Exit codes of pg_back, they are documented in the usage message
+const (
+	exitSuccess     = 0
+	exitFailure     = 1 // nothing could be dumped, e.g. bad configuration
+	exitPartial     = 2 // some databases could not be dumped
+	exitPostProcess = 3 // dumps are done but checksum, encryption or upload failed
+	exitInterrupted = 4 // stopped by a signal or the timeout
+)
+
+// interruptError is returned when the run is stopped before completion, the
+// dumps in progress are aborted and their files removed
+type interruptError struct {
+	reason string
+}
+
+func (e *interruptError) Error() string {
+	return fmt.Sprintf("run interrupted: %s", e.reason)
+}
+
+// dumpError is returned when some databases could not be dumped
+// successfully. failed may be empty when only the ACL or configuration of a
+// database could not be dumped, those databases are in partial. The databases
+// not dumped because of --stop-on-error are in skipped.
+type dumpError struct {
+	failed  []string
+	partial []string
+	skipped []string
+	total   int
+}
+
+func (e *dumpError) Error() string {
+	if len(e.failed) == 0 {
+		if len(e.partial) == 0 {
+			return "some operation failed"
+		}
+		return fmt.Sprintf("some operation failed on databases: %s", strings.Join(e.partial, ", "))
+	}
+
+	msg := fmt.Sprintf("dump of %d of %d databases failed: %s", len(e.failed), e.total, strings.Join(e.failed, ", "))
+	if len(e.skipped) > 0 {
+		msg += fmt.Sprintf(", %d skipped: %s", len(e.skipped), strings.Join(e.skipped, ", "))
+	}
+
+	return msg
+}
+
+// postProcessError is returned when dumps are done but processing the
+// produced files failed
+type postProcessError struct {
+	err error
+}
+
+func (e *postProcessError) Error() string {
+	return fmt.Sprintf("some error encountered in postprocessing: %s", e.err)
+}
+
+func (e *postProcessError) Unwrap() error {
+	return e.err
+}
+
+// exitStatus gives the exit code of the program for the error returned by
+// run()
+func exitStatus(err error) int {
+	var (
+		ierr *interruptError
+		derr *dumpError
+		perr *postProcessError
+	)
+
+	switch {
+	case err == nil:
+		return exitSuccess
+	case errors.As(err, &ierr):
+		return exitInterrupted
+	case errors.As(err, &derr):
+		if derr.total > 0 && len(derr.failed)+len(derr.skipped) == derr.total {
+			return exitFailure
+		}
+		return exitPartial
+	case errors.As(err, &perr):
+		return exitPostProcess
+	}
+
+	return exitFailure
+}
+
 type dump struct {
 	// Name of the database to dump
 	Database string
@@ -70,12 +167,72 @@ type dump struct {
 	// Keep original files after encryption
 	EncryptKeepSrc bool
 
+	// Start of the run, it names the timestamped subdirectory shared by
+	// all the files of the run
+	RunWhen time.Time
+
 	// Result
 	When     time.Time
+	End      time.Time
 	ExitCode int
+	Duration time.Duration
+	Size     int64
+
+	// Reason of the failure of the dump, nil when it succeeded
+	Err error
+
+	// The dump was not attempted because the run was interrupted or the
+	// dumps were stopped by --stop-on-error, ExitCode is not 0
+	Skipped bool
+
+	// The database did not change since the dump of a previous run, Path
+	// and When are the ones of this dump, no new dump was taken
+	Linked bool
 
 	// Version of pg_dump
 	PgDumpVersion int
+
+	// Checksum file listing the dump, set by post processing, empty when
+	// no checksum was computed
+	SumFile string
+
+	// Exported snapshot to use, empty to let pg_dump take its own
+	Snapshot string
+
+	// Permissions of the dump, the execute bit is added for directories.
+	// When 0, the dump is only readable by its owner
+	Mode os.FileMode
+
+	// Maximum duration of pg_dump, 0 means no limit
+	Timeout time.Duration
+
+	// Options of the session of pg_dump given by pg_back, like the lock
+	// and statement timeouts, before the ones of the database
+	SessionOptions string
+
+	// Number of times pg_dump is run again after a transient failure
+	Retries int
+
+	// Create a marker file next to the dump while pg_dump runs
+	WriteMarker bool
+
+	// Pool limiting the total number of pg_dump processes, nil for no
+	// limit
+	Workers workerPool
+
+	// Directory of the lock files, the backup directory when empty
+	LockDirectory string
+
+	// How long to wait for the lock of the database when another
+	// pg_back holds it
+	LockWait time.Duration
+
+	// Environment variables describing the run, given to the hooks
+	HookEnv []string
+
+	// Delay between two messages telling the dump is still running, 0
+	// to disable them
+	ProgressInterval time.Duration
 }
 
 type dbOpts struct {
@@ -92,6 +249,11 @@ type dbOpts struct {
 	// Compression level for compressed formats, -1 means the default
 	CompressLevel int
 
+	// Compression method of pg_dump, gzip, lz4 or zstd, and whether to
+	// use long-distance matching with zstd
+	CompressMethod string
+	CompressLong   bool
+
 	// Purge configuration
 	PurgeInterval time.Duration
 	PurgeKeep     int
@@ -104,9 +266,36 @@ type dbOpts struct {
 	Tables         []string
 	ExcludedTables []string
 
+	// Tables whose data is not dumped, only their definition
+	ExcludedTableData []string
+
 	// Other pg_dump options to use
 	PgDumpOpts []string
 
+	// Options of the session of pg_dump, like PGOPTIONS, to set
+	// parameters with -c
+	PgOptions string
+
+	// Sections to dump, all when empty
+	Sections []string
+
+	// Only dump the schema or the data
+	SchemaOnly bool
+	DataOnly   bool
+
+	// Leave out ownership, privileges or comments
+	NoOwner      bool
+	NoPrivileges bool
+	NoComments   bool
+
+	// Do not let pg_dump fsync the files, for throwaway storage
+	NoSync bool
+
+	// Drop objects before creating them, with IF EXISTS, in plain format
+	// dumps meant to be reloaded over an existing database
+	Clean    bool
+	IfExists bool
+
 	// Whether to force the dump of large objects or not with pg_dump -b or
 	// -B, or let pg_dump use its default. 0 means default, 1 include
 	// blobs, 2 exclude blobs.
@@ -114,14 +303,32 @@ type dbOpts struct {
 
 	// Connection user for that database
 	Username string
+
+	// Commands to run before and after pg_dump
+	PreDumpHook  string
+	PostDumpHook string
+
+	// Name of the logical replication slot to create, the dump uses the
+	// snapshot exported by its creation
+	LogicalSlot string
+
+	// Keys set in the section of the database in the configuration file,
+	// the other options come from the global section
+	SectionKeys []string
 }
 
 func main() {
 	// Use another function to allow the use of defer for cleanup, as
 	// os.Exit() does not run deferred functions
-	if err := run(); err != nil {
+	err := run()
+
+	// With --quiet-on-success, the messages held during the run are only
+	// shown when it fails
+	l.ReleaseOutput(err != nil)
+
+	if err != nil {
 		l.Fatalln(err)
-		os.Exit(1)
+		os.Exit(exitStatus(err))
 	}
 }
 
@@ -150,8 +357,20 @@ func run() (retVal error) {
 		return err
 	}
 
-	// Enable verbose mode or quiet mode as soon as possible
+	// Enable verbose mode or quiet mode as soon as possible, the format of
+	// messages may change when the configuration file is loaded
 	l.SetVerbosity(cliOpts.Verbose, cliOpts.Quiet)
+	if !cliOpts.Verbose && !cliOpts.Quiet {
+		if err := l.SetLevel(cliOpts.LogLevel); err != nil {
+			return err
+		}
+	}
+	if err := l.SetFormat(cliOpts.LogFormat); err != nil {
+		return err
+	}
+	if cliOpts.QuietOnSuccess {
+		l.HoldOutput()
+	}
 
 	var cliOptions options
 
@@ -161,7 +380,7 @@ func run() (retVal error) {
 	} else {
 		// Load configuration file and allow the default configuration
 		// file to be absent
-		cliOptions, err = loadConfigurationFile(cliOpts.CfgFile)
+		cliOptions, err = loadConfigurationFile(cliOpts.CfgFile, cliOpts.CfgDirectory)
 		if err != nil {
 			return err
 		}
@@ -171,27 +390,63 @@ func run() (retVal error) {
 	// the command line
 	opts := mergeCliAndConfigOptions(cliOpts, cliOptions, cliOptList)
 
-	err = ensureCipherParamsPresent(&opts)
-	if err != nil {
-		return fmt.Errorf("required cipher parameters not present: %w", err)
+	// -v and -q take precedence over the level from the configuration
+	if !opts.Verbose && !opts.Quiet {
+		if err := l.SetLevel(opts.LogLevel); err != nil {
+			return err
+		}
+	}
+	if err := l.SetFormat(opts.LogFormat); err != nil {
+		return err
+	}
+	if opts.LogFile != "" || opts.LogSyslog {
+		if err := l.SetOutputs(opts.LogFile, opts.LogSyslog); err != nil {
+			return err
+		}
+	}
+	if opts.QuietOnSuccess {
+		l.HoldOutput()
+	} else {
+		l.ReleaseOutput(true)
 	}
 
-	if (opts.Upload == "s3" || opts.Download == "s3" || opts.ListRemote == "s3") && opts.S3Bucket == "" {
-		return fmt.Errorf("a bucket is mandatory with s3")
+	// The timestamp format and location of the merged options apply to
+	// the names of all the files, and to the timestamps given on the
+	// command line checked with the options
+	setTimestampLayout(opts.TimeFormat)
+	setTimestampLocation(opts.TimestampUTC)
+
+	if err := checkOptions(&opts); err != nil {
+		return err
 	}
 
-	if (opts.Upload == "b2" || opts.Download == "b2" || opts.ListRemote == "b2") && opts.B2Bucket == "" {
-		return fmt.Errorf("a bucket is mandatory with B2")
+	// Stop there when only asked to check the configuration, before
+	// contacting PostgreSQL or any remote location
+	if opts.CheckConfig {
+		fmt.Println("configuration is valid")
+		return nil
 	}
 
-	if (opts.Upload == "gcs" || opts.Download == "gcs" || opts.ListRemote == "gcs") && opts.GCSBucket == "" {
-		return fmt.Errorf("a bucket is mandatory with gcs")
+	// The paths of the tools and the naming of the files are needed by
+	// all the modes below, including the ones that do not dump anything
+	setToolPaths(opts)
+
+	if opts.FilenameTemplate != "" {
+		nameTmpl, err = newNameTemplate(opts.FilenameTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid filename template: %w", err)
+		}
 	}
+	runSubdirs = opts.TimestampedSubdir
 
-	if (opts.Upload == "azure" || opts.Download == "azure" || opts.ListRemote == "azure") && opts.AzureContainer == "" {
-		return fmt.Errorf("a container is mandatory with azure")
+	// The self-test contacts PostgreSQL and the remote locations but does
+	// not dump anything
+	if opts.SelfTest {
+		return selfTest(os.Stdout, opts)
 	}
 
+	progressInterval = opts.ProgressInterval
+
 	// Run actions that won't dump databases first, in that case the list
 	// of databases become file globs.  Avoid getting wrong globs from the
 	// config file since we are using the remaining args from the command
@@ -213,6 +468,10 @@ func run() (retVal error) {
 		return nil
 	}
 
+	if opts.ListLocal {
+		return listLocalDumps(os.Stdout, opts.Directory, globs)
+	}
+
 	// When asked to download or decrypt the backups, do it here and exit, we have all
 	// required input (passphrase and backup directory)
 	if opts.Decrypt || opts.Download != "none" {
@@ -224,7 +483,7 @@ func run() (retVal error) {
 
 		if opts.Decrypt {
 			params := decryptParams{PrivateKey: opts.CipherPrivateKey, Passphrase: opts.CipherPassphrase}
-			if err := decryptDirectory(opts.Directory, params, opts.Jobs, globs); err != nil {
+			if err := decryptDirectory(opts.Directory, opts.DecryptDirectory, params, opts.Jobs, globs, opts.DecryptRemoveSrc); err != nil {
 				return err
 			}
 		}
@@ -232,31 +491,131 @@ func run() (retVal error) {
 		return nil
 	}
 
+	// Rekeying works on the files of the backup directory and exits
+	if opts.Rekey {
+		dec := decryptParams{PrivateKey: opts.CipherPrivateKey, Passphrase: opts.CipherPassphrase}
+		enc := encryptParams{PublicKey: opts.NewCipherPublicKey, Passphrase: opts.NewCipherPassphrase, Armor: opts.CipherArmor}
+		if opts.RekeyRemote != "none" {
+			return rekeyRemoteFiles(opts.RekeyRemote, opts, dec, enc, globs)
+		}
+		return rekeyDirectory(opts.Directory, dec, enc, opts.Jobs, globs)
+	}
+
 	// Remember when we start so that a purge interval of 0s won't remove
 	// the dumps we are taking. We truncate the time to the second because
 	// the purge parses the date in the name of the file and its resolution
 	// is the second, thus the parsing truncates to the second.
-	now := time.Now().Truncate(time.Second)
+	now := time.Now().In(timestampLocation).Truncate(time.Second)
 
-	if opts.BinDirectory != "" {
-		binDir = opts.BinDirectory
+	// Restoring uses the database names of the command line to find the
+	// dumps in the backup directory, then exit without dumping
+	if opts.Restore {
+		return restoreDatabases(opts, globs)
+	}
+
+	// Testing the restore of dumps uses the command line arguments the
+	// same way, and can be given paths to dumps
+	if opts.TestRestore {
+		return testRestoreDumps(opts, globs)
+	}
+
+	// Stop the dumps in progress when receiving a signal or when the run
+	// lasts too long, so that no lock nor incomplete dump is left behind
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case sig := <-sigs:
+			l.Warnf("received signal %s, stopping", sig)
+			// Restore the default behaviour so that a second
+			// signal terminates the process right away
+			signal.Stop(sigs)
+			cancel(&interruptError{reason: fmt.Sprintf("received signal %s", sig)})
+		case <-ctx.Done():
+		}
+	}()
+
+	if opts.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, opts.Timeout,
+			&interruptError{reason: fmt.Sprintf("timeout of %v reached", opts.Timeout)})
+		defer cancelTimeout()
+	}
+
+	// Results of the dumps are kept to output metrics and notify when the
+	// run is over, whatever its outcome
+	done := make([]*dump, 0)
+	defer func() {
+		for _, line := range runSummaryLines(done, time.Since(now), opts.Verbose) {
+			l.Infoln(line)
+		}
+	}()
+
+	if opts.MetricsFile != "" {
+		defer func() {
+			if err := writeMetricsFile(opts.MetricsFile, done, retVal == nil, time.Now()); err != nil {
+				l.Errorln("could not write metrics:", err)
+			}
+		}()
+	}
+
+	if opts.ResultJSON != "" {
+		defer func() {
+			r := newRunResult(done, retVal, opts, now, time.Since(now))
+			if err := writeResultFile(opts.ResultJSON, r, opts.FileMode); err != nil {
+				l.Errorln("could not write the result of the run:", err)
+			}
+		}()
+	}
+
+	if opts.NotifyWebhookURL != "" {
+		defer func() {
+			if retVal == nil && opts.NotifyOn == "failure" {
+				return
+			}
+
+			// Being unable to notify must not fail the backup
+			if err := notifyWebhook(opts.NotifyWebhookURL, done, retVal, now); err != nil {
+				l.Errorln("could not notify webhook:", err)
+			}
+		}()
 	}
 
-	// Ensure that pg_dump accepts the options we will give it
-	pgDumpVersion := pgToolVersion("pg_dump")
-	if pgDumpVersion < 80400 {
+	// Ensure that pg_dump accepts the options we will give it. The
+	// versions of the tools are retrieved once, version dependent
+	// behaviour is decided from them for the whole run
+	versions := getToolVersions()
+	if versions.PgDump < 80400 {
 		return fmt.Errorf("provided pg_dump is older than 8.4, unable use it.")
 	}
 
 	// Parse the connection information
 	l.Verboseln("processing input connection parameters")
-	conninfo, err := prepareConnInfo(opts.Host, opts.Port, opts.Username, opts.ConnDb)
+	conninfo, err := prepareConnInfo(opts.Host, opts.Port, opts.Username, opts.ConnDb, connParams(opts))
 	if err != nil {
 		return fmt.Errorf("could not compute connection string: %w", err)
 	}
 
-	defer postBackupHook(opts.PostHook)
-	if err := preBackupHook(opts.PreHook); err != nil {
+	// The post-backup hook is also given the list of databases, known
+	// later on
+	var databases []string
+	hookEnv := hookRunEnv(opts, now)
+	defer func() {
+		err := postBackupHook(opts.PostHook, opts.PostHookOnError, append(hookEnv, "PGBK_DATABASES="+strings.Join(databases, ","))...)
+		if err != nil {
+			if retVal != nil {
+				// Do not overwrite the error
+				l.Errorln(err)
+			} else {
+				retVal = err
+			}
+		}
+	}()
+	if err := preBackupHook(opts.PreHook, opts.PreHookOnError, hookEnv...); err != nil {
 		return err
 	}
 
@@ -266,7 +625,7 @@ func run() (retVal error) {
 
 	var wg sync.WaitGroup
 
-	postProcRet := postProcessFiles(producedFiles, &wg, opts)
+	postProcRet := postProcessFiles(producedFiles, &wg, opts, now)
 
 	// retVal allow us to return with an error from the post processing go
 	// routines, by changing it in a deferred function. Using deferred
@@ -302,62 +661,139 @@ func run() (retVal error) {
 	}
 	defer db.Close()
 
+	l.Infof("server version is %s, pg_dump version is %s", formatPgVersion(db.version), formatPgVersion(versions.PgDump))
+
+	if err := db.setStatementTimeout(opts.MetadataQueryTimeout); err != nil {
+		return err
+	}
+
 	if !opts.DumpOnly {
-		if !db.superuser {
-			l.Infoln("connection user is not superuser, some information will not be dumped")
+		if err := dumpInstance(opts, now, db, conninfo, versions, producedFiles); err != nil {
+			return err
 		}
+	}
 
-		// Then we can implicitely avoid dumping role password when using a
-		// regular user
-		dumpRolePasswords := opts.WithRolePasswords && db.superuser
-		if dumpRolePasswords {
-			l.Infoln("dumping globals")
-		} else {
-			l.Infoln("dumping globals without role passwords")
+	databases, err = listDatabases(db, opts.WithTemplates, opts.ExcludeDbs, opts.Dbnames, opts.OwnedBy, opts.IncludeDbPattern, opts.ExcludeDbPattern)
+	if err != nil {
+		return err
+	}
+
+	// Connect to each database like pg_dump would do, so that a database
+	// that cannot be dumped does not fail the run
+	if opts.SkipUnavailable {
+		var skipped []string
+		databases, skipped = skipUnavailableDatabases(databases, func(dbname string) error {
+			c := conninfo.Set("dbname", dbname)
+			if o, found := opts.PerDbOpts[dbname]; found && o.Username != "" {
+				c = c.Set("user", o.Username)
+			}
+			return probeDatabase(c)
+		})
+		if len(skipped) > 0 {
+			l.Infoln("unavailable databases skipped:", strings.Join(skipped, ", "))
 		}
-		if err := dumpGlobals(opts.Directory, opts.TimeFormat, dumpRolePasswords, conninfo, producedFiles); err != nil {
-			return fmt.Errorf("pg_dumpall of globals failed: %w", err)
+	}
+	l.Verboseln("databases to dump:", databases)
+
+	paused := false
+	if opts.PauseReplication {
+		paused, err = pauseReplicationWithTimeout(db, time.Duration(opts.PauseTimeout)*time.Second, opts.PauseRetryInterval, opts.PauseTimeoutAction == "continue")
+		if err != nil {
+			return err
 		}
+	} else {
+		l.Verboseln("not pausing replication, as requested")
+	}
+
+	// Export a snapshot from each database before starting any pg_dump
+	// so that all dumps see the data as close as possible to the same
+	// point in time. A snapshot cannot be imported in another database,
+	// so each dump is consistent on its own, and the snapshots are only
+	// exported one right after the other. Each transaction stays open,
+	// holding a connection, until the dump of its database is done.
+	snapshots := make(map[string]string)
+	synced := make(map[string]*pgSnapshot)
+	exported := make([]io.Closer, 0)
+	closeExported := func() {
+		for dbname, s := range synced {
+			s.Close()
+			delete(synced, dbname)
+		}
+		for _, s := range exported {
+			s.Close()
+		}
+		exported = exported[:0]
+	}
+	defer closeExported()
+
+	if opts.SyncSnapshot {
+		if versions.PgDump < 90500 {
+			l.Warnln("provided pg_dump is older than 9.5, not using synchronized snapshots")
+		} else if opts.MaxParallelWorkers > 0 && len(databases) > opts.MaxParallelWorkers {
+			// The connections holding the snapshots are capped like
+			// the pg_dump processes
+			l.Warnf("cannot hold the snapshots of %d databases with --max-parallel-workers %d, not using synchronized snapshots", len(databases), opts.MaxParallelWorkers)
+		} else {
+			l.Infoln("exporting snapshots of databases")
+			for _, dbname := range databases {
+				s, err := exportSnapshot(conninfo.Set("dbname", dbname))
+				if err != nil {
+					var verr *pgVersionError
+					if errors.As(err, &verr) {
+						// Synchronizing only some of the
+						// dumps would be misleading
+						l.Warnln(err)
+						l.Warnln("not using synchronized snapshots")
+						closeExported()
+						clear(snapshots)
+						break
+					}
 
-		l.Infoln("dumping instance configuration")
-		var (
-			verr *pgVersionError
-			perr *pgPrivError
-		)
+					return fmt.Errorf("could not export snapshot of %s: %w", dbname, err)
+				}
 
-		if err := dumpSettings(opts.Directory, opts.TimeFormat, db, producedFiles); err != nil {
-			if errors.As(err, &verr) || errors.As(err, &perr) {
-				l.Warnln(err)
-			} else {
-				return fmt.Errorf("could not dump configuration parameters: %w", err)
+				l.Verbosef("using snapshot %s for database %s", s.id, dbname)
+				snapshots[dbname] = s.id
+				synced[dbname] = s
 			}
 		}
-
-		if err := dumpConfigFiles(opts.Directory, opts.TimeFormat, db, producedFiles); err != nil {
-			return fmt.Errorf("could not dump configuration files: %w", err)
-		}
 	}
 
-	databases, err := listDatabases(db, opts.WithTemplates, opts.ExcludeDbs, opts.Dbnames)
+	// Create the logical replication slots asked for, the snapshot each
+	// one exports replaces the one of --sync-snapshot, so that logical
+	// replication can start from the slot right after the data of the
+	// dump
+	slots, err := createLogicalSlots(databases, opts, db.version, versions.PgDump, conninfo)
+	for _, s := range slots {
+		exported = append(exported, s)
+	}
 	if err != nil {
 		return err
 	}
-	l.Verboseln("databases to dump:", databases)
-
-	if err := pauseReplicationWithTimeout(db, opts.PauseTimeout); err != nil {
-		return err
+	for dbname, s := range slots {
+		l.Infof("created logical replication slot %s in %s at %s, using its snapshot %s", s.name, dbname, s.lsn, s.id)
+		snapshots[dbname] = s.id
 	}
 
-	exitCode := 0
+	// Databases whose dump failed, the ones dumped but whose ACL,
+	// configuration or other files failed, and the ones not dumped after
+	// a failure with --stop-on-error
+	var failedDumps, partialDumps, skippedDumps []string
 	maxWorkers := opts.Jobs
 	numJobs := len(databases)
 	jobs := make(chan *dump, numJobs)
 	results := make(chan *dump, numJobs)
 
+	// With --stop-on-error, the first failure stops the dumps in progress
+	// and the ones waiting for a worker, the rest of the run goes on
+	dumpCtx, stopDumps := context.WithCancelCause(ctx)
+	defer stopDumps(nil)
+
 	// start workers - thanks gobyexample.com
 	l.Verbosef("launching %d workers", maxWorkers)
+	pool := newWorkerPool(opts.MaxParallelWorkers)
 	for w := 0; w < maxWorkers; w++ {
-		go dumper(w, jobs, results, producedFiles)
+		go dumper(dumpCtx, w, jobs, results, producedFiles)
 	}
 
 	defDbOpts := defaultDbOpts(opts)
@@ -368,6 +804,11 @@ func run() (retVal error) {
 		publicKey = opts.CipherPublicKey
 	}
 
+	// The change signal of the databases is saved after their dump, to
+	// be compared on the next run with --skip-unchanged
+	states := make(map[string]dbState)
+	canSkipUnchanged := opts.SkipUnchanged
+
 	// feed the database
 	for _, dbname := range databases {
 		o, found := opts.PerDbOpts[dbname]
@@ -380,12 +821,55 @@ func run() (retVal error) {
 			Options:          o,
 			Directory:        opts.Directory,
 			TimeFormat:       opts.TimeFormat,
+			RunWhen:          now,
 			ConnString:       conninfo,
 			CipherPassphrase: passphrase,
 			CipherPublicKey:  publicKey,
 			EncryptKeepSrc:   opts.EncryptKeepSrc,
 			ExitCode:         -1,
-			PgDumpVersion:    pgDumpVersion,
+			PgDumpVersion:    versions.PgDump,
+			Snapshot:         snapshots[dbname],
+			Mode:             opts.FileMode,
+			Timeout:          opts.DumpTimeout,
+			SessionOptions:   sessionTimeoutOptions(opts.DumpLockTimeout, opts.DumpStatementTimeout),
+			Retries:          opts.DumpRetries,
+			WriteMarker:      opts.WriteMarkers,
+			Workers:          pool,
+			LockDirectory:    opts.LockDirectory,
+			LockWait:         opts.LockWait,
+			HookEnv:          hookEnv,
+			ProgressInterval: opts.ProgressInterval,
+		}
+
+		// A database with a logical replication slot is always dumped,
+		// the slot starts after the data of this dump
+		if canSkipUnchanged && slots[dbname] == nil {
+			cur, err := dbChangeSignal(db, dbname)
+			if err != nil {
+				var verr *pgVersionError
+				if errors.As(err, &verr) {
+					canSkipUnchanged = false
+				}
+				l.Warnln(err)
+			} else {
+				states[dbname] = cur
+
+				prev, err := readDbState(dbStatePath(opts.Directory, dbname))
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					l.Warnf("could not read the state of %s from the previous run: %s", dbname, err)
+				}
+
+				if err == nil && cur.unchangedSince(prev, o.PurgeKeep, now.Add(o.PurgeInterval)) {
+					l.Infof("database %s is unchanged since %s, using the dump %s", dbname, prev.When.Format(opts.TimeFormat), prev.Path)
+					d.Linked = true
+					d.Path = prev.Path
+					d.When = prev.When
+					d.Size = prev.DumpSize
+					d.ExitCode = 0
+					results <- d
+					continue
+				}
+			}
 		}
 
 		l.Verbosef("sending dump job for database %s to worker pool", dbname)
@@ -394,6 +878,7 @@ func run() (retVal error) {
 
 	canDumpACL := true
 	canDumpConfig := true
+	canDumpExtensions := true
 
 	// When asked to only dump database, exclude ACL and config even if
 	// this can lead of missing info on restore when pg_dump is older than
@@ -401,6 +886,7 @@ func run() (retVal error) {
 	if opts.DumpOnly {
 		canDumpACL = false
 		canDumpConfig = false
+		canDumpExtensions = false
 	}
 
 	// collect the result of the jobs
@@ -412,8 +898,50 @@ func run() (retVal error) {
 		d := <-results
 		dbname := d.Database
 		l.Verboseln("received job result of", dbname)
+		done = append(done, d)
+
+		// pg_dump has imported the snapshot, release its connection
+		if s, ok := synced[dbname]; ok {
+			s.Close()
+			delete(synced, dbname)
+		}
+
 		if d.ExitCode > 0 {
-			exitCode = 1
+			if d.Skipped {
+				skippedDumps = append(skippedDumps, dbname)
+			} else {
+				failedDumps = append(failedDumps, dbname)
+			}
+
+			if opts.StopOnError && dumpCtx.Err() == nil {
+				l.Errorf("stopping the other dumps after the failure of %s", dbname)
+				stopDumps(fmt.Errorf("dump of %s failed and --stop-on-error is set", dbname))
+			}
+
+			if s, ok := slots[dbname]; ok && opts.LogicalSlotKeep {
+				l.Errorf("logical replication slot %s is kept but the dump of %s failed, drop it with pg_drop_replication_slot()", s.name, dbname)
+			}
+		}
+
+		// Do not query the catalog for a database that was not
+		// dumped because of an interruption
+		if ctx.Err() != nil {
+			continue
+		}
+
+		// The files of an unchanged database are the ones of the
+		// previous run
+		if d.Linked {
+			continue
+		}
+
+		if s, ok := states[dbname]; ok && d.ExitCode == 0 {
+			s.Path = d.Path
+			s.When = d.When
+			s.DumpSize = d.Size
+			if err := writeDbState(dbStatePath(opts.Directory, dbname), s, opts.FileMode); err != nil {
+				l.Warnf("could not save the state of %s: %s", dbname, err)
+			}
 		}
 
 		// Dump the ACL and Configuration of the
@@ -421,17 +949,20 @@ func run() (retVal error) {
 		// if it fails once it fails all the time.
 		if canDumpACL {
 			l.Verboseln("dumping create database query and ACL of", dbname)
-			force := false
+			// The plain format does not have the creation of
+			// the database, it would be restored without
+			// --create
+			force := opts.AlwaysDumpCreateDB
 			if d.Options.Format == 'p' {
 				force = true
 			}
 
-			b, err = dumpCreateDBAndACL(db, dbname, force)
+			b, err = dumpCreateDBAndACL(db, dbname, versions.PgDump, force)
 			var verr *pgVersionError
 			if err != nil {
 				if !errors.As(err, &verr) {
 					l.Errorln(err)
-					exitCode = 1
+					partialDumps = append(partialDumps, dbname)
 				} else {
 					l.Warnln(err)
 					canDumpACL = false
@@ -441,12 +972,12 @@ func run() (retVal error) {
 
 		if canDumpConfig {
 			l.Verboseln("dumping configuration of", dbname)
-			c, err = dumpDBConfig(db, dbname)
+			c, err = dumpDBConfig(db, dbname, versions.PgDump, opts.AlwaysDumpCreateDB)
 			if err != nil {
 				var verr *pgVersionError
 				if !errors.As(err, &verr) {
 					l.Errorln(err)
-					exitCode = 1
+					partialDumps = append(partialDumps, dbname)
 				} else {
 					l.Warnln(err)
 					canDumpConfig = false
@@ -454,20 +985,43 @@ func run() (retVal error) {
 			}
 		}
 
+		if s, ok := slots[dbname]; ok && d.ExitCode == 0 {
+			if err := writeSlotFile(d, s, producedFiles); err != nil {
+				l.Errorf("could not write the position of the logical replication slot of %s: %s", dbname, err)
+				partialDumps = append(partialDumps, dbname)
+			}
+		}
+
+		// The list of extensions is taken from the database itself,
+		// only when it was dumped
+		if canDumpExtensions && d.ExitCode == 0 {
+			l.Verboseln("listing extensions of", dbname)
+			if err := dumpExtensions(d, opts.MetadataQueryTimeout, producedFiles); err != nil {
+				var verr *pgVersionError
+				if !errors.As(err, &verr) {
+					l.Errorf("could not list extensions of %s: %s", dbname, err)
+					partialDumps = append(partialDumps, dbname)
+				} else {
+					l.Warnln(err)
+					canDumpExtensions = false
+				}
+			}
+		}
+
 		// Write ACL and configuration to an SQL file
 		if len(b) > 0 || len(c) > 0 {
 
-			aclpath := formatDumpPath(d.Directory, d.TimeFormat, "createdb.sql", dbname, d.When, 0)
+			aclpath := formatDumpPath(d.Directory, d.TimeFormat, "createdb.sql", dbname, d.pathTime(), 0)
 			if err := os.MkdirAll(filepath.Dir(aclpath), 0700); err != nil {
 				l.Errorln(err)
-				exitCode = 1
+				partialDumps = append(partialDumps, dbname)
 				continue
 			}
 
 			f, err := os.Create(aclpath)
 			if err != nil {
 				l.Errorln(err)
-				exitCode = 1
+				partialDumps = append(partialDumps, dbname)
 				continue
 			}
 
@@ -476,7 +1030,7 @@ func run() (retVal error) {
 
 			f.Close()
 
-			if err := os.Chmod(aclpath, 0600); err != nil {
+			if err := os.Chmod(aclpath, modeOr(d.Mode, 0600)); err != nil {
 				return fmt.Errorf("could not chmod to more secure permission for ACL %s: %s", dbname, err)
 			}
 
@@ -490,13 +1044,23 @@ func run() (retVal error) {
 		}
 	}
 
-	if err := resumeReplication(db); err != nil {
-		l.Errorln(err)
+	// All dumps are done, the snapshots are no longer needed
+	closeExported()
+
+	if paused {
+		if err := resumeReplication(db); err != nil {
+			l.Errorln(err)
+		}
 	}
 	db.Close()
 
-	if exitCode != 0 {
-		return fmt.Errorf("some operation failed")
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	if len(failedDumps) > 0 || len(partialDumps) > 0 {
+		slices.Sort(partialDumps)
+		return &dumpError{failed: failedDumps, partial: slices.Compact(partialDumps), skipped: skippedDumps, total: numJobs}
 	}
 
 	// Closing the input channel makes the postprocessing go routine stop,
@@ -512,34 +1076,48 @@ func run() (retVal error) {
 	// (globals and settings) like databases
 	l.Infoln("purging old dumps")
 
-	var repo Repo
-
-	switch opts.Upload {
-	case "s3":
-		repo, err = NewS3Repo(opts)
-		if err != nil {
-			return fmt.Errorf("failed to prepare upload to S3: %w", err)
-		}
-	case "b2":
-		repo, err = NewB2Repo(opts)
-		if err != nil {
-			return fmt.Errorf("failed to prepare upload to B2: %w", err)
-		}
-	case "sftp":
-		repo, err = NewSFTPRepo(opts)
+	// Remote dumps are purged on all the locations that can be reached,
+	// there is no need to connect to them otherwise
+	var repos []uploadRepo
+	if opts.PurgeRemote {
+		repos, err = newUploadRepos(opts)
 		if err != nil {
-			return fmt.Errorf("failed to prepare upload over SFTP: %w", err)
+			retVal = &postProcessError{err: fmt.Errorf("failed to prepare remote purge: %w", err)}
 		}
-	case "gcs":
-		repo, err = NewGCSRepo(opts)
-		if err != nil {
-			return fmt.Errorf("failed to prepare upload to GCS: %w", err)
+	}
+	defer func() {
+		for _, repo := range repos {
+			repo.Close()
 		}
-	case "azure":
-		repo, err = NewAzRepo(opts)
-		if err != nil {
-			return fmt.Errorf("failed to prepare upload to Azure: %w", err)
+	}()
+
+	others := make([]string, 0)
+	if !opts.DumpOnly {
+		others = append(others, "pg_globals", "pg_roles", "pg_settings", "hba_file", "ident_file", "pg_tablespaces")
+	}
+
+	// Combined checksum files are purged like a run of the instance
+	if opts.ChecksumMode == "combined" {
+		others = append(others, "checksums")
+	}
+
+	if opts.TimestampedSubdir {
+		for dirpath, o := range runDirsToPurge(opts, databases, others, defDbOpts) {
+			limit := now.Add(o.PurgeInterval)
+			if err := purgeRunDirs(dirpath, o.PurgeKeep, limit); err != nil {
+				retVal = &postProcessError{err: err}
+			}
+
+			if opts.PurgeRemote {
+				for _, repo := range repos {
+					if err := purgeRemoteRunDirs(repo, opts.UploadPrefix, opts.Directory, dirpath, o.PurgeKeep, limit); err != nil {
+						retVal = &postProcessError{err: fmt.Errorf("purge on %s failed: %w", repo.name, err)}
+					}
+				}
+			}
 		}
+
+		return
 	}
 
 	for _, dbname := range databases {
@@ -550,26 +1128,28 @@ func run() (retVal error) {
 		limit := now.Add(o.PurgeInterval)
 
 		if err := purgeDumps(opts.Directory, dbname, o.PurgeKeep, limit); err != nil {
-			retVal = err
+			retVal = &postProcessError{err: err}
 		}
 
-		if opts.PurgeRemote && repo != nil {
-			if err := purgeRemoteDumps(repo, opts.UploadPrefix, opts.Directory, dbname, o.PurgeKeep, limit); err != nil {
-				retVal = err
+		if opts.PurgeRemote {
+			for _, repo := range repos {
+				if err := purgeRemoteDumps(repo, opts.UploadPrefix, opts.Directory, dbname, o.PurgeKeep, limit); err != nil {
+					retVal = &postProcessError{err: fmt.Errorf("purge on %s failed: %w", repo.name, err)}
+				}
 			}
 		}
 	}
 
-	if !opts.DumpOnly {
-		for _, other := range []string{"pg_globals", "pg_settings", "hba_file", "ident_file"} {
-			limit := now.Add(defDbOpts.PurgeInterval)
-			if err := purgeDumps(opts.Directory, other, defDbOpts.PurgeKeep, limit); err != nil {
-				retVal = err
-			}
+	for _, other := range others {
+		limit := now.Add(defDbOpts.PurgeInterval)
+		if err := purgeDumps(opts.Directory, other, defDbOpts.PurgeKeep, limit); err != nil {
+			retVal = &postProcessError{err: err}
+		}
 
-			if opts.PurgeRemote && repo != nil {
+		if opts.PurgeRemote {
+			for _, repo := range repos {
 				if err := purgeRemoteDumps(repo, opts.UploadPrefix, opts.Directory, other, defDbOpts.PurgeKeep, limit); err != nil {
-					retVal = err
+					retVal = &postProcessError{err: fmt.Errorf("purge on %s failed: %w", repo.name, err)}
 				}
 			}
 		}
@@ -580,39 +1160,109 @@ func run() (retVal error) {
 
 func defaultDbOpts(opts options) *dbOpts {
 	dbo := dbOpts{
-		Format:        opts.Format,
-		Jobs:          opts.DirJobs,
-		CompressLevel: opts.CompressLevel,
-		SumAlgo:       opts.SumAlgo,
-		PurgeInterval: opts.PurgeInterval,
-		PurgeKeep:     opts.PurgeKeep,
-		PgDumpOpts:    opts.PgDumpOpts,
-		Username:      opts.Username,
+		Format:            opts.Format,
+		Jobs:              opts.DirJobs,
+		CompressLevel:     opts.CompressLevel,
+		CompressMethod:    opts.CompressMethod,
+		CompressLong:      opts.CompressLong,
+		SumAlgo:           opts.SumAlgo,
+		PurgeInterval:     opts.PurgeInterval,
+		PurgeKeep:         opts.PurgeKeep,
+		PgDumpOpts:        opts.PgDumpOpts,
+		PgOptions:         opts.PgOptions,
+		Sections:          opts.DumpSections,
+		SchemaOnly:        opts.SchemaOnly,
+		DataOnly:          opts.DataOnly,
+		NoOwner:           opts.NoOwner,
+		NoPrivileges:      opts.NoPrivileges,
+		NoComments:        opts.NoComments,
+		NoSync:            opts.NoSync,
+		Clean:             opts.Clean,
+		IfExists:          opts.IfExists,
+		Username:          opts.Username,
+		PreDumpHook:       opts.PreDumpHook,
+		PostDumpHook:      opts.PostDumpHook,
+		Schemas:           opts.Schemas,
+		ExcludedSchemas:   opts.ExcludedSchemas,
+		Tables:            opts.Tables,
+		ExcludedTables:    opts.ExcludedTables,
+		ExcludedTableData: opts.ExcludedTableData,
+		LogicalSlot:       opts.LogicalSlot,
 	}
 	return &dbo
 }
 
-func (d *dump) dump(fc chan<- sumFileJob) error {
+// dump runs pg_dump for the database. When pg_dump fails with an error that
+// looks transient, the dump is tried again up to d.Retries times, waiting a
+// little longer after each attempt.
+func (d *dump) dump(ctx context.Context, fc chan<- sumFileJob) error {
+	for attempt := 1; ; attempt++ {
+		err := d.dumpOnce(ctx, fc)
+
+		var terr *transientDumpError
+		if err == nil || attempt > d.Retries || !errors.As(err, &terr) {
+			return err
+		}
+
+		// The incomplete dump was removed by dumpOnce, the next attempt
+		// has a new date, thus a new name
+		delay := time.Duration(attempt) * dumpRetryDelay
+		l.Warnf("dump of %s failed, retrying in %v (%d/%d): %s", d.Database, delay, attempt, d.Retries, err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// pathTime gives the time in the paths of the files of the dump. With
+// timestamped subdirectories, it is the start of the run so that all the
+// files of the run are in the same subdirectory, otherwise it is the start
+// of the dump.
+func (d *dump) pathTime() time.Time {
+	if runSubdirs && !d.RunWhen.IsZero() {
+		return d.RunWhen
+	}
+
+	return d.When
+}
+
+func (d *dump) dumpOnce(ctx context.Context, fc chan<- sumFileJob) error {
 	dbname := d.Database
 	d.ExitCode = 1
 
+	// Dumps waiting for a worker are skipped when the run is interrupted
+	// or the dumps are stopped
+	if ctx.Err() != nil {
+		d.Skipped = true
+		return fmt.Errorf("not dumped: %w", context.Cause(ctx))
+	}
+
 	l.Infoln("dumping database", dbname)
 
 	// Try to lock a file named after to database we are going to
 	// dump to prevent stacking pg_back processes if pg_dump last
 	// longer than a schedule of pg_back. If the lock cannot be
-	// acquired, skip the dump and exit with an error.
-	lock := formatDumpPath(d.Directory, d.TimeFormat, "lock", dbname, time.Time{}, 0)
-	flock, locked, err := lockPath(lock)
+	// acquired, possibly after waiting for it, skip the dump and exit
+	// with an error.
+	lockDir := d.Directory
+	if d.LockDirectory != "" {
+		lockDir = d.LockDirectory
+	}
+	lock := formatDumpPath(lockDir, d.TimeFormat, "lock", dbname, time.Time{}, 0)
+	flock, err := lockPathWait(lock, d.LockWait)
 	if err != nil {
-		return fmt.Errorf("unable to lock %s: %s", lock, err)
-	}
-
-	if !locked {
-		return fmt.Errorf("could not acquire lock for %s", dbname)
+		return fmt.Errorf("could not acquire lock for %s: %s", dbname, err)
 	}
 
-	d.When = time.Now()
+	start := time.Now()
+	d.When = start.In(timestampLocation)
+	defer func() {
+		d.End = time.Now()
+		d.Duration = d.End.Sub(start)
+	}()
 
 	var fileEnd string
 	switch d.Options.Format {
@@ -630,20 +1280,67 @@ func (d *dump) dump(fc chan<- sumFileJob) error {
 		fileEnd = "d"
 	}
 
-	file := formatDumpPath(d.Directory, d.TimeFormat, fileEnd, dbname, d.When, d.Options.CompressLevel)
-	formatOpt := fmt.Sprintf("-F%c", d.Options.Format)
-
-	command := execPath("pg_dump")
-	args := []string{formatOpt, "-f", file, "-w"}
+	file := formatDumpPath(d.Directory, d.TimeFormat, fileEnd, dbname, d.pathTime(), d.Options.CompressLevel)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		if err := unlockPath(flock); err != nil {
+			l.Errorf("could not release lock for %s: %s", dbname, err)
+			flock.Close()
+		}
+		return fmt.Errorf("could not create directory for %s: %s", file, err)
+	}
 
+	jobs := 1
 	if fileEnd == "d" && d.Options.Jobs > 1 {
 		if d.PgDumpVersion < 90300 {
 			l.Warnln("provided pg_dump version does not support parallel jobs, ignoring option")
 		} else {
-			args = append(args, "-j", fmt.Sprintf("%d", d.Options.Jobs))
+			jobs = d.Options.Jobs
+		}
+	}
+
+	// Wait for a free worker when the total number of pg_dump processes
+	// is limited, a directory format dump gets fewer parallel jobs when
+	// others are running
+	workers, err := d.Workers.acquire(ctx, jobs)
+	if err != nil {
+		if err := unlockPath(flock); err != nil {
+			l.Errorf("could not release lock for %s: %s", dbname, err)
+			flock.Close()
+		}
+		return fmt.Errorf("not dumped: %w", err)
+	}
+	if workers < jobs {
+		l.Infof("dumping %s with %d parallel jobs instead of %d, other dumps use the remaining workers", dbname, workers, jobs)
+	}
+
+	// The name of the database and the path of the dump are given to
+	// the hooks in the environment, along with the information on the run
+	hookEnv := append(d.HookEnv[:len(d.HookEnv):len(d.HookEnv)], "PGBK_DBNAME="+dbname, "PGBK_DUMP_PATH="+file)
+	if d.Options.PreDumpHook != "" {
+		l.Infoln("running pre-dump command for", dbname+":", d.Options.PreDumpHook)
+		if err := hookCommand(d.Options.PreDumpHook, "pre-dump:", hookEnv...); err != nil {
+			d.Workers.release(workers)
+			if err := unlockPath(flock); err != nil {
+				l.Errorf("could not release lock for %s: %s", dbname, err)
+				flock.Close()
+			}
+			return fmt.Errorf("pre-dump hook command failed: %s", err)
 		}
 	}
 
+	formatOpt := fmt.Sprintf("-F%c", d.Options.Format)
+
+	// pg_dump writes to a temporary path renamed once the dump is
+	// complete, so that only complete dumps have the final name
+	tmpFile := file + ".tmp"
+
+	command := execPath("pg_dump")
+	args := []string{formatOpt, "-f", tmpFile, "-w"}
+
+	if workers > 1 {
+		args = append(args, "-j", fmt.Sprintf("%d", workers))
+	}
+
 	// Included and excluded schemas and table
 	for _, obj := range d.Options.Schemas {
 		args = append(args, "-n", obj)
@@ -657,6 +1354,15 @@ func (d *dump) dump(fc chan<- sumFileJob) error {
 	for _, obj := range d.Options.ExcludedTables {
 		args = append(args, "-T", obj)
 	}
+	if len(d.Options.ExcludedTableData) > 0 {
+		if d.PgDumpVersion < 90200 {
+			l.Warnln("provided pg_dump version does not support --exclude-table-data, ignoring option")
+		} else {
+			for _, obj := range d.Options.ExcludedTableData {
+				args = append(args, "--exclude-table-data="+obj)
+			}
+		}
+	}
 
 	switch d.Options.WithBlobs {
 	case 1: // with blobs
@@ -669,15 +1375,80 @@ func (d *dump) dump(fc chan<- sumFileJob) error {
 		}
 	}
 
-	// Add compression level option only if not dumping in the tar format
-	if d.Options.CompressLevel >= 0 {
-		if d.Options.Format != 't' {
-			args = append(args, "-Z", fmt.Sprintf("%d", d.Options.CompressLevel))
+	if d.Options.SchemaOnly {
+		args = append(args, "-s")
+	}
+	if d.Options.DataOnly {
+		args = append(args, "-a")
+	}
+
+	if d.Options.NoOwner {
+		args = append(args, "-O")
+	}
+	if d.Options.NoPrivileges {
+		args = append(args, "-x")
+	}
+	if d.Options.NoComments {
+		if d.PgDumpVersion < 110000 {
+			l.Warnln("provided pg_dump version does not support --no-comments, ignoring option")
+		} else {
+			args = append(args, "--no-comments")
+		}
+	}
+	if d.Options.NoSync {
+		if d.PgDumpVersion < 120000 {
+			l.Warnln("provided pg_dump version does not support --no-sync, ignoring option")
+		} else {
+			args = append(args, "--no-sync")
+		}
+	}
+
+	// pg_dump ignores --clean with the other formats, pg_restore has its
+	// own option for them
+	if d.Options.Clean || d.Options.IfExists {
+		if d.Options.Format != 'p' {
+			l.Warnf("--clean and --if-exists only apply to the plain format, ignoring them for %s, use pg_restore --clean to restore", dbname)
+		} else if d.Options.Clean {
+			args = append(args, "-c")
+			if d.Options.IfExists {
+				if d.PgDumpVersion < 90400 {
+					l.Warnln("provided pg_dump version does not support --if-exists, ignoring option")
+				} else {
+					args = append(args, "--if-exists")
+				}
+			}
+		} else {
+			l.Warnf("--if-exists requires --clean, ignoring it for %s", dbname)
+		}
+	}
+
+	if len(d.Options.Sections) > 0 {
+		if d.PgDumpVersion < 90200 {
+			l.Warnln("provided pg_dump version does not support sections, ignoring option")
+		} else {
+			for _, s := range d.Options.Sections {
+				args = append(args, "--section="+s)
+			}
+		}
+	}
+
+	// Add compression option only if not dumping in the tar format, which
+	// is compressed by an external command during post processing
+	compressTar := false
+	if compressArgs := pgDumpCompressArgs(d.Options.CompressMethod, d.Options.CompressLevel, d.Options.CompressLong); len(compressArgs) > 0 {
+		if d.Options.Format == 't' {
+			compressTar = d.Options.CompressLevel != 0
+		} else if compressArgs[0] != "-Z" && d.PgDumpVersion < 160000 {
+			l.Warnf("provided pg_dump version does not support %s compression, ignoring option\n", d.Options.CompressMethod)
 		} else {
-			l.Warnln("compression level is not supported by the target format")
+			args = append(args, compressArgs...)
 		}
 	}
 
+	if d.Snapshot != "" {
+		args = append(args, "--snapshot="+d.Snapshot)
+	}
+
 	if len(d.Options.PgDumpOpts) > 0 {
 		args = append(args, d.Options.PgDumpOpts...)
 	}
@@ -689,37 +1460,118 @@ func (d *dump) dump(fc chan<- sumFileJob) error {
 	if d.Options.Username != "" {
 		conninfo = conninfo.Set("user", d.Options.Username)
 	}
+	if d.SessionOptions != "" {
+		conninfo = conninfo.AddOptions(d.SessionOptions)
+	}
+	if d.Options.PgOptions != "" {
+		conninfo = conninfo.AddOptions(d.Options.PgOptions)
+	}
 
 	var env []string
 
 	if d.PgDumpVersion < 90300 {
 		args = append(args, dbname)
 		env = os.Environ()
-		env = append(env, d.ConnString.MakeEnv()...)
+		env = append(env, conninfo.MakeEnv()...)
 	} else {
 		args = append(args, "-d", conninfo.String())
 	}
 
-	pgDumpCmd := exec.Command(command, args...)
+	dumpCtx := ctx
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		dumpCtx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	pgDumpCmd := exec.CommandContext(dumpCtx, command, args...)
 	pgDumpCmd.Env = env
+
+	// On timeout or interruption, let pg_dump cancel its queries and
+	// exit by itself, it is killed if it is still there after a while
+	pgDumpCmd.Cancel = func() error {
+		if ctx.Err() != nil {
+			l.Warnf("stopping pg_dump of %s", dbname)
+		} else {
+			l.Warnf("dump of %s lasts more than %v, stopping pg_dump", dbname, d.Timeout)
+		}
+		if err := pgDumpCmd.Process.Signal(os.Interrupt); err != nil {
+			return pgDumpCmd.Process.Kill()
+		}
+		return nil
+	}
+	pgDumpCmd.WaitDelay = 30 * time.Second
+
+	// External tools watching the backup directory can rely on the marker
+	// to know that the dump is being written
+	marker := ""
+	if d.WriteMarker {
+		marker = file + markerSuffix
+		if err := os.WriteFile(marker, nil, 0600); err != nil {
+			l.Warnf("could not create marker %s: %s", marker, err)
+			marker = ""
+		}
+	}
+
 	l.Verboseln("running:", pgDumpCmd)
+	stopProgress := startProgress(d.ProgressInterval, "dump of %s in progress", dbname)
 	stdoutStderr, err := pgDumpCmd.CombinedOutput()
+	stopProgress()
+	d.Workers.release(workers)
+
+	if err == nil {
+		if err = os.Rename(tmpFile, file); err != nil {
+			l.Errorf("could not rename %s to %s: %s", tmpFile, file, err)
+		}
+	}
+
+	if marker != "" {
+		if err := os.Remove(marker); err != nil {
+			l.Warnf("could not remove marker %s: %s", marker, err)
+		}
+	}
+
+	// The post-dump hook runs even when pg_dump fails, so that it can
+	// undo what the pre-dump hook did
+	var hookErr error
+	if d.Options.PostDumpHook != "" {
+		l.Infoln("running post-dump command for", dbname+":", d.Options.PostDumpHook)
+		if hookErr = hookCommand(d.Options.PostDumpHook, "post-dump:", hookEnv...); hookErr != nil {
+			l.Errorln("post-dump hook command failed for", dbname+":", hookErr)
+		}
+	}
+
 	if err != nil {
 		for _, line := range strings.Split(string(stdoutStderr), "\n") {
 			if line != "" {
-				l.Errorf("[%s] %s\n", dbname, line)
+				l.ForDatabase(dbname).Errorf("%s\n", line)
 			}
 		}
 		if err := unlockPath(flock); err != nil {
 			l.Errorf("could not release lock for %s: %s", dbname, err)
 			flock.Close()
 		}
+
+		// Do not leave an incomplete dump behind
+		if err := os.RemoveAll(tmpFile); err != nil {
+			l.Errorf("could not remove incomplete dump %s: %s", tmpFile, err)
+		}
+
+		if dumpCtx.Err() != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("pg_dump of %s stopped: %w", dbname, context.Cause(ctx))
+			}
+			return fmt.Errorf("pg_dump of %s did not finish within %v", dbname, d.Timeout)
+		}
+		if isTransientDumpFailure(stdoutStderr) {
+			return &transientDumpError{err: err}
+		}
 		return err
 	}
 	if len(stdoutStderr) > 0 {
 		for _, line := range strings.Split(string(stdoutStderr), "\n") {
 			if line != "" {
-				l.Infof("[%s] %s\n", dbname, line)
+				l.ForDatabase(dbname).Infof("%s\n", line)
 			}
 		}
 	}
@@ -729,36 +1581,112 @@ func (d *dump) dump(fc chan<- sumFileJob) error {
 		return fmt.Errorf("could not release lock for %s: %s", dbname, err)
 	}
 
+	// Get the size before post processing may encrypt or archive the
+	// dump
+	size, err := pathSize(file)
+	if err != nil {
+		l.Warnf("could not get size of %s: %s", file, err)
+	}
+	d.Size = size
+
 	// Send the info on the file for post processing
 	if fc != nil {
-		fc <- sumFileJob{
+		j := sumFileJob{
 			Path:    file,
 			SumAlgo: d.Options.SumAlgo,
+			Dump:    d,
 		}
+		if compressTar {
+			j.CompressMethod = d.Options.CompressMethod
+			j.CompressLevel = d.Options.CompressLevel
+			j.CompressLong = d.Options.CompressLong
+		}
+		fc <- j
 	}
 
 	d.Path = file
 	d.ExitCode = 0
 
-	var mode os.FileMode = 0600
+	mode := modeOr(d.Mode, 0600)
 	if d.Options.Format == 'd' {
 		// The hardening of permissions only apply to the top level
 		// directory, this won't make the contents executable
-		mode = 0700
+		mode = dirMode(mode)
 	}
 
 	if err := os.Chmod(file, mode); err != nil {
 		return fmt.Errorf("could not chmod to more secure permission for %s: %s", dbname, err)
 	}
 
+	// The dump is complete but the failure of the hook must be seen in
+	// the exit status
+	if hookErr != nil {
+		d.ExitCode = 1
+		return fmt.Errorf("post-dump hook command failed: %s", hookErr)
+	}
+
 	return nil
 }
 
-func dumper(id int, jobs <-chan *dump, results chan<- *dump, fc chan<- sumFileJob) {
+// markerSuffix is appended to the path of a dump to name the marker file
+// that exists while pg_dump runs
+const markerSuffix = ".writing"
+
+// dumpRetryDelay is the base delay before trying a failed dump again, it is
+// multiplied by the number of the attempt
+var dumpRetryDelay = 10 * time.Second
+
+// transientDumpError is returned by dumpOnce when pg_dump failed with an
+// error that may not happen again
+type transientDumpError struct {
+	err error
+}
+
+func (e *transientDumpError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientDumpError) Unwrap() error {
+	return e.err
+}
+
+// transientDumpMessages are parts of the error messages of pg_dump and libpq
+// showing a failure that may be solved by trying again: lost or refused
+// connections, lock timeouts, deadlocks and serialization failures
+var transientDumpMessages = []string{
+	"could not connect to server",
+	"server closed the connection unexpectedly",
+	"terminating connection",
+	"connection refused",
+	"timeout expired",
+	"lock timeout",
+	"could not obtain lock",
+	"deadlock detected",
+	"could not serialize access",
+	"the database system is starting up",
+	"the database system is shutting down",
+	"too many clients",
+}
+
+// isTransientDumpFailure tells if the output of a failed pg_dump shows an
+// error that may not happen again
+func isTransientDumpFailure(output []byte) bool {
+	out := strings.ToLower(string(output))
+	for _, m := range transientDumpMessages {
+		if strings.Contains(out, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func dumper(ctx context.Context, id int, jobs <-chan *dump, results chan<- *dump, fc chan<- sumFileJob) {
 	for j := range jobs {
 
-		if err := j.dump(fc); err != nil {
+		if err := j.dump(ctx, fc); err != nil {
 			l.Errorln("dump of", j.Database, "failed:", err)
+			j.Err = err
 			results <- j
 		} else {
 			l.Infoln("dump of", j.Database, "to", j.Path, "done")
@@ -769,16 +1697,33 @@ func dumper(id int, jobs <-chan *dump, results chan<- *dump, fc chan<- sumFileJo
 
 func ensureCipherParamsPresent(opts *options) error {
 	// Nothing needs to be done if we are not encrypting or decrypting
-	if !opts.Encrypt && !opts.Decrypt {
+	if !opts.Encrypt && !opts.Decrypt && !opts.Rekey {
 		return nil
 	}
 
+	// Rekeying encrypts with new parameters, the current ones decrypt
+	if opts.Rekey && len(opts.NewCipherPublicKey) == 0 && len(opts.NewCipherPassphrase) == 0 {
+		opts.NewCipherPassphrase = os.Getenv("PGBK_NEW_CIPHER_PASS")
+
+		if len(opts.NewCipherPassphrase) == 0 {
+			return fmt.Errorf("cannot use an empty passphrase for encryption")
+		}
+	}
+
 	// If we are encrypting or decrypting, make sure we either have a public/private key or a passphrase
 	needEncryptParams := opts.Encrypt && len(opts.CipherPublicKey) == 0 && len(opts.CipherPassphrase) == 0
-	needDecryptParams := opts.Decrypt && len(opts.CipherPrivateKey) == 0 && len(opts.CipherPassphrase) == 0
+	needDecryptParams := (opts.Decrypt || opts.Rekey) && len(opts.CipherPrivateKey) == 0 && len(opts.CipherPassphrase) == 0
 
-	if needEncryptParams || needDecryptParams { // Fallback on the environment
-		opts.CipherPassphrase = os.Getenv("PGBK_CIPHER_PASS")
+	if needEncryptParams || needDecryptParams {
+		if opts.CipherPassFile != "" {
+			passphrase, err := readSecretFile(opts.CipherPassFile)
+			if err != nil {
+				return err
+			}
+			opts.CipherPassphrase = passphrase
+		} else { // Fallback on the environment
+			opts.CipherPassphrase = os.Getenv("PGBK_CIPHER_PASS")
+		}
 
 		if len(opts.CipherPassphrase) == 0 {
 			return fmt.Errorf("cannot use an empty passphrase for encryption")
@@ -803,9 +1748,30 @@ func relPath(basedir, path string) string {
 	return target
 }
 
+// setToolPaths configures where execPath finds the PostgreSQL tools
+func setToolPaths(opts options) {
+	if opts.BinDirectory != "" {
+		binDir = opts.BinDirectory
+	}
+
+	binNames = map[string]string{
+		"pg_dump":    opts.PgDumpBinary,
+		"pg_dumpall": opts.PgDumpallBinary,
+		"pg_restore": opts.PgRestoreBinary,
+	}
+}
+
+// execPath gives the executable of a tool. A custom name is searched in the
+// binary directory, unless it is a path, while the default name gets the
+// .exe suffix on Windows.
 func execPath(prog string) string {
 	binFile := prog
-	if runtime.GOOS == "windows" {
+	if name := binNames[prog]; name != "" {
+		if strings.ContainsRune(name, os.PathSeparator) || strings.ContainsRune(name, '/') {
+			return name
+		}
+		binFile = name
+	} else if runtime.GOOS == "windows" {
 		binFile = fmt.Sprintf("%s.exe", prog)
 	}
 
@@ -836,6 +1802,37 @@ func cleanDBName(dbname string) string {
 	return dbname
 }
 
+// pgDumpCompressArgs returns the options of pg_dump for the compression
+// method and level. gzip uses -Z to stay compatible with older versions of
+// pg_dump, other methods use the --compress=method:detail form of pg_dump 16.
+func pgDumpCompressArgs(method string, level int, long bool) []string {
+	if level == 0 {
+		return []string{"-Z", "0"}
+	}
+
+	if method == "" || method == "gzip" {
+		if level < 0 {
+			return nil
+		}
+		return []string{"-Z", fmt.Sprintf("%d", level)}
+	}
+
+	detail := make([]string, 0, 2)
+	if level > 0 {
+		detail = append(detail, fmt.Sprintf("level=%d", level))
+	}
+	if long && method == "zstd" {
+		detail = append(detail, "long")
+	}
+
+	spec := method
+	if len(detail) > 0 {
+		spec += ":" + strings.Join(detail, ",")
+	}
+
+	return []string{"--compress=" + spec}
+}
+
 func formatDumpPath(dir string, timeFormat string, suffix string, dbname string, when time.Time, compressLevel int) string {
 	var f, s, d string
 
@@ -852,6 +1849,30 @@ func formatDumpPath(dir string, timeFormat string, suffix string, dbname string,
 		s = "dump"
 	}
 
+	if (suffix == "sql" || suffix == "out") && compressLevel > 0 {
+		s = s + ".gz"
+	}
+
+	// Timestamped subdirectories and the filename template only apply to
+	// files of a run, lock files stay next to the dumps
+	if runSubdirs && !when.IsZero() {
+		return filepath.Join(d, when.Format(timeFormat), fmt.Sprintf("%s.%s", dbname, s))
+	}
+
+	if nameTmpl != nil && !when.IsZero() {
+		f, err := nameTmpl.execute(nameTemplateData{
+			DBName:    dbname,
+			Time:      when,
+			Timestamp: when.Format(timeFormat),
+			Suffix:    s,
+		})
+		if err == nil {
+			return filepath.Join(d, f)
+		}
+
+		l.Warnf("could not use filename template for %s: %s", dbname, err)
+	}
+
 	// Output is "dir(formatted)/dbname_date.suffix" when the
 	// input time is not zero, otherwise do not include the date
 	// and time. Reference time for time.Format(): "Mon Jan 2
@@ -862,11 +1883,37 @@ func formatDumpPath(dir string, timeFormat string, suffix string, dbname string,
 		f = fmt.Sprintf("%s_%s.%s", dbname, when.Format(timeFormat), s)
 	}
 
-	if suffix == "sql" && compressLevel > 0 {
-		f = f + ".gz"
+	return filepath.Join(d, f)
+}
+
+// toolVersions are the numeric versions of the PostgreSQL tools used by a
+// run, in the format of server_version_num
+type toolVersions struct {
+	PgDump    int
+	PgDumpall int
+}
+
+// getToolVersions runs the tools once to get their versions, to avoid running
+// them again each time a feature depends on their version
+func getToolVersions() toolVersions {
+	return toolVersions{
+		PgDump:    pgToolVersion("pg_dump"),
+		PgDumpall: pgToolVersion("pg_dumpall"),
+	}
+}
+
+// formatPgVersion formats a numeric version like server_version_num for
+// display, e.g. 90624 gives 9.6.24 and 160004 gives 16.4
+func formatPgVersion(numver int) string {
+	if numver == 0 {
+		return "unknown"
 	}
 
-	return filepath.Join(d, f)
+	if numver >= 100000 {
+		return fmt.Sprintf("%d.%d", numver/10000, numver%10000)
+	}
+
+	return fmt.Sprintf("%d.%d.%d", numver/10000, numver/100%100, numver%100)
 }
 
 func pgToolVersion(tool string) int {
@@ -898,9 +1945,20 @@ func pgToolVersion(tool string) int {
 	return numver
 }
 
-func dumpGlobals(dir string, timeFormat string, withRolePasswords bool, conninfo *ConnInfo, fc chan<- sumFileJob) error {
+// dumpallOptions gives the option of pg_dumpall producing each file of the
+// globals, they are split into roles and tablespaces with --split-globals
+var dumpallOptions = map[string]string{
+	"pg_globals":     "-g",
+	"pg_roles":       "--roles-only",
+	"pg_tablespaces": "--tablespaces-only",
+}
+
+// dumpGlobals runs pg_dumpall to produce the file of the globals called name,
+// pg_globals for all the globals, or pg_roles or pg_tablespaces when they are
+// split
+func dumpGlobals(name string, dir string, timeFormat string, when time.Time, compressLevel int, withRolePasswords bool, conninfo *ConnInfo, pgDumpallVersion int, mode os.FileMode, fc chan<- sumFileJob) error {
 	command := execPath("pg_dumpall")
-	args := []string{"-g", "-w"}
+	args := []string{dumpallOptions[name], "-w"}
 
 	// pg_dumpall only connects to another database if it is given
 	// with the -l option
@@ -913,7 +1971,6 @@ func dumpGlobals(dir string, timeFormat string, withRolePasswords bool, conninfo
 	// information
 	var env []string
 
-	pgDumpallVersion := pgToolVersion("pg_dumpall")
 	if pgDumpallVersion < 90300 {
 		env = os.Environ()
 		env = append(env, conninfo.MakeEnv()...)
@@ -922,7 +1979,7 @@ func dumpGlobals(dir string, timeFormat string, withRolePasswords bool, conninfo
 	}
 
 	// The --no-role-passwords option was added to pg_dumpall from 10
-	if !withRolePasswords {
+	if !withRolePasswords && name != "pg_tablespaces" {
 		if pgDumpallVersion < 100000 {
 			return fmt.Errorf("pg_dumpall does not support --no-role-passwords, use pg_dumpall >= 10")
 		}
@@ -930,17 +1987,40 @@ func dumpGlobals(dir string, timeFormat string, withRolePasswords bool, conninfo
 		args = append(args, "--no-role-passwords")
 	}
 
-	file := formatDumpPath(dir, timeFormat, "sql", "pg_globals", time.Now(), 0)
-	args = append(args, "-f", file)
-
+	file := formatDumpPath(dir, timeFormat, "sql", name, when, compressLevel)
 	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
 		return err
 	}
 
-	pgDumpallCmd := exec.Command(command, args...)
-	pgDumpallCmd.Env = env
-	l.Verboseln("running:", pgDumpallCmd)
-	stdoutStderr, err := pgDumpallCmd.CombinedOutput()
+	// pg_dumpall cannot compress its output, when asked to, we read its
+	// standard output and compress it
+	var (
+		stdoutStderr []byte
+		err          error
+	)
+
+	if strings.HasSuffix(file, ".gz") {
+		var stderr bytes.Buffer
+
+		pgDumpallCmd := exec.Command(command, args...)
+		pgDumpallCmd.Env = env
+		pgDumpallCmd.Stderr = &stderr
+		l.Verboseln("running:", pgDumpallCmd)
+
+		err = writeInstanceFile(file, mode, compressLevel, func(w io.Writer) error {
+			pgDumpallCmd.Stdout = w
+			return pgDumpallCmd.Run()
+		})
+		stdoutStderr = stderr.Bytes()
+	} else {
+		args = append(args, "-f", file)
+
+		pgDumpallCmd := exec.Command(command, args...)
+		pgDumpallCmd.Env = env
+		l.Verboseln("running:", pgDumpallCmd)
+		stdoutStderr, err = pgDumpallCmd.CombinedOutput()
+	}
+
 	if err != nil {
 		for _, line := range strings.Split(string(stdoutStderr), "\n") {
 			if line != "" {
@@ -957,8 +2037,8 @@ func dumpGlobals(dir string, timeFormat string, withRolePasswords bool, conninfo
 		}
 	}
 
-	if err := os.Chmod(file, 0600); err != nil {
-		return fmt.Errorf("could not chmod to more secure permission for pg_globals: %s", err)
+	if err := os.Chmod(file, modeOr(mode, 0600)); err != nil {
+		return fmt.Errorf("could not chmod to more secure permission for %s: %s", name, err)
 	}
 
 	if fc != nil {
@@ -970,9 +2050,9 @@ func dumpGlobals(dir string, timeFormat string, withRolePasswords bool, conninfo
 	return nil
 }
 
-func dumpSettings(dir string, timeFormat string, db *pg, fc chan<- sumFileJob) error {
+func dumpSettings(dir string, timeFormat string, when time.Time, compressLevel int, db *pg, mode os.FileMode, fc chan<- sumFileJob) error {
 
-	file := formatDumpPath(dir, timeFormat, "out", "pg_settings", time.Now(), 0)
+	file := formatDumpPath(dir, timeFormat, "out", "pg_settings", when, compressLevel)
 
 	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
 		return err
@@ -986,7 +2066,7 @@ func dumpSettings(dir string, timeFormat string, db *pg, fc chan<- sumFileJob) e
 	// Use a Buffer to avoid creating an empty file
 	if len(s) > 0 {
 		l.Verboseln("writing settings to:", file)
-		if err := os.WriteFile(file, []byte(s), 0600); err != nil {
+		if err := writeInstanceFile(file, mode, compressLevel, writeString(s)); err != nil {
 			return err
 		}
 
@@ -1000,9 +2080,9 @@ func dumpSettings(dir string, timeFormat string, db *pg, fc chan<- sumFileJob) e
 	return nil
 }
 
-func dumpConfigFiles(dir string, timeFormat string, db *pg, fc chan<- sumFileJob) error {
+func dumpConfigFiles(dir string, timeFormat string, when time.Time, compressLevel int, db *pg, mode os.FileMode, fc chan<- sumFileJob) error {
 	for _, param := range []string{"hba_file", "ident_file"} {
-		file := formatDumpPath(dir, timeFormat, "out", param, time.Now(), 0)
+		file := formatDumpPath(dir, timeFormat, "out", param, when, compressLevel)
 
 		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
 			return err
@@ -1016,7 +2096,7 @@ func dumpConfigFiles(dir string, timeFormat string, db *pg, fc chan<- sumFileJob
 		// Use a Buffer to avoid creating an empty file
 		if len(s) > 0 {
 			l.Verbosef("writing contents of '%s' to: %s", param, file)
-			if err := os.WriteFile(file, []byte(s), 0600); err != nil {
+			if err := writeInstanceFile(file, mode, compressLevel, writeString(s)); err != nil {
 				return err
 			}
 
@@ -1029,67 +2109,755 @@ func dumpConfigFiles(dir string, timeFormat string, db *pg, fc chan<- sumFileJob
 			}
 		}
 	}
-	return nil
+	return nil
+}
+
+// writeInstanceFile creates file with the given mode and fills it with the
+// write function. The contents are compressed with gzip when the name of the
+// file ends with .gz, as chosen by formatDumpPath from the compression level.
+func writeInstanceFile(file string, mode os.FileMode, compressLevel int, write func(io.Writer) error) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, modeOr(mode, 0600))
+	if err != nil {
+		return err
+	}
+
+	// The umask may have removed permissions, and the file may already
+	// exist
+	if mode != 0 {
+		if err := f.Chmod(mode); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if !strings.HasSuffix(file, ".gz") {
+		if err := write(f); err != nil {
+			f.Close()
+			return err
+		}
+
+		return f.Close()
+	}
+
+	// Instance files are always compressed with gzip, the level may come
+	// from a compression method accepting higher levels
+	if compressLevel > gzip.BestCompression {
+		compressLevel = gzip.BestCompression
+	}
+
+	gz, err := gzip.NewWriterLevel(f, compressLevel)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := write(gz); err != nil {
+		gz.Close()
+		f.Close()
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// writeString returns a write function for writeInstanceFile that outputs s
+func writeString(s string) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.WriteString(w, s)
+		return err
+	}
+}
+
+// createLogicalSlots creates a logical replication slot in each database
+// configured with one, exporting the snapshot to give to pg_dump. The slots
+// created are returned even on error, so that they can be closed.
+func createLogicalSlots(databases []string, opts options, serverVersion int, pgDumpVersion int, conninfo *ConnInfo) (map[string]*pgSlotSnapshot, error) {
+	slots := make(map[string]*pgSlotSnapshot)
+
+	names := make(map[string]string)
+	for _, dbname := range databases {
+		o, found := opts.PerDbOpts[dbname]
+		if !found {
+			o = defaultDbOpts(opts)
+		}
+
+		if o.LogicalSlot == "" {
+			continue
+		}
+
+		// Slot names are unique in the cluster
+		if other, ok := names[o.LogicalSlot]; ok {
+			return slots, fmt.Errorf("logical replication slot %s is configured for both %s and %s", o.LogicalSlot, other, dbname)
+		}
+		names[o.LogicalSlot] = dbname
+	}
+
+	if len(names) == 0 {
+		return slots, nil
+	}
+
+	if pgDumpVersion < 90500 {
+		l.Warnln("provided pg_dump is older than 9.5, not creating logical replication slots")
+		return slots, nil
+	}
+
+	if serverVersion < 100000 {
+		l.Warnln("cluster version is older than 10, not creating logical replication slots")
+		return slots, nil
+	}
+
+	for _, dbname := range databases {
+		o, found := opts.PerDbOpts[dbname]
+		if !found {
+			o = defaultDbOpts(opts)
+		}
+
+		if o.LogicalSlot == "" {
+			continue
+		}
+
+		s, err := createSlotSnapshot(conninfo.Set("dbname", dbname), o.LogicalSlot, opts.LogicalSlotKeep)
+		if err != nil {
+			return slots, err
+		}
+		slots[dbname] = s
+	}
+
+	return slots, nil
+}
+
+// writeSlotFile writes the position of the logical replication slot created
+// for the dump next to it, logical replication can start from there to get
+// the changes made after the data of the dump
+func writeSlotFile(d *dump, s *pgSlotSnapshot, fc chan<- sumFileJob) error {
+	file := formatDumpPath(d.Directory, d.TimeFormat, "slot", d.Database, d.pathTime(), 0)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	contents := fmt.Sprintf("slot_name = %s\nconsistent_point = %s\nsnapshot_name = %s\noutput_plugin = %s\n", s.name, s.lsn, s.id, s.plugin)
+
+	l.Verboseln("writing logical replication slot of", d.Database, "to:", file)
+	if err := os.WriteFile(file, []byte(contents), modeOr(d.Mode, 0600)); err != nil {
+		return err
+	}
+
+	// WriteFile does not change the mode of an existing file
+	if d.Mode != 0 {
+		if err := os.Chmod(file, d.Mode); err != nil {
+			return err
+		}
+	}
+
+	if fc != nil {
+		fc <- sumFileJob{
+			Path:    file,
+			SumAlgo: d.Options.SumAlgo,
+		}
+	}
+
+	return nil
+}
+
+// dumpExtensions writes the list of extensions of the database of a dump
+// next to it, to know what to install on a fresh cluster before restoring
+func dumpExtensions(d *dump, timeout int, fc chan<- sumFileJob) error {
+	conninfo := d.ConnString.Set("dbname", d.Database)
+	if d.Options.Username != "" {
+		conninfo = conninfo.Set("user", d.Options.Username)
+	}
+
+	db, err := dbOpen(conninfo)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.setStatementTimeout(timeout); err != nil {
+		return err
+	}
+
+	s, err := listExtensions(db)
+	if err != nil {
+		return err
+	}
+
+	file := formatDumpPath(d.Directory, d.TimeFormat, "extensions.out", d.Database, d.pathTime(), 0)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	l.Verboseln("writing extensions of", d.Database, "to:", file)
+	if err := os.WriteFile(file, []byte(s), modeOr(d.Mode, 0600)); err != nil {
+		return err
+	}
+
+	// WriteFile does not change the mode of an existing file
+	if d.Mode != 0 {
+		if err := os.Chmod(file, d.Mode); err != nil {
+			return err
+		}
+	}
+
+	if fc != nil {
+		fc <- sumFileJob{
+			Path:    file,
+			SumAlgo: d.Options.SumAlgo,
+		}
+	}
+
+	return nil
+}
+
+// dumpInstance dumps the globals, settings, configuration files and
+// tablespaces of the instance concurrently. All of them are run even when one
+// fails, the errors are returned together. All files are named after the same
+// time, the start of the run.
+func dumpInstance(opts options, when time.Time, db *pg, conninfo *ConnInfo, versions toolVersions, fc chan<- sumFileJob) error {
+	if !db.superuser {
+		l.Infoln("connection user is not superuser, some information will not be dumped")
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	spawn := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// With split globals, roles and tablespaces go to their own file,
+	// the file of pg_dumpall replaces the one made from the catalog for
+	// tablespaces
+	globals := []string{"pg_globals"}
+	if opts.SplitGlobals {
+		globals = []string{"pg_roles", "pg_tablespaces"}
+	}
+
+	for _, name := range globals {
+		name := name
+		spawn(func() error {
+			// Then we can implicitely avoid dumping role password when
+			// using a regular user
+			dumpRolePasswords := opts.WithRolePasswords && db.superuser
+			if dumpRolePasswords || name == "pg_tablespaces" {
+				l.Infoln("dumping globals to", name)
+			} else {
+				l.Infoln("dumping globals to", name, "without role passwords")
+			}
+			if err := dumpGlobals(name, opts.Directory, opts.TimeFormat, when, opts.CompressLevel, dumpRolePasswords, conninfo, versions.PgDumpall, opts.FileMode, fc); err != nil {
+				return fmt.Errorf("pg_dumpall of %s failed: %w", name, err)
+			}
+			return nil
+		})
+	}
+
+	// The following use the same connection, their queries do not run
+	// in parallel but they do not wait for pg_dumpall
+	spawn(func() error {
+		l.Infoln("dumping instance configuration")
+		if err := dumpSettings(opts.Directory, opts.TimeFormat, when, opts.CompressLevel, db, opts.FileMode, fc); err != nil {
+			var (
+				verr *pgVersionError
+				perr *pgPrivError
+			)
+			if errors.As(err, &verr) || errors.As(err, &perr) {
+				l.Warnln(err)
+			} else {
+				return fmt.Errorf("could not dump configuration parameters: %w", err)
+			}
+		}
+		return nil
+	})
+
+	spawn(func() error {
+		if err := dumpConfigFiles(opts.Directory, opts.TimeFormat, when, opts.CompressLevel, db, opts.FileMode, fc); err != nil {
+			return fmt.Errorf("could not dump configuration files: %w", err)
+		}
+		return nil
+	})
+
+	if !opts.SplitGlobals {
+		spawn(func() error {
+			l.Infoln("dumping tablespaces")
+			if err := dumpTablespacesFile(opts.Directory, opts.TimeFormat, when, opts.CompressLevel, db, opts.FileMode, fc); err != nil {
+				var verr *pgVersionError
+				if errors.As(err, &verr) {
+					l.Warnln(err)
+				} else {
+					return fmt.Errorf("could not dump tablespaces: %w", err)
+				}
+			}
+			return nil
+		})
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func dumpTablespacesFile(dir string, timeFormat string, when time.Time, compressLevel int, db *pg, mode os.FileMode, fc chan<- sumFileJob) error {
+	s, err := dumpTablespaces(db)
+	if err != nil {
+		return err
+	}
+
+	// Only output a file when there are tablespaces besides the default
+	// ones
+	if len(s) == 0 {
+		l.Verboseln("no tablespace to dump")
+		return nil
+	}
+
+	file := formatDumpPath(dir, timeFormat, "sql", "pg_tablespaces", when, compressLevel)
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	l.Verboseln("writing tablespaces to:", file)
+	if err := writeInstanceFile(file, mode, compressLevel, writeString(s)); err != nil {
+		return err
+	}
+
+	if fc != nil {
+		fc <- sumFileJob{
+			Path: file,
+		}
+	}
+
+	return nil
+}
+
+// remotePrefix gives the prefix of the keys of the files uploaded with
+// uploadPrefix, ending with a slash so that only the contents of the remote
+// directory match
+func remotePrefix(uploadPrefix string) string {
+	if uploadPrefix == "" {
+		return ""
+	}
+
+	return forwardSlashes(filepath.Clean(uploadPrefix)) + "/"
+}
+
+func listRemoteFiles(repoName string, opts options, globs []string) error {
+	repo, err := newRepo(repoName, opts)
+	if err != nil {
+		return err
+	}
+
+	// Only the files uploaded with the prefix are listed, the globs
+	// apply to their path under the prefix
+	prefix := remotePrefix(opts.UploadPrefix)
+	remoteFiles, err := repo.List(prefix)
+	if err != nil {
+		return fmt.Errorf("could not list contents of remote location: %w", err)
+	}
+
+	for _, i := range remoteFiles {
+		key := strings.TrimPrefix(i.key, prefix)
+		keep := false
+		if len(globs) == 0 {
+			keep = true
+		}
+
+		for _, glob := range globs {
+			keep, err = filepath.Match(glob, key)
+			if err != nil {
+				return fmt.Errorf("bad patern: %w", err)
+			}
+
+			if keep {
+				break
+			}
+		}
+
+		if !keep {
+			continue
+		}
+
+		fmt.Println(key)
+	}
+
+	return nil
+}
+
+// instanceFileTimestamps gives the timestamps found in key when it is a file of
+// the instance, one of its path elements being named after one of these files
+func instanceFileTimestamps(key string) []time.Time {
+	isInstance := false
+	for _, elem := range strings.Split(filepath.ToSlash(key), "/") {
+		for _, name := range instanceFileNames {
+			if elem == name || strings.HasPrefix(elem, name+"_") || strings.HasPrefix(elem, name+".") {
+				isInstance = true
+			}
+		}
+	}
+
+	if !isInstance {
+		return nil
+	}
+
+	stamps := make([]time.Time, 0)
+	for _, s := range reDumpTimestamp.FindAllString(key, -1) {
+		if date, ok := parseDumpTimestamp(s); ok {
+			stamps = append(stamps, date)
+		}
+	}
+
+	return stamps
+}
+
+func downloadFiles(repoName string, opts options, dir string, globs []string) error {
+	repo, err := newRepo(repoName, opts)
+	if err != nil {
+		return err
+	}
+
+	// With --snapshot, all the files of the run are downloaded, the
+	// globs can further filter them
+	var when time.Time
+	if opts.Snapshot != "" {
+		when, _ = parseDumpTimestamp(opts.Snapshot)
+	}
+
+	// Without globs nor snapshot, there is nothing to download
+	if len(globs) == 0 && when.IsZero() {
+		return fmt.Errorf("no filter given to download files, use globs as command line arguments or --snapshot")
+	}
+
+	// Files are downloaded to their path under the prefix, the one they
+	// had in the backup directory
+	prefix := remotePrefix(opts.UploadPrefix)
+	remoteFiles, err := repo.List(prefix)
+	if err != nil {
+		return fmt.Errorf("could not list contents of remote location: %w", err)
+	}
+
+	// The dumps of the databases are stamped with their own start, the
+	// files of the run are the ones up to the start of the next run
+	var end time.Time
+	if !when.IsZero() {
+		stamps := make([]time.Time, 0)
+		for _, i := range remoteFiles {
+			stamps = append(stamps, instanceFileTimestamps(strings.TrimPrefix(i.key, prefix))...)
+		}
+		end = runEnd(stamps, when)
+	}
+
+	var count int
+	for _, i := range remoteFiles {
+		key := strings.TrimPrefix(i.key, prefix)
+		keep := len(globs) == 0
+		for _, glob := range globs {
+			keep, err = filepath.Match(glob, key)
+			if err != nil {
+				return fmt.Errorf("bad patern: %w", err)
+			}
+
+			if keep {
+				break
+			}
+		}
+
+		if keep && !when.IsZero() && !hasRunTimestamp(key, when, end) {
+			keep = false
+		}
+
+		if !keep {
+			l.Verboseln("skipping:", i.key)
+			continue
+		}
+
+		if i.isDir {
+			// The contents of the directories of a snapshot are
+			// listed with it
+			if when.IsZero() {
+				l.Warnf("%s is a directory, append %c* to the filter to download its contents", key, os.PathSeparator)
+			}
+			continue
+		}
+
+		// Create any parent directory under target dir
+		path := filepath.Join(dir, key)
+		parent := filepath.Dir(path)
+		if err := os.MkdirAll(parent, 0700); err != nil {
+			return fmt.Errorf("could not create directory %s: %w", parent, err)
+		}
+
+		if err := repo.Download(i.key, path); err != nil {
+			return err
+		}
+
+		if _, err := decompressDownload(path); err != nil {
+			return err
+		}
+		count++
+	}
+
+	if !when.IsZero() && count == 0 {
+		return fmt.Errorf("no file found for the snapshot %s", opts.Snapshot)
+	}
+
+	return nil
+}
+
+// decryptDirectory decrypts the files of dir matching the globs. The
+// decrypted files are written next to the encrypted ones, or under outdir
+// with the same relative path when it is not empty. When removeSrc is true,
+// encrypted files are removed once successfully decrypted.
+func decryptDirectory(dir string, outdir string, params decryptParams, workers int, globs []string, removeSrc bool) error {
+
+	// Run a pool of workers to decrypt concurrently
+	var wg sync.WaitGroup
+
+	// Workers pick paths from the file queue
+	fq := make(chan string)
+
+	// We need a channel to know if a worker got an error at some point and
+	// return an error
+	ret := make(chan bool, workers)
+
+	// Start workers that listen for filenames to decrypt until the queue
+	// is closed
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			l.Verboseln("started decrypt worker", id)
+			failed := false
+			for {
+				file, more := <-fq
+				if !more {
+					break
+				}
+
+				l.Verbosef("[%d] processing: %s\n", id, file)
+				dstFile := strings.TrimSuffix(file, ".age")
+				if outdir != "" {
+					dstFile = filepath.Join(outdir, relPath(dir, dstFile))
+					if err := os.MkdirAll(filepath.Dir(dstFile), 0700); err != nil {
+						l.Errorln(err)
+						failed = true
+						continue
+					}
+				}
+
+				if err := decryptFile(file, dstFile, params); err != nil {
+					l.Errorln(err)
+					failed = true
+					continue
+				}
+
+				if removeSrc {
+					l.Verboseln("removing", file)
+					if err := os.Remove(file); err != nil {
+						l.Errorln("could not remove source file:", err)
+						failed = true
+					}
+				}
+			}
+
+			if failed {
+				ret <- true
+			}
+
+			wg.Done()
+			l.Verboseln("terminated decrypt worker", id)
+		}(i)
+	}
+
+	// Send the encrypted files matching the globs to the workers
+	c, err := walkEncryptedFiles(dir, globs, func(file string) { fq <- file })
+	if err != nil {
+		close(fq)
+		wg.Wait()
+		return err
+	}
+
+	// Print a warning when no candidate files are found with a hint that the dbname is a glob
+	if c == 0 {
+		l.Warnln("no candidate file found for decryption. Maybe add a wildcard (*) to the patterns?")
+	}
+
+	// Closing the channel will make the workers stop as soon as it is
+	// empty
+	close(fq)
+	wg.Wait()
+
+	// Check the return channel to find if there was an error. There are
+	// maybe more than one but when creating the buffered channel we can't
+	// know the size of the buffer, so we limit to one error per worker to
+	// avoid being blocked by channel
+	select {
+	case _ = <-ret:
+		return fmt.Errorf("failure in decrypt, please examine logs")
+	default:
+		return nil
+	}
+}
+
+// rekeyDirectory encrypts again the encrypted files of dir matching the
+// globs, decrypting them with dec and encrypting them with enc. The files are
+// replaced in place, then the checksum files listing them are updated.
+func rekeyDirectory(dir string, dec decryptParams, enc encryptParams, workers int, globs []string) error {
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+
+	fq := make(chan string)
+	ret := make(chan bool, workers)
+	rekeyed := make(map[string]string)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			l.Verboseln("started rekey worker", id)
+			failed := false
+			for {
+				file, more := <-fq
+				if !more {
+					break
+				}
+
+				l.Infoln("rekeying", file)
+				if err := rekeyFile(file, dec, enc); err != nil {
+					l.Errorln(err)
+					failed = true
+					continue
+				}
+
+				mu.Lock()
+				rekeyed[file] = file
+				mu.Unlock()
+			}
+
+			if failed {
+				ret <- true
+			}
+
+			wg.Done()
+			l.Verboseln("terminated rekey worker", id)
+		}(i)
+	}
+
+	c, err := walkEncryptedFiles(dir, globs, func(file string) { fq <- file })
+	close(fq)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	if c == 0 {
+		l.Warnln("no candidate file found for rekeying. Maybe add a wildcard (*) to the patterns?")
+	}
+
+	// The encrypted files changed, so do their checksums, even when some
+	// files could not be rekeyed
+	if err := updateChecksumFiles(dir, rekeyed); err != nil {
+		return err
+	}
+
+	select {
+	case <-ret:
+		return fmt.Errorf("failure in rekey, please examine logs")
+	default:
+		return nil
+	}
 }
 
-func listRemoteFiles(repoName string, opts options, globs []string) error {
-	repo, err := NewRepo(repoName, opts)
+// rekeyRemoteFiles encrypts again the encrypted files of the remote location
+// matching the globs, the globs apply to their path under the prefix like with
+// --download. Each file is downloaded to a temporary directory, rekeyed and
+// uploaded back under the same key, then the remote checksum files listing
+// them are updated.
+func rekeyRemoteFiles(repoName string, opts options, dec decryptParams, enc encryptParams, globs []string) error {
+	repo, err := newRepo(repoName, opts)
 	if err != nil {
 		return err
 	}
+	defer repo.Close()
 
-	remoteFiles, err := repo.List("")
+	prefix := remotePrefix(opts.UploadPrefix)
+	remoteFiles, err := repo.List(prefix)
 	if err != nil {
 		return fmt.Errorf("could not list contents of remote location: %w", err)
 	}
 
+	tmpDir, err := os.MkdirTemp("", "pg_back-rekey-")
+	if err != nil {
+		return fmt.Errorf("could not create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Checksum files are processed once all the files are rekeyed, their
+	// contents is kept to only upload the ones that change
+	type sumFile struct {
+		key  string
+		path string
+		data []byte
+	}
+
+	var (
+		sumFiles []sumFile
+		c        int
+		failed   bool
+	)
+	rekeyed := make(map[string]string)
+
 	for _, i := range remoteFiles {
-		keep := false
-		if len(globs) == 0 {
-			keep = true
+		if i.isDir {
+			continue
 		}
 
-		for _, glob := range globs {
-			keep, err = filepath.Match(glob, i.key)
+		key := strings.TrimPrefix(i.key, prefix)
+		path := filepath.Join(tmpDir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("could not create directory %s: %w", filepath.Dir(path), err)
+		}
+
+		algo := strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(key, ".gz")), ".")
+		if algo != "none" && slices.Contains(sumAlgos, algo) {
+			if err := repo.Download(i.key, path); err != nil {
+				return err
+			}
+
+			path, err = decompressDownload(path)
 			if err != nil {
-				return fmt.Errorf("bad patern: %w", err)
+				return err
 			}
 
-			if keep {
-				break
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
 			}
-		}
 
-		if !keep {
+			sumFiles = append(sumFiles, sumFile{key: i.key, path: path, data: data})
 			continue
 		}
 
-		fmt.Println(i.key)
-	}
-
-	return nil
-}
-
-func downloadFiles(repoName string, opts options, dir string, globs []string) error {
-	repo, err := NewRepo(repoName, opts)
-	if err != nil {
-		return err
-	}
-
-	// Without globs, there is nothing to download
-	if len(globs) == 0 {
-		return fmt.Errorf("no filter given to download files, use globs as command line arguments")
-	}
-
-	remoteFiles, err := repo.List("")
-	if err != nil {
-		return fmt.Errorf("could not list contents of remote location: %w", err)
-	}
+		if filepath.Ext(key) != ".age" {
+			continue
+		}
 
-	for _, i := range remoteFiles {
-		keep := false
+		keep := len(globs) == 0
 		for _, glob := range globs {
-			keep, err = filepath.Match(glob, i.key)
+			keep, err = filepath.Match(glob, key)
 			if err != nil {
 				return fmt.Errorf("bad patern: %w", err)
 			}
@@ -1103,74 +2871,82 @@ func downloadFiles(repoName string, opts options, dir string, globs []string) er
 			l.Verboseln("skipping:", i.key)
 			continue
 		}
+		c++
 
-		if i.isDir {
-			l.Warnf("%s is a directory, append %c* to the filter to download its contents", i.key, os.PathSeparator)
+		l.Infoln("rekeying", i.key)
+		if err := repo.Download(i.key, path); err != nil {
+			l.Errorln(err)
+			failed = true
 			continue
 		}
 
-		// Create any parent directory under target dir
-		path := filepath.Join(dir, i.key)
-		parent := filepath.Dir(path)
-		if err := os.MkdirAll(parent, 0700); err != nil {
-			return fmt.Errorf("could not create directory %s: %w", parent, err)
+		if err := rekeyFile(path, dec, enc); err != nil {
+			l.Errorln(err)
+			failed = true
+			continue
 		}
 
-		if err := repo.Download(i.key, path); err != nil {
-			return err
+		if err := repo.Upload(path, i.key); err != nil {
+			l.Errorln(err)
+			failed = true
+			continue
 		}
-	}
-
-	return nil
-}
 
-func decryptDirectory(dir string, params decryptParams, workers int, globs []string) error {
+		// Checksum files list the path of the files in the backup
+		// directory or a path relative to them
+		rekeyed[path] = path
+		rekeyed[filepath.Join(opts.Directory, filepath.FromSlash(key))] = path
+	}
 
-	// Run a pool of workers to decrypt concurrently
-	var wg sync.WaitGroup
+	if c == 0 {
+		l.Warnln("no candidate file found for rekeying. Maybe add a wildcard (*) to the patterns?")
+	}
 
-	// Workers pick paths from the file queue
-	fq := make(chan string)
+	if err := updateChecksumFiles(tmpDir, rekeyed); err != nil {
+		return err
+	}
 
-	// We need a channel to know if a worker got an error at some point and
-	// return an error
-	ret := make(chan bool, workers)
+	for _, f := range sumFiles {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return err
+		}
 
-	// Start workers that listen for filenames to decrypt until the queue
-	// is closed
-	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go func(id int) {
-			l.Verboseln("started decrypt worker", id)
-			failed := false
-			for {
-				file, more := <-fq
-				if !more {
-					break
-				}
+		if bytes.Equal(data, f.data) {
+			continue
+		}
 
-				l.Verbosef("[%d] processing: %s\n", id, file)
-				if err := decryptFile(file, params); err != nil {
-					l.Errorln(err)
-					failed = true
-				}
-			}
+		// Checksum files compressed on upload are compressed again
+		src, _, err := uploadSource(f.path, strings.HasSuffix(f.key, ".gz"))
+		if err != nil {
+			return err
+		}
 
-			if failed {
-				ret <- true
-			}
+		l.Infoln("updating", f.key)
+		err = repo.Upload(src, f.key)
+		if src != f.path {
+			os.Remove(src)
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-			wg.Done()
-			l.Verboseln("terminated decrypt worker", id)
-		}(i)
+	if failed {
+		return fmt.Errorf("failure in rekey, please examine logs")
 	}
 
-	// Read the directory, filter the contents with the provided globs and
-	// send the path to the workers. When a directory is found, send its
-	// content, the first level only to the workers
+	return nil
+}
+
+// walkEncryptedFiles reads the directory, filters the contents with the
+// provided globs and gives the path of the encrypted files to fn. When a
+// directory is found, its content is given, the first level only. It
+// returns the number of files found.
+func walkEncryptedFiles(dir string, globs []string, fn func(string)) (int, error) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return fmt.Errorf("unable to read directory %s: %w", dir, err)
+		return 0, fmt.Errorf("unable to read directory %s: %w", dir, err)
 	}
 
 	var c int
@@ -1181,7 +2957,7 @@ func decryptDirectory(dir string, params decryptParams, workers int, globs []str
 			for _, glob := range globs {
 				keep, err = filepath.Match(glob, path.Name())
 				if err != nil {
-					return fmt.Errorf("bad patern: %w", err)
+					return c, fmt.Errorf("bad patern: %w", err)
 				}
 
 				if keep {
@@ -1196,7 +2972,7 @@ func decryptDirectory(dir string, params decryptParams, workers int, globs []str
 		}
 
 		if path.IsDir() {
-			l.Verboseln("dump is a directory, decrypting all files inside")
+			l.Verboseln("dump is a directory, processing all files inside")
 			subdir := filepath.Join(dir, path.Name())
 			subentries, err := os.ReadDir(subdir)
 			if err != nil {
@@ -1213,7 +2989,7 @@ func decryptDirectory(dir string, params decryptParams, workers int, globs []str
 				file := filepath.Join(subdir, subpath.Name())
 				if strings.HasSuffix(file, ".age") {
 					c++
-					fq <- file
+					fn(file)
 				}
 			}
 			continue
@@ -1222,30 +2998,11 @@ func decryptDirectory(dir string, params decryptParams, workers int, globs []str
 		file := filepath.Join(dir, path.Name())
 		if strings.HasSuffix(file, ".age") {
 			c++
-			fq <- file
+			fn(file)
 		}
 	}
 
-	// Print a warning when no candidate files are found with a hint that the dbname is a glob
-	if c == 0 {
-		l.Warnln("no candidate file found for decryption. Maybe add a wildcard (*) to the patterns?")
-	}
-
-	// Closing the channel will make the workers stop as soon as it is
-	// empty
-	close(fq)
-	wg.Wait()
-
-	// Check the return channel to find if there was an error. There are
-	// maybe more than one but when creating the buffered channel we can't
-	// know the size of the buffer, so we limit to one error per worker to
-	// avoid being blocked by channel
-	select {
-	case _ = <-ret:
-		return fmt.Errorf("failure in decrypt, please examine logs")
-	default:
-		return nil
-	}
+	return c, nil
 }
 
 // All FileJobs struct store information on post processing that must be done
@@ -1257,6 +3014,17 @@ type sumFileJob struct {
 
 	// Checksum algorithm
 	SumAlgo string
+
+	// Compression of a dump in the tar format, done before the checksum
+	// since pg_dump cannot compress this format. An empty method means
+	// no compression.
+	CompressMethod string
+	CompressLevel  int
+	CompressLong   bool
+
+	// Dump the file comes from, the checksum file is recorded in it. It
+	// is nil for the other files.
+	Dump *dump
 }
 
 type encryptParams struct {
@@ -1265,6 +3033,9 @@ type encryptParams struct {
 
 	// Encrypt with an AGE public key encoded in Bech32
 	PublicKey string
+
+	// Produce ASCII armored files
+	Armor bool
 }
 
 type decryptParams struct {
@@ -1296,34 +3067,111 @@ type sumEncryptFileJob struct {
 	SumAlgo string
 
 	SumFile string
+
+	// Directory dump containing the files, if any
+	Dir string
 }
 
 type uploadJob struct {
 	// Path to upload
 	Path string
+
+	// Directory dump containing the file, if any, removed once empty
+	// when local files are removed after upload
+	Dir string
 }
 
 // postProcessFiles is the entrypoint for common tasks to perform on files
 // produced during execution, checksum and encryption. Different go routines
 // are spawn to process the files as soon as possible
-func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options) chan error {
+func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options, when time.Time) chan error {
 	// Create a channel for errors so that we can inform the main goroutine
 	// that a job failed and have the program exit with a non-zero
 	// status. This chan is buffered with the number of goroutines using it
 	// here so that it never blocks, each go routine must send only one
 	// error, other are only logged.
-	ret := make(chan error, 4*opts.Jobs)
+	ret := make(chan error, 5*opts.Jobs)
 
 	// Create a channel so that each group of worker can tell their job is
 	// done and the next group can be stopped
 	done := make(chan bool)
 
-	// The order of tasks (checksum, encryption, checksum of encrypted
-	// files) is kept by passing jobs of different types to the next
-	// goroutine over channels
+	// In combined checksum mode, all checksums go to the same file
+	var manifest *sumManifest
+	if opts.ChecksumMode == "combined" {
+		manifest = newSumManifest(opts.Directory, opts.TimeFormat, when, opts.FileMode)
+	}
+
+	// The order of tasks (archive, checksum, encryption, checksum of
+	// encrypted files) is kept by passing jobs of different types to the
+	// next goroutine over channels
+	sumIn := make(chan sumFileJob)
 	encIn := make(chan encryptFileJob)
 	uploadIn := make(chan uploadJob)
 
+	for i := 0; i < opts.Jobs; i++ {
+		wg.Add(1)
+		go func(id int) {
+			l.Verboseln("started archive worker", id)
+			failed := false
+			for {
+				j, more := <-inFiles
+				if !more {
+					wg.Done()
+					done <- true
+					l.Verboseln("stopped archive worker", id)
+					return
+				}
+
+				// Only dumps in the directory format are archived,
+				// other files go straight to checksum
+				if opts.DirArchive && strings.HasSuffix(j.Path, ".d") {
+					if i, err := os.Stat(j.Path); err == nil && i.IsDir() {
+						l.Infoln("archiving", j.Path)
+						p, err := archiveDirectory(j.Path, opts.FileMode)
+						if err != nil {
+							l.Errorln("archive failed:", err)
+							if !failed {
+								ret <- fmt.Errorf("archive failed: %w", err)
+								failed = true
+							}
+						}
+
+						// The directory is kept and processed
+						// when the archive could not be written
+						if p != "" {
+							j.Path = p
+							if opts.DirArchiveCompress != "none" {
+								j.CompressMethod = opts.DirArchiveCompress
+								j.CompressLevel = -1
+							}
+						}
+					}
+				}
+
+				// Likewise, the dump is kept uncompressed when
+				// the compression fails
+				if j.CompressMethod != "" {
+					l.Infoln("compressing", j.Path, "with", j.CompressMethod)
+					p, err := compressTar(j.Path, j.CompressMethod, j.CompressLevel, j.CompressLong, opts.FileMode)
+					if err != nil {
+						l.Errorln("compression failed:", err)
+						if !failed {
+							ret <- fmt.Errorf("compression failed: %w", err)
+							failed = true
+						}
+					}
+
+					if p != "" {
+						j.Path = p
+					}
+				}
+
+				sumIn <- j
+			}
+		}(i)
+	}
+
 	for i := 0; i < opts.Jobs; i++ {
 		wg.Add(1)
 		go func(id int) {
@@ -1331,7 +3179,7 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 			failed := false
 			for {
 
-				j, more := <-inFiles
+				j, more := <-sumIn
 				if !more {
 					wg.Done()
 					done <- true
@@ -1345,10 +3193,37 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 				if j.SumAlgo == "" {
 					j.SumAlgo = opts.SumAlgo
 				}
+				j.SumAlgo = resolveSumAlgo(j.SumAlgo, opts.SumAutoThreshold, j.Path)
+
+				if manifest != nil && j.SumAlgo != "none" {
+					l.Infoln("computing checksum of", j.Path)
+					if err := manifest.add(j.Path, j.SumAlgo); err != nil {
+						l.Errorln("checksum failed:", err)
+						if !failed {
+							ret <- fmt.Errorf("checksum failed: %w", err)
+							failed = true
+						}
+						continue
+					}
+
+					if j.Dump != nil {
+						j.Dump.SumFile = manifest.path(j.SumAlgo)
+					}
 
-				if j.SumAlgo != "none" {
+					if opts.VerifyDump {
+						l.Infoln("verifying checksum of", j.Path)
+						if err := verifyChecksumFile(manifest.path(j.SumAlgo), j.SumAlgo, j.Path); err != nil {
+							l.Errorln("verification failed:", err)
+							if !failed {
+								ret <- fmt.Errorf("verification failed: %w", err)
+								failed = true
+							}
+							continue
+						}
+					}
+				} else if j.SumAlgo != "none" {
 					l.Infoln("computing checksum of", j.Path)
-					p, err := checksumFile(j.Path, j.SumAlgo)
+					p, err := checksumFile(j.Path, j.SumAlgo, opts.FileMode)
 					if err != nil {
 						l.Errorln("checksum failed:", err)
 						if !failed {
@@ -1358,16 +3233,37 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 						continue
 					}
 
-					// send the checksum file to encryption or upload
+					if j.Dump != nil {
+						j.Dump.SumFile = p
+					}
+
+					// Read the file again to catch a corruption
+					// before it is encrypted or uploaded
+					if opts.VerifyDump {
+						l.Infoln("verifying checksum of", j.Path)
+						if err := verifyChecksumFile(p, j.SumAlgo, j.Path); err != nil {
+							l.Errorln("verification failed:", err)
+							if !failed {
+								ret <- fmt.Errorf("verification failed: %w", err)
+								failed = true
+							}
+							continue
+						}
+					}
+
+					// send the checksum file to encryption or upload,
+					// the encrypted checksum file does not get its
+					// own checksum
 					if opts.Encrypt {
 						encIn <- encryptFileJob{
 							Path: p,
 							Params: encryptParams{
 								Passphrase: opts.CipherPassphrase,
 								PublicKey:  opts.CipherPublicKey,
+								Armor:      opts.CipherArmor,
 							},
 							KeepSrc: opts.EncryptKeepSrc,
-							SumAlgo: j.SumAlgo,
+							SumAlgo: "none",
 						}
 					} else if opts.Upload != "none" {
 						// upload the checksum file only if it won't be encrypted
@@ -1385,6 +3281,7 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 						Params: encryptParams{
 							Passphrase: opts.CipherPassphrase,
 							PublicKey:  opts.CipherPublicKey,
+							Armor:      opts.CipherArmor,
 						},
 						KeepSrc: opts.EncryptKeepSrc,
 						SumAlgo: j.SumAlgo,
@@ -1412,6 +3309,7 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 
 							uploadIn <- uploadJob{
 								Path: filepath.Join(j.Path, p.Name()),
+								Dir:  j.Path,
 							}
 						}
 					} else {
@@ -1442,6 +3340,13 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 				}
 
 				if opts.Encrypt {
+					// Files of directory dumps are encrypted
+					// inside the directory
+					var dir string
+					if i, err := os.Stat(j.Path); err == nil && i.IsDir() {
+						dir = j.Path
+					}
+
 					l.Infoln("encrypting", j.Path)
 					encFiles, err := encryptFile(j.Path, j.Params, j.KeepSrc)
 					if err != nil {
@@ -1453,20 +3358,13 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 						continue
 					}
 
-					// send the encrypted files to checksuming
+					// send the encrypted files to checksuming,
+					// they are uploaded after
 					sumEncIn <- sumEncryptFileJob{
 						Paths:   encFiles,
 						SumAlgo: j.SumAlgo,
 						SumFile: fmt.Sprintf("%s.age", j.Path),
-					}
-
-					// upload the encrypted files
-					if opts.Upload != "none" {
-						for _, p := range encFiles {
-							uploadIn <- uploadJob{
-								Path: p,
-							}
-						}
+						Dir:     dir,
 					}
 				}
 			}
@@ -1490,10 +3388,22 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 				if j.SumAlgo == "" {
 					j.SumAlgo = opts.SumAlgo
 				}
-
-				if j.SumAlgo != "none" {
+				j.SumAlgo = resolveSumAlgo(j.SumAlgo, opts.SumAutoThreshold, j.Paths...)
+
+				if manifest != nil && j.SumAlgo != "none" {
+					for _, p := range j.Paths {
+						l.Infoln("computing checksum of", p)
+						if err := manifest.add(p, j.SumAlgo); err != nil {
+							l.Errorln("checksum of encrypted files failed:", err)
+							if !failed {
+								ret <- fmt.Errorf("checksum of encrypted files failed: %w", err)
+								failed = true
+							}
+						}
+					}
+				} else if j.SumAlgo != "none" {
 					l.Infoln("computing checksum of", j.SumFile)
-					p, err := checksumFileList(j.Paths, j.SumAlgo, j.SumFile)
+					p, err := checksumFileList(j.Paths, j.SumAlgo, j.SumFile, opts.FileMode)
 					if err != nil {
 						l.Errorln("checksum of encrypted files failed:", err)
 						if !failed {
@@ -1510,15 +3420,37 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 						}
 					}
 				}
+
+				// upload the encrypted files once checksummed,
+				// they may be removed after upload
+				if opts.Upload != "none" {
+					for _, p := range j.Paths {
+						uploadIn <- uploadJob{
+							Path: p,
+							Dir:  j.Dir,
+						}
+					}
+				}
 			}
 		}(i)
 	}
 
-	repo, err := NewRepo(opts.Upload, opts)
+	// Destinations that cannot be prepared fail the post processing, the
+	// others still get the files
+	repos, err := newUploadRepos(opts)
 	if err != nil {
 		l.Errorln(err)
 		ret <- err
-		repo = nil
+	}
+
+	// Local files are removed only when they are on every destination
+	removeLocal := opts.RemoveLocal && err == nil
+
+	// Uploaded files are verified with the checksum algorithm of the run,
+	// or sha256 when checksums are disabled
+	verifyAlgo := opts.SumAlgo
+	if verifyAlgo == "none" {
+		verifyAlgo = "sha256"
 	}
 
 	for i := 0; i < opts.Jobs; i++ {
@@ -1535,16 +3467,60 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 					return
 				}
 
-				if opts.Upload != "none" && repo != nil {
-					// Prepend the global prefix to the relative path of the dump
-					if err := repo.Upload(j.Path, filepath.Join(opts.UploadPrefix, relPath(opts.Directory, j.Path))); err != nil {
+				// Prepend the global prefix to the relative path of the dump
+				target := filepath.Join(opts.UploadPrefix, relPath(opts.Directory, j.Path))
+
+				// The compressed copy is sent to all the
+				// destinations
+				src, suffix, err := uploadSource(j.Path, opts.CompressOnUpload)
+				if err != nil {
+					l.Errorln(err)
+					if !failed {
+						ret <- err
+						failed = true
+					}
+					continue
+				}
+				target += suffix
+
+				// A failure on a destination does not prevent
+				// sending the file to the others
+				uploaded := true
+				for _, repo := range repos {
+					if err := repo.Upload(src, target); err != nil {
+						err = fmt.Errorf("upload to %s failed: %w", repo.name, err)
 						l.Errorln(err)
 						if !failed {
 							ret <- err
 							failed = true
 						}
+						uploaded = false
 						continue
 					}
+
+					if opts.VerifyUpload {
+						l.Verboseln("verifying upload of", j.Path, "to", repo.name)
+						if err := verifyUpload(repo, src, target, resolveSumAlgo(verifyAlgo, opts.SumAutoThreshold, j.Path)); err != nil {
+							err = fmt.Errorf("upload to %s failed: %w", repo.name, err)
+							l.Errorln(err)
+							if !failed {
+								ret <- err
+								failed = true
+							}
+							uploaded = false
+							continue
+						}
+					}
+				}
+
+				if src != j.Path {
+					if err := os.Remove(src); err != nil {
+						l.Warnf("could not remove compressed copy of %s: %s", j.Path, err)
+					}
+				}
+
+				if removeLocal && uploaded {
+					removeUploadedFile(j)
 				}
 			}
 		}(i)
@@ -1555,8 +3531,13 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 	// worker to stop.
 	go func() {
 		// inFiles will be closed outside of the function, when all
-		// worker reading from it exit, close encIn to make the workers
+		// worker reading from it exit, close sumIn to make the workers
 		// reading from it stop, and so on.
+		for i := 0; i < opts.Jobs; i++ {
+			<-done
+		}
+		close(sumIn)
+
 		for i := 0; i < opts.Jobs; i++ {
 			<-done
 		}
@@ -1570,13 +3551,23 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 		for i := 0; i < opts.Jobs; i++ {
 			<-done
 		}
+
+		// The combined checksum files are complete once all files
+		// are processed, upload them last
+		if manifest != nil && opts.Upload != "none" {
+			for _, p := range manifest.paths() {
+				uploadIn <- uploadJob{
+					Path: p,
+				}
+			}
+		}
 		close(uploadIn)
 
 		for i := 0; i < opts.Jobs; i++ {
 			<-done
 		}
 
-		if repo != nil {
+		for _, repo := range repos {
 			repo.Close()
 		}
 
@@ -1585,6 +3576,26 @@ func postProcessFiles(inFiles chan sumFileJob, wg *sync.WaitGroup, opts options)
 	return ret
 }
 
+// removeUploadedFile removes the local copy of an uploaded file, and the
+// directory dump containing it once it is empty. A failure is only logged:
+// the file is safe on the remote locations and the purge removes it later.
+func removeUploadedFile(j uploadJob) {
+	l.Verboseln("removing uploaded file", j.Path)
+	if err := os.Remove(j.Path); err != nil {
+		l.Warnf("could not remove uploaded file: %s", err)
+		return
+	}
+
+	if j.Dir == "" {
+		return
+	}
+
+	// The other files of the directory may not be uploaded yet
+	if err := os.Remove(j.Dir); err == nil {
+		l.Verboseln("removed directory", j.Dir)
+	}
+}
+
 func stopPostProcess(wg *sync.WaitGroup, rc chan error) error {
 	// Ensure the postprocessing is complete before check the
 	// return channel, otherwise the select could miss it
@@ -1592,7 +3603,7 @@ func stopPostProcess(wg *sync.WaitGroup, rc chan error) error {
 
 	select {
 	case err := <-rc:
-		return fmt.Errorf("some error encountered in postprocessing: %w", err)
+		return &postProcessError{err: err}
 	default:
 	}
 
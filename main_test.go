@@ -26,9 +26,23 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/google/go-cmp/cmp"
+	"github.com/spf13/pflag"
 )
 
 func TestExecPath(t *testing.T) {
@@ -69,52 +83,1730 @@ func TestExecPath(t *testing.T) {
 	}
 }
 
-func TestEnsureCipherParamsPresent_NoEncryptNoDecrypt_NoParams_ReturnsNil(t *testing.T) {
-	opts := options{}
+func TestGetToolVersions(t *testing.T) {
+	tools := map[string]string{
+		"pg_dump":    "pg_dump (PostgreSQL) 16.4\n",
+		"pg_dumpall": "pg_dumpall (PostgreSQL) 9.6.24\n",
+	}
+	for tool, out := range tools {
+		fakeTool(t, tool, fmt.Sprintf("#!/bin/sh\nprintf '%s'\n", out))
+	}
 
-	err := ensureCipherParamsPresent(&opts)
+	got := getToolVersions()
+	if diff := cmp.Diff(toolVersions{PgDump: 160004, PgDumpall: 90624}, got); diff != "" {
+		t.Errorf("getToolVersions() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestExecPathBinaryNames(t *testing.T) {
+	bin := fakeTool(t, "pg_dump-16", "#!/bin/sh\nprintf 'pg_dump (PostgreSQL) 16.4\\n'\n")
+	defer func() { binNames = map[string]string{} }()
+
+	opts := defaultOptions()
+	opts.BinDirectory = bin
+	opts.PgDumpBinary = "pg_dump-16"
+	opts.PgRestoreBinary = "/opt/pg/bin/pg_restore"
+	setToolPaths(opts)
+
+	var tests = []struct {
+		prog string
+		want string
+	}{
+		{"pg_dump", filepath.Join(bin, "pg_dump-16")},
+		{"pg_dumpall", filepath.Join(bin, "pg_dumpall")},
+		{"pg_restore", "/opt/pg/bin/pg_restore"},
+		{"psql", filepath.Join(bin, "psql")},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if got := execPath(st.prog); got != st.want {
+				t.Errorf("expected %q, got %q", st.want, got)
+			}
+		})
+	}
+
+	if got := pgToolVersion("pg_dump"); got != 160004 {
+		t.Errorf("got version %d of the custom pg_dump, want 160004", got)
+	}
+}
+
+func TestFormatPgVersion(t *testing.T) {
+	var tests = []struct {
+		numver int
+		want   string
+	}{
+		{0, "unknown"},
+		{80417, "8.4.17"},
+		{90624, "9.6.24"},
+		{100000, "10.0"},
+		{160004, "16.4"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if got := formatPgVersion(st.numver); got != st.want {
+				t.Errorf("expected %q, got %q", st.want, got)
+			}
+		})
+	}
+}
+
+func TestPgDumpCompressArgs(t *testing.T) {
+	var tests = []struct {
+		method string
+		level  int
+		long   bool
+		want   []string
+	}{
+		{"gzip", -1, false, nil},
+		{"gzip", 6, false, []string{"-Z", "6"}},
+		{"zstd", 0, true, []string{"-Z", "0"}},
+		{"zstd", -1, false, []string{"--compress=zstd"}},
+		{"zstd", 19, false, []string{"--compress=zstd:level=19"}},
+		{"zstd", 19, true, []string{"--compress=zstd:level=19,long"}},
+		{"zstd", -1, true, []string{"--compress=zstd:long"}},
+		{"lz4", 12, true, []string{"--compress=lz4:level=12"}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := pgDumpCompressArgs(st.method, st.level, st.long)
+			if diff := cmp.Diff(st.want, got); diff != "" {
+				t.Errorf("pgDumpCompressArgs() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// fakeBinDir is the directory of the fake tools of the running test
+var fakeBinDir string
+
+// fakeTool writes script as the tool name in a temporary directory used as
+// binDir until the end of the test, the tools of a test share the same
+// directory, which is returned. The fake tools are shell scripts, the test
+// is skipped on Windows.
+func fakeTool(t *testing.T, name string, script string) string {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake tools are shell scripts")
+	}
+
+	if fakeBinDir == "" || binDir != fakeBinDir {
+		oldBinDir := binDir
+		fakeBinDir = t.TempDir()
+		binDir = fakeBinDir
+		t.Cleanup(func() {
+			binDir = oldBinDir
+			fakeBinDir = ""
+		})
+	}
+
+	if err := os.WriteFile(filepath.Join(binDir, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return binDir
+}
+
+// newTestDump gives the dump of the database db in the custom format to a
+// temporary directory, for tests running the fake pg_dump
+func newTestDump(t *testing.T) *dump {
+	return &dump{
+		Database:      "db",
+		Options:       &dbOpts{Format: 'c', CompressLevel: -1},
+		Directory:     t.TempDir(),
+		TimeFormat:    time.RFC3339,
+		ConnString:    &ConnInfo{},
+		ExitCode:      -1,
+		PgDumpVersion: 160000,
+		Mode:          0600,
+	}
+}
+
+func TestDumpTimeout(t *testing.T) {
+	script := "#!/bin/sh\nexec sleep 30\n"
+	fakeTool(t, "pg_dump", script)
+
+	dir := t.TempDir()
+	d := newTestDump(t)
+	d.Directory = dir
+	d.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	err := d.dump(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "did not finish") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("pg_dump was not stopped in time")
+	}
+
+	if d.ExitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", d.ExitCode)
+	}
+
+	lock := formatDumpPath(dir, time.RFC3339, "lock", "db", time.Time{}, 0)
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("lock file %s was not removed: %v", lock, err)
+	}
+}
+
+func TestDumpInterrupted(t *testing.T) {
+	// The fake pg_dump creates its output file then hangs
+	script := "#!/bin/sh\n: > \"$3\"\nexec sleep 30\n"
+	fakeTool(t, "pg_dump", script)
+
+	dir := t.TempDir()
+	newDump := func() *dump {
+		d := newTestDump(t)
+		d.Directory = dir
+		return d
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel(&interruptError{reason: "test"})
+	}()
+
+	d := newDump()
+	err := d.dump(ctx, nil)
+
+	var ierr *interruptError
+	if !errors.As(err, &ierr) {
+		t.Errorf("expected an interruptError, got %v", err)
+	}
+
+	if d.ExitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", d.ExitCode)
+	}
+
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		t.Errorf("should not return error")
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("unexpected file left in backup directory: %s", e.Name())
+	}
+
+	// Once interrupted, pg_dump is not run anymore
+	d = newDump()
+	if err := d.dump(ctx, nil); !errors.As(err, &ierr) {
+		t.Errorf("expected an interruptError, got %v", err)
 	}
 }
 
-func TestEnsureCipherParamsPresent_NoEncryptNoDecrypt_HasParams_ReturnsNil(t *testing.T) {
-	opts := options{
-		CipherPublicKey:  "foo1",
-		CipherPrivateKey: "bar99",
-		CipherPassphrase: "secretwords",
+func TestDumpRetries(t *testing.T) {
+	// The fake pg_dump fails on the first run with a transient error or
+	// not, depending on its argument, then creates its output file
+	count := filepath.Join(t.TempDir(), "count")
+	script := fmt.Sprintf(`#!/bin/sh
+echo run >> %s
+if [ $(wc -l < %s) -eq 1 ]; then
+	: > "$3"
+	echo "pg_dump: error: $MSG" >&2
+	exit 1
+fi
+: > "$3"
+`, count, count)
+	fakeTool(t, "pg_dump", script)
+
+	oldDelay := dumpRetryDelay
+	dumpRetryDelay = 10 * time.Millisecond
+	defer func() { dumpRetryDelay = oldDelay }()
+
+	var tests = []struct {
+		msg     string
+		retries int
+		fails   bool
+		runs    int
+	}{
+		{"server closed the connection unexpectedly", 2, false, 2},
+		{"server closed the connection unexpectedly", 0, true, 1},
+		{"permission denied for table t", 2, true, 1},
 	}
 
-	err := ensureCipherParamsPresent(&opts)
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			os.Remove(count)
+			t.Setenv("MSG", st.msg)
+
+			dir := t.TempDir()
+			d := newTestDump(t)
+			d.Directory = dir
+			d.TimeFormat = time.RFC3339Nano
+			d.Retries = st.retries
+
+			err := d.dump(context.Background(), nil)
+			if st.fails && (err == nil || d.ExitCode != 1) {
+				t.Errorf("expected the dump to fail, got %v and exit code %d", err, d.ExitCode)
+			}
+			if !st.fails && (err != nil || d.ExitCode != 0) {
+				t.Errorf("expected the dump to succeed, got %v and exit code %d", err, d.ExitCode)
+			}
+
+			runs, err := os.ReadFile(count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(string(runs), "run"); n != st.runs {
+				t.Errorf("expected %d runs of pg_dump, got %d", st.runs, n)
+			}
+
+			// Only the dump of the successful attempt is left
+			files, _ := filepath.Glob(filepath.Join(dir, "db_*.dump"))
+			if !st.fails && (len(files) != 1 || files[0] != d.Path) {
+				t.Errorf("unexpected dump files: %v", files)
+			}
+		})
+	}
+}
+
+func TestDumpTempName(t *testing.T) {
+	// The fake pg_dump records the name of its output file, then fails
+	// when asked to
+	output := filepath.Join(t.TempDir(), "output")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$3" > %s
+: > "$3"
+test -z "$FAIL" || exit 1
+`, output)
+	fakeTool(t, "pg_dump", script)
+
+	for i, fails := range []bool{false, true} {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if fails {
+				t.Setenv("FAIL", "1")
+			}
+
+			dir := t.TempDir()
+			d := newTestDump(t)
+			d.Directory = dir
+
+			err := d.dump(context.Background(), nil)
+			if fails != (err != nil) {
+				t.Fatalf("unexpected result: %v", err)
+			}
+
+			written, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(strings.TrimSpace(string(written)), ".dump.tmp") {
+				t.Errorf("pg_dump did not write to a temporary name: %s", written)
+			}
+
+			files, _ := filepath.Glob(filepath.Join(dir, "db_*"))
+			if fails && len(files) != 0 {
+				t.Errorf("unexpected files left after a failure: %v", files)
+			}
+			if !fails && (len(files) != 1 || files[0] != d.Path) {
+				t.Errorf("unexpected dump files: %v", files)
+			}
+		})
+	}
+}
+
+func TestDumpWriteMarker(t *testing.T) {
+	// The fake pg_dump records whether the marker exists while it runs,
+	// then fails when asked to
+	output := filepath.Join(t.TempDir(), "output")
+	script := fmt.Sprintf(`#!/bin/sh
+if test -f "${3%%.tmp}.writing"; then echo present; else echo absent; fi > %s
+: > "$3"
+test -z "$FAIL" || exit 1
+`, output)
+	fakeTool(t, "pg_dump", script)
+
+	var tests = []struct {
+		marker bool
+		fails  bool
+		want   string
+	}{
+		{false, false, "absent"},
+		{true, false, "present"},
+		{true, true, "present"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if st.fails {
+				t.Setenv("FAIL", "1")
+			}
+
+			dir := t.TempDir()
+			d := newTestDump(t)
+			d.Directory = dir
+			d.WriteMarker = st.marker
+
+			err := d.dump(context.Background(), nil)
+			if st.fails != (err != nil) {
+				t.Fatalf("unexpected result: %v", err)
+			}
+
+			got, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(string(got)) != st.want {
+				t.Errorf("got marker %s while pg_dump runs, want %s", got, st.want)
+			}
+
+			// The marker is always removed once pg_dump is done
+			markers, _ := filepath.Glob(filepath.Join(dir, "*"+markerSuffix))
+			if len(markers) != 0 {
+				t.Errorf("unexpected markers left: %v", markers)
+			}
+		})
+	}
+}
+
+func TestDumpNoSync(t *testing.T) {
+	// The fake pg_dump records its arguments
+	output := filepath.Join(t.TempDir(), "args")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\n: > \"$3\"\n", output)
+	fakeTool(t, "pg_dump", script)
+
+	var tests = []struct {
+		version int
+		want    bool
+	}{
+		{160000, true},
+		{110000, false},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			d := newTestDump(t)
+			d.Options.NoSync = true
+			d.PgDumpVersion = st.version
+			if err := d.dump(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			args, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(string(args), "--no-sync"); got != st.want {
+				t.Errorf("unexpected arguments for pg_dump %d: %s", st.version, args)
+			}
+		})
+	}
+}
+
+func TestDumpClean(t *testing.T) {
+	// The fake pg_dump records its arguments
+	output := filepath.Join(t.TempDir(), "args")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\n: > \"$3\"\n", output)
+	fakeTool(t, "pg_dump", script)
+
+	var tests = []struct {
+		format   rune
+		clean    bool
+		ifExists bool
+		version  int
+		want     []string
+		notWant  []string
+	}{
+		{'p', true, true, 160000, []string{" -c ", "--if-exists"}, nil},
+		{'p', true, false, 160000, []string{" -c "}, []string{"--if-exists"}},
+		{'p', true, true, 90300, []string{" -c "}, []string{"--if-exists"}},
+		{'p', false, true, 160000, nil, []string{" -c ", "--if-exists"}},
+		{'c', true, true, 160000, nil, []string{" -c ", "--if-exists"}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			d := newTestDump(t)
+			d.Options.Format = st.format
+			d.Options.Clean = st.clean
+			d.Options.IfExists = st.ifExists
+			d.PgDumpVersion = st.version
+			if err := d.dump(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			args, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range st.want {
+				if !strings.Contains(string(args), w) {
+					t.Errorf("missing %q in arguments of pg_dump: %s", w, args)
+				}
+			}
+			for _, w := range st.notWant {
+				if strings.Contains(string(args), w) {
+					t.Errorf("unexpected %q in arguments of pg_dump: %s", w, args)
+				}
+			}
+		})
+	}
+}
+
+func TestDumpGlobalsSplit(t *testing.T) {
+	// The fake pg_dumpall writes its arguments to the output file, given
+	// last with -f
+	script := "#!/bin/sh\nfor a; do out=$a; done\necho \"$@\" > \"$out\"\n"
+	fakeTool(t, "pg_dumpall", script)
+
+	var tests = []struct {
+		name    string
+		want    string
+		notWant string
+	}{
+		{"pg_globals", "-g -w", ""},
+		{"pg_roles", "--roles-only -w", ""},
+		{"pg_tablespaces", "--tablespaces-only -w", "--no-role-passwords"},
+	}
+
+	dir := t.TempDir()
+	when := time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC)
+	fc := make(chan sumFileJob, 1)
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if err := dumpGlobals(st.name, dir, time.RFC3339, when, 0, false, &ConnInfo{}, 160000, 0600, fc); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			job := <-fc
+			if want := formatDumpPath(dir, time.RFC3339, "sql", st.name, when, 0); job.Path != want {
+				t.Errorf("got file %s, want %s", job.Path, want)
+			}
+
+			args, err := os.ReadFile(job.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(args), st.want) {
+				t.Errorf("unexpected arguments for %s: %s", st.name, args)
+			}
+			if st.notWant != "" && strings.Contains(string(args), st.notWant) {
+				t.Errorf("unexpected %s in arguments for %s: %s", st.notWant, st.name, args)
+			}
+		})
+	}
+}
+
+func TestDumpRunSubdir(t *testing.T) {
+	fakeTool(t, "pg_dump", "#!/bin/sh\n: > \"$3\"\n")
+
+	runSubdirs = true
+	defer func() { runSubdirs = false }()
+
+	// The dumps of the run start at different seconds, all their files
+	// go to the subdirectory of the run
+	run := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	var starts []time.Time
+	for _, dbname := range []string{"b1", "b2"} {
+		if len(starts) > 0 {
+			time.Sleep(time.Until(starts[0].Truncate(time.Second).Add(time.Second)))
+		}
+
+		d := newTestDump(t)
+		d.Database = dbname
+		d.Directory = dir
+		d.RunWhen = run
+		if err := d.dump(context.Background(), nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		if want := filepath.Join(dir, run.Format(time.RFC3339), dbname+".dump"); d.Path != want {
+			t.Errorf("got dump %s, want %s", d.Path, want)
+		}
+		starts = append(starts, d.When)
+	}
+
+	if starts[0].Truncate(time.Second).Equal(starts[1].Truncate(time.Second)) {
+		t.Errorf("the dumps started in the same second: %v", starts)
+	}
+}
+
+func TestDumpLockDirectory(t *testing.T) {
+	// The fake pg_dump fails when the lock is not in the lock directory
+	lockDir := filepath.Join(t.TempDir(), "locks")
+	lock := filepath.Join(lockDir, "db.lock")
+	script := fmt.Sprintf("#!/bin/sh\ntest -f %s || exit 1\n: > \"$3\"\n", lock)
+	fakeTool(t, "pg_dump", script)
+
+	dir := t.TempDir()
+	d := newTestDump(t)
+	d.Directory = dir
+	d.LockDirectory = lockDir
+	if err := d.dump(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("lock file %s was not removed: %v", lock, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "db.lock")); !os.IsNotExist(err) {
+		t.Errorf("lock file created in the backup directory: %v", err)
+	}
+}
+
+func TestDumpHooks(t *testing.T) {
+	// The fake pg_dump creates its output file
+	script := "#!/bin/sh\n: > \"$3\"\n"
+	fakeTool(t, "pg_dump", script)
+
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "hooks")
+	newDump := func(pre, post string) *dump {
+		d := newTestDump(t)
+		d.Options.PreDumpHook = pre
+		d.Options.PostDumpHook = post
+		d.Directory = dir
+		d.HookEnv = []string{"PGBK_TIMESTAMP=now"}
+		return d
+	}
+
+	d := newDump(
+		fmt.Sprintf("sh -c 'echo pre $PGBK_DBNAME $PGBK_TIMESTAMP >> %s'", out),
+		fmt.Sprintf("sh -c 'echo post $PGBK_DBNAME $PGBK_DUMP_PATH >> %s'", out),
+	)
+	if err := d.dump(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got, err := os.ReadFile(out)
 	if err != nil {
-		t.Errorf("should not return error")
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("pre db now\npost db %s\n", d.Path); string(got) != want {
+		t.Errorf("unexpected output of hooks: got %q, want %q", got, want)
+	}
+
+	// A failing pre-dump hook prevents the dump
+	d = newDump("false", "")
+	if err := d.dump(context.Background(), nil); err == nil {
+		t.Errorf("expected an error when the pre-dump hook fails")
+	}
+	if d.ExitCode != 1 || d.Path != "" {
+		t.Errorf("database was dumped after a failed pre-dump hook")
+	}
+
+	// A failing post-dump hook makes the dump fail
+	d = newDump("", "false")
+	if err := d.dump(context.Background(), nil); err == nil {
+		t.Errorf("expected an error when the post-dump hook fails")
+	}
+	if d.ExitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", d.ExitCode)
+	}
+
+	lock := formatDumpPath(dir, time.RFC3339, "lock", "db", time.Time{}, 0)
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("lock file %s was not removed: %v", lock, err)
 	}
 }
 
-func TestEnsureCipherParamsPresent_Encrypt_NoParams_Failure(t *testing.T) {
-	opts := options{
-		Encrypt:          true,
-		CipherPrivateKey: "bar99",
+func TestDumpExcludeTableData(t *testing.T) {
+	// The fake pg_dump creates its output file and saves its arguments
+	out := filepath.Join(t.TempDir(), "args")
+	script := fmt.Sprintf("#!/bin/sh\n: > \"$3\"\necho \"$@\" > %s\n", out)
+	fakeTool(t, "pg_dump", script)
+
+	var tests = []struct {
+		version int
+		want    bool
+	}{
+		{160000, true},
+		{90100, false},
 	}
 
-	err := ensureCipherParamsPresent(&opts)
-	if err == nil {
-		t.Errorf("should have error about not finding passphrase")
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			d := newTestDump(t)
+			d.Options.ExcludedTableData = []string{"queue", "cache_*"}
+			d.PgDumpVersion = st.version
+			if err := d.dump(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			has := strings.Contains(string(got), "--exclude-table-data=queue --exclude-table-data=cache_*")
+			if has != st.want {
+				t.Errorf("unexpected arguments for pg_dump %d: %s", st.version, got)
+			}
+		})
 	}
 }
 
-func TestEnsureCipherParamsPresent_Encrypt_NoParamsButEnv_Success(t *testing.T) {
-	opts := options{
-		Encrypt: true,
+func TestDumpStopOnError(t *testing.T) {
+	// The fake pg_dump fails for b1 and records the databases it dumps
+	out := filepath.Join(t.TempDir(), "dumped")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$3\" >> %s\ncase \"$3\" in *b1_*) exit 1;; esac\n: > \"$3\"\n", out)
+	fakeTool(t, "pg_dump", script)
+
+	newDump := func(dbname string) *dump {
+		d := newTestDump(t)
+		d.Database = dbname
+		return d
 	}
-	t.Setenv("PGBK_CIPHER_PASS", "works")
 
-	err := ensureCipherParamsPresent(&opts)
+	// The failure of b1 stops the dumps like run() does with
+	// --stop-on-error, b2 is then skipped without running pg_dump
+	ctx, stopDumps := context.WithCancelCause(context.Background())
+	defer stopDumps(nil)
+
+	d1 := newDump("b1")
+	err := d1.dump(ctx, nil)
+	if err == nil {
+		t.Fatalf("expected the dump of b1 to fail")
+	}
+	if d1.Skipped {
+		t.Errorf("b1 was dumped but is reported as skipped")
+	}
+	stopDumps(err)
+
+	d2 := newDump("b2")
+	if err := d2.dump(ctx, nil); err == nil {
+		t.Fatalf("expected the dump of b2 to be skipped")
+	}
+	if !d2.Skipped || d2.ExitCode == 0 {
+		t.Errorf("b2 is not reported as skipped: skipped %v, exit code %d", d2.Skipped, d2.ExitCode)
+	}
+
+	got, err := os.ReadFile(out)
 	if err != nil {
-		t.Errorf("should have read environment variable")
+		t.Fatal(err)
+	}
+	if strings.Contains(string(got), "b2_") {
+		t.Errorf("pg_dump ran for b2: %s", got)
 	}
+}
 
-	if opts.CipherPassphrase != "works" {
-		t.Errorf("passphrase was not read correctly from environment")
+func TestDumpSchemaDataSections(t *testing.T) {
+	// The fake pg_dump creates its output file and saves its arguments
+	out := filepath.Join(t.TempDir(), "args")
+	script := fmt.Sprintf("#!/bin/sh\n: > \"$3\"\necho \"$@\" > %s\n", out)
+	fakeTool(t, "pg_dump", script)
+
+	var tests = []struct {
+		schemaOnly bool
+		dataOnly   bool
+		sections   []string
+		version    int
+		want       []string
+		notWant    []string
+	}{
+		{false, false, nil, 160000, nil, []string{" -s ", " -a ", "--section"}},
+		{true, false, nil, 160000, []string{" -s "}, []string{" -a "}},
+		{false, true, nil, 160000, []string{" -a "}, []string{" -s "}},
+		{false, false, []string{"pre-data", "data"}, 160000, []string{"--section=pre-data --section=data"}, nil},
+		{false, false, []string{"pre-data"}, 90100, nil, []string{"--section"}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			d := newTestDump(t)
+			d.Options.SchemaOnly = st.schemaOnly
+			d.Options.DataOnly = st.dataOnly
+			d.Options.Sections = st.sections
+			d.PgDumpVersion = st.version
+			if err := d.dump(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, w := range st.want {
+				if !strings.Contains(string(got), w) {
+					t.Errorf("%q not found in arguments of pg_dump %d: %s", w, st.version, got)
+				}
+			}
+			for _, w := range st.notWant {
+				if strings.Contains(string(got), w) {
+					t.Errorf("unexpected %q in arguments of pg_dump %d: %s", w, st.version, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDumpOwnerPrivilegesComments(t *testing.T) {
+	// The fake pg_dump creates its output file and saves its arguments
+	out := filepath.Join(t.TempDir(), "args")
+	script := fmt.Sprintf("#!/bin/sh\n: > \"$3\"\necho \"$@\" > %s\n", out)
+	fakeTool(t, "pg_dump", script)
+
+	var tests = []struct {
+		noOwner      bool
+		noPrivileges bool
+		noComments   bool
+		version      int
+		want         []string
+		notWant      []string
+	}{
+		{false, false, false, 160000, nil, []string{" -O ", " -x ", "--no-comments"}},
+		{true, false, false, 160000, []string{" -O "}, []string{" -x "}},
+		{false, true, false, 160000, []string{" -x "}, []string{" -O "}},
+		{false, false, true, 160000, []string{"--no-comments"}, nil},
+		{true, true, true, 100000, []string{" -O ", " -x "}, []string{"--no-comments"}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			d := newTestDump(t)
+			d.Options.NoOwner = st.noOwner
+			d.Options.NoPrivileges = st.noPrivileges
+			d.Options.NoComments = st.noComments
+			d.PgDumpVersion = st.version
+			if err := d.dump(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			got, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, w := range st.want {
+				if !strings.Contains(string(got), w) {
+					t.Errorf("%q not found in arguments of pg_dump %d: %s", w, st.version, got)
+				}
+			}
+			for _, w := range st.notWant {
+				if strings.Contains(string(got), w) {
+					t.Errorf("unexpected %q in arguments of pg_dump %d: %s", w, st.version, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRunListLocalTemplate(t *testing.T) {
+	t.Setenv("PGBK_CIPHER_PASS", "")
+
+	dir := t.TempDir()
+	tmpl := "{{.DBName}}/{{.Time.Format \"2006\"}}/{{.DBName}}_{{.Timestamp}}.{{.Suffix}}"
+
+	// Create a dump named after the template
+	var err error
+	nameTmpl, err = newNameTemplate(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := formatDumpPath(dir, defaultOptions().TimeFormat, "dump", "db", time.Now(), 0)
+	nameTmpl = nil
+	if err := os.MkdirAll(filepath.Dir(dump), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dump, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldArgs := os.Args
+	oldStdout := os.Stdout
+	defer func() {
+		os.Args = oldArgs
+		os.Stdout = oldStdout
+		nameTmpl = nil
+		runSubdirs = false
+	}()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	os.Args = []string{"pg_back", "--no-config-file", "-b", dir, "--filename-template", tmpl, "--list-local"}
+	pflag.CommandLine = pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+
+	err = run()
+	w.Close()
+	os.Stdout = oldStdout
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The dump is only found when the template is used
+	if !strings.HasPrefix(string(out), "db\n") || !strings.Contains(string(out), ": 1 files, 4 bytes\n") {
+		t.Errorf("unexpected output of --list-local:\n%s", out)
+	}
+}
+
+func TestCreateLogicalSlots(t *testing.T) {
+	opts := defaultOptions()
+	opts.PerDbOpts = map[string]*dbOpts{
+		"a": {LogicalSlot: "sub"},
+		"b": {LogicalSlot: "sub"},
+		"c": {},
+	}
+
+	// Slot names are checked before connecting
+	if _, err := createLogicalSlots([]string{"a", "b", "c"}, opts, 160000, 160000, &ConnInfo{}); err == nil {
+		t.Errorf("expected an error with the same slot for two databases")
+	}
+
+	// Nothing to do without slots or with old versions
+	slots, err := createLogicalSlots([]string{"c"}, opts, 160000, 160000, &ConnInfo{})
+	if err != nil || len(slots) != 0 {
+		t.Errorf("expected no slots, got %v, %v", slots, err)
+	}
+
+	slots, err = createLogicalSlots([]string{"a", "c"}, opts, 90600, 160000, &ConnInfo{})
+	if err != nil || len(slots) != 0 {
+		t.Errorf("expected no slots, got %v, %v", slots, err)
+	}
+}
+
+func TestWriteSlotFile(t *testing.T) {
+	dir := t.TempDir()
+	when := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	d := &dump{
+		Database:   "db",
+		Options:    &dbOpts{SumAlgo: "none"},
+		Directory:  dir,
+		TimeFormat: time.RFC3339,
+		When:       when,
+		Mode:       0600,
+	}
+	s := &pgSlotSnapshot{name: "sub", lsn: "0/16B6C50", id: "00000003-00000002-1", plugin: "pgoutput"}
+
+	if err := writeSlotFile(d, s, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got, err := os.ReadFile(formatDumpPath(dir, time.RFC3339, "slot", "db", when, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "slot_name = sub\nconsistent_point = 0/16B6C50\nsnapshot_name = 00000003-00000002-1\noutput_plugin = pgoutput\n"
+	if string(got) != want {
+		t.Errorf("unexpected slot file: got %q, want %q", got, want)
+	}
+}
+
+func TestWriteInstanceFile(t *testing.T) {
+	dir := t.TempDir()
+	when := time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC)
+
+	for _, level := range []int{-1, 0, 6} {
+		file := formatDumpPath(dir, "2006-01-02_15-04-05", "out", "pg_settings", when, level)
+		if err := writeInstanceFile(file, 0600, level, writeString("work_mem = 4MB\n")); err != nil {
+			t.Fatalf("level %d: %s", level, err)
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var r io.Reader = f
+		if level > 0 {
+			if !strings.HasSuffix(file, ".out.gz") {
+				t.Errorf("expected a .out.gz file, got %s", file)
+			}
+
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("level %d: %s", level, err)
+			}
+			r = gz
+		}
+
+		data, err := io.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "work_mem = 4MB\n" {
+			t.Errorf("level %d: got %q", level, string(data))
+		}
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	var tests = []struct {
+		give error
+		want int
+	}{
+		{nil, exitSuccess},
+		{errors.New("bad option"), exitFailure},
+		{&dumpError{failed: []string{"b1", "b2", "b3"}, total: 50}, exitPartial},
+		{&dumpError{partial: []string{"b1"}, total: 50}, exitPartial},
+		{&dumpError{failed: []string{"b1", "b2"}, total: 2}, exitFailure},
+		{&dumpError{failed: []string{"b1"}, skipped: []string{"b2"}, total: 2}, exitFailure},
+		{&dumpError{failed: []string{"b1"}, skipped: []string{"b2"}, total: 3}, exitPartial},
+		{&postProcessError{err: errors.New("upload failed")}, exitPostProcess},
+		{fmt.Errorf("wrapped: %w", &postProcessError{err: errors.New("upload failed")}), exitPostProcess},
+		{&interruptError{reason: "received signal terminated"}, exitInterrupted},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if got := exitStatus(st.give); got != st.want {
+				t.Errorf("got %d, want %d", got, st.want)
+			}
+		})
+	}
+}
+
+func TestDumpErrorMessage(t *testing.T) {
+	var tests = []struct {
+		give *dumpError
+		want string
+	}{
+		{&dumpError{total: 3}, "some operation failed"},
+		{&dumpError{partial: []string{"b1", "b3"}, total: 3}, "some operation failed on databases: b1, b3"},
+		{&dumpError{failed: []string{"b2", "b1"}, partial: []string{"b3"}, total: 3}, "dump of 2 of 3 databases failed: b2, b1"},
+		{&dumpError{failed: []string{"b1"}, skipped: []string{"b2", "b3"}, total: 4}, "dump of 1 of 4 databases failed: b1, 2 skipped: b2, b3"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if got := st.give.Error(); got != st.want {
+				t.Errorf("got %q, want %q", got, st.want)
+			}
+		})
+	}
+}
+
+func TestEnsureCipherParamsPresent_NoEncryptNoDecrypt_NoParams_ReturnsNil(t *testing.T) {
+	opts := options{}
+
+	err := ensureCipherParamsPresent(&opts)
+	if err != nil {
+		t.Errorf("should not return error")
+	}
+}
+
+func TestEnsureCipherParamsPresent_NoEncryptNoDecrypt_HasParams_ReturnsNil(t *testing.T) {
+	opts := options{
+		CipherPublicKey:  "foo1",
+		CipherPrivateKey: "bar99",
+		CipherPassphrase: "secretwords",
+	}
+
+	err := ensureCipherParamsPresent(&opts)
+	if err != nil {
+		t.Errorf("should not return error")
+	}
+}
+
+func TestEnsureCipherParamsPresent_Encrypt_NoParams_Failure(t *testing.T) {
+	opts := options{
+		Encrypt:          true,
+		CipherPrivateKey: "bar99",
+	}
+
+	err := ensureCipherParamsPresent(&opts)
+	if err == nil {
+		t.Errorf("should have error about not finding passphrase")
+	}
+}
+
+func TestEnsureCipherParamsPresent_Encrypt_NoParamsButEnv_Success(t *testing.T) {
+	opts := options{
+		Encrypt: true,
+	}
+	t.Setenv("PGBK_CIPHER_PASS", "works")
+
+	err := ensureCipherParamsPresent(&opts)
+	if err != nil {
+		t.Errorf("should have read environment variable")
+	}
+
+	if opts.CipherPassphrase != "works" {
+		t.Errorf("passphrase was not read correctly from environment")
+	}
+}
+
+func TestEnsureCipherParamsPresent_Encrypt_PassFile_Success(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pass")
+	if err := os.WriteFile(path, []byte("from file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options{
+		Encrypt:        true,
+		CipherPassFile: path,
+	}
+	t.Setenv("PGBK_CIPHER_PASS", "from env")
+
+	err := ensureCipherParamsPresent(&opts)
+	if err != nil {
+		t.Errorf("should have read the passphrase file: %s", err)
+	}
+
+	if opts.CipherPassphrase != "from file" {
+		t.Errorf("passphrase was not read correctly from file, got %q", opts.CipherPassphrase)
+	}
+
+	opts = options{
+		Encrypt:        true,
+		CipherPassFile: filepath.Join(t.TempDir(), "missing"),
+	}
+	if err := ensureCipherParamsPresent(&opts); err == nil {
+		t.Errorf("should have error about the missing passphrase file")
+	}
+}
+
+func TestRekeyDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(dir, "db.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{"b_2023-01-01T00:00:00Z.dump", filepath.Join("db.d", "toc.dat")}
+	for _, f := range files {
+		path := filepath.Join(dir, f)
+		if err := os.WriteFile(path, []byte("to be encrypted"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := encryptFile(path, encryptParams{PublicKey: TEST_PUBLIC_KEY}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sumFile, err := checksumFile(filepath.Join(dir, files[0]+".age"), "sha256", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(sumFile)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rekeyDirectory(dir, decryptParams{PrivateKey: TEST_PRIVATE_KEY}, encryptParams{PublicKey: identity.Recipient().String()}, 2, nil); err != nil {
+		t.Fatalf("rekeyDirectory: %v", err)
+	}
+
+	after, _ := os.ReadFile(sumFile)
+	if string(before) == string(after) {
+		t.Errorf("checksum file was not updated")
+	}
+
+	for _, f := range files {
+		if err := decryptFile(filepath.Join(dir, f+".age"), filepath.Join(dir, f), decryptParams{PrivateKey: identity.String()}); err != nil {
+			t.Errorf("could not decrypt %s with the new key: %s", f, err)
+		}
+	}
+
+	// Files cannot be rekeyed with the old key anymore
+	if err := rekeyDirectory(dir, decryptParams{PrivateKey: TEST_PRIVATE_KEY}, encryptParams{PublicKey: TEST_PUBLIC_KEY}, 2, nil); err == nil {
+		t.Errorf("expected an error when rekeying with the old key")
+	}
+}
+
+func TestRekeyRemoteFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	name := "b_2023-01-01T00:00:00Z.dump"
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("to be encrypted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := encryptFile(path, encryptParams{PublicKey: TEST_PUBLIC_KEY}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	sumFile, err := checksumFile(path+".age", "sha256", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The files are on the remote under the prefix, the checksum file
+	// lists the path of the dump in the backup directory
+	repo := newMemRepo()
+	for _, f := range []string{path + ".age", sumFile} {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo.put("pfx/"+filepath.Base(f), data, time.Now())
+	}
+	repo.put("pfx/other.sql", []byte("not encrypted"), time.Now())
+	before := repo.keys()
+
+	oldNewRepo := newRepo
+	newRepo = func(kind string, opts options) (Repo, error) {
+		return repo, nil
+	}
+	defer func() { newRepo = oldNewRepo }()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := defaultOptions()
+	opts.Directory = dir
+	opts.UploadPrefix = "pfx"
+	if err := rekeyRemoteFiles("s3", opts, decryptParams{PrivateKey: TEST_PRIVATE_KEY}, encryptParams{PublicKey: identity.Recipient().String()}, []string{"b_*"}); err != nil {
+		t.Fatalf("rekeyRemoteFiles: %v", err)
+	}
+
+	if diff := cmp.Diff(before, repo.keys()); diff != "" {
+		t.Errorf("remote files mismatch (-want +got):\n%s", diff)
+	}
+
+	// The remote file decrypts with the new key and its checksum is
+	// the one of the rekeyed file
+	if err := os.WriteFile(path+".age", repo.files["pfx/"+name+".age"].data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decryptFile(path+".age", path, decryptParams{PrivateKey: identity.String()}); err != nil {
+		t.Errorf("could not decrypt %s with the new key: %s", name, err)
+	}
+
+	if _, err := checksumFile(path+".age", "sha256", 0600); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(sumFile)
+	if got := repo.files["pfx/"+filepath.Base(sumFile)].data; string(got) != string(want) {
+		t.Errorf("remote checksum file was not updated, got %q, want %q", got, want)
+	}
+}
+
+func TestDecryptDirectoryOutdir(t *testing.T) {
+	dir := t.TempDir()
+	outdir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "sub", "b_2023-01-01T00:00:00Z.sql")
+	if err := os.WriteFile(path, []byte("to be encrypted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := encryptFile(path, encryptParams{Passphrase: "secret"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decryptDirectory(dir, outdir, decryptParams{Passphrase: "secret"}, 1, nil, false); err != nil {
+		t.Fatalf("decryptDirectory: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(outdir, "sub", "b_2023-01-01T00:00:00Z.sql"))
+	if err != nil {
+		t.Fatalf("decrypted file not found in output directory: %v", err)
+	}
+	if string(got) != "to be encrypted" {
+		t.Errorf("got %q, want %q", got, "to be encrypted")
+	}
+
+	if _, err := os.Stat(path + ".age"); err != nil {
+		t.Errorf("encrypted file should be left untouched: %v", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("decrypted file should not be written in the backup directory")
+	}
+}
+
+func TestDecryptDirectoryRemoveSrc(t *testing.T) {
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "a_2023-01-01T00:00:00Z.sql")
+	if err := os.WriteFile(good, []byte("to be encrypted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encryptFile(good, encryptParams{Passphrase: "secret"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file that cannot be decrypted must be kept
+	bad := filepath.Join(dir, "b_2023-01-01T00:00:00Z.sql.age")
+	if err := os.WriteFile(bad, []byte("not encrypted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := decryptDirectory(dir, "", decryptParams{Passphrase: "secret"}, 1, nil, true); err == nil {
+		t.Errorf("expected an error on the invalid file")
+	}
+
+	if _, err := os.Stat(good); err != nil {
+		t.Errorf("decrypted file not found: %v", err)
+	}
+	if _, err := os.Stat(good + ".age"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("encrypted file should have been removed: %v", err)
+	}
+	if _, err := os.Stat(bad); err != nil {
+		t.Errorf("file that failed to decrypt should be kept: %v", err)
+	}
+}
+
+func TestDownloadFilesUploadPrefix(t *testing.T) {
+	remote := t.TempDir()
+	dir := t.TempDir()
+
+	files := []string{
+		"host1/db/db_2023-01-02T03:04:05Z.dump",
+		"host2/db/db_2023-01-02T03:04:05Z.dump",
+		"host10/db/db_2023-01-02T03:04:05Z.dump",
+	}
+	for _, f := range files {
+		path := filepath.Join(remote, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := defaultOptions()
+	opts.LocalDirectory = remote
+	opts.UploadPrefix = "host1"
+
+	// Globs apply to the path under the prefix
+	if err := downloadFiles("local", opts, dir, []string{"db/*"}); err != nil {
+		t.Fatalf("downloadFiles: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "db", "db_2023-01-02T03:04:05Z.dump"))
+	if err != nil {
+		t.Fatalf("file was not downloaded without its prefix: %s", err)
+	}
+	if string(got) != files[0] {
+		t.Errorf("got the file %s, want %s", got, files[0])
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "host10")); err == nil {
+		t.Errorf("files of another prefix should not have been downloaded")
+	}
+}
+
+func TestDownloadFilesSnapshot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("testing on windows")
+	}
+
+	remote := t.TempDir()
+	dir := t.TempDir()
+
+	files := []string{
+		"pg_globals_2023-01-02T03:04:05Z.sql",
+		"db/db_2023-01-02T03:04:05Z.dump",
+		"db/db_2023-01-02T03:04:05Z.dump.sha256",
+		"db/db_2023-01-01T03:04:05Z.dump",
+		"other/other_2023-01-02T03:04:05Z.d/toc.dat",
+	}
+	for _, f := range files {
+		path := filepath.Join(remote, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("truc\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := defaultOptions()
+	opts.LocalDirectory = remote
+	opts.Snapshot = "2023-01-02T03:04:05Z"
+
+	if err := downloadFiles("local", opts, dir, nil); err != nil {
+		t.Fatalf("downloadFiles: %v", err)
+	}
+
+	for i, f := range files {
+		_, err := os.Stat(filepath.Join(dir, f))
+		if want := i != 3; want != (err == nil) {
+			t.Errorf("%s: downloaded is %v, want %v", f, err == nil, want)
+		}
+	}
+
+	// Globs filter the files of the snapshot
+	dir = t.TempDir()
+	if err := downloadFiles("local", opts, dir, []string{"db/*"}); err != nil {
+		t.Fatalf("downloadFiles: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, files[0])); err == nil {
+		t.Errorf("%s should not have been downloaded", files[0])
+	}
+
+	opts.Snapshot = "2023-01-03T03:04:05Z"
+	if err := downloadFiles("local", opts, t.TempDir(), nil); err == nil {
+		t.Errorf("expected an error when no file matches the snapshot")
+	}
+}
+
+func TestDownloadFilesSnapshotRunWindow(t *testing.T) {
+	remote := newMemRepo()
+	oldNewRepo := newRepo
+	newRepo = func(kind string, opts options) (Repo, error) { return remote, nil }
+	defer func() { newRepo = oldNewRepo }()
+
+	// The dumps of the databases are stamped with their own start, after
+	// the globals of their run
+	files := []string{
+		"pg_globals_2023-01-02T03:04:05Z.sql",
+		"db/db_2023-01-02T03:04:15Z.dump",
+		"other/other_2023-01-02T03:05:00Z.dump",
+		"pg_globals_2023-01-03T03:04:05Z.sql",
+		"db/db_2023-01-03T03:04:06Z.dump",
+	}
+	for _, f := range files {
+		remote.put(filepath.FromSlash(f), []byte("truc\n"), time.Now())
+	}
+
+	opts := defaultOptions()
+	opts.Snapshot = "2023-01-02T03:04:05Z"
+
+	dir := t.TempDir()
+	if err := downloadFiles("mem", opts, dir, nil); err != nil {
+		t.Fatalf("downloadFiles: %v", err)
+	}
+
+	for i, f := range files {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f)))
+		if want := i < 3; want != (err == nil) {
+			t.Errorf("%s: downloaded is %v, want %v", f, err == nil, want)
+		}
+	}
+
+	// The last run has no end
+	opts.Snapshot = "2023-01-03T03:04:05Z"
+	dir = t.TempDir()
+	if err := downloadFiles("mem", opts, dir, nil); err != nil {
+		t.Fatalf("downloadFiles: %v", err)
+	}
+
+	for i, f := range files {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f)))
+		if want := i >= 3; want != (err == nil) {
+			t.Errorf("%s: downloaded is %v, want %v", f, err == nil, want)
+		}
+	}
+}
+
+func TestPostProcessRemoveLocal(t *testing.T) {
+	dir := t.TempDir()
+	remote := t.TempDir()
+
+	file := filepath.Join(dir, "db_2023-05-02T10:00:00Z.dump")
+	dirDump := filepath.Join(dir, "db_2023-05-02T10:00:00Z.d")
+	if err := os.MkdirAll(dirDump, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{file, filepath.Join(dirDump, "toc.dat"), filepath.Join(dirDump, "1.dat")} {
+		if err := os.WriteFile(p, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := defaultOptions()
+	opts.Directory = dir
+	opts.SumAlgo = "sha256"
+	opts.Upload = "local"
+	opts.LocalDirectory = remote
+	opts.RemoveLocal = true
+
+	var wg sync.WaitGroup
+	files := make(chan sumFileJob)
+	ret := postProcessFiles(files, &wg, opts, time.Now())
+	for _, p := range []string{file, dirDump} {
+		files <- sumFileJob{Path: p}
+	}
+	close(files)
+
+	if err := stopPostProcess(&wg, ret); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Everything was uploaded then removed from the backup directory
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("local files left after upload: %v", entries)
+	}
+
+	for _, p := range []string{
+		"db_2023-05-02T10:00:00Z.dump",
+		"db_2023-05-02T10:00:00Z.dump.sha256",
+		"db_2023-05-02T10:00:00Z.d/toc.dat",
+		"db_2023-05-02T10:00:00Z.d/1.dat",
+		"db_2023-05-02T10:00:00Z.d.sha256",
+	} {
+		if _, err := os.Stat(filepath.Join(remote, p)); err != nil {
+			t.Errorf("file not uploaded: %s", err)
+		}
+	}
+}
+
+func TestPostProcessEncryptedFiles(t *testing.T) {
+	var tests = []struct {
+		keep bool
+		want []string
+	}{
+		{
+			false,
+			[]string{
+				"db_2023-05-02T10:00:00Z.dump.age",
+				"db_2023-05-02T10:00:00Z.dump.age.sha256",
+				"db_2023-05-02T10:00:00Z.dump.sha256.age",
+			},
+		},
+		{
+			true,
+			[]string{
+				"db_2023-05-02T10:00:00Z.dump",
+				"db_2023-05-02T10:00:00Z.dump.age",
+				"db_2023-05-02T10:00:00Z.dump.age.sha256",
+				"db_2023-05-02T10:00:00Z.dump.sha256",
+				"db_2023-05-02T10:00:00Z.dump.sha256.age",
+			},
+		},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "db_2023-05-02T10:00:00Z.dump")
+			if err := os.WriteFile(file, []byte("data"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := defaultOptions()
+			opts.Directory = dir
+			opts.SumAlgo = "sha256"
+			opts.Encrypt = true
+			opts.EncryptKeepSrc = st.keep
+			opts.CipherPassphrase = "secret"
+
+			var wg sync.WaitGroup
+			files := make(chan sumFileJob)
+			ret := postProcessFiles(files, &wg, opts, time.Now())
+			files <- sumFileJob{Path: file}
+			close(files)
+
+			if err := stopPostProcess(&wg, ret); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(entries))
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if diff := cmp.Diff(st.want, got); diff != "" {
+				t.Errorf("postProcessFiles() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPostProcessUploadDestinations(t *testing.T) {
+	var tests = []struct {
+		broken bool
+		local  int
+	}{
+		{false, 0},
+		{true, 5},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "db_2023-05-02T10:00:00Z.dump")
+			dirDump := filepath.Join(dir, "db_2023-05-02T10:00:00Z.d")
+			if err := os.MkdirAll(dirDump, 0700); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{file, filepath.Join(dirDump, "toc.dat"), filepath.Join(dirDump, "1.dat")} {
+				if err := os.WriteFile(p, []byte("data"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s3 := newMemRepo()
+			gcs := newMemRepo()
+			oldNewRepo := newRepo
+			newRepo = func(kind string, opts options) (Repo, error) {
+				if kind == "gcs" && st.broken {
+					return brokenRepo{gcs}, nil
+				}
+				if kind == "gcs" {
+					return gcs, nil
+				}
+				return s3, nil
+			}
+			defer func() { newRepo = oldNewRepo }()
+
+			opts := defaultOptions()
+			opts.Directory = dir
+			opts.SumAlgo = "sha256"
+			opts.Upload = "s3,gcs"
+			opts.UploadPrefix = "backups"
+			opts.VerifyUpload = true
+			opts.RemoveLocal = true
+
+			var wg sync.WaitGroup
+			files := make(chan sumFileJob)
+			ret := postProcessFiles(files, &wg, opts, time.Now())
+			for _, p := range []string{file, dirDump} {
+				files <- sumFileJob{Path: p}
+			}
+			close(files)
+
+			err := stopPostProcess(&wg, ret)
+			if st.broken && err == nil {
+				t.Errorf("expected an error on the broken destination")
+			}
+			if !st.broken && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// A working destination gets all the files, even when
+			// another fails
+			want := []string{
+				"backups/db_2023-05-02T10:00:00Z.d.sha256",
+				"backups/db_2023-05-02T10:00:00Z.d/1.dat",
+				"backups/db_2023-05-02T10:00:00Z.d/toc.dat",
+				"backups/db_2023-05-02T10:00:00Z.dump",
+				"backups/db_2023-05-02T10:00:00Z.dump.sha256",
+			}
+			if diff := cmp.Diff(want, s3.keys()); diff != "" {
+				t.Errorf("postProcessFiles() mismatch (-want +got):\n%s", diff)
+			}
+
+			if st.broken {
+				if len(gcs.keys()) != 0 {
+					t.Errorf("got %v on the broken destination", gcs.keys())
+				}
+			} else if diff := cmp.Diff(want, gcs.keys()); diff != "" {
+				t.Errorf("postProcessFiles() mismatch (-want +got):\n%s", diff)
+			}
+
+			// Local files are only removed once they are on every
+			// destination
+			local := 0
+			filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && d.Type().IsRegular() {
+					local++
+				}
+				return nil
+			})
+			if local != st.local {
+				t.Errorf("got %d local files, want %d", local, st.local)
+			}
+		})
+	}
+}
+
+func TestPostProcessDumpSumFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db_2023-05-02T10:00:00Z.dump")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := defaultOptions()
+	opts.Directory = dir
+	opts.SumAlgo = "sha256"
+
+	d := &dump{Database: "db"}
+
+	var wg sync.WaitGroup
+	files := make(chan sumFileJob)
+	ret := postProcessFiles(files, &wg, opts, time.Now())
+	files <- sumFileJob{Path: path, SumAlgo: "sha256", Dump: d}
+	close(files)
+
+	if err := stopPostProcess(&wg, ret); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if d.SumFile != path+".sha256" {
+		t.Errorf("got checksum file %q, want %q", d.SumFile, path+".sha256")
+	}
+}
+
+func TestPostProcessCompressOnUpload(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"pg_globals_2023-05-02T10:00:00Z.sql", "db_2023-05-02T10:00:00Z.sql.gz"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := newMemRepo()
+	oldNewRepo := newRepo
+	newRepo = func(kind string, opts options) (Repo, error) {
+		return repo, nil
+	}
+	defer func() { newRepo = oldNewRepo }()
+
+	opts := defaultOptions()
+	opts.Directory = dir
+	opts.SumAlgo = "sha256"
+	opts.Upload = "s3"
+	opts.VerifyUpload = true
+	opts.CompressOnUpload = true
+
+	var wg sync.WaitGroup
+	files := make(chan sumFileJob)
+	ret := postProcessFiles(files, &wg, opts, time.Now())
+	for _, name := range []string{"pg_globals_2023-05-02T10:00:00Z.sql", "db_2023-05-02T10:00:00Z.sql.gz"} {
+		files <- sumFileJob{Path: filepath.Join(dir, name)}
+	}
+	close(files)
+
+	if err := stopPostProcess(&wg, ret); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []string{
+		"db_2023-05-02T10:00:00Z.sql.gz",
+		"db_2023-05-02T10:00:00Z.sql.gz.sha256.gz",
+		"pg_globals_2023-05-02T10:00:00Z.sql.gz",
+		"pg_globals_2023-05-02T10:00:00Z.sql.sha256.gz",
+	}
+	if diff := cmp.Diff(want, repo.keys()); diff != "" {
+		t.Errorf("postProcessFiles() mismatch (-want +got):\n%s", diff)
+	}
+
+	// The compressed copies are removed once uploaded
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("got %v, want the dumps and their checksum files", entries)
+	}
+
+	// Downloads give back the original files
+	out := t.TempDir()
+	if err := downloadFiles("s3", opts, out, []string{"*"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	data, err := os.ReadFile(filepath.Join(out, "pg_globals_2023-05-02T10:00:00Z.sql"))
+	if err != nil || string(data) != "data" {
+		t.Errorf("got %q and %v, want the original file", string(data), err)
 	}
 }
@@ -0,0 +1,177 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const lastSuccessMetric = "pg_back_last_success_timestamp_seconds"
+
+// pathSize returns the size of a file or the total size of the files inside
+// a directory, for the directory format
+func pathSize(path string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// escapeLabelValue escapes a value of a label for the Prometheus text
+// format
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// readLastSuccess gets the time of the last successful run from a previous
+// metrics file, so that it is kept when the current run fails
+func readLastSuccess(path string) (float64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == lastSuccessMetric {
+			v, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return 0, false
+			}
+			return v, true
+		}
+	}
+
+	return 0, false
+}
+
+// writeMetrics outputs the metrics of a run in the Prometheus text format
+func writeMetrics(w io.Writer, dumps []*dump, lastSuccess float64, haveSuccess bool) error {
+	b := new(strings.Builder)
+
+	if haveSuccess {
+		fmt.Fprintf(b, "# HELP %s Time of the last successful run of pg_back.\n", lastSuccessMetric)
+		fmt.Fprintf(b, "# TYPE %s gauge\n", lastSuccessMetric)
+		fmt.Fprintf(b, "%s %s\n", lastSuccessMetric, strconv.FormatFloat(lastSuccess, 'f', -1, 64))
+	}
+
+	metrics := []struct {
+		name  string
+		help  string
+		value func(d *dump) string
+	}{
+		{"pg_back_dump_duration_seconds", "Duration of the dump of the database.", func(d *dump) string {
+			return strconv.FormatFloat(d.Duration.Seconds(), 'f', -1, 64)
+		}},
+		{"pg_back_dump_size_bytes", "Size of the dump of the database.", func(d *dump) string {
+			return strconv.FormatInt(d.Size, 10)
+		}},
+		{"pg_back_dump_failed", "Whether the dump of the database failed.", func(d *dump) string {
+			if d.ExitCode != 0 {
+				return "1"
+			}
+			return "0"
+		}},
+	}
+
+	for _, m := range metrics {
+		if len(dumps) == 0 {
+			break
+		}
+
+		fmt.Fprintf(b, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(b, "# TYPE %s gauge\n", m.name)
+		for _, d := range dumps {
+			fmt.Fprintf(b, "%s{database=\"%s\"} %s\n", m.name, escapeLabelValue(d.Database), m.value(d))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeMetricsFile writes the metrics of the run to path, for the textfile
+// collector of node_exporter. The file is replaced atomically so that the
+// collector never reads a partial file.
+func writeMetricsFile(path string, dumps []*dump, success bool, now time.Time) error {
+	lastSuccess, haveSuccess := readLastSuccess(path)
+	if success {
+		lastSuccess = float64(now.Unix())
+		haveSuccess = true
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if err := writeMetrics(f, dumps, lastSuccess, haveSuccess); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// The collector must be able to read the file
+	if err := os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	l.Verboseln("metrics written to", path)
+
+	return nil
+}
@@ -0,0 +1,90 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetricsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pg_back.prom")
+
+	dumps := []*dump{
+		{Database: "b1", ExitCode: 0, Duration: 1500 * time.Millisecond, Size: 1024},
+		{Database: `b"2`, ExitCode: 1, Duration: 2 * time.Second},
+	}
+
+	now := time.Unix(1700000000, 0)
+	if err := writeMetricsFile(path, dumps, true, now); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("could not read metrics file:", err)
+	}
+
+	want := []string{
+		"pg_back_last_success_timestamp_seconds 1700000000\n",
+		"pg_back_dump_duration_seconds{database=\"b1\"} 1.5\n",
+		"pg_back_dump_size_bytes{database=\"b1\"} 1024\n",
+		"pg_back_dump_failed{database=\"b1\"} 0\n",
+		"pg_back_dump_failed{database=\"b\\\"2\"} 1\n",
+	}
+	for _, w := range want {
+		if !strings.Contains(string(b), w) {
+			t.Errorf("metrics file does not contain %q:\n%s", w, string(b))
+		}
+	}
+
+	// A failed run keeps the time of the last success
+	if err := writeMetricsFile(path, dumps, false, now.Add(time.Hour)); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	b, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal("could not read metrics file:", err)
+	}
+
+	if !strings.Contains(string(b), "pg_back_last_success_timestamp_seconds 1700000000\n") {
+		t.Errorf("time of last success not kept:\n%s", string(b))
+	}
+
+	// No temporary file must remain
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files in directory, want 1", len(entries))
+	}
+}
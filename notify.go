@@ -0,0 +1,145 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds the time spent on the webhook so that an unreachable
+// endpoint does not delay the end of the run for long
+const notifyTimeout = 10 * time.Second
+
+// runSummary is the payload sent to the webhook at the end of a run
+type runSummary struct {
+	Status     string `json:"status"`
+	Succeeded  int    `json:"succeeded"`
+	Failed     int    `json:"failed"`
+	TotalBytes int64  `json:"total_bytes"`
+	Timestamp  string `json:"timestamp"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newRunSummary(dumps []*dump, runErr error, when time.Time) runSummary {
+	s := runSummary{
+		Status:    "success",
+		Timestamp: when.Format(time.RFC3339),
+	}
+
+	for _, d := range dumps {
+		if d.ExitCode != 0 {
+			s.Failed++
+		} else {
+			s.Succeeded++
+		}
+		s.TotalBytes += d.Size
+	}
+
+	if runErr != nil {
+		s.Status = "failure"
+		s.Error = runErr.Error()
+	}
+
+	return s
+}
+
+// runSummaryLines formats the summary of the run logged at the end: the
+// totals and the failed databases, and the details of every database when
+// verbose
+func runSummaryLines(dumps []*dump, elapsed time.Duration, verbose bool) []string {
+	if len(dumps) == 0 {
+		return nil
+	}
+
+	s := newRunSummary(dumps, nil, time.Time{})
+	lines := []string{fmt.Sprintf("summary: %d of %d dumps succeeded, %s in %s",
+		s.Succeeded, len(dumps), formatBytes(s.TotalBytes), elapsed.Round(time.Second))}
+
+	sorted := slices.Clone(dumps)
+	slices.SortFunc(sorted, func(a, b *dump) int {
+		return strings.Compare(a.Database, b.Database)
+	})
+
+	for _, d := range sorted {
+		if d.Skipped {
+			lines = append(lines, fmt.Sprintf("summary: %s: skipped", d.Database))
+			continue
+		}
+
+		if d.ExitCode != 0 {
+			lines = append(lines, fmt.Sprintf("summary: %s: failed after %s", d.Database, d.Duration.Round(time.Millisecond)))
+			continue
+		}
+
+		if !verbose {
+			continue
+		}
+
+		checksum := "no checksum"
+		if d.SumFile != "" {
+			checksum = "checksum in " + d.SumFile
+		}
+
+		status := "success"
+		if d.Linked {
+			status = "unchanged"
+		}
+
+		lines = append(lines, fmt.Sprintf("summary: %s: %s, %s in %s, %s, %s", d.Database, status,
+			formatBytes(d.Size), d.Duration.Round(time.Millisecond), checksum, d.Path))
+	}
+
+	return lines
+}
+
+// notifyWebhook POSTs a summary of the run as JSON to url
+func notifyWebhook(url string, dumps []*dump, runErr error, when time.Time) error {
+	body, err := json.Marshal(newRunSummary(dumps, runErr, when))
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+
+	l.Verboseln("sending notification to", url)
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response from webhook: %s", resp.Status)
+	}
+
+	return nil
+}
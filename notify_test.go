@@ -0,0 +1,128 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNotifyWebhook(t *testing.T) {
+	var got runSummary
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	dumps := []*dump{
+		{Database: "b1", ExitCode: 0, Size: 100},
+		{Database: "b2", ExitCode: 1, Size: 20},
+		{Database: "b3", ExitCode: 0, Size: 3},
+	}
+	when := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	if err := notifyWebhook(srv.URL, dumps, errors.New("some operation failed"), when); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	want := runSummary{
+		Status:     "failure",
+		Succeeded:  2,
+		Failed:     1,
+		TotalBytes: 123,
+		Timestamp:  "2023-05-01T10:00:00Z",
+		Error:      "some operation failed",
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// The webhook responding with an error is reported
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if err := notifyWebhook(srv.URL, dumps, nil, when); err == nil {
+		t.Errorf("expected an error when the webhook fails")
+	}
+}
+
+func TestRunSummaryLines(t *testing.T) {
+	dumps := []*dump{
+		{Database: "b2", ExitCode: 1, Duration: 2 * time.Second},
+		{Database: "b1", ExitCode: 0, Size: 2048, Duration: 1500 * time.Millisecond,
+			Options: &dbOpts{SumAlgo: "sha256"}, Path: "/backups/b1.dump", SumFile: "/backups/b1.dump.sha256"},
+		{Database: "b3", ExitCode: 0, Size: 1024, Linked: true,
+			Options: &dbOpts{SumAlgo: "none"}, Path: "/backups/b3.dump"},
+		{Database: "b4", ExitCode: 1, Skipped: true},
+	}
+
+	var tests = []struct {
+		verbose bool
+		want    []string
+	}{
+		{false, []string{
+			"summary: 2 of 4 dumps succeeded, 3.0 KiB in 1m5s",
+			"summary: b2: failed after 2s",
+			"summary: b4: skipped",
+		}},
+		{true, []string{
+			"summary: 2 of 4 dumps succeeded, 3.0 KiB in 1m5s",
+			"summary: b1: success, 2.0 KiB in 1.5s, checksum in /backups/b1.dump.sha256, /backups/b1.dump",
+			"summary: b2: failed after 2s",
+			"summary: b3: unchanged, 1.0 KiB in 0s, no checksum, /backups/b3.dump",
+			"summary: b4: skipped",
+		}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := runSummaryLines(dumps, 65*time.Second, st.verbose)
+			if diff := cmp.Diff(st.want, got); diff != "" {
+				t.Errorf("runSummaryLines() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if got := runSummaryLines(nil, time.Second, true); got != nil {
+		t.Errorf("expected no summary without dumps, got %v", got)
+	}
+}
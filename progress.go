@@ -0,0 +1,182 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// progressInterval is the delay between two messages reporting the progress
+// of file transfers, 0 disables them
+var progressInterval time.Duration
+
+// progressCounter counts the bytes written to it and logs the amount of data
+// transferred and the rate at most once per interval. It can be written to
+// concurrently, by the parts of a transfer.
+type progressCounter struct {
+	mu       sync.Mutex
+	name     string
+	interval time.Duration
+	start    time.Time
+	last     time.Time
+	total    int64
+}
+
+func newProgressCounter(name string) *progressCounter {
+	now := time.Now()
+	return &progressCounter{name: name, interval: progressInterval, start: now, last: now}
+}
+
+func (p *progressCounter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.total += int64(len(b))
+
+	now := time.Now()
+	if now.Sub(p.last) >= p.interval {
+		p.last = now
+		elapsed := now.Sub(p.start)
+		l.Infof("%s: %s transferred in %v (%s/s)\n", p.name, formatBytes(p.total),
+			elapsed.Round(time.Second), formatBytes(int64(float64(p.total)/elapsed.Seconds())))
+	}
+
+	return len(b), nil
+}
+
+// progressReader returns a reader that logs the progress of the data read
+// from r, or r itself when progress reporting is disabled
+func progressReader(r io.Reader, name string) io.Reader {
+	if progressInterval <= 0 {
+		return r
+	}
+
+	return io.TeeReader(r, newProgressCounter(name))
+}
+
+// readerAtSeeker is a file read by parts at any offset, like the ones
+// uploaded concurrently by parts
+type readerAtSeeker interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+type progressReadAt struct {
+	readerAtSeeker
+	counter *progressCounter
+}
+
+func (r *progressReadAt) Read(b []byte) (int, error) {
+	n, err := r.readerAtSeeker.Read(b)
+	r.counter.Write(b[:n])
+	return n, err
+}
+
+func (r *progressReadAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.readerAtSeeker.ReadAt(b, off)
+	r.counter.Write(b[:n])
+	return n, err
+}
+
+// progressReaderAt returns a reader that logs the progress of the data read
+// from r, at any offset, or r itself when progress reporting is disabled
+func progressReaderAt(r readerAtSeeker, name string) readerAtSeeker {
+	if progressInterval <= 0 {
+		return r
+	}
+
+	return &progressReadAt{readerAtSeeker: r, counter: newProgressCounter(name)}
+}
+
+type progressWriteAt struct {
+	w       io.WriterAt
+	counter *progressCounter
+}
+
+func (w *progressWriteAt) WriteAt(b []byte, off int64) (int, error) {
+	n, err := w.w.WriteAt(b, off)
+	w.counter.Write(b[:n])
+	return n, err
+}
+
+// progressWriterAt returns a writer that logs the progress of the data
+// written to w, at any offset, or w itself when progress reporting is
+// disabled
+func progressWriterAt(w io.WriterAt, name string) io.WriterAt {
+	if progressInterval <= 0 {
+		return w
+	}
+
+	return &progressWriteAt{w: w, counter: newProgressCounter(name)}
+}
+
+// startProgress logs that the operation is still running every interval
+// until the returned function is called
+func startProgress(interval time.Duration, format string, args ...interface{}) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	start := time.Now()
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				l.Infof("%s, running for %v\n", msg, time.Since(start).Round(time.Second))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// formatBytes formats a number of bytes with binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,128 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	var tests = []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024, "5.0 MiB"},
+		{3 * 1024 * 1024 * 1024, "3.0 GiB"},
+	}
+
+	for i, st := range tests {
+		t.Run(st.want, func(t *testing.T) {
+			if got := formatBytes(st.n); got != st.want {
+				t.Errorf("%d: got %q, want %q", i, got, st.want)
+			}
+		})
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+
+	src := strings.NewReader("some data")
+
+	progressInterval = 0
+	if r := progressReader(src, "test"); r != io.Reader(src) {
+		t.Errorf("reader should not be wrapped when progress is disabled")
+	}
+
+	progressInterval = time.Hour
+	r := progressReader(src, "test")
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "some data" {
+		t.Errorf("got %q, want %q", data, "some data")
+	}
+}
+
+func TestProgressReaderWriterAt(t *testing.T) {
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+
+	src := strings.NewReader("some data")
+	dst, err := os.Create(filepath.Join(t.TempDir(), "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	progressInterval = 0
+	if r := progressReaderAt(src, "test"); r != readerAtSeeker(src) {
+		t.Errorf("reader should not be wrapped when progress is disabled")
+	}
+	if w := progressWriterAt(dst, "test"); w != io.WriterAt(dst) {
+		t.Errorf("writer should not be wrapped when progress is disabled")
+	}
+
+	// Parts are transferred concurrently, at their offset
+	progressInterval = time.Hour
+	r := progressReaderAt(src, "test")
+	w := progressWriterAt(dst, "test")
+
+	var wg sync.WaitGroup
+	for _, off := range []int64{0, 5} {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			b := make([]byte, 4)
+			n, err := r.ReadAt(b, off)
+			if err != nil && err != io.EOF {
+				t.Error(err)
+			}
+			if _, err := w.WriteAt(b[:n], off); err != nil {
+				t.Error(err)
+			}
+		}(off)
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "some\x00data" {
+		t.Errorf("got %q, want %q", data, "some\x00data")
+	}
+}
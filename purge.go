@@ -26,17 +26,168 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"time"
+	"unicode"
 )
 
+// builtinTimestampLayouts are the layouts of the legacy and rfc3339 timestamp
+// formats
+var builtinTimestampLayouts = []string{"2006-01-02_15-04-05", time.RFC3339}
+
+// timestampLayouts lists the layouts tried to parse the timestamps in the
+// names of the files, a custom layout is added to the built-in ones by
+// setTimestampLayout
+var timestampLayouts = builtinTimestampLayouts
+
+// timestampLocation is the time zone of the timestamps in the names of the
+// files, it is UTC when forced by setTimestampLocation
+var timestampLocation = time.Local
+
+// setTimestampLocation makes the timestamps in the names of the files use
+// UTC instead of the local time zone
+func setTimestampLocation(utc bool) {
+	timestampLocation = time.Local
+	if utc {
+		timestampLocation = time.UTC
+	}
+}
+
+// parseDumpTimestamp parses the timestamp part of a filename produced by
+// pg_back. We match the string using every timestamp format possible so that
+// the format can be changed without breaking the purge
+func parseDumpTimestamp(s string) (time.Time, bool) {
+	for _, layout := range timestampLayouts {
+
+		// Parse the format to a time in the timezone of the
+		// timestamps, local or UTC, when the timezone is not part of
+		// the string, otherwise it uses to timezone written in the
+		// string. We do this because the timestamps were written in
+		// this timezone.
+		date, _ := time.ParseInLocation(layout, s, timestampLocation)
+		if !date.IsZero() {
+			return date, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// builtinTimestampPattern matches the timestamps in the legacy and rfc3339
+// formats
+const builtinTimestampPattern = `\d{4}-\d{2}-\d{2}(?:_\d{2}-\d{2}-\d{2}|T\d{2}:\d{2}:\d{2}(?:Z|[+-]\d{2}:\d{2}))`
+
+// dumpTimestampPattern matches the timestamp in the name of the files, in
+// any of the formats accepted by parseDumpTimestamp
+var dumpTimestampPattern = builtinTimestampPattern
+
+var reDumpTimestamp = regexp.MustCompile(dumpTimestampPattern)
+
+// setTimestampLayout makes a custom timestamp layout recognized in the names
+// of the files, in addition to the built-in ones, so that the purge keeps
+// matching the files whatever the format used when they were written
+func setTimestampLayout(layout string) {
+	timestampLayouts = builtinTimestampLayouts
+	dumpTimestampPattern = builtinTimestampPattern
+
+	if !slices.Contains(builtinTimestampLayouts, layout) {
+		timestampLayouts = append(slices.Clone(builtinTimestampLayouts), layout)
+		dumpTimestampPattern = `(?:` + builtinTimestampPattern + `|` + layoutPattern(layout) + `)`
+	}
+
+	reDumpTimestamp = regexp.MustCompile(dumpTimestampPattern)
+}
+
+// layoutPattern returns a regular expression matching the timestamps
+// formatted with layout. It is built from sample dates, in UTC and with an
+// offset, where digits, letters and signs are made generic.
+func layoutPattern(layout string) string {
+	samples := make([]string, 0, 2)
+	for _, loc := range []*time.Location{time.UTC, time.FixedZone("", -5*3600)} {
+		var b strings.Builder
+		var prev rune
+		for _, r := range time.Date(2023, 11, 22, 21, 43, 54, 0, loc).Format(layout) {
+			class := r
+			switch {
+			case unicode.IsDigit(r):
+				class = '0'
+				if prev != class {
+					b.WriteString(`\d+`)
+				}
+			case unicode.IsLetter(r):
+				class = 'a'
+				if prev != class {
+					b.WriteString(`[A-Za-z]+`)
+				}
+			case r == '+' || r == '-':
+				b.WriteString(`[+-]`)
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+			prev = class
+		}
+
+		if !slices.Contains(samples, b.String()) {
+			samples = append(samples, b.String())
+		}
+	}
+
+	return `(?:` + strings.Join(samples, "|") + `)`
+}
+
+// runEnd finds the end of the run started at when, that is the start of the
+// next run, among the timestamps of the files of the instance: they are
+// dumped once per run and stamped with its start, while the dumps of the
+// databases are stamped with their own start. The end is zero for the last
+// run. When no run started at when, the end is when itself so that only the
+// files stamped with this time are part of it.
+func runEnd(stamps []time.Time, when time.Time) time.Time {
+	started := false
+	var end time.Time
+	for _, t := range stamps {
+		if t.Equal(when) {
+			started = true
+		}
+
+		if t.After(when) && (end.IsZero() || t.Before(end)) {
+			end = t
+		}
+	}
+
+	if !started {
+		return when
+	}
+
+	return end
+}
+
+// inRun tells if the time t is part of the run started at when and ending at
+// end, as given by runEnd
+func inRun(t time.Time, when time.Time, end time.Time) bool {
+	return t.Equal(when) || (t.After(when) && (end.IsZero() || t.Before(end)))
+}
+
+// hasRunTimestamp tells if one of the timestamps found in path, in the name
+// of the file or of one of its parent directories, is part of the run started
+// at when and ending at end
+func hasRunTimestamp(path string, when time.Time, end time.Time) bool {
+	for _, s := range reDumpTimestamp.FindAllString(path, -1) {
+		if date, ok := parseDumpTimestamp(s); ok && inRun(date, when, end) {
+			return true
+		}
+	}
+
+	return false
+}
+
 type purgeJob struct {
 	datetime time.Time
 	dirs     []string
@@ -47,36 +198,58 @@ func genPurgeJobs(items []Item, dbname string) []purgeJob {
 	jobs := make(map[string]purgeJob)
 
 	// The files to purge must be grouped by date. depending on the options
-	// there can be up to 6 files for a database or output
-	reExt := regexp.MustCompile(`^(sql|d|dump|tar|out|createdb\.sql)(?:\.(sha\d{1,3}|age))?(?:\.(sha\d{1,3}|age))?(?:\.(sha\d{1,3}))?`)
+	// there can be up to 5 files for a database or output: the dump, its
+	// checksum, the encrypted dump, the checksum of the encrypted dump and
+	// the encrypted checksum, e.g. .dump, .dump.sha256, .dump.age,
+	// .dump.age.sha256 and .dump.sha256.age. The combined checksum files
+	// have the algorithm as extension. Older versions also produced the
+	// checksum of the encrypted checksum, .dump.sha256.age.sha256. An
+	// incomplete dump left by a crash has a .tmp suffix. On remote
+	// locations, files compressed on upload have a .gz suffix.
+	sumExt := `sha\d{1,3}|blake2b-\d{3}|xxh64|xxh3`
+	reExt := regexp.MustCompile(`^(?:sql|d|d\.tar|dump|tar|out|createdb\.sql|extensions\.out|slot|` + sumExt + `)(?:\.(?:gz|zst|lz4))?(?:\.(?:` + sumExt + `))?(?:\.age)?(?:\.(?:` + sumExt + `))?(?:\.gz)?(?:\.tmp)?$`)
+
+	// With a filename template, the keys are paths relative to the
+	// directory of the dumps, their name is converted to the default
+	// name to be parsed
+	var reName *regexp.Regexp
+	if nameTmpl != nil {
+		reName = nameTmpl.nameRegexp(dbname)
+	}
 
 	for _, item := range items {
-		if strings.HasPrefix(item.key, cleanDBName(dbname)+"_") {
-			dateNExt := strings.TrimPrefix(item.key, cleanDBName(dbname)+"_")
+		name := item.key
+		if reName != nil {
+			var ok bool
+			if name, ok = canonicalDumpName(reName, item.key, dbname); !ok {
+				continue
+			}
+		} else if runSubdirs {
+			var ok bool
+			if name, ok = runSubdirName(item.key, dbname); !ok {
+				continue
+			}
+		}
+
+		// Remote repositories list the contents of dumps in the
+		// directory format as keys under the directory of the dump,
+		// e.g. db_{date}.d/toc.dat. They are attributed to the job of
+		// the directory so that the dump is purged as a unit
+		name, inner, inDir := strings.Cut(filepath.ToSlash(name), "/")
+
+		if strings.HasPrefix(name, cleanDBName(dbname)+"_") {
+			dateNExt := strings.TrimPrefix(name, cleanDBName(dbname)+"_")
 			parts := strings.SplitN(dateNExt, ".", 2)
+			if len(parts) != 2 {
+				continue
+			}
 
-			var (
-				date   time.Time
-				parsed bool
-			)
-
-			// We match the file using every timestamp format
-			// possible so that the format can be changed without
-			// breaking the purge
-			for _, layout := range []string{"2006-01-02_15-04-05", time.RFC3339} {
-
-				// Parse the format to a time in the local
-				// timezone when the timezone is not part of
-				// the string, otherwise it uses to timezone
-				// written in the string. We do this because
-				// the limit is in the local timezone.
-				date, _ = time.ParseInLocation(layout, parts[0], time.Local)
-				if !date.IsZero() {
-					parsed = true
-					break
-				}
+			if inDir && (inner == "" || strings.TrimSuffix(parts[1], ".tmp") != "d") {
+				// only dumps in the directory format contain files
+				continue
 			}
 
+			date, parsed := parseDumpTimestamp(parts[0])
 			if !parsed {
 				// the file does not match the time format, skip it
 				continue
@@ -84,8 +257,7 @@ func genPurgeJobs(items []Item, dbname string) []purgeJob {
 
 			// Identify the kind of file based on the dot separated
 			// strings at the end of its name
-			matches := reExt.FindStringSubmatch(parts[1])
-			if len(matches) == 5 {
+			if reExt.MatchString(parts[1]) {
 				job := jobs[parts[0]]
 
 				if job.datetime.IsZero() {
@@ -108,9 +280,13 @@ func genPurgeJobs(items []Item, dbname string) []purgeJob {
 		}
 	}
 
-	// The output is a list of jobs, sorted by date, youngest first
+	// The output is a list of jobs, sorted by date, youngest first. The
+	// directories are sorted in reverse order so that subdirectories come
+	// before their parent, for repositories that cannot remove non-empty
+	// directories
 	jobList := make([]purgeJob, 0)
 	for _, j := range jobs {
+		sort.Sort(sort.Reverse(sort.StringSlice(j.dirs)))
 		jobList = append(jobList, j)
 	}
 
@@ -121,6 +297,102 @@ func genPurgeJobs(items []Item, dbname string) []purgeJob {
 	return jobList
 }
 
+// listDumpItems lists the files of the directory containing the dumps of
+// dbname. With a filename template, files are searched in subdirectories and
+// their keys are relative to dirpath. Directories matching the name of a dump
+// are not walked into. With timestamped subdirectories, the files of the
+// subdirectories of the runs are listed.
+func listDumpItems(dirpath string, dbname string) ([]Item, error) {
+	files := make([]Item, 0)
+
+	if runSubdirs {
+		runs, err := listRunDirs(dirpath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, run := range runs {
+			entries, err := os.ReadDir(filepath.Join(dirpath, run.name))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, e := range entries {
+				info, err := e.Info()
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, Item{key: filepath.Join(run.name, e.Name()), modtime: info.ModTime(), isDir: e.IsDir()})
+			}
+		}
+
+		return files, nil
+	}
+
+	if nameTmpl == nil {
+		entries, err := os.ReadDir(dirpath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, Item{key: e.Name(), modtime: info.ModTime(), isDir: e.IsDir()})
+		}
+
+		return files, nil
+	}
+
+	reName := nameTmpl.nameRegexp(dbname)
+	err := filepath.WalkDir(dirpath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == dirpath {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, Item{key: relPath(dirpath, path), modtime: info.ModTime(), isDir: d.IsDir()})
+
+		if d.IsDir() && reName.MatchString(d.Name()) {
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+// removeEmptyDirs removes the empty parent directories of path left by the
+// purge when using a filename template, up to dirpath which is kept
+func removeEmptyDirs(path string, dirpath string) {
+	if nameTmpl == nil {
+		return
+	}
+
+	for dir := filepath.Dir(path); dir != dirpath && strings.HasPrefix(dir, dirpath); dir = filepath.Dir(dir) {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+
+		l.Verboseln("removing empty directory", dir)
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
 func purgeDumps(directory string, dbname string, keep int, limit time.Time) error {
 	l.Verboseln("purge:", dbname, "limit:", limit, "keep:", keep)
 
@@ -128,27 +400,10 @@ func purgeDumps(directory string, dbname string, keep int, limit time.Time) erro
 	// have to compute it first. This is why a dbname is required to purge
 	// old dumps
 	dirpath := filepath.Dir(formatDumpPath(directory, "", "", dbname, time.Time{}, 0))
-	dir, err := os.Open(dirpath)
+	files, err := listDumpItems(dirpath, dbname)
 	if err != nil {
 		return fmt.Errorf("could not purge %s: %s", dirpath, err)
 	}
-	defer dir.Close()
-
-	files := make([]Item, 0)
-	for {
-		var f []os.FileInfo
-		f, err = dir.Readdir(1)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				// reset to avoid returning is.EOF at the end
-				err = nil
-				break
-			}
-			return fmt.Errorf("could not purge %s: %s", dirpath, err)
-		}
-
-		files = append(files, Item{key: f[0].Name(), modtime: f[0].ModTime(), isDir: f[0].IsDir()})
-	}
 
 	// Parse and group by date. We remove groups of files produced by
 	// the same run (including checksums, encrypted files, etc)
@@ -176,6 +431,7 @@ func purgeDumps(directory string, dbname string, keep int, limit time.Time) erro
 					if err = os.Remove(path); err != nil {
 						l.Errorln(err)
 					}
+					removeEmptyDirs(path, dirpath)
 				}
 
 				for _, d := range j.dirs {
@@ -184,6 +440,7 @@ func purgeDumps(directory string, dbname string, keep int, limit time.Time) erro
 					if err = os.RemoveAll(path); err != nil {
 						l.Errorln(err)
 					}
+					removeEmptyDirs(path, dirpath)
 				}
 			} else {
 				for _, f := range j.files {
@@ -204,6 +461,183 @@ func purgeDumps(directory string, dbname string, keep int, limit time.Time) erro
 	return nil
 }
 
+// runDir is the subdirectory of a run, with timestamped subdirectories
+type runDir struct {
+	name     string
+	datetime time.Time
+}
+
+// listRunDirs finds the subdirectories of the runs in dirpath, youngest
+// first. Other subdirectories are ignored.
+func listRunDirs(dirpath string) ([]runDir, error) {
+	entries, err := os.ReadDir(dirpath)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]runDir, 0)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		if date, ok := parseDumpTimestamp(e.Name()); ok {
+			runs = append(runs, runDir{name: e.Name(), datetime: date})
+		}
+	}
+
+	sort.SliceStable(runs, func(i, j int) bool {
+		return runs[i].datetime.After(runs[j].datetime)
+	})
+
+	return runs, nil
+}
+
+// purgeRunDirs removes the subdirectories of the runs older than limit from
+// dirpath, keeping at least keep of them. The files of all the databases of
+// a run are removed together.
+func purgeRunDirs(dirpath string, keep int, limit time.Time) error {
+	l.Verboseln("purge runs:", dirpath, "limit:", limit, "keep:", keep)
+
+	runs, err := listRunDirs(dirpath)
+	if err != nil {
+		return fmt.Errorf("could not purge %s: %s", dirpath, err)
+	}
+
+	if keep >= len(runs) || keep < 0 {
+		return nil
+	}
+
+	for _, r := range runs[:keep] {
+		l.Verboseln("keeping (count)", filepath.Join(dirpath, r.name))
+	}
+
+	for _, r := range runs[keep:] {
+		path := filepath.Join(dirpath, r.name)
+		if !r.datetime.Before(limit) {
+			l.Verboseln("keeping (age)", path)
+			continue
+		}
+
+		l.Infoln("removing", path)
+		if err = os.RemoveAll(path); err != nil {
+			l.Errorln(err)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not purge %s: %s", dirpath, err)
+	}
+
+	return nil
+}
+
+// runDirsToPurge gives the directories containing the subdirectories of the
+// runs, with the options of their purge. When the name of the database is
+// part of the backup directory, each database has its own runs purged with
+// its options, otherwise the runs are shared and the default options apply.
+func runDirsToPurge(opts options, databases []string, others []string, defDbOpts *dbOpts) map[string]*dbOpts {
+	dirs := make(map[string]*dbOpts)
+
+	for _, dbname := range databases {
+		o, found := opts.PerDbOpts[dbname]
+		if !found || !strings.Contains(opts.Directory, "{dbname}") {
+			o = defDbOpts
+		}
+
+		dirs[filepath.Dir(formatDumpPath(opts.Directory, "", "", dbname, time.Time{}, 0))] = o
+	}
+
+	for _, other := range others {
+		dirpath := filepath.Dir(formatDumpPath(opts.Directory, "", "", other, time.Time{}, 0))
+		if _, found := dirs[dirpath]; !found {
+			dirs[dirpath] = defDbOpts
+		}
+	}
+
+	return dirs
+}
+
+// purgeRemoteRunDirs removes the runs older than limit from the remote copy
+// of dirpath, keeping at least keep of them, like purgeRunDirs
+func purgeRemoteRunDirs(repo Repo, uploadPrefix string, directory string, dirpath string, keep int, limit time.Time) error {
+	l.Verboseln("remote purge runs:", dirpath, "limit:", limit, "keep:", keep)
+
+	parentDir := filepath.Join(uploadPrefix, relPath(directory, dirpath))
+	prefix := parentDir + "/"
+	if parentDir == "." {
+		parentDir = ""
+		prefix = ""
+	}
+
+	l.Verboseln("remote file prefix:", prefix)
+
+	remoteFiles, err := repo.List(prefix)
+	if err != nil {
+		return fmt.Errorf("could not purge: %w", err)
+	}
+
+	// Group the files by the subdirectory of their run, the directory
+	// itself is listed by some repositories
+	jobs := make(map[string]purgeJob)
+	for _, i := range remoteFiles {
+		f, err := filepath.Rel(parentDir, i.key)
+		if err != nil {
+			l.Warnf("could not process remote file %s: %s", i.key, err)
+			continue
+		}
+
+		run, _, _ := strings.Cut(filepath.ToSlash(f), "/")
+		date, ok := parseDumpTimestamp(run)
+		if !ok {
+			continue
+		}
+
+		job := jobs[run]
+		job.datetime = date
+		if i.isDir {
+			job.dirs = append(job.dirs, f)
+		} else {
+			job.files = append(job.files, f)
+		}
+		jobs[run] = job
+	}
+
+	runs := make([]purgeJob, 0, len(jobs))
+	for _, j := range jobs {
+		sort.Sort(sort.Reverse(sort.StringSlice(j.dirs)))
+		runs = append(runs, j)
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].datetime.After(runs[j].datetime)
+	})
+
+	if keep >= len(runs) || keep < 0 {
+		return nil
+	}
+
+	for _, j := range runs[keep:] {
+		if !j.datetime.Before(limit) {
+			continue
+		}
+
+		for _, f := range append(j.files, j.dirs...) {
+			path := filepath.Join(parentDir, f)
+			l.Infoln("removing remote", path)
+			if err = repo.Remove(path); err != nil {
+				l.Errorln(err)
+			}
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not purge: %w", err)
+	}
+
+	return nil
+}
+
 func purgeRemoteDumps(repo Repo, uploadPrefix string, directory string, dbname string, keep int, limit time.Time) error {
 	l.Verboseln("remote purge:", dbname, "limit:", limit, "keep:", keep)
 
@@ -214,6 +648,18 @@ func purgeRemoteDumps(repo Repo, uploadPrefix string, directory string, dbname s
 	dirpath := filepath.Dir(formatDumpPath(directory, "", "", dbname, time.Time{}, 0))
 	prefix := filepath.Join(uploadPrefix, relPath(directory, filepath.Join(dirpath, cleanDBName(dbname))))
 
+	// With a filename template, files can be in any subdirectory. The
+	// separator is the one of the local paths, like in the keys given by
+	// the local and sftp repositories, the others convert it
+	if nameTmpl != nil {
+		prefix = filepath.Dir(prefix)
+		if prefix == "." {
+			prefix = ""
+		} else {
+			prefix += string(filepath.Separator)
+		}
+	}
+
 	l.Verboseln("remote file prefix:", prefix)
 
 	// Get the list of files from the repository, this includes the
@@ -295,3 +741,134 @@ func purgeRemoteDumps(repo Repo, uploadPrefix string, directory string, dbname s
 
 	return nil
 }
+
+// localDumpNames finds the names of the databases, and of the instance level
+// files, having files in the backup directory
+func localDumpNames(directory string) ([]string, error) {
+	var re *regexp.Regexp
+	if nameTmpl != nil {
+		re = nameTmpl.dbnameRegexp()
+	} else if runSubdirs {
+		re = regexp.MustCompile(`^(.+?)\.(?:sql|d|dump|tar|out|createdb\.sql|extensions\.out|slot|sha\d{1,3}|blake2b-\d{3}|xxh64|xxh3)(?:\.|$)`)
+	} else {
+		re = regexp.MustCompile(`^(.+)_` + dumpTimestampPattern + `\.`)
+	}
+
+	// The name of the database can be part of the path of the backup
+	// directory
+	dirs, err := filepath.Glob(strings.ReplaceAll(directory, "{dbname}", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool)
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if path == dir {
+				return nil
+			}
+
+			if matches := re.FindStringSubmatch(d.Name()); matches != nil {
+				found[matches[1]] = true
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+
+			// Without a template, dumps are not in subdirectories,
+			// except the ones of the runs
+			if d.IsDir() && nameTmpl == nil {
+				if _, ok := parseDumpTimestamp(d.Name()); runSubdirs && ok && filepath.Dir(path) == dir {
+					return nil
+				}
+				return fs.SkipDir
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// listLocalDumps prints the files of each run found in the backup directory,
+// grouped like the purge does, for the databases and instance level files
+// matching the globs, or all of them when there are no globs
+func listLocalDumps(w io.Writer, directory string, globs []string) error {
+	names, err := localDumpNames(directory)
+	if err != nil {
+		return fmt.Errorf("could not list contents of %s: %w", directory, err)
+	}
+
+	for _, name := range names {
+		keep := len(globs) == 0
+		for _, glob := range globs {
+			keep, err = filepath.Match(glob, name)
+			if err != nil {
+				return fmt.Errorf("bad pattern: %w", err)
+			}
+
+			if keep {
+				break
+			}
+		}
+
+		if !keep {
+			continue
+		}
+
+		dirpath := filepath.Dir(formatDumpPath(directory, "", "", name, time.Time{}, 0))
+		items, err := listDumpItems(dirpath, name)
+		if err != nil {
+			return fmt.Errorf("could not list contents of %s: %w", dirpath, err)
+		}
+
+		jobs := genPurgeJobs(items, name)
+		if len(jobs) == 0 {
+			continue
+		}
+
+		fmt.Fprintln(w, name)
+		for _, j := range jobs {
+			files := make([]string, 0, len(j.files)+len(j.dirs))
+			files = append(files, j.files...)
+			files = append(files, j.dirs...)
+			sort.Strings(files)
+
+			var size int64
+			encrypted := ""
+			for _, f := range files {
+				s, err := pathSize(filepath.Join(dirpath, f))
+				if err != nil {
+					l.Warnf("could not get size of %s: %s", f, err)
+				}
+				size += s
+
+				if strings.HasSuffix(f, ".age") {
+					encrypted = ", encrypted"
+				}
+			}
+
+			fmt.Fprintf(w, "  %s: %d files, %d bytes%s\n", j.datetime.Format(time.RFC3339), len(files), size, encrypted)
+			for _, f := range files {
+				fmt.Fprintf(w, "    %s\n", filepath.Join(dirpath, f))
+			}
+		}
+	}
+
+	return nil
+}
@@ -26,13 +26,17 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 // func purgeDumps(directory string, dbname string, keep int, limit time.Time) error
@@ -169,3 +173,535 @@ func TestPurgeDumps(t *testing.T) {
 		})
 	}
 }
+
+func TestGenPurgeJobsChecksums(t *testing.T) {
+	items := []Item{
+		{key: "checksums_2023-05-01T10:00:00+02:00.sha256"},
+		{key: "checksums_2023-05-02T10:00:00+02:00.sha256"},
+		{key: "checksums_2023-05-02T10:00:00+02:00.xxh3"},
+		{key: "checksums_2023-05-02T10:00:00+02:00.blake2b-512"},
+		{key: "checksums_2023-05-02T10:00:00+02:00.txt"},
+	}
+
+	jobs := genPurgeJobs(items, "checksums")
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(jobs))
+	}
+
+	// youngest first
+	if len(jobs[0].files) != 3 {
+		t.Errorf("got %v, want 3 files", jobs[0].files)
+	}
+	if len(jobs[1].files) != 1 {
+		t.Errorf("got %v, want 1 file", jobs[1].files)
+	}
+}
+
+func TestGenPurgeJobsExtensions(t *testing.T) {
+	items := []Item{
+		{key: "db_2023-05-02T10:00:00+02:00.dump"},
+		{key: "db_2023-05-02T10:00:00+02:00.extensions.out"},
+		{key: "db_2023-05-02T10:00:00+02:00.extensions.out.sha256"},
+		{key: "db_2023-05-02T10:00:00+02:00.extensions.out.age"},
+		{key: "db_2023-05-02T10:00:00+02:00.slot"},
+	}
+
+	jobs := genPurgeJobs(items, "db")
+	if len(jobs) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(jobs))
+	}
+
+	if len(jobs[0].files) != 5 {
+		t.Errorf("got %v, want 5 files", jobs[0].files)
+	}
+}
+
+func TestGenPurgeJobsCompressedOnUpload(t *testing.T) {
+	items := []Item{
+		{key: "db_2023-05-02T10:00:00+02:00.dump.gz"},
+		{key: "db_2023-05-02T10:00:00+02:00.dump.sha256.gz"},
+		{key: "db_2023-05-02T10:00:00+02:00.createdb.sql.gz"},
+		{key: "db_2023-05-02T10:00:00+02:00.dump.age"},
+		{key: "db_2023-05-02T10:00:00+02:00.dump.age.sha256.gz"},
+	}
+
+	jobs := genPurgeJobs(items, "db")
+	if len(jobs) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(jobs))
+	}
+
+	if len(jobs[0].files) != 5 {
+		t.Errorf("got %v, want 5 files", jobs[0].files)
+	}
+}
+
+func TestGenPurgeJobsLockAndState(t *testing.T) {
+	items := []Item{
+		{key: "db_2023-05-02T10:00:00+02:00.dump"},
+		{key: "db.lock"},
+		{key: "db.state"},
+	}
+
+	jobs := genPurgeJobs(items, "db")
+	if len(jobs) != 1 {
+		t.Fatalf("got %d jobs, want 1", len(jobs))
+	}
+
+	if len(jobs[0].files) != 1 {
+		t.Errorf("got %v, want only the dump", jobs[0].files)
+	}
+}
+
+func TestListLocalDumps(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{
+		"db_1_2023-05-02_10-00-00.dump",
+		"db_1_2023-05-02_10-00-00.dump.sha256",
+		"db_1_2023-05-03_10-00-00.dump.age",
+		"db_2023-05-03_10-00-00.dump",
+		"pg_globals_2023-05-03_10-00-00.sql",
+		"notes.txt",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names, err := localDumpNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"db", "db_1", "pg_globals"}, names); diff != "" {
+		t.Errorf("localDumpNames() mismatch (-want +got):\n%s", diff)
+	}
+
+	var buf bytes.Buffer
+	if err := listLocalDumps(&buf, dir, []string{"db_*"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := buf.String()
+	if !strings.HasPrefix(got, "db_1\n") || strings.Contains(got, "pg_globals") {
+		t.Errorf("unexpected selection of dumps:\n%s", got)
+	}
+
+	for _, want := range []string{": 1 files, 4 bytes, encrypted\n", ": 2 files, 8 bytes\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in output:\n%s", want, got)
+		}
+	}
+}
+
+func TestGenPurgeJobsCompressed(t *testing.T) {
+	items := []Item{
+		{key: "pg_settings_2023-05-02T10:00:00+02:00.out.gz"},
+		{key: "pg_settings_2023-05-02T10:00:00+02:00.out.gz.sha256"},
+		{key: "pg_settings_2023-05-02T10:00:00+02:00.out.gz.age"},
+		{key: "pg_settings_2023-05-01T10:00:00+02:00.tar.zst"},
+		{key: "pg_settings_2023-05-01T10:00:00+02:00.tar.zst.sha256"},
+		{key: "pg_settings_2023-05-01T10:00:00+02:00.tar.lz4.age"},
+		{key: "pg_settings_2023-05-01T10:00:00+02:00.tar.xz"},
+	}
+
+	jobs := genPurgeJobs(items, "pg_settings")
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(jobs))
+	}
+
+	if len(jobs[0].files) != 3 {
+		t.Errorf("got %v, want 3 files", jobs[0].files)
+	}
+	if len(jobs[1].files) != 3 {
+		t.Errorf("got %v, want 3 files", jobs[1].files)
+	}
+}
+
+func TestHasRunTimestamp(t *testing.T) {
+	when := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	local := when.In(time.Local).Format("2006-01-02_15-04-05")
+
+	var tests = []struct {
+		path string
+		want bool
+	}{
+		{"db_2023-01-02T03:04:05Z.dump", true},
+		{"db_2023-01-02T03:04:05Z.dump.sha256", true},
+		{"db/db_2023-01-02T03:04:05Z.d/toc.dat", true},
+		{"db_" + local + ".sql", true},
+		{"db_2023-01-02T03:04:06Z.dump", false},
+		{"pg_globals.sql", false},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if got := hasRunTimestamp(st.path, when, when); got != st.want {
+				t.Errorf("%s: got %v, want %v", st.path, got, st.want)
+			}
+		})
+	}
+}
+
+func TestRunEnd(t *testing.T) {
+	first := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	second := first.Add(time.Hour)
+	stamps := []time.Time{second, first, first}
+
+	var tests = []struct {
+		when time.Time
+		end  time.Time
+		in   []time.Time
+		out  []time.Time
+	}{
+		{first, second, []time.Time{first, first.Add(time.Minute)}, []time.Time{first.Add(-time.Second), second}},
+		{second, time.Time{}, []time.Time{second, second.Add(24 * time.Hour)}, []time.Time{first}},
+		{first.Add(time.Minute), first.Add(time.Minute), []time.Time{first.Add(time.Minute)}, []time.Time{first.Add(2 * time.Minute)}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			end := runEnd(stamps, st.when)
+			if !end.Equal(st.end) {
+				t.Errorf("got end %v, want %v", end, st.end)
+			}
+
+			for _, ts := range st.in {
+				if !inRun(ts, st.when, end) {
+					t.Errorf("%v should be in the run", ts)
+				}
+			}
+
+			for _, ts := range st.out {
+				if inRun(ts, st.when, end) {
+					t.Errorf("%v should not be in the run", ts)
+				}
+			}
+		})
+	}
+}
+
+func TestGenPurgeJobsCustomTimestamp(t *testing.T) {
+	setTimestampLayout("20060102T150405Z")
+	defer setTimestampLayout(time.RFC3339)
+
+	// Files written with the built-in formats before the change of format
+	// are still purged
+	items := []Item{
+		{key: "db_20230503T100000Z.dump"},
+		{key: "db_20230503T100000Z.dump.sha256"},
+		{key: "db_20230502T100000Z.dump"},
+		{key: "db_2023-05-01T10:00:00+02:00.dump"},
+		{key: "db_2023-04-30_10-00-00.dump"},
+		{key: "db_2023-05-01.dump"},
+	}
+
+	jobs := genPurgeJobs(items, "db")
+	if len(jobs) != 4 {
+		t.Fatalf("got %d jobs, want 4", len(jobs))
+	}
+
+	// youngest first
+	if len(jobs[0].files) != 2 || jobs[0].files[0] != "db_20230503T100000Z.dump" {
+		t.Errorf("got %v, want the files of the last run", jobs[0].files)
+	}
+
+	if !hasRunTimestamp("db/db_20230502T100000Z.dump", jobs[1].datetime, jobs[1].datetime) {
+		t.Errorf("timestamp in custom format not found")
+	}
+}
+
+func TestGenPurgeJobsUTC(t *testing.T) {
+	setTimestampLocation(true)
+	defer setTimestampLocation(false)
+
+	// Timestamps without a time zone are in UTC, the others keep theirs
+	items := []Item{
+		{key: "db_2023-05-02_10-00-00.dump"},
+		{key: "db_2023-05-01T10:00:00+02:00.dump"},
+	}
+
+	jobs := genPurgeJobs(items, "db")
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(jobs))
+	}
+
+	want := []time.Time{
+		time.Date(2023, 5, 2, 10, 0, 0, 0, time.UTC),
+		time.Date(2023, 5, 1, 8, 0, 0, 0, time.UTC),
+	}
+	for i, j := range jobs {
+		if !j.datetime.Equal(want[i]) {
+			t.Errorf("got %s, want %s", j.datetime, want[i])
+		}
+	}
+}
+
+func TestGenPurgeJobsEncrypted(t *testing.T) {
+	items := []Item{
+		{key: "db_2023-05-02T10:00:00+02:00.dump"},
+		{key: "db_2023-05-02T10:00:00+02:00.dump.sha256"},
+		{key: "db_2023-05-02T10:00:00+02:00.dump.sha256.age"},
+		{key: "db_2023-05-02T10:00:00+02:00.dump.age"},
+		{key: "db_2023-05-02T10:00:00+02:00.dump.age.sha256"},
+		// produced by older versions
+		{key: "db_2023-05-02T10:00:00+02:00.dump.sha256.age.sha256"},
+		{key: "db_2023-05-01T10:00:00+02:00.d", isDir: true},
+		{key: "db_2023-05-01T10:00:00+02:00.d.xxh3"},
+		{key: "db_2023-05-01T10:00:00+02:00.d.xxh3.age"},
+		{key: "db_2023-05-01T10:00:00+02:00.d.age.xxh3"},
+		{key: "db_2023-04-30T10:00:00+02:00.d.tar.age"},
+		{key: "db_2023-04-30T10:00:00+02:00.d.tar.age.blake2b-256"},
+		{key: "db_2023-04-30T10:00:00+02:00.sql.gz.sha512.age"},
+		{key: "db_2023-04-30T10:00:00+02:00.dump.tmp"},
+		// markers of dumps in progress are left to pg_back
+		{key: "db_2023-04-30T10:00:00+02:00.dump.writing"},
+		{key: "db_2023-04-30T10:00:00+02:00.d.writing"},
+		// not produced by pg_back
+		{key: "db_2023-04-29T10:00:00+02:00.dump.bak"},
+		{key: "db_2023-04-29T10:00:00+02:00.age"},
+		{key: "db_2023-04-29T10:00:00+02:00.dump.age.age"},
+	}
+
+	jobs := genPurgeJobs(items, "db")
+	if len(jobs) != 3 {
+		t.Fatalf("got %d jobs, want 3: %v", len(jobs), jobs)
+	}
+
+	// youngest first
+	if len(jobs[0].files) != 6 {
+		t.Errorf("got %v, want 6 files", jobs[0].files)
+	}
+	if len(jobs[1].dirs) != 1 || len(jobs[1].files) != 3 {
+		t.Errorf("got %v and %v, want 1 directory and 3 files", jobs[1].dirs, jobs[1].files)
+	}
+	if len(jobs[2].files) != 4 {
+		t.Errorf("got %v, want 4 files", jobs[2].files)
+	}
+}
+
+func TestGenPurgeJobsDirectoryContents(t *testing.T) {
+	items := []Item{
+		{key: "db_2023-05-02T10:00:00+02:00.d", isDir: true},
+		{key: "db_2023-05-02T10:00:00+02:00.d/toc.dat"},
+		{key: "db_2023-05-02T10:00:00+02:00.d/3012.dat.gz"},
+		{key: "db_2023-05-02T10:00:00+02:00.d.sha256"},
+		// object stores do not list directories
+		{key: "db_2023-05-01T10:00:00+02:00.d/toc.dat"},
+		{key: "db_2023-05-01T10:00:00+02:00.d/3012.dat.gz"},
+		{key: "db_2023-05-01T10:00:00+02:00.d.age.sha256"},
+		// only the directory format has contents
+		{key: "db_2023-04-30T10:00:00+02:00.dump/toc.dat"},
+		{key: "db_2023-04-30T10:00:00+02:00/toc.dat"},
+	}
+
+	jobs := genPurgeJobs(items, "db")
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want 2: %v", len(jobs), jobs)
+	}
+
+	// youngest first
+	if len(jobs[0].dirs) != 1 || len(jobs[0].files) != 3 {
+		t.Errorf("got %v and %v, want 1 directory and 3 files", jobs[0].dirs, jobs[0].files)
+	}
+	if len(jobs[1].dirs) != 0 || len(jobs[1].files) != 3 {
+		t.Errorf("got %v and %v, want 3 files", jobs[1].dirs, jobs[1].files)
+	}
+}
+
+func TestPurgeRemoteDirectoryDumps(t *testing.T) {
+	remote := t.TempDir()
+	for _, p := range []string{
+		"backups/db_2023-05-01T10:00:00Z.d/toc.dat",
+		"backups/db_2023-05-01T10:00:00Z.d/3012.dat.gz",
+		"backups/db_2023-05-01T10:00:00Z.d.sha256",
+		"backups/db_2023-05-02T10:00:00Z.d/toc.dat",
+		"backups/db_2023-05-02T10:00:00Z.d.sha256",
+	} {
+		path := filepath.Join(remote, p)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := &localRepo{baseDir: remote}
+	if err := purgeRemoteDumps(repo, "backups", "/var/backups/pg", "db", 1, time.Now()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(remote, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(entries))
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+
+	want := []string{"db_2023-05-02T10:00:00Z.d", "db_2023-05-02T10:00:00Z.d.sha256"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("purgeRemoteDumps() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPurgeRemoteRunDirs(t *testing.T) {
+	remote := t.TempDir()
+	for _, p := range []string{
+		"backups/2023-05-01T10:00:00Z/db.d/toc.dat",
+		"backups/2023-05-01T10:00:00Z/db.d.sha256",
+		"backups/2023-05-01T10:00:00Z/pg_globals.sql",
+		"backups/2023-05-02T10:00:00Z/db.dump",
+		"backups/2023-05-03T10:00:00Z/db.dump",
+		"backups/other/db.dump",
+	} {
+		path := filepath.Join(remote, p)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := &localRepo{baseDir: remote}
+	if err := purgeRemoteRunDirs(repo, "backups", "/var/backups/pg", "/var/backups/pg", 1, time.Date(2023, 5, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(remote, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(entries))
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+
+	// The older run is removed with its directory, the second one is
+	// younger than the limit
+	want := []string{"2023-05-02T10:00:00Z", "2023-05-03T10:00:00Z", "other"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("purgeRemoteRunDirs() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// pagedRepo is a memRepo listing its files a few at a time, like S3
+// without continuation tokens
+type pagedRepo struct {
+	*memRepo
+}
+
+func (r pagedRepo) List(prefix string) ([]Item, error) {
+	return listS3Objects(fakeS3List(r.keys(), 2, false), "bucket", prefix)
+}
+
+func TestPurgeRemoteSpecialFiles(t *testing.T) {
+	repo := pagedRepo{newMemRepo()}
+	for _, name := range []string{"pg_globals", "pg_settings", "hba_file", "ident_file"} {
+		for _, date := range []string{"2023-05-01T10:00:00Z", "2023-05-02T10:00:00Z", "2023-05-03T10:00:00Z"} {
+			ext := "out"
+			if name == "pg_globals" {
+				ext = "sql"
+			}
+			repo.put(fmt.Sprintf("backups/%s_%s.%s", name, date, ext), nil, time.Time{})
+			repo.put(fmt.Sprintf("backups/%s_%s.%s.sha256", name, date, ext), nil, time.Time{})
+		}
+	}
+
+	// A database whose name starts like a special file is not purged
+	// with it
+	repo.put("backups/hba_2023-05-01T10:00:00Z.dump", nil, time.Time{})
+	repo.put("backups/pg_globals_old_2023-05-01T10:00:00Z.dump", nil, time.Time{})
+	before := len(repo.keys())
+
+	limit := time.Date(2023, 5, 10, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"pg_globals", "pg_settings", "hba_file", "ident_file"} {
+		if err := purgeRemoteDumps(repo, "backups", "/var/backups/pg", name, 1, limit); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	want := []string{
+		"backups/hba_2023-05-01T10:00:00Z.dump",
+		"backups/hba_file_2023-05-03T10:00:00Z.out",
+		"backups/hba_file_2023-05-03T10:00:00Z.out.sha256",
+		"backups/ident_file_2023-05-03T10:00:00Z.out",
+		"backups/ident_file_2023-05-03T10:00:00Z.out.sha256",
+		"backups/pg_globals_2023-05-03T10:00:00Z.sql",
+		"backups/pg_globals_2023-05-03T10:00:00Z.sql.sha256",
+		"backups/pg_globals_old_2023-05-01T10:00:00Z.dump",
+		"backups/pg_settings_2023-05-03T10:00:00Z.out",
+		"backups/pg_settings_2023-05-03T10:00:00Z.out.sha256",
+	}
+	if diff := cmp.Diff(want, repo.keys()); diff != "" {
+		t.Errorf("purgeRemoteDumps() mismatch (-want +got):\n%s", diff)
+	}
+
+	// The two oldest of each special file are removed with their checksum
+	if removed := before - len(repo.keys()); removed != 16 {
+		t.Errorf("expected 16 files removed, got %d", removed)
+	}
+}
+
+func TestPurgeRemoteDumpsGrouping(t *testing.T) {
+	repo := newMemRepo()
+	for _, key := range []string{
+		// encrypted custom format with all the checksums
+		"backups/db_2023-05-01T10:00:00Z.dump.age",
+		"backups/db_2023-05-01T10:00:00Z.dump.age.sha256",
+		"backups/db_2023-05-01T10:00:00Z.dump.sha256.age",
+		"backups/db_2023-05-01T10:00:00Z.createdb.sql",
+		// directory format
+		"backups/db_2023-05-02T10:00:00Z.d/toc.dat",
+		"backups/db_2023-05-02T10:00:00Z.d/3012.dat.gz",
+		"backups/db_2023-05-02T10:00:00Z.d.sha256",
+		// interrupted upload of a custom format dump
+		"backups/db_2023-05-03T10:00:00Z.dump.tmp",
+		"backups/db_2023-05-04T10:00:00Z.dump",
+		"backups/db_2023-05-04T10:00:00Z.dump.sha256",
+		"backups/db_2023-05-05T10:00:00Z.dump",
+		// not dumps of db
+		"backups/db_notes.txt",
+		"backups/db2_2023-05-01T10:00:00Z.dump",
+		"other/db_2023-05-01T10:00:00Z.dump",
+	} {
+		repo.put(key, []byte("data"), time.Time{})
+	}
+
+	// The two last runs are kept by count, the one of 05-03 is younger
+	// than the limit
+	limit := time.Date(2023, 5, 3, 0, 0, 0, 0, time.UTC)
+	if err := purgeRemoteDumps(repo, "backups", "/var/backups/pg", "db", 2, limit); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want := []string{
+		"backups/db2_2023-05-01T10:00:00Z.dump",
+		"backups/db_2023-05-03T10:00:00Z.dump.tmp",
+		"backups/db_2023-05-04T10:00:00Z.dump",
+		"backups/db_2023-05-04T10:00:00Z.dump.sha256",
+		"backups/db_2023-05-05T10:00:00Z.dump",
+		"backups/db_notes.txt",
+		"other/db_2023-05-01T10:00:00Z.dump",
+	}
+	if diff := cmp.Diff(want, repo.keys()); diff != "" {
+		t.Errorf("purgeRemoteDumps() mismatch (-want +got):\n%s", diff)
+	}
+
+	// Everything older than the limit goes when nothing is kept by count
+	if err := purgeRemoteDumps(repo, "backups", "/var/backups/pg", "db", 0, time.Date(2023, 5, 4, 12, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	want = []string{
+		"backups/db2_2023-05-01T10:00:00Z.dump",
+		"backups/db_2023-05-05T10:00:00Z.dump",
+		"backups/db_notes.txt",
+		"other/db_2023-05-01T10:00:00Z.dump",
+	}
+	if diff := cmp.Diff(want, repo.keys()); diff != "" {
+		t.Errorf("purgeRemoteDumps() mismatch (-want +got):\n%s", diff)
+	}
+}
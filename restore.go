@@ -0,0 +1,784 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// restoreDump holds the files of a run of pg_back needed to restore a
+// database
+type restoreDump struct {
+	// Name of the database to restore
+	Database string
+
+	// Date of the dump
+	When time.Time
+
+	// Path to the dump file or directory, it may be encrypted
+	Path string
+
+	// Format of the dump deduced from the suffix of the file
+	Format rune
+
+	// Path to the SQL file creating the database, empty when it was not
+	// produced
+	CreateDBPath string
+}
+
+// reDumpSuffix matches the suffix of the dump of a database, after the
+// timestamp in the name of the file
+var reDumpSuffix = regexp.MustCompile(`^(sql|sql\.gz|dump|tar|tar\.gz|tar\.zst|tar\.lz4|d|d\.tar|d\.tar\.gz|d\.tar\.zst|d\.tar\.lz4)(?:\.age)?$`)
+
+// reDirArchive matches the end of the name of an archived directory dump,
+// possibly compressed and encrypted
+var reDirArchive = regexp.MustCompile(`\.d\.tar(?:\.(?:gz|zst|lz4))?(?:\.age)?$`)
+
+// dumpSuffixFormat gives the format of a dump from the suffix of its file
+func dumpSuffixFormat(suffix string) (rune, bool) {
+	matches := reDumpSuffix.FindStringSubmatch(suffix)
+	if matches == nil {
+		return 0, false
+	}
+
+	switch matches[1] {
+	case "sql", "sql.gz":
+		return 'p', true
+	case "dump":
+		return 'c', true
+	case "tar", "tar.gz", "tar.zst", "tar.lz4":
+		return 't', true
+	}
+
+	return 'd', true
+}
+
+// findRestoreDump searches the backup directory for the dump of dbname taken
+// at the given time, or the most recent one when the time is zero. It groups
+// files the same way the purge does to find the files of a run.
+func findRestoreDump(directory string, dbname string, when time.Time) (*restoreDump, error) {
+	dirpath := filepath.Dir(formatDumpPath(directory, "", "", dbname, time.Time{}, 0))
+	files, err := listDumpItems(dirpath, dbname)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", dirpath, err)
+	}
+
+	jobs := genPurgeJobs(files, dbname)
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no dump found for %s in %s", dbname, dirpath)
+	}
+
+	var job *purgeJob
+	if when.IsZero() {
+		// jobs are sorted youngest first
+		job = &jobs[0]
+	} else {
+		for i, j := range jobs {
+			if j.datetime.Equal(when) {
+				job = &jobs[i]
+				break
+			}
+		}
+
+		if job == nil {
+			return nil, fmt.Errorf("no dump of %s found at %s", dbname, when.Format(time.RFC3339))
+		}
+	}
+
+	d := &restoreDump{
+		Database: dbname,
+		When:     job.datetime,
+	}
+
+	prefix := cleanDBName(dbname) + "_"
+
+	var reName *regexp.Regexp
+	if nameTmpl != nil {
+		reName = nameTmpl.nameRegexp(dbname)
+	}
+
+	for _, f := range append(job.files, job.dirs...) {
+		name := f
+		if reName != nil {
+			name, _ = canonicalDumpName(reName, f, dbname)
+		} else if runSubdirs {
+			name, _ = runSubdirName(f, dbname)
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(name, prefix), ".", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		if parts[1] == "createdb.sql" || parts[1] == "createdb.sql.age" {
+			d.CreateDBPath = filepath.Join(dirpath, f)
+			continue
+		}
+
+		format, ok := dumpSuffixFormat(parts[1])
+		if !ok {
+			continue
+		}
+
+		d.Path = filepath.Join(dirpath, f)
+		d.Format = format
+	}
+
+	if d.Path == "" {
+		return nil, fmt.Errorf("no dump file of %s found for %s", dbname, d.When.Format(time.RFC3339))
+	}
+
+	return d, nil
+}
+
+// openRestoreInput opens a dump file for reading, decrypting and
+// uncompressing its contents on the fly when needed so that no plain text
+// copy of the dump is written to disk. The returned function must be called
+// to release resources.
+func openRestoreInput(path string, params decryptParams) (io.Reader, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		r       io.Reader = f
+		closers           = []func(){func() { f.Close() }}
+	)
+
+	cleanup := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	if strings.HasSuffix(path, ".age") {
+		l.Verboseln("decrypting", path, "in memory")
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(ageDecrypt(f, pw, params))
+		}()
+
+		// Closing the read end of the pipe ensures the decrypting
+		// goroutine stops if the reader did not consume everything
+		closers = append(closers, func() { pr.Close() })
+		r = pr
+	}
+
+	if strings.HasSuffix(strings.TrimSuffix(path, ".age"), ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("could not uncompress %s: %w", path, err)
+		}
+
+		closers = append(closers, func() { gz.Close() })
+		r = gz
+	}
+
+	// Dumps in the tar format compressed with zstd or lz4 are uncompressed
+	// by the external command that compressed them
+	for _, method := range []string{"zstd", "lz4"} {
+		c := tarCompressors[method]
+		if !strings.HasSuffix(strings.TrimSuffix(path, ".age"), ".tar."+c.suffix) {
+			continue
+		}
+
+		cmd := exec.Command(c.command, "-d", "-q", "-c")
+		cmd.Stdin = r
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("could not uncompress %s: %w", path, err)
+		}
+
+		l.Verboseln("running:", cmd)
+		if err := cmd.Start(); err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("could not uncompress %s: %w", path, err)
+		}
+
+		closers = append(closers, func() {
+			out.Close()
+			cmd.Wait()
+		})
+		r = out
+	}
+
+	return r, cleanup, nil
+}
+
+func runRestoreCommand(dbname string, cmd *exec.Cmd) error {
+	l.Verboseln("running:", cmd)
+	stdoutStderr, err := cmd.CombinedOutput()
+	if err != nil {
+		for _, line := range strings.Split(string(stdoutStderr), "\n") {
+			if line != "" {
+				l.ForDatabase(dbname).Errorf("%s\n", line)
+			}
+		}
+		return err
+	}
+	if len(stdoutStderr) > 0 {
+		for _, line := range strings.Split(string(stdoutStderr), "\n") {
+			if line != "" {
+				l.ForDatabase(dbname).Infof("%s\n", line)
+			}
+		}
+	}
+
+	return nil
+}
+
+// runPsqlFile executes the SQL script at path with psql, with the script
+// given on its standard input. When stopOnError is false, the errors of SQL
+// statements are only reported in the output of psql.
+func runPsqlFile(dbname string, conninfo *ConnInfo, path string, params decryptParams, stopOnError bool) error {
+	input, cleanup, err := openRestoreInput(path, params)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	args := []string{"-X", "-w"}
+	if stopOnError {
+		args = append(args, "-v", "ON_ERROR_STOP=1")
+	}
+	args = append(args, "-d", conninfo.String())
+
+	psqlCmd := exec.Command(execPath("psql"), args...)
+	psqlCmd.Stdin = input
+
+	return runRestoreCommand(dbname, psqlCmd)
+}
+
+// restoreInput prepares the input of pg_restore for a dump in an archive
+// format. It gives the path of the dump, or a reader when the dump must be
+// given on the standard input of pg_restore: encrypted dumps are decrypted in
+// memory and compressed tar dumps are uncompressed on the fly. Archived
+// directory dumps are extracted next to the archive. The returned function
+// must be called to release resources.
+func restoreInput(d *restoreDump, params decryptParams) (string, io.Reader, func(), error) {
+	path := d.Path
+	cleanup := func() {}
+	encrypted := strings.HasSuffix(path, ".age")
+	if d.Format == 'd' {
+		// Archived directory dumps must be extracted for pg_restore,
+		// it is done next to the archive and removed afterwards
+		if reDirArchive.MatchString(path) {
+			tmp, err := os.MkdirTemp(filepath.Dir(path), "pg_back-restore-")
+			if err != nil {
+				return "", nil, nil, fmt.Errorf("could not create directory to extract %s: %w", path, err)
+			}
+			cleanup = func() { os.RemoveAll(tmp) }
+
+			l.Verboseln("extracting", path, "to", tmp)
+			input, closeInput, err := openRestoreInput(path, params)
+			if err != nil {
+				cleanup()
+				return "", nil, nil, err
+			}
+
+			err = extractArchive(input, tmp)
+			closeInput()
+			if err != nil {
+				cleanup()
+				return "", nil, nil, fmt.Errorf("could not extract %s: %w", path, err)
+			}
+
+			path = filepath.Join(tmp, reDirArchive.ReplaceAllString(filepath.Base(path), ".d"))
+			encrypted = false
+		} else if _, err := os.Stat(filepath.Join(path, "toc.dat.age")); err == nil {
+			return "", nil, nil, fmt.Errorf("directory format dump %s is encrypted, decrypt it first with --decrypt", path)
+		}
+	}
+
+	// Compressed tar dumps are uncompressed on the fly like encrypted ones
+	if !encrypted && (d.Format != 't' || strings.HasSuffix(path, ".tar")) {
+		return path, nil, cleanup, nil
+	}
+
+	r, closeInput, err := openRestoreInput(path, params)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return path, r, closeInput, nil
+}
+
+func restoreDatabase(d *restoreDump, conninfo *ConnInfo, jobs int, create bool, params decryptParams) error {
+	dbname := d.Database
+	target := conninfo.Set("dbname", dbname)
+
+	if create && d.CreateDBPath != "" {
+		l.Infoln("creating database", dbname, "with", d.CreateDBPath)
+		if err := runPsqlFile(dbname, conninfo, d.CreateDBPath, params, true); err != nil {
+			return fmt.Errorf("could not create database %s: %w", dbname, err)
+		}
+	}
+
+	l.Infoln("restoring", d.Path, "into", dbname)
+
+	if d.Format == 'p' {
+		if err := runPsqlFile(dbname, target, d.Path, params, true); err != nil {
+			return fmt.Errorf("restore of %s failed: %w", dbname, err)
+		}
+
+		return nil
+	}
+
+	args := []string{"-w"}
+
+	// When no SQL file was produced to create the database, let pg_restore
+	// create it: it has to connect to another database to do so
+	if create && d.CreateDBPath == "" {
+		args = append(args, "-C")
+		target = conninfo
+	}
+
+	path, input, cleanup, err := restoreInput(d, params)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if jobs > 1 {
+		if d.Format == 't' || input != nil {
+			l.Warnln("parallel restore is not possible with this dump, ignoring --restore-jobs")
+		} else {
+			args = append(args, "-j", fmt.Sprintf("%d", jobs))
+		}
+	}
+
+	args = append(args, "-d", target.String())
+	if input == nil {
+		args = append(args, path)
+	}
+
+	pgRestoreCmd := exec.Command(execPath("pg_restore"), args...)
+	pgRestoreCmd.Stdin = input
+
+	if err := runRestoreCommand(dbname, pgRestoreCmd); err != nil {
+		return fmt.Errorf("restore of %s failed: %w", dbname, err)
+	}
+
+	return nil
+}
+
+// instanceFileNames are the names used in place of a database name for the
+// files of the whole instance
+var instanceFileNames = []string{"pg_globals", "pg_roles", "pg_settings", "hba_file", "ident_file", "pg_tablespaces", "checksums"}
+
+// snapshotEnd finds the end of the run started at when in the backup
+// directory, using the files of the instance, see runEnd
+func snapshotEnd(directory string, when time.Time) time.Time {
+	stamps := make([]time.Time, 0)
+	for _, name := range instanceFileNames {
+		dirpath := filepath.Dir(formatDumpPath(directory, "", "", name, time.Time{}, 0))
+		files, err := listDumpItems(dirpath, name)
+		if err != nil {
+			continue
+		}
+
+		for _, j := range genPurgeJobs(files, name) {
+			stamps = append(stamps, j.datetime)
+		}
+	}
+
+	return runEnd(stamps, when)
+}
+
+// findSnapshotDump searches the backup directory for the dump of dbname taken
+// during the run started at when and ending at end. The dump of a database is
+// stamped with its own start, the oldest one of the run is taken.
+func findSnapshotDump(directory string, dbname string, when time.Time, end time.Time) (*restoreDump, error) {
+	dirpath := filepath.Dir(formatDumpPath(directory, "", "", dbname, time.Time{}, 0))
+	files, err := listDumpItems(dirpath, dbname)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", dirpath, err)
+	}
+
+	var found time.Time
+	for _, j := range genPurgeJobs(files, dbname) {
+		if inRun(j.datetime, when, end) && (found.IsZero() || j.datetime.Before(found)) {
+			found = j.datetime
+		}
+	}
+
+	if found.IsZero() {
+		return nil, fmt.Errorf("no dump of %s found in the run of %s", dbname, when.Format(time.RFC3339))
+	}
+
+	return findRestoreDump(directory, dbname, found)
+}
+
+// snapshotDatabases finds the databases having a dump taken during the run
+// started at the given time in the backup directory
+func snapshotDatabases(directory string, when time.Time) ([]string, error) {
+	names, err := localDumpNames(directory)
+	if err != nil {
+		return nil, fmt.Errorf("could not list dumps of %s: %w", directory, err)
+	}
+
+	end := snapshotEnd(directory, when)
+
+	dbnames := make([]string, 0, len(names))
+	for _, name := range names {
+		if slices.Contains(instanceFileNames, name) {
+			continue
+		}
+
+		if _, err := findSnapshotDump(directory, name, when, end); err == nil {
+			dbnames = append(dbnames, name)
+		}
+	}
+
+	return dbnames, nil
+}
+
+// snapshotGlobals finds the files of the globals of the run taken at the
+// given time: the one of pg_dumpall -g, or the roles then the tablespaces
+// when the globals are split
+func snapshotGlobals(directory string, when time.Time) ([]*restoreDump, error) {
+	if d, err := findRestoreDump(directory, "pg_globals", when); err == nil {
+		return []*restoreDump{d}, nil
+	}
+
+	roles, err := findRestoreDump(directory, "pg_roles", when)
+	if err != nil {
+		return nil, fmt.Errorf("no dump of the globals found at %s", when.Format(time.RFC3339))
+	}
+
+	dumps := []*restoreDump{roles}
+	if d, err := findRestoreDump(directory, "pg_tablespaces", when); err == nil {
+		dumps = append(dumps, d)
+	}
+
+	return dumps, nil
+}
+
+func restoreDatabases(opts options, dbnames []string) error {
+	timestamp := opts.RestoreTimestamp
+	if opts.Snapshot != "" {
+		timestamp = opts.Snapshot
+	}
+
+	var when time.Time
+	if timestamp != "" {
+		t, ok := parseDumpTimestamp(timestamp)
+		if !ok {
+			return fmt.Errorf("invalid timestamp: %s", timestamp)
+		}
+		when = t
+	}
+
+	// When restoring a snapshot, all the databases dumped during the run
+	// are restored unless some are given on the command line
+	if len(dbnames) == 0 && opts.Snapshot != "" {
+		names, err := snapshotDatabases(opts.Directory, when)
+		if err != nil {
+			return err
+		}
+		dbnames = names
+	}
+
+	if len(dbnames) == 0 {
+		if opts.Snapshot != "" {
+			return fmt.Errorf("no database dump found for the snapshot %s", opts.Snapshot)
+		}
+		return fmt.Errorf("no database to restore, give database names as command line arguments")
+	}
+
+	conninfo, err := prepareConnInfo(opts.Host, opts.Port, opts.Username, opts.ConnDb, connParams(opts))
+	if err != nil {
+		return fmt.Errorf("could not compute connection string: %w", err)
+	}
+
+	params := decryptParams{PrivateKey: opts.CipherPrivateKey, Passphrase: opts.CipherPassphrase}
+	if params.PrivateKey == "" && params.Passphrase == "" {
+		params.Passphrase = os.Getenv("PGBK_CIPHER_PASS")
+	}
+
+	failed := false
+
+	// Roles and tablespaces of a snapshot are created first, so that the
+	// restore of the databases can use them. Objects that already exist
+	// make psql report errors, they do not stop the restore.
+	if opts.Snapshot != "" {
+		if dumps, err := snapshotGlobals(opts.Directory, when); err != nil {
+			l.Warnln("roles and tablespaces are not restored:", err)
+		} else {
+			for _, d := range dumps {
+				l.Infoln("restoring roles and tablespaces from", d.Path)
+				if err := runPsqlFile(d.Database, conninfo, d.Path, params, false); err != nil {
+					l.Errorln("restore of roles and tablespaces failed:", err)
+					failed = true
+				}
+			}
+		}
+	}
+
+	// The dumps of the databases of a snapshot are taken during its run,
+	// after the files of the instance
+	var end time.Time
+	if opts.Snapshot != "" {
+		end = snapshotEnd(opts.Directory, when)
+	}
+
+	for _, dbname := range dbnames {
+		var d *restoreDump
+		if opts.Snapshot != "" {
+			d, err = findSnapshotDump(opts.Directory, dbname, when, end)
+		} else {
+			d, err = findRestoreDump(opts.Directory, dbname, when)
+		}
+		if err != nil {
+			l.Errorln(err)
+			failed = true
+			continue
+		}
+
+		if err := restoreDatabase(d, conninfo, opts.RestoreJobs, opts.RestoreCreate, params); err != nil {
+			l.Errorln(err)
+			failed = true
+			continue
+		}
+
+		l.Infoln("restore of", dbname, "from", d.Path, "done")
+	}
+
+	if failed {
+		return fmt.Errorf("some restore failed, please examine logs")
+	}
+
+	return nil
+}
+
+// dumpFromPath describes the dump at path given on the command line, its
+// format is deduced from the suffix of its name
+func dumpFromPath(path string) (*restoreDump, error) {
+	base := filepath.Base(strings.TrimSuffix(path, string(os.PathSeparator)))
+	for i, c := range base {
+		if c != '.' {
+			continue
+		}
+
+		if format, ok := dumpSuffixFormat(base[i+1:]); ok {
+			return &restoreDump{Database: base[:i], Path: path, Format: format}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("could not find the format of the dump %s from its name", path)
+}
+
+// isDumpPath tells if an argument of the command line is the path to an
+// existing dump rather than the name of a database
+func isDumpPath(arg string) bool {
+	if !strings.ContainsAny(arg, "/"+string(os.PathSeparator)) {
+		return false
+	}
+
+	_, err := os.Stat(arg)
+	return err == nil
+}
+
+// listDumpContents runs pg_restore --list on a dump in an archive format and
+// gives the number of entries of its table of contents. Plain format dumps
+// are read to the end, which checks their decryption and compression.
+func listDumpContents(d *restoreDump, params decryptParams) (int, error) {
+	if d.Format == 'p' {
+		input, cleanup, err := openRestoreInput(d.Path, params)
+		if err != nil {
+			return 0, err
+		}
+		defer cleanup()
+
+		if _, err := io.Copy(io.Discard, input); err != nil {
+			return 0, fmt.Errorf("could not read %s: %w", d.Path, err)
+		}
+
+		return 0, nil
+	}
+
+	path, input, cleanup, err := restoreInput(d, params)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanup()
+
+	args := []string{"-l"}
+	if input == nil {
+		args = append(args, path)
+	}
+
+	cmd := exec.Command(execPath("pg_restore"), args...)
+	cmd.Stdin = input
+
+	l.Verboseln("running:", cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		var eerr *exec.ExitError
+		if errors.As(err, &eerr) {
+			for _, line := range strings.Split(string(eerr.Stderr), "\n") {
+				if line != "" {
+					l.ForDatabase(d.Database).Errorf("%s\n", line)
+				}
+			}
+		}
+		return 0, fmt.Errorf("pg_restore --list failed: %w", err)
+	}
+
+	// Comments of the listing start with a semicolon
+	entries := 0
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" && !strings.HasPrefix(line, ";") {
+			entries++
+		}
+	}
+
+	return entries, nil
+}
+
+// testRestoreDump checks that a dump can be restored. Its contents are
+// listed with pg_restore, then with full, it is restored into the throwaway
+// database called target, created for the test and dropped afterwards.
+func testRestoreDump(d *restoreDump, conninfo *ConnInfo, target string, full bool, jobs int, params decryptParams) error {
+	entries, err := listDumpContents(d, params)
+	if err != nil {
+		return err
+	}
+
+	if d.Format != 'p' {
+		l.Infof("%s contains %d entries", d.Path, entries)
+	}
+
+	if !full {
+		return nil
+	}
+
+	db, err := dbOpen(conninfo)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// An existing database is never reused nor dropped, it could be
+	// anything but a leftover of a previous test
+	l.Infoln("creating throwaway database", target)
+	query := "CREATE DATABASE " + sqlQuoteIdent(target)
+	l.Verboseln("executing SQL query:", query)
+	if _, err := db.conn.Exec(query); err != nil {
+		return fmt.Errorf("could not create database %s: %w", target, err)
+	}
+
+	defer func() {
+		l.Infoln("dropping throwaway database", target)
+		query := "DROP DATABASE IF EXISTS " + sqlQuoteIdent(target)
+		l.Verboseln("executing SQL query:", query)
+		if _, err := db.conn.Exec(query); err != nil {
+			l.Errorf("could not drop database %s: %s", target, err)
+		}
+	}()
+
+	throwaway := *d
+	throwaway.Database = target
+
+	return restoreDatabase(&throwaway, conninfo, jobs, false, params)
+}
+
+// testRestoreDumps tests the restore of the dumps given on the command line,
+// either as paths or as database names whose dump is searched in the backup
+// directory like --restore does
+func testRestoreDumps(opts options, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no dump to test, give database names or paths to dumps as command line arguments")
+	}
+
+	var when time.Time
+	if opts.RestoreTimestamp != "" {
+		t, ok := parseDumpTimestamp(opts.RestoreTimestamp)
+		if !ok {
+			return fmt.Errorf("invalid timestamp: %s", opts.RestoreTimestamp)
+		}
+		when = t
+	}
+
+	conninfo, err := prepareConnInfo(opts.Host, opts.Port, opts.Username, opts.ConnDb, connParams(opts))
+	if err != nil {
+		return fmt.Errorf("could not compute connection string: %w", err)
+	}
+
+	params := decryptParams{PrivateKey: opts.CipherPrivateKey, Passphrase: opts.CipherPassphrase}
+	if params.PrivateKey == "" && params.Passphrase == "" {
+		params.Passphrase = os.Getenv("PGBK_CIPHER_PASS")
+	}
+
+	failed := 0
+	for _, arg := range args {
+		var (
+			d   *restoreDump
+			err error
+		)
+
+		// Paths are told apart from database names by their separator
+		if isDumpPath(arg) {
+			d, err = dumpFromPath(arg)
+		} else {
+			d, err = findRestoreDump(opts.Directory, arg, when)
+		}
+
+		if err != nil {
+			l.Errorln(err)
+			failed++
+			continue
+		}
+
+		l.Infoln("testing the restore of", d.Path)
+		if err := testRestoreDump(d, conninfo, opts.TestRestoreDbname, opts.TestRestoreFull, opts.RestoreJobs, params); err != nil {
+			l.Errorf("test restore of %s failed: %s", d.Path, err)
+			failed++
+			continue
+		}
+
+		l.Infoln("test restore of", d.Path, "succeeded")
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("test restore failed for %d of %d dumps", failed, len(args))
+	}
+
+	return nil
+}
@@ -0,0 +1,362 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFindRestoreDump(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("testing on windows")
+	}
+
+	wd := t.TempDir()
+
+	older := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	newer := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for _, f := range []string{
+		formatDumpPath(wd, time.RFC3339, "dump", "db", older, 0),
+		formatDumpPath(wd, time.RFC3339, "dump", "db", older, 0) + ".sha256",
+		formatDumpPath(wd, time.RFC3339, "createdb.sql", "db", older, 0),
+		formatDumpPath(wd, time.RFC3339, "sql", "db", newer, 1) + ".age",
+		formatDumpPath(wd, time.RFC3339, "dump", "other", newer, 0),
+		formatDumpPath(wd, time.RFC3339, "d", "other", older, 0) + ".tar",
+		formatDumpPath(wd, time.RFC3339, "tar", "third", older, 0) + ".zst.age",
+	} {
+		if err := os.WriteFile(f, []byte("truc\n"), 0600); err != nil {
+			t.Fatal("could not create test file:", err)
+		}
+	}
+
+	var tests = []struct {
+		dbname   string
+		when     time.Time
+		path     string
+		format   rune
+		createdb string
+		fails    bool
+	}{
+		{"db", time.Time{}, formatDumpPath(wd, time.RFC3339, "sql", "db", newer, 1) + ".age", 'p', "", false},
+		{"db", older, formatDumpPath(wd, time.RFC3339, "dump", "db", older, 0), 'c', formatDumpPath(wd, time.RFC3339, "createdb.sql", "db", older, 0), false},
+		{"other", older, formatDumpPath(wd, time.RFC3339, "d", "other", older, 0) + ".tar", 'd', "", false},
+		{"third", time.Time{}, formatDumpPath(wd, time.RFC3339, "tar", "third", older, 0) + ".zst.age", 't', "", false},
+		{"db", older.Add(time.Minute), "", 0, "", true},
+		{"missing", time.Time{}, "", 0, "", true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := findRestoreDump(wd, st.dbname, st.when)
+			if err != nil {
+				if !st.fails {
+					t.Errorf("did not want an error, got %s", err)
+				}
+				return
+			}
+
+			if st.fails {
+				t.Errorf("excepted an error got nil")
+			}
+
+			if got.Path != st.path {
+				t.Errorf("got path %q, want %q", got.Path, st.path)
+			}
+
+			if got.Format != st.format {
+				t.Errorf("got format %q, want %q", got.Format, st.format)
+			}
+
+			if got.CreateDBPath != st.createdb {
+				t.Errorf("got createdb path %q, want %q", got.CreateDBPath, st.createdb)
+			}
+		})
+	}
+}
+
+func TestOpenRestoreInput(t *testing.T) {
+	wd := t.TempDir()
+
+	encrypted, err := b64.StdEncoding.DecodeString(TEST_ENCRYPTED_FILE_BASE64)
+	if err != nil {
+		t.Fatalf("could not decode golden string")
+	}
+
+	path := filepath.Join(wd, "db.dump.age")
+	if err := os.WriteFile(path, encrypted, 0600); err != nil {
+		t.Fatal("could not create test file:", err)
+	}
+
+	r, cleanup, err := openRestoreInput(path, decryptParams{PrivateKey: TEST_PRIVATE_KEY})
+	if err != nil {
+		t.Fatalf("openRestoreInput returned: %v", err)
+	}
+	defer cleanup()
+
+	got := &bytes.Buffer{}
+	if _, err := io.Copy(got, r); err != nil {
+		t.Fatalf("could not read decrypted input: %v", err)
+	}
+
+	if got.String() != TEST_PLAINTEXT_FILE {
+		t.Errorf("got %q, want %q", got.String(), TEST_PLAINTEXT_FILE)
+	}
+}
+
+func TestSnapshotDatabases(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("testing on windows")
+	}
+
+	wd := t.TempDir()
+
+	older := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	newer := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for _, f := range []string{
+		formatDumpPath(wd, time.RFC3339, "sql", "pg_globals", newer, 0),
+		formatDumpPath(wd, time.RFC3339, "out", "pg_settings", newer, 0),
+		formatDumpPath(wd, time.RFC3339, "dump", "db", older, 0),
+		formatDumpPath(wd, time.RFC3339, "dump", "db", newer, 0),
+		formatDumpPath(wd, time.RFC3339, "createdb.sql", "db", newer, 0),
+		formatDumpPath(wd, time.RFC3339, "sql", "other", newer, 1),
+		formatDumpPath(wd, time.RFC3339, "dump", "old", older, 0),
+	} {
+		if err := os.WriteFile(f, []byte("truc\n"), 0600); err != nil {
+			t.Fatal("could not create test file:", err)
+		}
+	}
+
+	got, err := snapshotDatabases(wd, newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"db", "other"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSnapshotDatabasesRunWindow(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("testing on windows")
+	}
+
+	wd := t.TempDir()
+
+	// The dumps of the databases start after the files of the instance,
+	// each one at its own time
+	first := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	second := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for _, f := range []string{
+		formatDumpPath(wd, time.RFC3339, "sql", "pg_globals", first, 0),
+		formatDumpPath(wd, time.RFC3339, "dump", "db", first.Add(10*time.Second), 0),
+		formatDumpPath(wd, time.RFC3339, "dump", "other", first.Add(42*time.Second), 0),
+		formatDumpPath(wd, time.RFC3339, "sql", "pg_globals", second, 0),
+		formatDumpPath(wd, time.RFC3339, "dump", "db", second.Add(5*time.Second), 0),
+		formatDumpPath(wd, time.RFC3339, "dump", "last", second.Add(20*time.Second), 0),
+	} {
+		if err := os.WriteFile(f, []byte("truc\n"), 0600); err != nil {
+			t.Fatal("could not create test file:", err)
+		}
+	}
+
+	var tests = []struct {
+		when time.Time
+		want []string
+		dump time.Time
+	}{
+		{first, []string{"db", "other"}, first.Add(10 * time.Second)},
+		{second, []string{"db", "last"}, second.Add(5 * time.Second)},
+		{first.Add(10 * time.Second), []string{"db"}, first.Add(10 * time.Second)},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := snapshotDatabases(wd, st.when)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(st.want) {
+				t.Errorf("got %v, want %v", got, st.want)
+			}
+
+			d, err := findSnapshotDump(wd, "db", st.when, snapshotEnd(wd, st.when))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !d.When.Equal(st.dump) {
+				t.Errorf("got dump of %v, want %v", d.When, st.dump)
+			}
+		})
+	}
+}
+
+func TestSnapshotGlobals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("testing on windows")
+	}
+
+	wd := t.TempDir()
+
+	older := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	newer := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for _, f := range []string{
+		formatDumpPath(wd, time.RFC3339, "sql", "pg_globals", older, 0),
+		formatDumpPath(wd, time.RFC3339, "sql", "pg_tablespaces", older, 0),
+		formatDumpPath(wd, time.RFC3339, "sql", "pg_roles", newer, 0),
+		formatDumpPath(wd, time.RFC3339, "sql", "pg_tablespaces", newer, 0),
+	} {
+		if err := os.WriteFile(f, []byte("truc\n"), 0600); err != nil {
+			t.Fatal("could not create test file:", err)
+		}
+	}
+
+	var tests = []struct {
+		when time.Time
+		want []string
+	}{
+		{older, []string{"pg_globals"}},
+		{newer, []string{"pg_roles", "pg_tablespaces"}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			dumps, err := snapshotGlobals(wd, st.when)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, 0, len(dumps))
+			for _, d := range dumps {
+				got = append(got, d.Database)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(st.want) {
+				t.Errorf("got %v, want %v", got, st.want)
+			}
+		})
+	}
+
+	if _, err := snapshotGlobals(wd, time.Now()); err == nil {
+		t.Errorf("expected an error without globals")
+	}
+}
+
+func TestDumpFromPath(t *testing.T) {
+	var tests = []struct {
+		path   string
+		dbname string
+		format rune
+		fails  bool
+	}{
+		{"/backups/db_2024-05-17_10-00-00.dump", "db_2024-05-17_10-00-00", 'c', false},
+		{"/backups/my.db_2024-05-17_10-00-00.sql.gz.age", "my.db_2024-05-17_10-00-00", 'p', false},
+		{"/backups/db_2024-05-17_10-00-00.d/", "db_2024-05-17_10-00-00", 'd', false},
+		{"/backups/db_2024-05-17_10-00-00.tar.zst", "db_2024-05-17_10-00-00", 't', false},
+		{"/backups/db_2024-05-17_10-00-00.dump.sha256", "", 0, true},
+		{"/backups/README", "", 0, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := dumpFromPath(filepath.FromSlash(st.path))
+			if err != nil {
+				if !st.fails {
+					t.Errorf("did not want an error, got %s", err)
+				}
+				return
+			}
+
+			if st.fails {
+				t.Fatalf("excepted an error got nil")
+			}
+
+			if got.Database != st.dbname || got.Format != st.format {
+				t.Errorf("got %q and %q, want %q and %q", got.Database, got.Format, st.dbname, st.format)
+			}
+		})
+	}
+}
+
+func TestTestRestoreDumps(t *testing.T) {
+	// The fake pg_restore lists a table of contents, unless the dump
+	// file is empty
+	script := "#!/bin/sh\ntest -s \"$2\" || { echo 'pg_restore: error: input file is too short' >&2; exit 1; }\n" +
+		"echo ';'\necho '; Archive created at 2024-05-17 10:00:00 UTC'\necho '215; 1259 16385 TABLE public t1 postgres'\necho '3312; 0 16385 TABLE DATA public t1 postgres'\n"
+	fakeTool(t, "pg_restore", script)
+
+	wd := t.TempDir()
+	when := time.Now().Add(-time.Hour).Truncate(time.Second)
+	good := formatDumpPath(wd, time.RFC3339, "dump", "db", when, 0)
+	plain := formatDumpPath(wd, time.RFC3339, "sql", "other", when, 0)
+	broken := formatDumpPath(wd, time.RFC3339, "dump", "broken", when, 0)
+
+	for path, contents := range map[string]string{good: "PGDMP", plain: "select 1;\n", broken: ""} {
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := &restoreDump{Database: "db", Path: good, Format: 'c'}
+	entries, err := listDumpContents(d, decryptParams{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if entries != 2 {
+		t.Errorf("got %d entries, want 2", entries)
+	}
+
+	opts := defaultOptions()
+	opts.Directory = wd
+
+	// Dumps can be given by database name or by path
+	if err := testRestoreDumps(opts, []string{"db", plain}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	err = testRestoreDumps(opts, []string{"db", "broken", "missing"})
+	if err == nil || err.Error() != "test restore failed for 2 of 3 dumps" {
+		t.Errorf("got %v, want an error for 2 of 3 dumps", err)
+	}
+
+	if err := testRestoreDumps(opts, nil); err == nil {
+		t.Errorf("expected an error without dumps to test")
+	}
+}
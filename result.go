@@ -0,0 +1,241 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// dumpResult is the outcome of the dump of a database in the result of the
+// run
+type dumpResult struct {
+	Database        string  `json:"database"`
+	Format          string  `json:"format"`
+	Path            string  `json:"path,omitempty"`
+	Size            int64   `json:"size"`
+	Checksum        string  `json:"checksum,omitempty"`
+	ChecksumAlgo    string  `json:"checksum_algorithm,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Unchanged       bool    `json:"unchanged,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// uploadResult is a remote location the files of the run are uploaded to
+type uploadResult struct {
+	Name     string `json:"name"`
+	Location string `json:"location"`
+}
+
+// runResult is the outcome of a run written with --result-json, for the
+// tools wrapping pg_back
+type runResult struct {
+	Status          string         `json:"status"`
+	ExitCode        int            `json:"exit_code"`
+	Timestamp       string         `json:"timestamp"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Databases       []dumpResult   `json:"databases"`
+	Uploads         []uploadResult `json:"uploads"`
+	Error           string         `json:"error,omitempty"`
+}
+
+// formatNames gives the name of the formats of pg_dump, by option value
+var formatNames = map[rune]string{
+	'p': "plain",
+	'c': "custom",
+	't': "tar",
+	'd': "directory",
+}
+
+// readChecksum gets the checksum of a dump from the checksum file written
+// next to it. Nothing is found for the directory format, which has a
+// checksum per file, or when the checksums go to a manifest.
+func readChecksum(path string, algo string) string {
+	f, err := os.Open(fmt.Sprintf("%s.%s", path, algo))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return ""
+	}
+
+	sum, file, found := strings.Cut(scanner.Text(), "  ")
+	if !found || file != path {
+		return ""
+	}
+
+	return sum
+}
+
+// uploadLocation describes where files are uploaded to by a remote location,
+// in the form of a URL
+func uploadLocation(name string, opts options) string {
+	prefix := remotePrefix(opts.UploadPrefix)
+
+	switch name {
+	case "s3":
+		return "s3://" + path.Join(opts.S3Bucket, prefix) + "/"
+	case "b2":
+		return "b2://" + path.Join(opts.B2Bucket, prefix) + "/"
+	case "gcs":
+		return "gs://" + path.Join(opts.GCSBucket, prefix) + "/"
+	case "azure":
+		return "azure://" + path.Join(opts.AzureContainer, prefix) + "/"
+	case "sftp":
+		u := url.URL{Scheme: "sftp", Host: opts.SFTPHost, Path: path.Join("/", opts.SFTPDirectory, prefix)}
+		if opts.SFTPPort != "" {
+			u.Host += ":" + opts.SFTPPort
+		}
+		if opts.SFTPUsername != "" {
+			u.User = url.User(opts.SFTPUsername)
+		}
+		return u.String()
+	case "local":
+		return filepath.Join(opts.LocalDirectory, filepath.FromSlash(prefix))
+	}
+
+	return ""
+}
+
+func newRunResult(dumps []*dump, runErr error, opts options, when time.Time, elapsed time.Duration) runResult {
+	r := runResult{
+		Status:          "success",
+		ExitCode:        exitStatus(runErr),
+		Timestamp:       when.Format(time.RFC3339),
+		DurationSeconds: elapsed.Seconds(),
+		Databases:       make([]dumpResult, 0, len(dumps)),
+		Uploads:         make([]uploadResult, 0),
+	}
+
+	if runErr != nil {
+		r.Status = "failure"
+		r.Error = runErr.Error()
+	}
+
+	sorted := slices.Clone(dumps)
+	slices.SortFunc(sorted, func(a, b *dump) int {
+		return strings.Compare(a.Database, b.Database)
+	})
+
+	for _, d := range sorted {
+		res := dumpResult{
+			Database:        d.Database,
+			Path:            d.Path,
+			Size:            d.Size,
+			DurationSeconds: d.Duration.Seconds(),
+			Unchanged:       d.Linked,
+		}
+
+		if d.Options != nil {
+			res.Format = formatNames[d.Options.Format]
+			if d.Options.SumAlgo != "none" && d.Options.SumAlgo != "" && d.Path != "" {
+				// The size is taken before encryption, like the
+				// checksum
+				res.ChecksumAlgo = d.Options.SumAlgo
+				if res.ChecksumAlgo == "auto" {
+					res.ChecksumAlgo = sumAlgoForSize(d.Size, opts.SumAutoThreshold)
+				}
+				res.Checksum = readChecksum(d.Path, res.ChecksumAlgo)
+			}
+		}
+
+		if d.ExitCode != 0 {
+			res.Error = "dump failed"
+			if d.Err != nil {
+				res.Error = d.Err.Error()
+			}
+		}
+
+		r.Databases = append(r.Databases, res)
+	}
+
+	for _, name := range uploadTargets(opts.Upload) {
+		r.Uploads = append(r.Uploads, uploadResult{Name: name, Location: uploadLocation(name, opts)})
+	}
+
+	return r
+}
+
+// writeResult outputs the result of the run as a single JSON object
+func writeResult(w io.Writer, r runResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// writeResultFile writes the result of the run to path, or to stdout when
+// path is "-". The file is replaced atomically so that a tool waiting for it
+// never reads a partial result.
+func writeResultFile(path string, r runResult, mode os.FileMode) error {
+	if path == "-" {
+		return writeResult(os.Stdout, r)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if err := writeResult(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if mode != 0 {
+		if err := os.Chmod(tmp, mode); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	l.Verboseln("result written to", path)
+
+	return nil
+}
@@ -0,0 +1,185 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "b1.dump")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readChecksum(path, "sha256"); got != "" {
+		t.Errorf("expected no checksum without checksum file, got %q", got)
+	}
+
+	if _, err := checksumFile(path, "sha256", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+	if got := readChecksum(path, "sha256"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The checksum file of a directory lists many files
+	d := filepath.Join(dir, "b2.d")
+	if err := os.Mkdir(d, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d, "toc.dat"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checksumFile(d, "sha256", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := readChecksum(d, "sha256"); got != "" {
+		t.Errorf("expected no checksum for a directory, got %q", got)
+	}
+}
+
+func TestUploadLocation(t *testing.T) {
+	opts := defaultOptions()
+	opts.UploadPrefix = "pg/prod"
+	opts.S3Bucket = "backups"
+	opts.GCSBucket = "gbackups"
+	opts.SFTPHost = "storage"
+	opts.SFTPPort = "2222"
+	opts.SFTPUsername = "pgbk"
+	opts.SFTPDirectory = "/srv/dumps"
+	opts.LocalDirectory = "/mnt/nfs"
+
+	var tests = []struct {
+		name string
+		want string
+	}{
+		{"s3", "s3://backups/pg/prod/"},
+		{"gcs", "gs://gbackups/pg/prod/"},
+		{"sftp", "sftp://pgbk@storage:2222/srv/dumps/pg/prod"},
+		{"local", "/mnt/nfs/pg/prod"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			if got := uploadLocation(st.name, opts); got != st.want {
+				t.Errorf("got %q, want %q", got, st.want)
+			}
+		})
+	}
+
+	opts.UploadPrefix = ""
+	if got := uploadLocation("s3", opts); got != "s3://backups/" {
+		t.Errorf("got %q, want %q", got, "s3://backups/")
+	}
+}
+
+func TestWriteResultFile(t *testing.T) {
+	opts := defaultOptions()
+	opts.Upload = "s3"
+	opts.S3Bucket = "backups"
+
+	dumps := []*dump{
+		{Database: "b2", ExitCode: 1, Duration: 2 * time.Second, Options: &dbOpts{Format: 'c', SumAlgo: "none"},
+			Err: errors.New("pg_dump exited with status 1")},
+		{Database: "b1", ExitCode: 0, Size: 2048, Duration: 1500 * time.Millisecond,
+			Options: &dbOpts{Format: 'd', SumAlgo: "sha256"}, Path: "/backups/b1.d"},
+		{Database: "b3", ExitCode: 0, Size: 1024, Linked: true,
+			Options: &dbOpts{Format: 'c', SumAlgo: "none"}, Path: "/backups/b3.dump"},
+	}
+	when := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	runErr := &dumpError{failed: []string{"b2"}, total: 3}
+
+	path := filepath.Join(t.TempDir(), "result.json")
+	r := newRunResult(dumps, runErr, opts, when, 65*time.Second)
+	if err := writeResultFile(path, r, 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got runResult
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("invalid JSON: %s\n%s", err, b)
+	}
+
+	want := runResult{
+		Status:          "failure",
+		ExitCode:        exitPartial,
+		Timestamp:       "2023-05-01T10:00:00Z",
+		DurationSeconds: 65,
+		Databases: []dumpResult{
+			{Database: "b1", Format: "directory", Path: "/backups/b1.d", Size: 2048, ChecksumAlgo: "sha256", DurationSeconds: 1.5},
+			{Database: "b2", Format: "custom", DurationSeconds: 2, Error: "pg_dump exited with status 1"},
+			{Database: "b3", Format: "custom", Path: "/backups/b3.dump", Size: 1024, Unchanged: true},
+		},
+		Uploads: []uploadResult{{Name: "s3", Location: "s3://backups/"}},
+		Error:   "dump of 1 of 3 databases failed: b2",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("result mismatch (-want +got):\n%s", diff)
+	}
+
+	// A successful run without dumps nor uploads still gives lists
+	r = newRunResult(nil, nil, defaultOptions(), when, time.Second)
+	if err := writeResultFile(path, r, 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	b, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = runResult{
+		Status:          "success",
+		ExitCode:        exitSuccess,
+		Timestamp:       "2023-05-01T10:00:00Z",
+		DurationSeconds: 1,
+		Databases:       []dumpResult{},
+		Uploads:         []uploadResult{},
+	}
+	got = runResult{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("invalid JSON: %s\n%s", err, b)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("result mismatch (-want +got):\n%s", diff)
+	}
+}
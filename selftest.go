@@ -0,0 +1,205 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// selfTestCheck is one of the checks of --self-test. When it passes, run
+// returns a short description of what was checked.
+type selfTestCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+// selfTest checks that pg_back can do its job with the given options,
+// without dumping anything: the backup directory is writable, the
+// PostgreSQL tools run, the connection works and files can be uploaded to
+// each remote location. The result of each check is written to w.
+func selfTest(w io.Writer, opts options) error {
+	setToolPaths(opts)
+
+	checks := []selfTestCheck{
+		{"backup directory", func() (string, error) { return checkBackupDirectory(opts.Directory) }},
+		{"pg_dump", func() (string, error) { return checkToolVersion("pg_dump", 80400) }},
+	}
+
+	if !opts.DumpOnly {
+		checks = append(checks, selfTestCheck{"pg_dumpall", func() (string, error) { return checkToolVersion("pg_dumpall", 80400) }})
+	}
+
+	checks = append(checks, selfTestCheck{"connection", func() (string, error) { return checkConnection(opts) }})
+
+	for _, name := range uploadTargets(opts.Upload) {
+		name := name
+		checks = append(checks, selfTestCheck{"upload to " + name, func() (string, error) { return checkRepo(name, opts) }})
+	}
+
+	return runSelfTest(w, checks)
+}
+
+// runSelfTest runs all the checks, even when some fail, and reports their
+// result. The error gives the number of failed checks.
+func runSelfTest(w io.Writer, checks []selfTestCheck) error {
+	failed := 0
+	for _, c := range checks {
+		l.Verboseln("self-test: checking", c.name)
+		msg, err := c.run()
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %s: %s\n", c.name, err)
+			continue
+		}
+
+		fmt.Fprintf(w, "PASS %s: %s\n", c.name, msg)
+	}
+
+	fmt.Fprintf(w, "%d checks passed, %d failed\n", len(checks)-failed, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("self-test failed: %d of %d checks failed", failed, len(checks))
+	}
+
+	return nil
+}
+
+// checkBackupDirectory ensures a file can be written in the backup
+// directory. When the path contains {dbname}, the directories of the
+// databases are created by the dumps, so their parent is checked.
+func checkBackupDirectory(dir string) (string, error) {
+	if i := strings.Index(dir, "{dbname}"); i >= 0 {
+		dir = filepath.Dir(dir[:i])
+	}
+
+	if err := validateDirectory(dir); err != nil {
+		return "", fmt.Errorf("invalid directory %s: %w", dir, err)
+	}
+
+	f, err := os.CreateTemp(dir, ".pg_back-selftest-")
+	if err != nil {
+		return "", fmt.Errorf("could not write to %s: %w", dir, err)
+	}
+	f.Close()
+
+	if err := os.Remove(f.Name()); err != nil {
+		return "", fmt.Errorf("could not remove %s: %w", f.Name(), err)
+	}
+
+	return fmt.Sprintf("%s is writable", dir), nil
+}
+
+// checkToolVersion runs the tool to get its version, which must be at least
+// minVersion
+func checkToolVersion(tool string, minVersion int) (string, error) {
+	version := pgToolVersion(tool)
+	if version == 0 {
+		return "", fmt.Errorf("could not get the version of %s", execPath(tool))
+	}
+
+	if version < minVersion {
+		return "", fmt.Errorf("%s version %s is older than %s", tool, formatPgVersion(version), formatPgVersion(minVersion))
+	}
+
+	return fmt.Sprintf("version %s", formatPgVersion(version)), nil
+}
+
+// checkConnection connects to PostgreSQL like a run would do
+func checkConnection(opts options) (string, error) {
+	conninfo, err := prepareConnInfo(opts.Host, opts.Port, opts.Username, opts.ConnDb, connParams(opts))
+	if err != nil {
+		return "", fmt.Errorf("could not compute connection string: %w", err)
+	}
+
+	db, err := dbOpen(conninfo)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	if db.superuser {
+		return fmt.Sprintf("server version %s, connected as superuser", formatPgVersion(db.version)), nil
+	}
+
+	return fmt.Sprintf("server version %s", formatPgVersion(db.version)), nil
+}
+
+// checkRepo uploads a small file to the remote location, lists it and
+// removes it
+func checkRepo(name string, opts options) (string, error) {
+	repo, err := NewRepo(name, opts)
+	if err != nil {
+		return "", err
+	}
+	defer repo.Close()
+
+	f, err := os.CreateTemp("", "pg_back-selftest-")
+	if err != nil {
+		return "", fmt.Errorf("could not create test file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("pg_back self-test\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not write test file: %w", err)
+	}
+
+	target := filepath.Join(opts.UploadPrefix, filepath.Base(f.Name()))
+	if err := repo.Upload(f.Name(), target); err != nil {
+		return "", err
+	}
+
+	items, err := repo.List(forwardSlashes(target))
+	if err != nil {
+		repo.Remove(target)
+		return "", fmt.Errorf("could not list %s: %w", target, err)
+	}
+
+	found := false
+	for _, i := range items {
+		if forwardSlashes(i.key) == forwardSlashes(target) {
+			found = true
+			break
+		}
+	}
+
+	if err := repo.Remove(target); err != nil {
+		return "", fmt.Errorf("could not remove %s: %w", target, err)
+	}
+
+	if !found {
+		return "", fmt.Errorf("uploaded file %s is not listed", target)
+	}
+
+	return fmt.Sprintf("uploaded, listed and removed %s", target), nil
+}
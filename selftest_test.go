@@ -0,0 +1,133 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	var tests = []struct {
+		checks []selfTestCheck
+		want   string
+		fails  bool
+	}{
+		{
+			[]selfTestCheck{
+				{"first", func() (string, error) { return "ok", nil }},
+				{"second", func() (string, error) { return "fine", nil }},
+			},
+			"PASS first: ok\nPASS second: fine\n2 checks passed, 0 failed\n",
+			false,
+		},
+		{
+			[]selfTestCheck{
+				{"first", func() (string, error) { return "", errors.New("broken") }},
+				{"second", func() (string, error) { return "fine", nil }},
+			},
+			"FAIL first: broken\nPASS second: fine\n1 checks passed, 1 failed\n",
+			true,
+		},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			var buf bytes.Buffer
+			err := runSelfTest(&buf, st.checks)
+			if st.fails != (err != nil) {
+				t.Errorf("unexpected result: %v", err)
+			}
+
+			if buf.String() != st.want {
+				t.Errorf("got %q, want %q", buf.String(), st.want)
+			}
+		})
+	}
+}
+
+func TestCheckBackupDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	var tests = []struct {
+		path  string
+		fails bool
+	}{
+		{dir, false},
+		{filepath.Join(dir, "{dbname}"), false},
+		{filepath.Join(dir, "pg_{dbname}", "dumps"), false},
+		{filepath.Join(dir, "missing"), true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			_, err := checkBackupDirectory(st.path)
+			if st.fails != (err != nil) {
+				t.Errorf("unexpected result: %v", err)
+			}
+
+			// The test file is removed
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 0 {
+				t.Errorf("files left in the backup directory: %v", entries)
+			}
+		})
+	}
+}
+
+func TestCheckRepo(t *testing.T) {
+	remote := t.TempDir()
+
+	opts := defaultOptions()
+	opts.LocalDirectory = remote
+	opts.UploadPrefix = "prefix"
+	if err := os.Mkdir(filepath.Join(remote, "prefix"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := checkRepo("local", opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(msg, "prefix/pg_back-selftest-") {
+		t.Errorf("unexpected message: %s", msg)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(remote, "prefix"))
+	if len(entries) != 0 {
+		t.Errorf("files left on the remote location: %v", entries)
+	}
+
+	opts.LocalDirectory = filepath.Join(remote, "missing")
+	if _, err := checkRepo("local", opts); err == nil {
+		t.Errorf("expected an error with a missing local directory")
+	}
+}
@@ -26,11 +26,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/jackc/pgtype"
 	_ "github.com/jackc/pgx/v4/stdlib"
+	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 )
@@ -106,6 +109,60 @@ func dbOpen(conninfo *ConnInfo) (*pg, error) {
 	return newDB, nil
 }
 
+// probeDatabase checks that a connection to the database of conninfo can be
+// opened, like pg_dump would do
+func probeDatabase(conninfo *ConnInfo) error {
+	db, err := sql.Open("pgx", conninfo.String())
+	if err != nil {
+		return fmt.Errorf("could not open database: %s", err)
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		return fmt.Errorf("could not connect to database: %s", err)
+	}
+
+	return nil
+}
+
+// skipUnavailableDatabases removes from the list the databases probe cannot
+// connect to, e.g. a database with a connection limit of 0 or being
+// created, so that they are reported as skipped instead of failed dumps
+func skipUnavailableDatabases(databases []string, probe func(dbname string) error) ([]string, []string) {
+	available := make([]string, 0, len(databases))
+	skipped := make([]string, 0)
+
+	for _, d := range databases {
+		if err := probe(d); err != nil {
+			l.Warnf("skipping database %s, it is not available: %s", d, err)
+			skipped = append(skipped, d)
+			continue
+		}
+
+		available = append(available, d)
+	}
+
+	return available, skipped
+}
+
+// setStatementTimeout limits the duration of the queries gathering
+// information from the catalog, so that pg_back cannot block forever, on a
+// locked catalog for example. The timeout is in seconds, 0 disables it.
+func (db *pg) setStatementTimeout(timeout int) error {
+	// The setting is per session, keep a single connection in the pool so
+	// that all queries run in the session where it is set
+	db.conn.SetMaxOpenConns(1)
+	db.conn.SetMaxIdleConns(1)
+
+	query := fmt.Sprintf("SET statement_timeout TO %d", timeout*1000)
+	l.Verboseln("executing SQL query:", query)
+	if _, err := db.conn.Exec(query); err != nil {
+		return fmt.Errorf("could not set statement_timeout: %s", err)
+	}
+
+	return nil
+}
+
 func (db *pg) Close() error {
 	l.Verboseln("closing connection to PostgreSQL")
 	return db.conn.Close()
@@ -134,31 +191,38 @@ func sqlQuoteIdent(s string) string {
 	return strings.ReplaceAll(s, "\"", "\"\"")
 }
 
-func listAllDatabases(db *pg, withTemplates bool) ([]string, error) {
+// listAllDatabases lists the databases accepting connections, only the ones
+// owned by the roles of ownedBy when it is not empty. When given, the
+// includePattern and excludePattern regular expressions are matched against
+// the names by the server, so that only the relevant databases are
+// retrieved on instances with many of them.
+func listAllDatabases(db *pg, withTemplates bool, ownedBy []string, includePattern string, excludePattern string) ([]string, error) {
 	var (
-		query  string
 		dbname string
+		owner  string
 	)
 
-	if withTemplates {
-		query = "select datname from pg_database where datallowconn;"
-	} else {
-		query = "select datname from pg_database where datallowconn and not datistemplate;"
-	}
+	query, args := listDatabasesQuery(withTemplates, includePattern, excludePattern)
 
 	dbs := make([]string, 0)
 	l.Verboseln("executing SQL query:", query)
-	rows, err := db.conn.Query(query)
+	rows, err := db.conn.Query(query, args...)
 	if err != nil {
 		return dbs, fmt.Errorf("could not list databases: %s", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		err := rows.Scan(&dbname)
+		err := rows.Scan(&dbname, &owner)
 		if err != nil {
 			continue
 		}
+
+		if len(ownedBy) > 0 && !slices.Contains(ownedBy, owner) {
+			l.Verbosef("skipping database %s owned by %s", dbname, owner)
+			continue
+		}
+
 		dbs = append(dbs, dbname)
 	}
 	if err := rows.Err(); err != nil {
@@ -167,56 +231,156 @@ func listAllDatabases(db *pg, withTemplates bool) ([]string, error) {
 	return dbs, nil
 }
 
-func listDatabases(db *pg, withTemplates bool, excludedDbs []string, includedDbs []string) ([]string, error) {
-	var (
-		databases []string
-		err       error
-	)
+// isDatabasePattern tells if the name of a database given to include or
+// exclude databases is a glob pattern
+func isDatabasePattern(name string) bool {
+	return strings.ContainsAny(name, `*?[\`)
+}
 
-	// When an explicit list of database is given, allow to select
-	// templates
-	if len(includedDbs) > 0 {
-		databases, err = listAllDatabases(db, true)
-		if err != nil {
-			return databases, err
-		}
-		realDbs := make([]string, 0, len(includedDbs))
+// matchDatabase checks if dbname matches the name or glob pattern. The name
+// is compared first, so that databases with glob characters in their name
+// can be given as is.
+func matchDatabase(pattern string, dbname string) bool {
+	if pattern == dbname {
+		return true
+	}
+
+	matched, err := filepath.Match(pattern, dbname)
+	return err == nil && matched
+}
 
-	nextidb:
-		for _, d := range includedDbs {
+// includeDatabases selects databases matching the given names or glob
+// patterns, in the order of the patterns. Names are searched in all
+// databases, while patterns only match candidates, so that they do not
+// select templates by mistake. A pattern being the exact name of a database
+// selects it.
+func includeDatabases(all []string, candidates []string, includedDbs []string) []string {
+	realDbs := make([]string, 0, len(includedDbs))
+	seen := make(map[string]bool)
+
+	for _, d := range includedDbs {
+		dbs := all
+		if slices.Contains(all, d) {
+			dbs = []string{d}
+		} else if isDatabasePattern(d) {
+			dbs = candidates
+		}
 
-			for _, e := range databases {
-				if d == e {
-					realDbs = append(realDbs, d)
-					continue nextidb
+		found := false
+		for _, e := range dbs {
+			if matchDatabase(d, e) {
+				found = true
+				if !seen[e] {
+					realDbs = append(realDbs, e)
+					seen[e] = true
 				}
 			}
-			l.Warnf("database \"%s\" does not exists, excluded", d)
 		}
-		databases = realDbs
-	} else {
-		databases, err = listAllDatabases(db, withTemplates)
-		if err != nil {
-			return databases, err
+
+		if !found {
+			if isDatabasePattern(d) {
+				l.Warnf("no database matches \"%s\"", d)
+			} else {
+				l.Warnf("database \"%s\" does not exists, excluded", d)
+			}
 		}
 	}
 
-	// Exclude databases even if they are explicitly included
-	if len(excludedDbs) > 0 {
-		filtered := make([]string, 0, len(databases))
+	return realDbs
+}
+
+// excludeDatabases removes databases matching any of the given names or glob
+// patterns
+func excludeDatabases(databases []string, excludedDbs []string) []string {
+	filtered := make([]string, 0, len(databases))
 
-	nextfdb:
-		for _, d := range databases {
-			for _, e := range excludedDbs {
-				if d == e {
-					continue nextfdb
-				}
+nextfdb:
+	for _, d := range databases {
+		for _, e := range excludedDbs {
+			if matchDatabase(e, d) {
+				continue nextfdb
 			}
-			filtered = append(filtered, d)
 		}
-		databases = filtered
+		filtered = append(filtered, d)
 	}
-	return databases, nil
+
+	return filtered
+}
+
+// selectDatabases applies the inclusion and exclusion rules to the databases
+// accepting connections, all. The candidates are the databases that can be
+// selected implicitly, that is all of them but the templates, unless they are
+// requested. The rules are, in order:
+//
+//   - without any database to include, all candidates are selected
+//   - a database included by its exact name is selected, even if it is a
+//     template: this is how a template is dumped without templates
+//   - a glob pattern to include only selects candidates, so "*" and
+//     "template1" select all databases and the template1 template
+//   - exclusion wins: a database matching a name or a pattern to exclude is
+//     never selected, even when included by its exact name
+func selectDatabases(all []string, candidates []string, includedDbs []string, excludedDbs []string) []string {
+	databases := candidates
+	if len(includedDbs) > 0 {
+		databases = includeDatabases(all, candidates, includedDbs)
+	}
+
+	if len(excludedDbs) == 0 {
+		return databases
+	}
+
+	selected := excludeDatabases(databases, excludedDbs)
+	for _, d := range includedDbs {
+		if !isDatabasePattern(d) && slices.Contains(databases, d) && !slices.Contains(selected, d) {
+			l.Warnf("database \"%s\" is both included and excluded, excluded", d)
+		}
+	}
+
+	return selected
+}
+
+// listDatabasesQuery builds the query of listAllDatabases and its
+// parameters, the patterns are given as parameters to avoid any quoting issue
+func listDatabasesQuery(withTemplates bool, includePattern string, excludePattern string) (string, []interface{}) {
+	var args []interface{}
+
+	query := "select datname, pg_get_userbyid(datdba) from pg_database where datallowconn"
+	if !withTemplates {
+		query += " and not datistemplate"
+	}
+	if includePattern != "" {
+		args = append(args, includePattern)
+		query += fmt.Sprintf(" and datname ~ $%d", len(args))
+	}
+	if excludePattern != "" {
+		args = append(args, excludePattern)
+		query += fmt.Sprintf(" and datname !~ $%d", len(args))
+	}
+
+	return query + ";", args
+}
+
+// listDatabases gives the databases to dump. The regular expressions of
+// includePattern and excludePattern are applied first by the server, then the
+// names and glob patterns of includedDbs and excludedDbs, see
+// selectDatabases.
+func listDatabases(db *pg, withTemplates bool, excludedDbs []string, includedDbs []string, ownedBy []string, includePattern string, excludePattern string) ([]string, error) {
+	// When an explicit list of database is given, allow to select
+	// templates by their name
+	all, err := listAllDatabases(db, withTemplates || len(includedDbs) > 0, ownedBy, includePattern, excludePattern)
+	if err != nil {
+		return all, err
+	}
+
+	candidates := all
+	if !withTemplates && len(includedDbs) > 0 {
+		candidates, err = listAllDatabases(db, false, ownedBy, includePattern, excludePattern)
+		if err != nil {
+			return candidates, err
+		}
+	}
+
+	return selectDatabases(all, candidates, includedDbs, excludedDbs), nil
 }
 
 type pgVersionError struct {
@@ -235,8 +399,11 @@ func (e *pgPrivError) Error() string {
 	return e.s
 }
 
-// pg_dumpacl stuff
-func dumpCreateDBAndACL(db *pg, dbname string, force bool) (string, error) {
+// pg_dumpacl stuff. pg_dump 11 and newer include the creation and ACL of the
+// database in custom, tar and directory dumps, so they are only output when
+// force is true: for the plain format, which does not have them, or when
+// asked with --always-dump-createdb.
+func dumpCreateDBAndACL(db *pg, dbname string, pgDumpVersion int, force bool) (string, error) {
 	var s string
 
 	if dbname == "" {
@@ -252,7 +419,7 @@ func dumpCreateDBAndACL(db *pg, dbname string, force bool) (string, error) {
 	// this is no longer necessary after 11. Dumping ACL is the
 	// job of pg_dump so we have to check its version, not the
 	// server
-	if pgToolVersion("pg_dump") >= 110000 && !force {
+	if pgDumpVersion >= 110000 && !force {
 		l.Verboseln("no need to dump create database query and database ACL with pg_dump from >=11")
 		return "", nil
 	}
@@ -414,7 +581,10 @@ func makeACLCommands(aclitem string, dbname string, owner string) string {
 	return s
 }
 
-func dumpDBConfig(db *pg, dbname string) (string, error) {
+// dumpDBConfig outputs the configuration of the database, the settings of
+// ALTER DATABASE and ALTER ROLE IN DATABASE. pg_dump 11 and newer include
+// them in the dump, so they are only output when force is true.
+func dumpDBConfig(db *pg, dbname string, pgDumpVersion int, force bool) (string, error) {
 	var s string
 
 	if dbname == "" {
@@ -429,7 +599,7 @@ func dumpDBConfig(db *pg, dbname string) (string, error) {
 	// this is no longer necessary after 11. Dumping ACL is the
 	// job of pg_dump so we have to check its version, not the
 	// server
-	if pgToolVersion("pg_dump") >= 110000 {
+	if pgDumpVersion >= 110000 && !force {
 		l.Verboseln("no need to dump database configuration with pg_dump from >=11")
 		return "", nil
 	}
@@ -539,6 +709,160 @@ func showSettings(db *pg) (string, error) {
 	}
 }
 
+// dumpTablespaces outputs the SQL commands to create the tablespaces of the
+// cluster at their location, with their options, owner and privileges. The
+// default tablespaces are left out.
+func dumpTablespaces(db *pg) (string, error) {
+	var s, query string
+
+	// spcoptions was added in 9.0
+	if db.version < 90000 {
+		return "", &pgVersionError{s: "cluster version is older than 9.0, not dumping tablespaces"}
+	}
+
+	location := "pg_tablespace_location(t.oid)"
+	if db.version < 90200 {
+		location = "t.spclocation"
+	}
+
+	query = "SELECT spcname, pg_get_userbyid(spcowner), " + location + ", spcoptions, spcacl " +
+		"FROM pg_tablespace t WHERE spcname !~ '^pg_' ORDER BY spcname"
+
+	l.Verboseln("executing SQL query:", query)
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return "", fmt.Errorf("could not query tablespaces: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			name     string
+			owner    string
+			location string
+			options  pgtype.TextArray
+			acl      pgtype.TextArray
+		)
+
+		if err := rows.Scan(&name, &owner, &location, &options, &acl); err != nil {
+			return "", fmt.Errorf("could not get row: %s", err)
+		}
+
+		s += fmt.Sprintf("--\n-- Tablespace %s\n--\n\n", name)
+		s += fmt.Sprintf("CREATE TABLESPACE \"%s\" OWNER \"%s\" LOCATION %s;\n", sqlQuoteIdent(name), sqlQuoteIdent(owner), sqlQuoteLiteral(location))
+
+		opts := make([]string, 0, len(options.Elements))
+		for _, e := range options.Elements {
+			if e.Status != pgtype.Null {
+				opts = append(opts, e.String)
+			}
+		}
+		if len(opts) > 0 {
+			s += fmt.Sprintf("ALTER TABLESPACE \"%s\" SET (%s);\n", sqlQuoteIdent(name), strings.Join(opts, ", "))
+		}
+
+		// A NULL acl means the default privileges, only the owner
+		// can create objects in the tablespace
+		if acl.Status != pgtype.Null {
+			s += fmt.Sprintf("REVOKE ALL ON TABLESPACE \"%s\" FROM PUBLIC;\n", sqlQuoteIdent(name))
+			s += fmt.Sprintf("REVOKE ALL ON TABLESPACE \"%s\" FROM \"%s\";\n", sqlQuoteIdent(name), sqlQuoteIdent(owner))
+			for _, e := range acl.Elements {
+				if e.Status != pgtype.Null {
+					s += makeTablespaceACLCommands(e.String, name, owner)
+				}
+			}
+		}
+
+		s += "\n"
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("could not retrive rows: %s", err)
+	}
+
+	return s, nil
+}
+
+// makeTablespaceACLCommands gives the GRANT command of an aclitem of a
+// tablespace, where the only privilege is CREATE
+func makeTablespaceACLCommands(aclitem string, spcname string, owner string) string {
+	var s string
+
+	// the aclitem format is "grantee=privs/grantor", see makeACLCommands
+	t := strings.Split(aclitem, "=")
+	if len(t) != 2 {
+		return ""
+	}
+	grantee := t[0]
+
+	t = strings.Split(t[1], "/")
+	if len(t) != 2 {
+		return ""
+	}
+	privs, grantor := t[0], t[1]
+
+	if !strings.HasPrefix(privs, "C") {
+		return ""
+	}
+
+	if grantee == "" {
+		grantee = "PUBLIC"
+	} else {
+		grantee = fmt.Sprintf("\"%s\"", sqlQuoteIdent(grantee))
+	}
+
+	if grantor != owner {
+		s += fmt.Sprintf("SET SESSION AUTHORIZATION \"%s\";\n", sqlQuoteIdent(grantor))
+	}
+
+	s += fmt.Sprintf("GRANT CREATE ON TABLESPACE \"%s\" TO %s", sqlQuoteIdent(spcname), grantee)
+	if privs == "C*" {
+		s += " WITH GRANT OPTION"
+	}
+	s += ";\n"
+
+	if grantor != owner {
+		s += "RESET SESSION AUTHORIZATION;\n"
+	}
+
+	return s
+}
+
+// listExtensions outputs the extensions installed in the database db is
+// connected to, one per line with their version and schema separated by tabs
+func listExtensions(db *pg) (string, error) {
+	var s string
+
+	if db.version < 90100 {
+		return "", &pgVersionError{s: "cluster version is older than 9.1, not listing extensions"}
+	}
+
+	query := "SELECT extname, extversion, nspname FROM pg_extension e " +
+		"JOIN pg_namespace n ON (n.oid = e.extnamespace) ORDER BY extname"
+
+	l.Verboseln("executing SQL query:", query)
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return "", fmt.Errorf("could not query extensions: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, version, schema string
+		if err := rows.Scan(&name, &version, &schema); err != nil {
+			return "", fmt.Errorf("could not get row: %s", err)
+		}
+
+		s += fmt.Sprintf("%s\t%s\t%s\n", name, version, schema)
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("could not retrive rows: %s", err)
+	}
+
+	return s, nil
+}
+
 func extractFileFromSettings(db *pg, name string) (string, error) {
 	query := "SELECT setting, pg_read_file(setting, 0, (pg_stat_file(setting)).size) FROM pg_settings WHERE name = $1"
 
@@ -615,8 +939,16 @@ func canPauseReplication(db *pg) (bool, error) {
 		return false, nil
 	}
 
+	// Before 10, the function checks if the user is superuser
+	if db.version < 100000 && !db.superuser {
+		return false, nil
+	}
+
+	// Without the privilege to execute the function, trying to pause
+	// would fail, this is the case of non superusers by default
 	query := fmt.Sprintf("SELECT 1 FROM pg_proc "+
-		"WHERE proname='pg_%s_replay_pause' AND pg_is_in_recovery()", db.xlogOrWal)
+		"WHERE proname='pg_%[1]s_replay_pause' AND pg_is_in_recovery() "+
+		"AND has_function_privilege('pg_%[1]s_replay_pause()', 'execute')", db.xlogOrWal)
 	l.Verboseln("executing SQL query:", query)
 	rows, err := db.conn.Query(query)
 	if err != nil {
@@ -639,61 +971,76 @@ func canPauseReplication(db *pg) (bool, error) {
 	return true, nil
 }
 
-func pauseReplicationWithTimeout(db *pg, timeOut int) error {
+// pauseReplicationWithTimeout pauses the replay on a standby, trying again
+// every interval while exclusive locks are held, for up to timeout. It tells
+// if the replay was paused. When the timeout is reached, the run fails unless
+// continueOnTimeout is true, in which case the dumps are done without pausing.
+func pauseReplicationWithTimeout(db *pg, timeout time.Duration, interval time.Duration, continueOnTimeout bool) (bool, error) {
 
+	// Not being able to pause replication is not an error, the server
+	// may not be a standby or we may not be allowed to pause, dump
+	// without pausing
 	if ok, err := canPauseReplication(db); !ok {
-		return err
+		if err != nil {
+			l.Warnf("%s, not pausing replication", err)
+		} else {
+			l.Verboseln("replication cannot be paused, skipping")
+		}
+		return false, nil
 	}
 
-	ticker := time.NewTicker(time.Duration(10) * time.Second)
-	done := make(chan bool)
-	stop := make(chan bool)
-	fail := make(chan error)
-
 	l.Infoln("pausing replication")
 
-	// We want to retry pausing replication at a defined interval
-	// but not forever. We cannot put the timeout in the same
-	// select as the ticker since the ticker would always win
-	go func() {
-		var rerr *pgReplicaHasLocks
-		defer ticker.Stop()
-
-		for {
-			if err := pauseReplication(db); err != nil {
-				if errors.As(err, &rerr) {
-					l.Warnln(err)
-				} else {
-					fail <- err
-					return
-				}
-			} else {
-				done <- true
-				return
-			}
+	err := retryPause(func() error { return pauseReplication(db) }, timeout, interval)
+	if err != nil {
+		var terr *pauseTimeoutError
+		if continueOnTimeout && errors.As(err, &terr) {
+			l.Warnf("%s, dumping without pausing replication", err)
+			return false, nil
+		}
+		return false, err
+	}
 
-			select {
-			case <-stop:
-				return
-			case <-ticker.C:
-				break
-			}
+	l.Infoln("replication paused")
+	return true, nil
+}
+
+type pauseTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *pauseTimeoutError) Error() string {
+	return fmt.Sprintf("replication not paused after %v", e.timeout)
+}
+
+// retryPause calls pause until it succeeds, waiting interval between the
+// attempts that fail because of exclusive locks held on the standby. The last
+// attempt is made when timeout is reached.
+func retryPause(pause func() error, timeout time.Duration, interval time.Duration) error {
+	var rerr *pgReplicaHasLocks
+	deadline := time.Now().Add(timeout)
+
+	for attempt := 1; ; attempt++ {
+		err := pause()
+		if err == nil {
+			return nil
 		}
-	}()
 
-	// Return as soon as the replication is paused or stop the
-	// goroutine if we hit the timeout
-	select {
-	case <-done:
-		l.Infoln("replication paused")
-	case <-time.After(time.Duration(timeOut) * time.Second):
-		stop <- true
-		return fmt.Errorf("replication not paused after %v", time.Duration(timeOut)*time.Second)
-	case err := <-fail:
-		return fmt.Errorf("%s", err)
-	}
+		if !errors.As(err, &rerr) {
+			return err
+		}
 
-	return nil
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return &pauseTimeoutError{timeout: timeout}
+		}
+		if wait > interval {
+			wait = interval
+		}
+
+		l.Warnf("%s, attempt %d, retrying in %v", err, attempt, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+	}
 }
 
 func resumeReplication(db *pg) error {
@@ -711,3 +1058,135 @@ func resumeReplication(db *pg) error {
 
 	return nil
 }
+
+// pgSnapshot is an exported snapshot kept alive by an open transaction, so
+// that pg_dump can import it with --snapshot
+type pgSnapshot struct {
+	db *pg
+	tx *sql.Tx
+	id string
+}
+
+// exportSnapshot opens a transaction on the database of the connection and
+// exports its snapshot. A snapshot can only be imported in the database
+// where it was exported, so a connection to each dumped database is needed.
+func exportSnapshot(conninfo *ConnInfo) (*pgSnapshot, error) {
+	db, err := dbOpen(conninfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// pg_export_snapshot() exists since 9.2, but require 9.5 like the
+	// newest pg_dump versions do to use --snapshot reliably
+	if db.version < 90500 {
+		db.Close()
+		return nil, &pgVersionError{s: "cluster version is older than 9.5, not using synchronized snapshots"}
+	}
+
+	tx, err := db.conn.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not start transaction: %s", err)
+	}
+
+	var id string
+	query := "SELECT pg_export_snapshot()"
+	l.Verboseln("executing SQL query:", query)
+	if err := tx.QueryRow(query).Scan(&id); err != nil {
+		tx.Rollback()
+		db.Close()
+		return nil, fmt.Errorf("could not export snapshot: %s", err)
+	}
+
+	return &pgSnapshot{db: db, tx: tx, id: id}, nil
+}
+
+// Close ends the transaction exporting the snapshot, it must only be called
+// once pg_dump has imported it
+func (s *pgSnapshot) Close() error {
+	s.tx.Rollback()
+	return s.db.Close()
+}
+
+// pgSlotSnapshot is a logical replication slot created on a replication
+// connection, along with the snapshot exported at its creation. The
+// snapshot can be imported until the connection runs another command, the
+// connection is kept idle until pg_dump is done.
+type pgSlotSnapshot struct {
+	db     *pg
+	conn   *sql.Conn
+	name   string
+	lsn    string
+	id     string
+	plugin string
+}
+
+// createSlotSnapshot creates a logical replication slot using the pgoutput
+// plugin in the database of the connection, and exports the snapshot
+// matching the point where the slot starts. A temporary slot is dropped when
+// the connection is closed, unless keep is true.
+func createSlotSnapshot(conninfo *ConnInfo, name string, keep bool) (*pgSlotSnapshot, error) {
+	// Replication commands are only available with the simple query
+	// protocol on a replication connection
+	db, err := dbOpen(conninfo.Set("replication", "database").Set("prefer_simple_protocol", "true"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Temporary slots and the EXPORT_SNAPSHOT option exist since 10
+	if db.version < 100000 {
+		db.Close()
+		return nil, &pgVersionError{s: "cluster version is older than 10, not creating logical replication slots"}
+	}
+
+	conn, err := db.conn.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not get connection: %s", err)
+	}
+
+	temporary := "TEMPORARY "
+	if keep {
+		temporary = ""
+	}
+
+	s := &pgSlotSnapshot{db: db, conn: conn}
+	query := fmt.Sprintf("CREATE_REPLICATION_SLOT \"%s\" %sLOGICAL pgoutput EXPORT_SNAPSHOT", sqlQuoteIdent(name), temporary)
+	l.Verboseln("executing replication command:", query)
+	if err := conn.QueryRowContext(context.Background(), query).Scan(&s.name, &s.lsn, &s.id, &s.plugin); err != nil {
+		conn.Close()
+		db.Close()
+		return nil, fmt.Errorf("could not create logical replication slot %s: %s", name, err)
+	}
+
+	return s, nil
+}
+
+// Close closes the replication connection, which drops the slot when it is
+// temporary. It must only be called once pg_dump has imported the snapshot.
+func (s *pgSlotSnapshot) Close() error {
+	s.conn.Close()
+	return s.db.Close()
+}
+
+// dbChangeSignal gives the size of a database and the number of rows
+// inserted, updated and deleted in it, according to the cumulative
+// statistics, along with the time they were last reset. It is a cheap way to
+// tell if a database may have changed since a previous run.
+func dbChangeSignal(db *pg, dbname string) (dbState, error) {
+	var s dbState
+
+	// stats_reset was added to pg_stat_database in 9.1
+	if db.version < 90100 {
+		return s, &pgVersionError{s: "cluster version is older than 9.1, not skipping unchanged databases"}
+	}
+
+	query := "SELECT pg_database_size(d.datname), s.tup_inserted + s.tup_updated + s.tup_deleted, coalesce(s.stats_reset::text, '') " +
+		"FROM pg_database d JOIN pg_stat_database s ON (s.datid = d.oid) WHERE d.datname = $1"
+	l.Verboseln("executing SQL query:", query)
+	if err := db.conn.QueryRow(query, dbname).Scan(&s.Size, &s.Changes, &s.StatsReset); err != nil {
+		return s, fmt.Errorf("could not get the size and statistics of %s: %s", dbname, err)
+	}
+
+	return s, nil
+}
@@ -26,13 +26,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"io"
 	"os"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -134,6 +137,47 @@ func TestMakeACLCommands(t *testing.T) {
 	}
 }
 
+func TestMakeTablespaceACLCommands(t *testing.T) {
+	var tests = []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"invalid", ""},
+		{"=/", ""},
+		{"testrole=C/testrole", "GRANT CREATE ON TABLESPACE \"ts\" TO \"testrole\";\n"},
+		{"=C/testrole", "GRANT CREATE ON TABLESPACE \"ts\" TO PUBLIC;\n"},
+		{"other=C*/testrole", "GRANT CREATE ON TABLESPACE \"ts\" TO \"other\" WITH GRANT OPTION;\n"},
+		{"third=C/other", "SET SESSION AUTHORIZATION \"other\";\nGRANT CREATE ON TABLESPACE \"ts\" TO \"third\";\nRESET SESSION AUTHORIZATION;\n"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := makeTablespaceACLCommands(st.input, "ts", "testrole")
+			if got != st.want {
+				t.Errorf("got '%s', want '%s'", got, st.want)
+			}
+		})
+	}
+}
+
+func TestDumpTablespaces(t *testing.T) {
+	needPgConn(t)
+
+	// The test cluster may not have any tablespace besides the default
+	// ones, only check the output is consistent
+	got, err := dumpTablespaces(testdb)
+	if err != nil {
+		t.Errorf("expected non nil error, got %q", err)
+	}
+
+	for _, v := range strings.Split(got, "\n") {
+		if strings.HasPrefix(v, "CREATE TABLESPACE \"pg_") {
+			t.Errorf("default tablespaces must not be dumped: %s", v)
+		}
+	}
+}
+
 func TestDbOpen(t *testing.T) {
 	if os.Getenv("PGBK_TEST_CONNINFO") == "" {
 		t.Skip("testing with PostgreSQL disabled")
@@ -170,7 +214,7 @@ func TestListAllDatabases(t *testing.T) {
 
 	for i, st := range tests {
 		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
-			got, err := listAllDatabases(testdb, st.templates)
+			got, err := listAllDatabases(testdb, st.templates, nil, "", "")
 			if err != nil {
 				t.Errorf("expected non nil error, got %q", err)
 			}
@@ -198,13 +242,105 @@ func TestListDatabases(t *testing.T) {
 		{true, []string{"b1", "b3"}, []string{}, []string{"b2", "postgres", "template1"}},
 		{false, []string{"b1", "b3"}, []string{}, []string{"b2", "postgres"}},
 		{false, []string{"b1", "b3"}, []string{"b1", "b2", "template1"}, []string{"b2", "template1"}},
+		{false, []string{}, []string{"*", "template1"}, []string{"b1", "b2", "postgres", "template1"}},
+		{false, []string{"template1"}, []string{"template1"}, []string{}},
+		{true, []string{"template*"}, []string{}, []string{"b1", "b2", "postgres"}},
+	}
+
+	needPgConn(t)
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := listDatabases(testdb, st.withTemplates, st.excludedDbs, st.includedDbs, nil, "", "")
+			if err != nil {
+				t.Errorf("expected non nil error, got %q", err)
+			}
+
+			if diff := cmp.Diff(st.want, got, cmpopts.EquateEmpty(), cmpopts.SortSlices(func(x, y string) bool { return x < y })); diff != "" {
+				t.Errorf("listDatabases() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestListDatabasesQuery(t *testing.T) {
+	base := "select datname, pg_get_userbyid(datdba) from pg_database where datallowconn"
+
+	var tests = []struct {
+		withTemplates bool
+		include       string
+		exclude       string
+		query         string
+		args          []interface{}
+	}{
+		{true, "", "", base + ";", nil},
+		{false, "", "", base + " and not datistemplate;", nil},
+		{false, "^tenant_", "", base + " and not datistemplate and datname ~ $1;", []interface{}{"^tenant_"}},
+		{true, "", "_old$", base + " and datname !~ $1;", []interface{}{"_old$"}},
+		{false, "^tenant_", "_old$", base + " and not datistemplate and datname ~ $1 and datname !~ $2;", []interface{}{"^tenant_", "_old$"}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			query, args := listDatabasesQuery(st.withTemplates, st.include, st.exclude)
+			if query != st.query {
+				t.Errorf("got query %q, want %q", query, st.query)
+			}
+			if diff := cmp.Diff(st.args, args, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("listDatabasesQuery() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestListDatabasesPatterns(t *testing.T) {
+	var tests = []struct {
+		includedDbs []string
+		include     string
+		exclude     string
+		want        []string
+	}{
+		{[]string{}, "^b", "", []string{"b1", "b2"}},
+		{[]string{}, "", "^b", []string{"postgres"}},
+		{[]string{}, "^b", "2$", []string{"b1"}},
+		// the server side filter applies before names and globs
+		{[]string{"b*", "postgres"}, "", "1$", []string{"b2", "postgres"}},
+		{[]string{"template1"}, "^b", "", []string{}},
+	}
+
+	needPgConn(t)
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := listDatabases(testdb, false, []string{}, st.includedDbs, nil, st.include, st.exclude)
+			if err != nil {
+				t.Errorf("expected non nil error, got %q", err)
+			}
+
+			if diff := cmp.Diff(st.want, got, cmpopts.EquateEmpty(), cmpopts.SortSlices(func(x, y string) bool { return x < y })); diff != "" {
+				t.Errorf("listDatabases() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestListDatabasesOwnedBy(t *testing.T) {
+	var tests = []struct {
+		includedDbs []string
+		ownedBy     []string
+		want        []string
+	}{
+		{[]string{}, []string{"u1"}, []string{"b1", "b2"}},
+		{[]string{}, []string{"u1", "u3"}, []string{"b1", "b2"}},
+		{[]string{}, []string{"u3"}, []string{}},
+		{[]string{"b1", "postgres"}, []string{"u1"}, []string{"b1"}},
 	}
 
 	needPgConn(t)
 
 	for i, st := range tests {
 		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
-			got, err := listDatabases(testdb, st.withTemplates, st.excludedDbs, st.includedDbs)
+			got, err := listDatabases(testdb, false, []string{}, st.includedDbs, st.ownedBy, "", "")
 			if err != nil {
 				t.Errorf("expected non nil error, got %q", err)
 			}
@@ -216,19 +352,134 @@ func TestListDatabases(t *testing.T) {
 	}
 }
 
+func TestIncludeExcludeDatabases(t *testing.T) {
+	all := []string{"postgres", "template1", "tenant_001", "tenant_002", "tenant_010", "app[1]", "other"}
+	candidates := []string{"postgres", "tenant_001", "tenant_002", "tenant_010", "app[1]", "other"}
+
+	var tests = []struct {
+		includedDbs []string
+		excludedDbs []string
+		want        []string
+	}{
+		// exact names still work, including templates
+		{[]string{"other", "template1"}, []string{}, []string{"other", "template1"}},
+		// patterns do not match templates
+		{[]string{"t*"}, []string{}, []string{"tenant_001", "tenant_002", "tenant_010"}},
+		{[]string{"tenant_00?"}, []string{}, []string{"tenant_001", "tenant_002"}},
+		// overlapping patterns only select a database once
+		{[]string{"tenant_*", "tenant_00[12]", "other"}, []string{}, []string{"tenant_001", "tenant_002", "tenant_010", "other"}},
+		// exclusion wins over inclusion
+		{[]string{"tenant_*"}, []string{"tenant_01*"}, []string{"tenant_001", "tenant_002"}},
+		{[]string{"tenant_*", "other"}, []string{"*"}, []string{}},
+		{[]string{"tenant_001"}, []string{"tenant_00?"}, []string{}},
+		// exact names with glob characters are matched as is
+		{[]string{"app[1]", "app["}, []string{}, []string{"app[1]"}},
+		{[]string{"tenant_*"}, []string{"app[1]"}, []string{"tenant_001", "tenant_002", "tenant_010"}},
+		{[]string{"*"}, []string{"app[1]"}, []string{"postgres", "tenant_001", "tenant_002", "tenant_010", "other"}},
+		{[]string{"app[[]1]"}, []string{}, []string{"app[1]"}},
+		{[]string{"nothing_*"}, []string{}, []string{}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := excludeDatabases(includeDatabases(all, candidates, st.includedDbs), st.excludedDbs)
+			if diff := cmp.Diff(st.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("includeDatabases() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSelectDatabases(t *testing.T) {
+	all := []string{"postgres", "template1", "tpl_app", "b1", "b2"}
+	noTemplates := []string{"postgres", "b1", "b2"}
+
+	var tests = []struct {
+		candidates  []string
+		includedDbs []string
+		excludedDbs []string
+		want        []string
+	}{
+		// without inclusion, all candidates are selected
+		{noTemplates, []string{}, []string{}, []string{"postgres", "b1", "b2"}},
+		{all, []string{}, []string{}, []string{"postgres", "template1", "tpl_app", "b1", "b2"}},
+		{all, []string{}, []string{"t*"}, []string{"postgres", "b1", "b2"}},
+		// a template given by its exact name is always selected
+		{noTemplates, []string{"template1"}, []string{}, []string{"template1"}},
+		{noTemplates, []string{"b1", "template1"}, []string{"b2"}, []string{"b1", "template1"}},
+		// patterns only select templates when they are candidates
+		{noTemplates, []string{"*"}, []string{}, []string{"postgres", "b1", "b2"}},
+		{noTemplates, []string{"*", "template1"}, []string{}, []string{"postgres", "b1", "b2", "template1"}},
+		{noTemplates, []string{"t*"}, []string{}, []string{}},
+		{all, []string{"t*"}, []string{}, []string{"template1", "tpl_app"}},
+		// exclusion wins, by name or pattern
+		{noTemplates, []string{"*", "template1"}, []string{"template1"}, []string{"postgres", "b1", "b2"}},
+		{noTemplates, []string{"template1", "tpl_app"}, []string{"tpl_*"}, []string{"template1"}},
+		{all, []string{"t*"}, []string{"template1"}, []string{"tpl_app"}},
+		{noTemplates, []string{"b*"}, []string{"b2"}, []string{"b1"}},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got := selectDatabases(all, st.candidates, st.includedDbs, st.excludedDbs)
+			if diff := cmp.Diff(st.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("selectDatabases() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSkipUnavailableDatabases(t *testing.T) {
+	probe := func(dbname string) error {
+		if strings.HasPrefix(dbname, "down") {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	available, skipped := skipUnavailableDatabases([]string{"b1", "down1", "b2", "down2"}, probe)
+	if diff := cmp.Diff([]string{"b1", "b2"}, available); diff != "" {
+		t.Errorf("skipUnavailableDatabases() available mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"down1", "down2"}, skipped); diff != "" {
+		t.Errorf("skipUnavailableDatabases() skipped mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestProbeDatabase(t *testing.T) {
+	needPgConn(t)
+
+	conninfo, err := parseConnInfo(os.Getenv("PGBK_TEST_CONNINFO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := probeDatabase(conninfo.Set("dbname", "b1")); err != nil {
+		t.Errorf("could not probe b1: %s", err)
+	}
+	if err := probeDatabase(conninfo.Set("dbname", "missing")); err == nil {
+		t.Errorf("expected an error when probing a missing database")
+	}
+}
+
 func TestDumpDBConfig(t *testing.T) {
+	b1 := "ALTER ROLE \"u1\" IN DATABASE \"b1\" SET \"work_mem\" TO '1MB';\nALTER DATABASE \"b1\" SET \"log_min_duration_statement\" TO '10s';\nALTER DATABASE \"b1\" SET \"work_mem\" TO '5MB';\n"
+
 	var tests = []struct {
-		want string
+		version int
+		force   bool
+		want    string
 	}{
-		{"ALTER ROLE \"u1\" IN DATABASE \"b1\" SET \"work_mem\" TO '1MB';\nALTER DATABASE \"b1\" SET \"log_min_duration_statement\" TO '10s';\nALTER DATABASE \"b1\" SET \"work_mem\" TO '5MB';\n"},
+		{100000, false, b1},
+		{160000, false, ""},
+		{160000, true, b1},
 	}
 
 	needPgConn(t)
-	needPgDump(t)
 
 	for i, st := range tests {
 		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
-			got, err := dumpDBConfig(testdb, "b1")
+			got, err := dumpDBConfig(testdb, "b1", st.version, st.force)
 			if err != nil {
 				t.Errorf("expected non nil error, got %q", err)
 			}
@@ -268,19 +519,29 @@ func TestShowSettings(t *testing.T) {
 
 func TestDumpCreateDBAndACL(t *testing.T) {
 	needPgConn(t)
-	needPgDump(t)
 
+	b1 := "--\n-- Database creation\n--\n\nCREATE DATABASE \"b1\" WITH TEMPLATE = template0 OWNER = \"u1\" ENCODING = 'UTF8' LC_COLLATE = 'en_US.UTF-8' LC_CTYPE = 'en_US.UTF-8';\n\n"
+	b2 := "--\n-- Database creation\n--\n\nCREATE DATABASE \"b2\" WITH TEMPLATE = template0 OWNER = \"u1\" ENCODING = 'UTF8' LC_COLLATE = 'en_US.UTF-8' LC_CTYPE = 'en_US.UTF-8';\n\n--\n-- Database privileges \n--\n\nREVOKE CONNECT, TEMPORARY ON DATABASE \"b2\" FROM PUBLIC;\nGRANT CONNECT ON DATABASE \"b2\" TO \"u2\";\n"
+
+	// With pg_dump 11 and newer, the creation and ACL of the database are
+	// only output when forced, for the plain format
 	var tests = []struct {
-		db   string
-		want string
+		db      string
+		version int
+		force   bool
+		want    string
 	}{
-		{"b1", "--\n-- Database creation\n--\n\nCREATE DATABASE \"b1\" WITH TEMPLATE = template0 OWNER = \"u1\" ENCODING = 'UTF8' LC_COLLATE = 'en_US.UTF-8' LC_CTYPE = 'en_US.UTF-8';\n\n"},
-		{"b2", "--\n-- Database creation\n--\n\nCREATE DATABASE \"b2\" WITH TEMPLATE = template0 OWNER = \"u1\" ENCODING = 'UTF8' LC_COLLATE = 'en_US.UTF-8' LC_CTYPE = 'en_US.UTF-8';\n\n--\n-- Database privileges \n--\n\nREVOKE CONNECT, TEMPORARY ON DATABASE \"b2\" FROM PUBLIC;\nGRANT CONNECT ON DATABASE \"b2\" TO \"u2\";\n"},
+		{"b1", 100000, false, b1},
+		{"b2", 100000, false, b2},
+		{"b1", 160000, false, ""},
+		{"b2", 160000, false, ""},
+		{"b1", 160000, true, b1},
+		{"b2", 160000, true, b2},
 	}
 
-	for _, st := range tests {
-		t.Run(fmt.Sprintf("%s", st.db), func(t *testing.T) {
-			got, err := dumpCreateDBAndACL(testdb, st.db, false)
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, err := dumpCreateDBAndACL(testdb, st.db, st.version, st.force)
 			if err != nil {
 				t.Errorf("expected non nil error, got %q", err)
 			}
@@ -313,3 +574,88 @@ func TestExtractFileFromSettings(t *testing.T) {
 
 // Testing replication management fonctions needs a more complex setup
 // so we skip it.
+
+func TestExportSnapshot(t *testing.T) {
+	if os.Getenv("PGBK_TEST_CONNINFO") == "" {
+		t.Skip("testing with PostgreSQL disabled")
+	}
+
+	conninfo, err := parseConnInfo(os.Getenv("PGBK_TEST_CONNINFO"))
+	if err != nil {
+		t.Fatalf("unable to parse PGBK_TEST_CONNINFO: %s", err)
+	}
+
+	s, err := exportSnapshot(conninfo)
+	if err != nil {
+		var verr *pgVersionError
+		if errors.As(err, &verr) {
+			t.Skip(err)
+		}
+		t.Fatalf("expected an ok on exportSnapshot(), got %s", err)
+	}
+
+	if s.id == "" {
+		t.Errorf("expected a snapshot id, got nothing")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Errorf("expected an ok on Close(), got %s", err)
+	}
+}
+
+func TestRetryPause(t *testing.T) {
+	locked := &pgReplicaHasLocks{}
+	other := errors.New("permission denied")
+
+	var tests = []struct {
+		failures int   // number of attempts failing with locks
+		fail     error // error returned after the failures
+		timeout  time.Duration
+		want     int // expected number of attempts
+		wantErr  string
+	}{
+		{0, nil, time.Second, 1, ""},
+		{3, nil, time.Second, 4, ""},
+		{-1, nil, 25 * time.Millisecond, 0, "replication not paused after 25ms"},
+		{1, other, time.Second, 2, "permission denied"},
+	}
+
+	l.logger.SetOutput(io.Discard)
+	defer l.logger.SetOutput(os.Stderr)
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			attempts := 0
+			pause := func() error {
+				attempts++
+				if st.failures < 0 || attempts <= st.failures {
+					return locked
+				}
+				return st.fail
+			}
+
+			err := retryPause(pause, st.timeout, 10*time.Millisecond)
+			if st.wantErr == "" {
+				if err != nil {
+					t.Errorf("did not want an error, got %s", err)
+				}
+			} else if err == nil || err.Error() != st.wantErr {
+				t.Errorf("got error %v, want %q", err, st.wantErr)
+			}
+
+			if st.want > 0 && attempts != st.want {
+				t.Errorf("got %d attempts, want %d", attempts, st.want)
+			}
+
+			if st.failures < 0 {
+				var terr *pauseTimeoutError
+				if !errors.As(err, &terr) {
+					t.Errorf("expected a pauseTimeoutError, got %T", err)
+				}
+				if attempts < 2 {
+					t.Errorf("expected several attempts before the timeout, got %d", attempts)
+				}
+			}
+		})
+	}
+}
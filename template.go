@@ -0,0 +1,200 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// nameTemplateData holds the fields available in the filename template
+type nameTemplateData struct {
+	DBName    string
+	Time      time.Time
+	Timestamp string
+	Suffix    string
+}
+
+// nameTemplate produces the path of files relative to the backup directory,
+// instead of the default <dbname>_<timestamp>.<suffix>
+type nameTemplate struct {
+	tmpl *template.Template
+
+	// base name of the files with the fields replaced by markers, to
+	// find files produced with the template when purging
+	base string
+}
+
+// Markers used in place of the fields to analyse the output of the template
+const (
+	tmplDBName    = "\x00dbname\x00"
+	tmplTimestamp = "\x00timestamp\x00"
+	tmplSuffix    = "\x00suffix\x00"
+)
+
+// nameTmpl is the filename template in use, nil for the default naming
+var nameTmpl *nameTemplate
+
+// runSubdirs stores the files of each run in a subdirectory of the backup
+// directory named after the timestamp of the run, e.g.
+// <timestamp>/<dbname>.dump
+var runSubdirs bool
+
+// newNameTemplate parses and checks a filename template. The name of the
+// file must contain the database name and the timestamp, end with the
+// suffix, and not depend on the time otherwise, so that the purge can find
+// the files of each run. The directories can use any field.
+func newNameTemplate(text string) (*nameTemplate, error) {
+	tmpl, err := template.New("filename").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &nameTemplate{tmpl: tmpl}
+
+	var bases [2]string
+	for i, when := range []time.Time{
+		time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC),
+		time.Date(2012, 11, 10, 9, 8, 7, 0, time.UTC),
+	} {
+		path, err := t.execute(nameTemplateData{
+			DBName:    tmplDBName,
+			Time:      when,
+			Timestamp: tmplTimestamp,
+			Suffix:    tmplSuffix,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if !filepath.IsLocal(path) {
+			return nil, fmt.Errorf("template must produce a relative path inside the backup directory")
+		}
+
+		bases[i] = filepath.Base(path)
+	}
+
+	base := bases[0]
+	switch {
+	case base != bases[1]:
+		return nil, errors.New("the name of the file must not depend on .Time, use .Timestamp")
+	case !strings.Contains(base, tmplDBName):
+		return nil, errors.New("the name of the file must contain {{.DBName}}")
+	case !strings.Contains(base, tmplTimestamp):
+		return nil, errors.New("the name of the file must contain {{.Timestamp}}")
+	case !strings.HasSuffix(base, "."+tmplSuffix) || strings.Count(base, tmplSuffix) != 1:
+		return nil, errors.New("the name of the file must end with .{{.Suffix}}")
+	}
+
+	t.base = base
+
+	return t, nil
+}
+
+func (t *nameTemplate) execute(data nameTemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	return filepath.Clean(filepath.FromSlash(buf.String())), nil
+}
+
+// nameRegexp returns a regular expression matching the name of the files of
+// dbname, it captures the timestamp and the suffix, along with any extension
+// added after it
+func (t *nameTemplate) nameRegexp(dbname string) *regexp.Regexp {
+	re := regexp.QuoteMeta(strings.TrimSuffix(t.base, "."+tmplSuffix))
+	re = strings.ReplaceAll(re, tmplDBName, regexp.QuoteMeta(cleanDBName(dbname)))
+
+	// Only the first timestamp is captured, the others must be there
+	re = strings.Replace(re, tmplTimestamp, "(.+?)", 1)
+	re = strings.ReplaceAll(re, tmplTimestamp, ".+?")
+
+	return regexp.MustCompile("^" + re + `\.(.+)$`)
+}
+
+// dbnameRegexp returns a regular expression matching the name of the files
+// of any database, it captures the name of the database
+func (t *nameTemplate) dbnameRegexp() *regexp.Regexp {
+	re := regexp.QuoteMeta(strings.TrimSuffix(t.base, "."+tmplSuffix))
+	re = strings.Replace(re, tmplDBName, "(.+)", 1)
+	re = strings.ReplaceAll(re, tmplDBName, ".+")
+	re = strings.ReplaceAll(re, tmplTimestamp, dumpTimestampPattern)
+
+	return regexp.MustCompile("^" + re + `\.(.+)$`)
+}
+
+// canonicalDumpName gives the default name of a file produced with the
+// template, given its path relative to the backup directory, so that it can
+// be parsed like any other file. Files inside a dump in the directory format
+// keep their path relative to the dump.
+func canonicalDumpName(re *regexp.Regexp, path string, dbname string) (string, bool) {
+	components := strings.Split(filepath.ToSlash(path), "/")
+	for i, c := range components {
+		matches := re.FindStringSubmatch(c)
+		if matches == nil {
+			continue
+		}
+
+		name := cleanDBName(dbname) + "_" + matches[1] + "." + matches[2]
+		if i < len(components)-1 {
+			name += "/" + strings.Join(components[i+1:], "/")
+		}
+
+		return name, true
+	}
+
+	return "", false
+}
+
+// runSubdirName gives the default name of a file stored in the subdirectory
+// of its run, given its path relative to the backup directory, so that it
+// can be parsed like any other file. Files inside a dump in the directory
+// format keep their path relative to the dump.
+func runSubdirName(path string, dbname string) (string, bool) {
+	run, name, found := strings.Cut(filepath.ToSlash(path), "/")
+	if !found {
+		return "", false
+	}
+
+	if _, ok := parseDumpTimestamp(run); !ok {
+		return "", false
+	}
+
+	prefix := cleanDBName(dbname) + "."
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+
+	return cleanDBName(dbname) + "_" + run + "." + strings.TrimPrefix(name, prefix), true
+}
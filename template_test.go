@@ -0,0 +1,328 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewNameTemplate(t *testing.T) {
+	var tests = []struct {
+		give      string
+		wantError bool
+	}{
+		{"{{.DBName}}_{{.Timestamp}}.{{.Suffix}}", false},
+		{"{{.DBName}}/{{.Time.Format \"2006/01\"}}/{{.DBName}}_{{.Timestamp}}.{{.Suffix}}", false},
+		{"backup-{{.Timestamp}}-{{.DBName}}.{{.Suffix}}", false},
+		{"{{.DBName}}_{{.Timestamp}}", true},                          // no suffix
+		{"{{.DBName}}.{{.Suffix}}", true},                             // no timestamp
+		{"dump_{{.Timestamp}}.{{.Suffix}}", true},                     // no dbname
+		{"{{.DBName}}_{{.Time.Format \"2006\"}}.{{.Suffix}}", true},   // time in the name
+		{"{{.DBName}}_{{.Timestamp}}.{{.Suffix}}.bak", true},          // suffix not at the end
+		{"../{{.DBName}}_{{.Timestamp}}.{{.Suffix}}", true},           // outside of the directory
+		{"{{.DBName}}_{{.Timestamp}}.{{.Suffix}", true},               // syntax error
+		{"{{.DBName}}_{{.Timestamp}}_{{.Unknown}}.{{.Suffix}}", true}, // unknown field
+	}
+
+	for _, st := range tests {
+		t.Run(st.give, func(t *testing.T) {
+			_, err := newNameTemplate(st.give)
+			if err == nil && st.wantError {
+				t.Errorf("expected an error got nil")
+			} else if err != nil && !st.wantError {
+				t.Errorf("did not want an error, got %s", err)
+			}
+		})
+	}
+}
+
+func TestFormatDumpPathTemplate(t *testing.T) {
+	var err error
+	nameTmpl, err = newNameTemplate("{{.DBName}}/{{.Time.Format \"2006/01\"}}/{{.DBName}}_{{.Timestamp}}.{{.Suffix}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { nameTmpl = nil }()
+
+	when := time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC)
+
+	got := formatDumpPath("/backups", "2006-01-02_15-04-05", "sql", "db", when, 6)
+	want := filepath.Join("/backups", "db", "2024", "05", "db_2024-05-17_10-00-00.sql.gz")
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Lock files are not affected
+	got = formatDumpPath("/backups", "2006-01-02_15-04-05", "lock", "db", time.Time{}, 0)
+	if want := filepath.Join("/backups", "db.lock"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPurgeDumpsTemplate(t *testing.T) {
+	var err error
+	nameTmpl, err = newNameTemplate("{{.DBName}}/{{.Time.Format \"2006/01\"}}/{{.DBName}}_{{.Timestamp}}.{{.Suffix}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { nameTmpl = nil }()
+
+	dir := t.TempDir()
+	format := "2006-01-02_15-04-05"
+	older := time.Date(2023, 1, 10, 10, 0, 0, 0, time.Local)
+	newer := time.Date(2024, 5, 17, 10, 0, 0, 0, time.Local)
+
+	files := []string{
+		formatDumpPath(dir, format, "dump", "db", older, 0),
+		formatDumpPath(dir, format, "dump", "db", older, 0) + ".sha256",
+		formatDumpPath(dir, format, "createdb.sql", "db", older, 0),
+		formatDumpPath(dir, format, "dump", "db", newer, 0),
+		formatDumpPath(dir, format, "dump", "db_other", older, 0),
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte{}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirDump := formatDumpPath(dir, format, "d", "db", older, 0)
+	if err := os.MkdirAll(dirDump, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dirDump, "toc.dat"), []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := purgeDumps(dir, "db", 1, time.Now()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var remaining []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			remaining = append(remaining, relPath(dir, path))
+		}
+		return nil
+	})
+
+	want := []string{
+		filepath.Join("db", "2024", "05", "db_2024-05-17_10-00-00.dump"),
+		filepath.Join("db_other", "2023", "01", "db_other_2023-01-10_10-00-00.dump"),
+	}
+	if diff := cmp.Diff(want, remaining); diff != "" {
+		t.Errorf("purgeDumps() mismatch (-want +got):\n%s", diff)
+	}
+
+	// Empty directories left by the purge are removed
+	if _, err := os.Stat(filepath.Join(dir, "db", "2023")); !os.IsNotExist(err) {
+		t.Errorf("expected empty directory to be removed, got %v", err)
+	}
+
+	// The remaining dump can be found for restore
+	d, err := findRestoreDump(dir, "db", time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.Path != filepath.Join(dir, want[0]) || d.Format != 'c' {
+		t.Errorf("unexpected dump found: %+v", d)
+	}
+}
+
+func TestLocalDumpNamesTemplate(t *testing.T) {
+	var err error
+	nameTmpl, err = newNameTemplate("{{.DBName}}/{{.Time.Format \"2006/01\"}}/{{.DBName}}_{{.Timestamp}}.{{.Suffix}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { nameTmpl = nil }()
+
+	dir := t.TempDir()
+	for _, f := range []string{
+		filepath.Join("my_db", "2023", "01", "my_db_2023-01-10_10-00-00.dump"),
+		filepath.Join("db", "2023", "02", "db_2023-02-10_10-00-00.d", "toc.dat"),
+		filepath.Join("db", "README"),
+	} {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := localDumpNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 || got[0] != "db" || got[1] != "my_db" {
+		t.Errorf("got %v, want [db my_db]", got)
+	}
+}
+
+func TestFormatDumpPathRunSubdirs(t *testing.T) {
+	runSubdirs = true
+	defer func() { runSubdirs = false }()
+
+	when := time.Date(2024, 5, 17, 10, 0, 0, 0, time.UTC)
+
+	got := formatDumpPath("/backups", "2006-01-02_15-04-05", "sql", "db", when, 6)
+	want := filepath.Join("/backups", "2024-05-17_10-00-00", "db.sql.gz")
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Lock files are not affected
+	got = formatDumpPath("/backups", "2006-01-02_15-04-05", "lock", "db", time.Time{}, 0)
+	if want := filepath.Join("/backups", "db.lock"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRunSubdirName(t *testing.T) {
+	var tests = []struct {
+		path   string
+		dbname string
+		want   string
+		ok     bool
+	}{
+		{"2024-05-17_10-00-00/db.dump", "db", "db_2024-05-17_10-00-00.dump", true},
+		{"2024-05-17_10-00-00/db.d/toc.dat", "db", "db_2024-05-17_10-00-00.d/toc.dat", true},
+		{"2024-05-17_10-00-00/db_other.dump", "db", "", false},
+		{"2024-05-17_10-00-00/pg_globals.sql", "pg_globals", "pg_globals_2024-05-17_10-00-00.sql", true},
+		{"not_a_run/db.dump", "db", "", false},
+		{"db.lock", "db", "", false},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			got, ok := runSubdirName(st.path, st.dbname)
+			if got != st.want || ok != st.ok {
+				t.Errorf("got %q, %v, want %q, %v", got, ok, st.want, st.ok)
+			}
+		})
+	}
+}
+
+func TestPurgeRunDirs(t *testing.T) {
+	runSubdirs = true
+	defer func() { runSubdirs = false }()
+
+	dir := t.TempDir()
+	format := "2006-01-02_15-04-05"
+	oldest := time.Date(2023, 1, 10, 10, 0, 0, 0, time.Local)
+	older := time.Date(2023, 1, 11, 10, 0, 0, 0, time.Local)
+	newer := time.Date(2024, 5, 17, 10, 0, 0, 0, time.Local)
+
+	files := []string{
+		formatDumpPath(dir, format, "dump", "db", oldest, 0),
+		formatDumpPath(dir, format, "sql", "pg_globals", oldest, 0),
+		formatDumpPath(dir, format, "dump", "db", older, 0),
+		formatDumpPath(dir, format, "dump", "db", older, 0) + ".sha256",
+		formatDumpPath(dir, format, "dump", "db_other", older, 0),
+		formatDumpPath(dir, format, "dump", "db", newer, 0),
+		formatDumpPath(dir, format, "sql", "pg_globals", newer, 0),
+		filepath.Join(dir, "db.lock"),
+		filepath.Join(dir, "notes", "README"),
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f, []byte{}, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirDump := formatDumpPath(dir, format, "d", "db_other", oldest, 0)
+	if err := os.MkdirAll(dirDump, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dirDump, "toc.dat"), []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := localDumpNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"db", "db_other", "pg_globals"}, names); diff != "" {
+		t.Errorf("localDumpNames() mismatch (-want +got):\n%s", diff)
+	}
+
+	// The runs are kept as a whole, whatever the databases they contain
+	if err := purgeRunDirs(dir, 2, time.Now()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var remaining []string
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			remaining = append(remaining, relPath(dir, path))
+		}
+		return nil
+	})
+
+	want := []string{
+		filepath.Join("2023-01-11_10-00-00", "db.dump"),
+		filepath.Join("2023-01-11_10-00-00", "db.dump.sha256"),
+		filepath.Join("2023-01-11_10-00-00", "db_other.dump"),
+		filepath.Join("2024-05-17_10-00-00", "db.dump"),
+		filepath.Join("2024-05-17_10-00-00", "pg_globals.sql"),
+		"db.lock",
+		filepath.Join("notes", "README"),
+	}
+	if diff := cmp.Diff(want, remaining); diff != "" {
+		t.Errorf("purgeRunDirs() mismatch (-want +got):\n%s", diff)
+	}
+
+	// The dumps of the runs can be found for restore
+	d, err := findRestoreDump(dir, "db", older)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.Path != filepath.Join(dir, want[0]) || d.Format != 'c' {
+		t.Errorf("unexpected dump found: %+v", d)
+	}
+
+	d, err = findRestoreDump(dir, "db_other", time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.Path != filepath.Join(dir, want[2]) {
+		t.Errorf("unexpected dump found: %+v", d)
+	}
+}
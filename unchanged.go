@@ -0,0 +1,151 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dbState records the change signal of a database when it was last dumped,
+// and the dump produced then, to skip the dump of unchanged databases
+type dbState struct {
+	Size       int64     `json:"size"`
+	Changes    int64     `json:"changes"`
+	StatsReset string    `json:"stats_reset"`
+	Path       string    `json:"path,omitempty"`
+	When       time.Time `json:"when,omitempty"`
+	DumpSize   int64     `json:"dump_size,omitempty"`
+}
+
+// dbStatePath gives the path of the state file of a database in the backup
+// directory, named like its lock file. It is not part of the files of a run,
+// thus never purged nor uploaded.
+func dbStatePath(directory string, dbname string) string {
+	return formatDumpPath(directory, "", "state", dbname, time.Time{}, 0)
+}
+
+func readDbState(path string) (dbState, error) {
+	var s dbState
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+// writeDbState replaces the state file at path, using a temporary file so
+// that a failure cannot leave a partial state that could match by mistake
+func writeDbState(path string, s dbState, mode os.FileMode) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if mode != 0 {
+		if err := f.Chmod(mode); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// dumpExists tells if the dump recorded in the state is still on disk,
+// possibly archived, compressed or encrypted by the post processing, which
+// happens after the state is saved
+func (s dbState) dumpExists() bool {
+	if s.Path == "" {
+		return false
+	}
+
+	suffixes := []string{"", ".tar"}
+	for _, c := range tarCompressors {
+		suffixes = append(suffixes, "."+c.suffix, ".tar."+c.suffix)
+	}
+
+	var paths []string
+	for _, suffix := range suffixes {
+		paths = append(paths, s.Path+suffix, s.Path+suffix+".age")
+	}
+
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			l.Warnf("could not check %s: %s", p, err)
+		}
+	}
+
+	return false
+}
+
+// unchangedSince tells if the dump recorded in the previous state can be
+// used instead of dumping the database again: the size and the change
+// signal of the database must be the same, and the previous dump must still
+// exist and not be removed by the purge of this run. The purge always keeps
+// the newest dump when the minimum number of dumps to keep is not 0.
+func (s dbState) unchangedSince(prev dbState, keep int, limit time.Time) bool {
+	if s.Size != prev.Size || s.Changes != prev.Changes || s.StatsReset != prev.StatsReset {
+		return false
+	}
+
+	if keep == 0 && !prev.When.After(limit) {
+		return false
+	}
+
+	return prev.dumpExists()
+}
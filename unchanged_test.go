@@ -0,0 +1,138 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDbState(t *testing.T) {
+	dir := t.TempDir()
+	path := dbStatePath(dir, "db")
+	if want := filepath.Join(dir, "db.state"); path != want {
+		t.Errorf("expected state path %s, got %s", want, path)
+	}
+
+	when := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := dbState{Size: 8000, Changes: 42, StatsReset: "2024-01-01", Path: filepath.Join(dir, "db.dump"), When: when, DumpSize: 100}
+	if err := writeDbState(path, s, 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	got, err := readDbState(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if diff := cmp.Diff(s, got); diff != "" {
+		t.Errorf("readDbState() mismatch (-want +got):\n%s", diff)
+	}
+
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected mode of state file: %v, %v", fi, err)
+	}
+}
+
+func TestDbStateDumpExists(t *testing.T) {
+	dir := t.TempDir()
+
+	// Tar dumps are compressed and directory dumps archived by the post
+	// processing, after the state is saved with the path of the dump
+	for _, f := range []string{"a.tar.zst", "b.d.tar.gz.age", "c.tar.lz4", "d.dump"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		path string
+		want bool
+	}{
+		{"a.tar", true},
+		{"b.d", true},
+		{"c.tar", true},
+		{"d.dump", true},
+		{"e.tar", false},
+		{"", false},
+	}
+
+	for _, st := range tests {
+		t.Run(st.path, func(t *testing.T) {
+			s := dbState{}
+			if st.path != "" {
+				s.Path = filepath.Join(dir, st.path)
+			}
+
+			if got := s.dumpExists(); got != st.want {
+				t.Errorf("expected %v, got %v", st.want, got)
+			}
+		})
+	}
+}
+
+func TestDbStateUnchangedSince(t *testing.T) {
+	dir := t.TempDir()
+	dump := filepath.Join(dir, "db_2024-03-01.dump")
+	if err := os.WriteFile(dump+".age", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	when := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	prev := dbState{Size: 8000, Changes: 42, StatsReset: "r", Path: dump, When: when}
+
+	var tests = []struct {
+		cur   dbState
+		prev  dbState
+		keep  int
+		limit time.Time
+		want  bool
+	}{
+		// Encrypted dump still there, newer than the purge limit
+		{dbState{Size: 8000, Changes: 42, StatsReset: "r"}, prev, 0, when.Add(-time.Hour), true},
+		// Rows changed
+		{dbState{Size: 8000, Changes: 43, StatsReset: "r"}, prev, 0, when.Add(-time.Hour), false},
+		// Size changed
+		{dbState{Size: 8192, Changes: 42, StatsReset: "r"}, prev, 0, when.Add(-time.Hour), false},
+		// Statistics reset
+		{dbState{Size: 8000, Changes: 42, StatsReset: "s"}, prev, 0, when.Add(-time.Hour), false},
+		// The dump would be purged by this run
+		{dbState{Size: 8000, Changes: 42, StatsReset: "r"}, prev, 0, when.Add(time.Hour), false},
+		// The purge keeps the newest dump
+		{dbState{Size: 8000, Changes: 42, StatsReset: "r"}, prev, 1, when.Add(time.Hour), true},
+		// The dump is gone
+		{dbState{Size: 8000, Changes: 42, StatsReset: "r"}, dbState{Size: 8000, Changes: 42, StatsReset: "r", Path: filepath.Join(dir, "gone.dump"), When: when}, 0, when.Add(-time.Hour), false},
+	}
+
+	for i, st := range tests {
+		if got := st.cur.unchangedSince(st.prev, st.keep, st.limit); got != st.want {
+			t.Errorf("test %d: expected %v, got %v", i, st.want, got)
+		}
+	}
+}
@@ -26,15 +26,19 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -42,6 +46,7 @@ import (
 	"github.com/Backblaze/blazer/b2"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -78,6 +83,160 @@ type Item struct {
 	isDir   bool
 }
 
+// verifyUpload downloads target back from the repo and compares its checksum,
+// computed with algo, to the one of the local file at path. The copy is
+// written next to the local file and removed afterwards.
+func verifyUpload(repo Repo, path string, target string, algo string) error {
+	h, err := newHash(algo)
+	if err != nil {
+		return err
+	}
+
+	want, err := computeChecksum(path, h)
+	if err != nil {
+		return fmt.Errorf("could not compute checksum of %s: %w", path, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".pg_back-verify-")
+	if err != nil {
+		return fmt.Errorf("could not create file to verify upload of %s: %w", path, err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpPath)
+
+	if err := repo.Download(target, tmpPath); err != nil {
+		return fmt.Errorf("could not download %s to verify it: %w", target, err)
+	}
+
+	got, err := computeChecksum(tmpPath, h)
+	if err != nil {
+		return fmt.Errorf("could not compute checksum of downloaded %s: %w", target, err)
+	}
+
+	if got != want {
+		return fmt.Errorf("upload of %s is corrupted: the %s checksum of %s does not match", path, algo, target)
+	}
+
+	return nil
+}
+
+// uploadGzipComment is the comment of the gzip header of the files compressed
+// on upload, it tells download to decompress them
+const uploadGzipComment = "pg_back compress_on_upload"
+
+// compressedExts are the extensions of the files that are not compressed
+// again on upload, they are compressed by pg_dump or encrypted
+var compressedExts = []string{".gz", ".zst", ".lz4", ".age"}
+
+// compressForUpload writes a gzip compressed copy of path in the temporary
+// directory, to be uploaded instead of path, and returns its path. The caller
+// removes it. The backup directory is left alone, so that an interrupted run
+// does not leave the copy among the dumps.
+func compressForUpload(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp("", "pg_back-upload-")
+	if err != nil {
+		return "", fmt.Errorf("could not create file to compress %s: %w", path, err)
+	}
+
+	gz := gzip.NewWriter(dst)
+	gz.Name = filepath.Base(path)
+	gz.Comment = uploadGzipComment
+
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", fmt.Errorf("could not compress %s: %w", path, err)
+	}
+
+	return dst.Name(), nil
+}
+
+// decompressDownload decompresses the downloaded file at path when it was
+// compressed on upload, the result replaces it without the .gz suffix. The
+// path of the file to use is returned.
+func decompressDownload(path string) (string, error) {
+	if filepath.Ext(path) != ".gz" {
+		return path, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return path, err
+	}
+	defer src.Close()
+
+	// Files compressed by pg_dump are left untouched
+	gz, err := gzip.NewReader(src)
+	if err != nil || gz.Comment != uploadGzipComment {
+		return path, nil
+	}
+	defer gz.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return path, err
+	}
+
+	dstPath := strings.TrimSuffix(path, ".gz")
+	dst, err := os.CreateTemp(filepath.Dir(path), ".pg_back-download-")
+	if err != nil {
+		return path, fmt.Errorf("could not create file to decompress %s: %w", path, err)
+	}
+
+	_, err = io.Copy(dst, gz)
+	if err == nil {
+		err = dst.Chmod(info.Mode().Perm())
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), dstPath)
+	}
+
+	if err != nil {
+		os.Remove(dst.Name())
+		return path, fmt.Errorf("could not decompress %s: %w", path, err)
+	}
+
+	src.Close()
+	if err := os.Remove(path); err != nil {
+		l.Warnf("could not remove %s: %s", path, err)
+	}
+
+	return dstPath, nil
+}
+
+// uploadSource gives the file to upload for path and the suffix of its
+// remote key. With compress, files that are not already compressed are
+// gzipped to a temporary file that must be removed once uploaded.
+func uploadSource(path string, compress bool) (string, string, error) {
+	if !compress || slices.Contains(compressedExts, filepath.Ext(path)) {
+		return path, "", nil
+	}
+
+	gzPath, err := compressForUpload(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	return gzPath, ".gz", nil
+}
+
 // Replace any backslashes from windows to forward slashed
 func forwardSlashes(target string) string {
 	return strings.ReplaceAll(target, fmt.Sprintf("%c", os.PathSeparator), "/")
@@ -115,11 +274,47 @@ func NewRepo(kind string, opts options) (Repo, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to prepare Azure repo: %w", err)
 		}
+	case "local":
+		repo, err = NewLocalRepo(opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare local repo: %w", err)
+		}
 	}
 
 	return repo, nil
 }
 
+// newRepo prepares the remote location of the kind, tests replace it to use
+// a repository without network access
+var newRepo = NewRepo
+
+// uploadRepo is a remote location files are uploaded to, named after the
+// value given to the upload option
+type uploadRepo struct {
+	name string
+	Repo
+}
+
+// newUploadRepos prepares all the remote locations to upload to. The
+// locations that could not be prepared are reported in the error, the
+// others are returned so that they can still be used.
+func newUploadRepos(opts options) ([]uploadRepo, error) {
+	var errs []error
+
+	repos := make([]uploadRepo, 0)
+	for _, name := range uploadTargets(opts.Upload) {
+		repo, err := newRepo(name, opts)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		repos = append(repos, uploadRepo{name: name, Repo: repo})
+	}
+
+	return repos, errors.Join(errs...)
+}
+
 type b2repo struct {
 	appKey                string
 	b2Bucket              *b2.Bucket
@@ -140,6 +335,14 @@ type s3repo struct {
 	endPoint   string
 	forcePath  bool
 	disableSSL bool
+	sse        string
+	sseKMSKey  string
+	class      string
+	roleARN    string
+	roleName   string
+	partSize   int64
+	parallel   int
+	retries    int
 	session    *session.Session
 }
 
@@ -186,7 +389,7 @@ func (r *b2repo) Upload(path string, target string) error {
 	w.ConcurrentUploads = r.concurrentConnections
 
 	l.Infof("uploading %s to B2 bucket %s\n", path, r.bucket)
-	if _, err := io.Copy(w, f); err != nil {
+	if _, err := io.Copy(w, progressReader(f, "upload of "+path)); err != nil {
 		return err
 	}
 
@@ -200,20 +403,15 @@ func (r *b2repo) Download(target string, path string) error {
 	}
 	defer f.Close()
 
-	bucket := r.b2Bucket
-
 	l.Infof("downloading %s from B2 bucket %s to %s\n", target, r.bucket, path)
 
-	rf := bucket.Object(target).NewReader(r.ctx)
+	// The remote object is the target, the local file is the path
+	rf := r.b2Bucket.Object(target).NewReader(r.ctx)
 	rf.ConcurrentDownloads = r.concurrentConnections
 	defer rf.Close()
 
-	if err != nil {
-		return err
-	}
-
-	if _, err := io.Copy(f, rf); err != nil {
-		return err
+	if _, err := io.Copy(f, progressReader(rf, "download of "+target)); err != nil {
+		return fmt.Errorf("unable to download %q from %q: %w", target, r.bucket, err)
 	}
 
 	return nil
@@ -227,7 +425,7 @@ func (r *b2repo) List(prefix string) ([]Item, error) {
 
 	files := make([]Item, 0)
 
-	i := r.b2Bucket.List(r.ctx, b2.ListPrefix(prefix))
+	i := r.b2Bucket.List(r.ctx, b2.ListPrefix(forwardSlashes(prefix)))
 	for i.Next() {
 		obj := i.Object()
 
@@ -265,6 +463,14 @@ func NewS3Repo(opts options) (*s3repo, error) {
 		endPoint:   opts.S3EndPoint,
 		forcePath:  opts.S3ForcePath,
 		disableSSL: opts.S3DisableTLS,
+		sse:        opts.S3SSE,
+		sseKMSKey:  opts.S3KMSKeyID,
+		class:      opts.S3StorageClass,
+		roleARN:    opts.S3RoleARN,
+		roleName:   opts.S3RoleSessionName,
+		partSize:   int64(opts.S3PartSize) * 1024 * 1024,
+		parallel:   opts.S3Concurrency,
+		retries:    opts.S3Retries,
 	}
 
 	conf := aws.NewConfig()
@@ -304,6 +510,21 @@ func NewS3Repo(opts options) (*s3repo, error) {
 
 	r.session = session
 
+	// Assume the role using the credentials found above, static keys,
+	// profile or defaults of the SDK
+	if r.roleARN != "" {
+		name := r.roleName
+		if name == "" {
+			name = "pg_back"
+		}
+
+		l.Verbosef("assuming role %s with session name %s\n", r.roleARN, name)
+		creds := stscreds.NewCredentials(session, r.roleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = name
+		})
+		r.session = session.Copy(&aws.Config{Credentials: creds})
+	}
+
 	return r, nil
 }
 
@@ -318,14 +539,55 @@ func (r *s3repo) Upload(path string, target string) error {
 	}
 	defer file.Close()
 
-	uploader := s3manager.NewUploader(r.session)
+	// Parts of a failed multipart upload are removed by the uploader
+	// so that they are not billed
+	uploader := s3manager.NewUploader(r.session, func(u *s3manager.Uploader) {
+		if r.partSize > 0 {
+			u.PartSize = r.partSize
+		}
+		if r.parallel > 0 {
+			u.Concurrency = r.parallel
+		}
+	})
 
-	l.Infof("uploading %s to S3 bucket %s\n", path, r.bucket)
-	_, err = uploader.Upload(&s3manager.UploadInput{
+	// A run killed during an upload leaves the parts in the bucket, where
+	// they are billed until the upload is aborted
+	key := forwardSlashes(target)
+	svc := s3.New(r.session)
+	if err := abortS3Uploads(svc.ListMultipartUploads, svc.AbortMultipartUpload, r.bucket, key); err != nil {
+		l.Warnln(err)
+	}
+
+	input := &s3manager.UploadInput{
 		Bucket: aws.String(r.bucket),
-		Key:    aws.String(forwardSlashes(target)),
-		Body:   file,
-	})
+		Key:    aws.String(key),
+		Body:   progressReaderAt(file, "upload of "+path),
+	}
+
+	if r.sse != "" {
+		input.ServerSideEncryption = aws.String(r.sse)
+		if r.sseKMSKey != "" {
+			input.SSEKMSKeyId = aws.String(r.sseKMSKey)
+		}
+	}
+
+	if r.class != "" {
+		input.StorageClass = aws.String(r.class)
+	}
+
+	l.Infof("uploading %s to S3 bucket %s\n", path, r.bucket)
+	for attempt := 0; ; attempt++ {
+		_, err = uploader.Upload(input)
+		if err == nil || attempt >= r.retries {
+			break
+		}
+
+		// Uploads are not resumed, the whole file is sent again
+		l.Warnf("upload of %s failed, retrying (%d/%d): %s\n", path, attempt+1, r.retries, err)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("upload error: %w", err)
+		}
+	}
 
 	if err != nil {
 		return fmt.Errorf("unable to upload %q to %q: %w", path, r.bucket, err)
@@ -334,6 +596,50 @@ func (r *s3repo) Upload(path string, target string) error {
 	return nil
 }
 
+// abortS3Uploads aborts the multipart uploads of key that were never
+// completed nor aborted, for example by a run interrupted while uploading
+func abortS3Uploads(list func(*s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error),
+	abort func(*s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error), bucket string, key string) error {
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(key),
+	}
+
+	for {
+		resp, err := list(input)
+		if err != nil {
+			return fmt.Errorf("could not list incomplete uploads of %s: %w", key, err)
+		}
+
+		// The prefix also matches longer keys, like the checksum
+		// file of a dump
+		for _, u := range resp.Uploads {
+			if aws.StringValue(u.Key) != key {
+				continue
+			}
+
+			l.Infof("aborting incomplete upload %s of %s\n", aws.StringValue(u.UploadId), key)
+			_, err := abort(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      u.Key,
+				UploadId: u.UploadId,
+			})
+			if err != nil {
+				return fmt.Errorf("could not abort incomplete upload of %s: %w", key, err)
+			}
+		}
+
+		if !aws.BoolValue(resp.IsTruncated) || (aws.StringValue(resp.NextKeyMarker) == "" && aws.StringValue(resp.NextUploadIdMarker) == "") {
+			break
+		}
+
+		input.KeyMarker = resp.NextKeyMarker
+		input.UploadIdMarker = resp.NextUploadIdMarker
+	}
+
+	return nil
+}
+
 func (r *s3repo) Download(target string, path string) error {
 	file, err := os.Create(path)
 	if err != nil {
@@ -344,7 +650,7 @@ func (r *s3repo) Download(target string, path string) error {
 	downloader := s3manager.NewDownloader(r.session)
 
 	l.Infof("downloading %s from S3 bucket %s to %s\n", target, r.bucket, path)
-	_, err = downloader.Download(file, &s3.GetObjectInput{
+	_, err = downloader.Download(progressWriterAt(file, "download of "+target), &s3.GetObjectInput{
 		Bucket: aws.String(r.bucket),
 		Key:    aws.String(forwardSlashes(target)),
 	})
@@ -359,35 +665,57 @@ func (r *s3repo) Download(target string, path string) error {
 func (r *s3repo) List(prefix string) ([]Item, error) {
 	svc := s3.New(r.session)
 
+	return listS3Objects(svc.ListObjectsV2, r.bucket, prefix)
+}
+
+// listS3Objects gets the objects of the bucket starting with prefix using
+// list, one page after the other. Some S3 compatible services truncate the
+// results without giving a continuation token, the listing then continues
+// after the last key received.
+func listS3Objects(list func(*s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error), bucket string, prefix string) ([]Item, error) {
 	files := make([]Item, 0)
 
-	var contToken *string
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(forwardSlashes(prefix)),
+	}
 
 	for {
-		resp, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
-			Bucket:            aws.String(r.bucket),
-			Prefix:            aws.String(forwardSlashes(prefix)),
-			ContinuationToken: contToken,
-		})
-
+		resp, err := list(input)
 		if err != nil {
-			return files, fmt.Errorf("could not list items in S3 bucket %s: %w", r.bucket, err)
+			return files, fmt.Errorf("could not list items in S3 bucket %s: %w", bucket, err)
 		}
 
+		var lastKey string
 		for _, item := range resp.Contents {
-			file := Item{
-				key:     *item.Key,
-				modtime: *item.LastModified,
+			if item.Key == nil {
+				continue
 			}
 
-			files = append(files, file)
+			files = append(files, Item{
+				key:     *item.Key,
+				modtime: aws.TimeValue(item.LastModified),
+			})
+			lastKey = *item.Key
 		}
 
-		if !*resp.IsTruncated {
+		if !aws.BoolValue(resp.IsTruncated) {
 			break
 		}
 
-		contToken = resp.NextContinuationToken
+		if aws.StringValue(resp.NextContinuationToken) != "" {
+			input.ContinuationToken = resp.NextContinuationToken
+			input.StartAfter = nil
+			continue
+		}
+
+		// Asking again for the same page would never end
+		if lastKey == "" {
+			return files, fmt.Errorf("could not list items in S3 bucket %s: truncated result without any key or continuation token", bucket)
+		}
+
+		input.ContinuationToken = nil
+		input.StartAfter = aws.String(lastKey)
 	}
 
 	return files, nil
@@ -416,6 +744,10 @@ type sftpRepo struct {
 	identityFile     string
 	baseDir          string
 	disableHostCheck bool
+	knownHosts       string
+	addHostKey       bool
+	connectTimeout   time.Duration
+	ioTimeout        time.Duration
 	conn             *ssh.Client
 	client           *sftp.Client
 }
@@ -464,13 +796,38 @@ func expandHomeDir(path string) (string, error) {
 	return expanded, nil
 }
 
-func hostKeyCheck(ignore bool) ssh.HostKeyCallback {
+// hostKeyCheck returns the callback validating the key of the remote host
+// using the given known_hosts file or the default ones of OpenSSH. When
+// addUnknown is true, the key of an unknown host is appended to the
+// known_hosts file, the last of the default ones when none is given.
+func hostKeyCheck(ignore bool, knownHosts string, addUnknown bool) ssh.HostKeyCallback {
 	if ignore {
 		return ssh.InsecureIgnoreHostKey()
 	}
 
+	candidates := []string{"/etc/ssh/ssh_known_hosts", "~/.ssh/known_hosts"}
+	if knownHosts != "" {
+		candidates = []string{knownHosts}
+	}
+
+	var addTo string
+	if addUnknown {
+		path, err := expandHomeDir(candidates[len(candidates)-1])
+		if err == nil {
+			err = createKnownHosts(path)
+		}
+
+		if err != nil {
+			return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				return fmt.Errorf("ssh: unable to prepare known hosts file: %w", err)
+			}
+		}
+
+		addTo = path
+	}
+
 	knownHostsFiles := make([]string, 0)
-	for _, p := range []string{"/etc/ssh/ssh_known_hosts", "~/.ssh/known_hosts"} {
+	for _, p := range candidates {
 		path, err := expandHomeDir(p)
 		if err != nil {
 			continue
@@ -501,7 +858,54 @@ func hostKeyCheck(ignore bool) ssh.HostKeyCallback {
 		}
 	}
 
-	return knownHostsKeyCb
+	if addTo == "" {
+		return knownHostsKeyCb
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := knownHostsKeyCb(hostname, remote, key)
+
+		// Only trust the key on first use, an empty list of wanted
+		// keys means the host is unknown. A key mismatch is always
+		// an error.
+		var kerr *knownhosts.KeyError
+		if errors.As(err, &kerr) && len(kerr.Want) == 0 {
+			l.Warnf("adding host key of %s to %s\n", hostname, addTo)
+			return appendKnownHost(addTo, hostname, key)
+		}
+
+		return err
+	}
+}
+
+// createKnownHosts ensures the known_hosts file exists so that it can be
+// loaded and keys can be appended to it
+func createKnownHosts(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func appendKnownHost(path string, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("ssh: could not add host key: %w", err)
+	}
+	defer f.Close()
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return fmt.Errorf("ssh: could not add host key: %w", err)
+	}
+
+	return nil
 }
 
 func pubKeyAuth(identity string, passphrase string) ([]ssh.Signer, error) {
@@ -562,6 +966,10 @@ func NewSFTPRepo(opts options) (*sftpRepo, error) {
 		baseDir:          opts.SFTPDirectory,
 		identityFile:     opts.SFTPIdentityFile,
 		disableHostCheck: opts.SFTPIgnoreKnownHosts,
+		knownHosts:       opts.SFTPKnownHosts,
+		addHostKey:       opts.SFTPAddHostKey,
+		connectTimeout:   time.Duration(opts.SFTPConnectTimeout) * time.Second,
+		ioTimeout:        time.Duration(opts.SFTPIOTimeout) * time.Second,
 	}
 
 	if r.port == "" {
@@ -601,17 +1009,32 @@ func NewSFTPRepo(opts options) (*sftpRepo, error) {
 	config := &ssh.ClientConfig{
 		User:            r.user,
 		Auth:            methods,
-		HostKeyCallback: hostKeyCheck(r.disableHostCheck),
+		HostKeyCallback: hostKeyCheck(r.disableHostCheck, r.knownHosts, r.addHostKey),
+		Timeout:         r.connectTimeout,
 	}
 
-	// Connect to the remote server and perform the SSH handshake.
-	hostport := fmt.Sprintf("%s:%s", r.host, r.port)
-	conn, err := ssh.Dial("tcp", hostport, config)
+	// Connect to the remote server and perform the SSH handshake. The
+	// timeout applies to both so that a dead host cannot hang us
+	hostport := net.JoinHostPort(r.host, r.port)
+	tcpConn, err := net.DialTimeout("tcp", hostport, r.connectTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("unable to connect to %s: %w", hostport, err)
 	}
 
-	r.conn = conn
+	if r.connectTimeout > 0 {
+		tcpConn.SetDeadline(time.Now().Add(r.connectTimeout))
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(tcpConn, hostport, config)
+	if err != nil {
+		tcpConn.Close()
+		return nil, fmt.Errorf("unable to connect to %s: %w", hostport, err)
+	}
+
+	// Remove the deadline now that the connection is established
+	tcpConn.SetDeadline(time.Time{})
+
+	r.conn = ssh.NewClient(c, chans, reqs)
 
 	// Open a sftp client over the SSH connection, it is safe to use it
 	// concurrently, so we keep it in the repo struct
@@ -630,6 +1053,9 @@ func (r *sftpRepo) Close() error {
 	return r.conn.Close()
 }
 
+// sftpPartSuffix is appended to the name of files being uploaded over SFTP
+const sftpPartSuffix = ".part"
+
 func (r *sftpRepo) Upload(path string, target string) error {
 	l.Infof("uploading %s to %s:%s using sftp\n", path, r.host, r.baseDir)
 
@@ -656,19 +1082,48 @@ func (r *sftpRepo) Upload(path string, target string) error {
 		}
 	}
 
-	dst, err := r.client.Create(rpath)
+	// Send the data to a temporary file renamed once complete, so that
+	// an interrupted upload never looks like a complete file
+	tmpPath := rpath + sftpPartSuffix
+	dst, err := r.client.Create(tmpPath)
 	if err != nil {
-		return fmt.Errorf("sftp: could not open destination %s: %w", rpath, err)
+		return fmt.Errorf("sftp: could not open destination %s: %w", tmpPath, err)
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, src); err != nil {
+	if _, err := r.copy(dst, progressReader(src, "upload of "+path)); err != nil {
+		dst.Close()
+		r.client.Remove(tmpPath)
 		return fmt.Errorf("sftp: could not send data with sftp: %s", err)
 	}
 
+	if err := dst.Close(); err != nil {
+		r.client.Remove(tmpPath)
+		return fmt.Errorf("sftp: could not close %s: %w", tmpPath, err)
+	}
+
+	if err := r.rename(tmpPath, rpath); err != nil {
+		r.client.Remove(tmpPath)
+		return fmt.Errorf("sftp: could not rename %s to %s: %w", tmpPath, rpath, err)
+	}
+
 	return nil
 }
 
+// rename moves oldname to newname, replacing newname if it exists. The
+// rename of the SFTP protocol fails when the target exists, so the posix
+// rename extension of OpenSSH is used when the server supports it.
+func (r *sftpRepo) rename(oldname string, newname string) error {
+	if err := r.client.PosixRename(oldname, newname); err == nil {
+		return nil
+	}
+
+	if err := r.client.Remove(newname); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return r.client.Rename(oldname, newname)
+}
+
 func (r *sftpRepo) Download(target string, path string) error {
 	l.Infof("downloading %s from %s:%s using sftp\n", target, r.host, r.baseDir)
 
@@ -692,13 +1147,48 @@ func (r *sftpRepo) Download(target string, path string) error {
 	}
 	defer src.Close()
 
-	if _, err := io.Copy(dst, src); err != nil {
+	if _, err := r.copy(dst, progressReader(src, "download of "+target)); err != nil {
 		return fmt.Errorf("sftp: could not receive data with sftp: %s", err)
 	}
 
 	return nil
 }
 
+// timeoutReader postpones the timer each time some data is read
+type timeoutReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.timer.Reset(t.timeout)
+	return n, err
+}
+
+// copy works like io.Copy but closes the SSH connection when no data could be
+// transferred during the I/O timeout, making the copy fail instead of hanging
+// forever on a stalled connection
+func (r *sftpRepo) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if r.ioTimeout == 0 {
+		return io.Copy(dst, src)
+	}
+
+	var stalled atomic.Bool
+	timer := time.AfterFunc(r.ioTimeout, func() {
+		stalled.Store(true)
+		r.conn.Close()
+	})
+
+	n, err := io.Copy(dst, &timeoutReader{r: src, timer: timer, timeout: r.ioTimeout})
+	if !timer.Stop() && stalled.Load() {
+		return n, fmt.Errorf("no data transferred for %v, connection closed", r.ioTimeout)
+	}
+
+	return n, err
+}
+
 func (r *sftpRepo) List(prefix string) (items []Item, rerr error) {
 	items = make([]Item, 0)
 
@@ -726,6 +1216,11 @@ func (r *sftpRepo) List(prefix string) (items []Item, rerr error) {
 			continue
 		}
 
+		// Skip the files of uploads in progress or interrupted
+		if strings.HasSuffix(path, sftpPartSuffix) {
+			continue
+		}
+
 		finfo := w.Stat()
 		items = append(items, Item{
 			key:     path,
@@ -753,17 +1248,51 @@ func (r *sftpRepo) Remove(path string) error {
 }
 
 type gcsRepo struct {
-	bucket  string
-	url     string // Endpoint URL
-	keyFile string
-	client  *storage.Client
+	bucket     string
+	url        string // Endpoint URL
+	keyFile    string
+	hmacKeyID  string
+	hmacSecret string
+	client     *storage.Client
+
+	// HMAC keys only work with the S3 compatible XML API of GCS, when
+	// they are used the operations go through an S3 client
+	interop *s3repo
 }
 
+// gcsInteropEndPoint is the S3 compatible endpoint of GCS
+const gcsInteropEndPoint = "https://storage.googleapis.com"
+
 func NewGCSRepo(opts options) (*gcsRepo, error) {
 	r := &gcsRepo{
-		bucket:  opts.GCSBucket,
-		url:     opts.GCSEndPoint,
-		keyFile: opts.GCSCredentialsFile,
+		bucket:     opts.GCSBucket,
+		url:        opts.GCSEndPoint,
+		keyFile:    opts.GCSCredentialsFile,
+		hmacKeyID:  opts.GCSHMACKeyID,
+		hmacSecret: opts.GCSHMACSecret,
+	}
+
+	if r.hmacKeyID != "" {
+		l.Verboseln("using HMAC keys with the S3 compatible API of GCS")
+		endPoint := r.url
+		if endPoint == "" {
+			endPoint = gcsInteropEndPoint
+		}
+
+		interop, err := NewS3Repo(options{
+			S3Region:   "auto",
+			S3Bucket:   r.bucket,
+			S3EndPoint: endPoint,
+			S3KeyID:    r.hmacKeyID,
+			S3Secret:   r.hmacSecret,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not create GCS client: %w", err)
+		}
+
+		r.interop = interop
+
+		return r, nil
 	}
 
 	options := make([]option.ClientOption, 0)
@@ -772,7 +1301,10 @@ func NewGCSRepo(opts options) (*gcsRepo, error) {
 	}
 
 	if r.keyFile != "" {
+		l.Verboseln("using credentials file", r.keyFile, "for GCS")
 		options = append(options, option.WithCredentialsFile(r.keyFile))
+	} else {
+		l.Verboseln("using Application Default Credentials for GCS")
 	}
 
 	client, err := storage.NewClient(context.Background(), options...)
@@ -786,10 +1318,18 @@ func NewGCSRepo(opts options) (*gcsRepo, error) {
 }
 
 func (r *gcsRepo) Close() error {
+	if r.interop != nil {
+		return r.interop.Close()
+	}
+
 	return r.client.Close()
 }
 
 func (r *gcsRepo) Upload(path string, target string) error {
+	if r.interop != nil {
+		return r.interop.Upload(path, target)
+	}
+
 	file, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("upload error: %w", err)
@@ -800,7 +1340,7 @@ func (r *gcsRepo) Upload(path string, target string) error {
 	defer obj.Close()
 
 	l.Infof("uploading %s to GCS bucket %s\n", path, r.bucket)
-	if _, err := io.Copy(obj, file); err != nil {
+	if _, err := io.Copy(obj, progressReader(file, "upload of "+path)); err != nil {
 		return fmt.Errorf("could not write data to GCS object: %w", err)
 	}
 
@@ -810,6 +1350,10 @@ func (r *gcsRepo) Upload(path string, target string) error {
 }
 
 func (r *gcsRepo) Download(target string, path string) error {
+	if r.interop != nil {
+		return r.interop.Download(target, path)
+	}
+
 	file, err := os.Create(path)
 	if err != nil {
 		return fmt.Errorf("download error: %w", err)
@@ -823,7 +1367,7 @@ func (r *gcsRepo) Download(target string, path string) error {
 	defer obj.Close()
 
 	l.Infof("downloading %s from GCS bucket %s to %s\n", target, r.bucket, path)
-	if _, err := io.Copy(file, obj); err != nil {
+	if _, err := io.Copy(file, progressReader(obj, "download of "+target)); err != nil {
 		return fmt.Errorf("could not read data from GCS object: %w", err)
 	}
 
@@ -831,6 +1375,10 @@ func (r *gcsRepo) Download(target string, path string) error {
 }
 
 func (r *gcsRepo) List(prefix string) (items []Item, rerr error) {
+	if r.interop != nil {
+		return r.interop.List(prefix)
+	}
+
 	items = make([]Item, 0)
 
 	it := r.client.Bucket(r.bucket).Objects(context.Background(), &storage.Query{Prefix: forwardSlashes(prefix)})
@@ -856,6 +1404,10 @@ func (r *gcsRepo) List(prefix string) (items []Item, rerr error) {
 }
 
 func (r *gcsRepo) Remove(path string) error {
+	if r.interop != nil {
+		return r.interop.Remove(path)
+	}
+
 	if err := r.client.Bucket(r.bucket).Object(forwardSlashes(path)).Delete(context.Background()); err != nil {
 		return fmt.Errorf("could not remove %s from GCS bucket %s: %w", path, r.bucket, err)
 	}
@@ -924,7 +1476,7 @@ func (r *azRepo) Upload(path string, target string) error {
 	defer file.Close()
 
 	l.Infof("uploading %s to Azure container %s\n", path, r.container)
-	_, err = r.client.UploadFile(context.Background(), r.container, path, file, nil)
+	_, err = r.client.UploadStream(context.Background(), r.container, forwardSlashes(target), progressReader(file, "upload of "+path), nil)
 	if err != nil {
 		return fmt.Errorf("could not upload %s to Azure: %w", path, err)
 	}
@@ -940,11 +1492,18 @@ func (r *azRepo) Download(target string, path string) error {
 	defer file.Close()
 
 	l.Infof("downloading %s from Azure container %s\n", target, r.container)
-	_, err = r.client.DownloadFile(context.Background(), r.container, target, file, nil)
+	resp, err := r.client.DownloadStream(context.Background(), r.container, forwardSlashes(target), nil)
 	if err != nil {
 		return fmt.Errorf("could not download %s from Azure: %w", target, err)
 	}
 
+	body := resp.NewRetryReader(context.Background(), nil)
+	defer body.Close()
+
+	if _, err := io.Copy(file, progressReader(body, "download of "+target)); err != nil {
+		return fmt.Errorf("could not download %s from Azure: %w", target, err)
+	}
+
 	return nil
 }
 
@@ -986,3 +1545,111 @@ func (r *azRepo) Remove(path string) error {
 func (r *azRepo) Close() error {
 	return nil
 }
+
+type localRepo struct {
+	baseDir string
+}
+
+func NewLocalRepo(opts options) (*localRepo, error) {
+	r := &localRepo{
+		baseDir: opts.LocalDirectory,
+	}
+
+	if err := validateDirectory(r.baseDir); err != nil {
+		return nil, fmt.Errorf("invalid local directory %s: %w", r.baseDir, err)
+	}
+
+	return r, nil
+}
+
+func (r *localRepo) Close() error {
+	return nil
+}
+
+// copyLocalFile copies the contents of src to dst, creating the parent
+// directories of dst with secure permissions
+func copyLocalFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, progressReader(in, "copy of "+src)); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func (r *localRepo) Upload(path string, target string) error {
+	rpath := filepath.Join(r.baseDir, target)
+
+	l.Infof("copying %s to %s\n", path, rpath)
+	if err := copyLocalFile(path, rpath); err != nil {
+		return fmt.Errorf("could not copy %s to %s: %w", path, rpath, err)
+	}
+
+	return nil
+}
+
+func (r *localRepo) Download(target string, path string) error {
+	rpath := filepath.Join(r.baseDir, target)
+
+	l.Infof("copying %s to %s\n", rpath, path)
+	if err := copyLocalFile(rpath, path); err != nil {
+		return fmt.Errorf("could not copy %s to %s: %w", rpath, path, err)
+	}
+
+	return nil
+}
+
+func (r *localRepo) List(prefix string) (items []Item, rerr error) {
+	items = make([]Item, 0)
+
+	rerr = filepath.WalkDir(r.baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			l.Warnln("could not list file:", err)
+			return err
+		}
+
+		if path == r.baseDir {
+			return nil
+		}
+
+		key := relPath(r.baseDir, path)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		finfo, err := d.Info()
+		if err != nil {
+			l.Warnln("could not list file:", err)
+			return err
+		}
+
+		items = append(items, Item{
+			key:     key,
+			modtime: finfo.ModTime(),
+			isDir:   d.IsDir(),
+		})
+
+		return nil
+	})
+
+	return
+}
+
+func (r *localRepo) Remove(path string) error {
+	return os.Remove(filepath.Join(r.baseDir, path))
+}
@@ -1,11 +1,32 @@
 package main
 
 import (
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestExpandHomeDir(t *testing.T) {
@@ -109,3 +130,769 @@ func TestForwardSlashes(t *testing.T) {
 		})
 	}
 }
+
+func TestHostKeyCheckAddUnknown(t *testing.T) {
+	genKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("could not generate key: %s", err)
+		}
+
+		key, err := ssh.NewPublicKey(pub)
+		if err != nil {
+			t.Fatalf("could not convert key: %s", err)
+		}
+
+		return key
+	}
+
+	path := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	key := genKey()
+
+	// Unknown hosts are refused without TOFU, the file is not created
+	if err := hostKeyCheck(false, path, false)("sftp.example.com:22", addr, key); err == nil {
+		t.Errorf("expected an error on unknown host, got nil")
+	}
+
+	// The key is added on first use then checked
+	if err := hostKeyCheck(false, path, true)("sftp.example.com:22", addr, key); err != nil {
+		t.Errorf("expected the unknown host key to be added, got %s", err)
+	}
+
+	if err := hostKeyCheck(false, path, false)("sftp.example.com:22", addr, key); err != nil {
+		t.Errorf("expected the added host key to be accepted, got %s", err)
+	}
+
+	// A changed key must never be trusted
+	if err := hostKeyCheck(false, path, true)("sftp.example.com:22", addr, genKey()); err == nil {
+		t.Errorf("expected an error on host key mismatch, got nil")
+	}
+}
+
+func TestLocalRepo(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	repo, err := NewLocalRepo(options{LocalDirectory: dst})
+	if err != nil {
+		t.Fatalf("could not create local repo: %s", err)
+	}
+	defer repo.Close()
+
+	path := filepath.Join(src, "b1_2023-01-02T15:04:05Z.dump")
+	if err := os.WriteFile(path, []byte("some data"), 0600); err != nil {
+		t.Fatalf("could not create test file: %s", err)
+	}
+
+	target := filepath.Join("prefix", "b1_2023-01-02T15:04:05Z.dump")
+	if err := repo.Upload(path, target); err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	items, err := repo.List(filepath.Join("prefix", "b1"))
+	if err != nil {
+		t.Fatalf("list failed: %s", err)
+	}
+
+	if len(items) != 1 || items[0].key != target || items[0].isDir {
+		t.Errorf("unexpected list result: %v", items)
+	}
+
+	back := filepath.Join(src, "downloaded.dump")
+	if err := repo.Download(target, back); err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+
+	data, err := os.ReadFile(back)
+	if err != nil {
+		t.Fatalf("could not read downloaded file: %s", err)
+	}
+
+	if string(data) != "some data" {
+		t.Errorf("got %q, want %q", string(data), "some data")
+	}
+
+	if err := repo.Remove(target); err != nil {
+		t.Errorf("remove failed: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, target)); !os.IsNotExist(err) {
+		t.Errorf("expected file to be removed, got %v", err)
+	}
+}
+
+func TestB2RepoDownload(t *testing.T) {
+	keyID := os.Getenv("PGBK_TEST_B2_KEY_ID")
+	appKey := os.Getenv("PGBK_TEST_B2_APP_KEY")
+	bucket := os.Getenv("PGBK_TEST_B2_BUCKET")
+	if keyID == "" || appKey == "" || bucket == "" {
+		t.Skip("PGBK_TEST_B2_KEY_ID, PGBK_TEST_B2_APP_KEY and PGBK_TEST_B2_BUCKET are needed to test B2")
+	}
+
+	repo, err := NewB2Repo(options{
+		B2KeyID:                 keyID,
+		B2AppKey:                appKey,
+		B2Bucket:                bucket,
+		B2ConcurrentConnections: 1,
+	})
+	if err != nil {
+		t.Fatalf("could not create B2 repo: %s", err)
+	}
+	defer repo.Close()
+
+	src := t.TempDir()
+	path := filepath.Join(src, "b1_2023-01-02T15:04:05Z.dump")
+	if err := os.WriteFile(path, []byte("some data"), 0600); err != nil {
+		t.Fatalf("could not create test file: %s", err)
+	}
+
+	target := "pg_back-test/b1_2023-01-02T15:04:05Z.dump"
+	if err := repo.Upload(path, target); err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+	defer repo.Remove(target)
+
+	// Download takes the remote name first and the local path second,
+	// the local source must be left untouched
+	back := filepath.Join(src, "downloaded.dump")
+	if err := repo.Download(target, back); err != nil {
+		t.Fatalf("download failed: %s", err)
+	}
+
+	for _, p := range []string{path, back} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("could not read %s: %s", p, err)
+		}
+
+		if string(data) != "some data" {
+			t.Errorf("%s: got %q, want %q", p, string(data), "some data")
+		}
+	}
+}
+
+// corruptRepo is a local repo that alters downloaded files
+type corruptRepo struct {
+	*localRepo
+}
+
+func (r corruptRepo) Download(target string, path string) error {
+	return os.WriteFile(path, []byte("corrupted"), 0600)
+}
+
+func TestVerifyUpload(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+
+	repo, err := NewLocalRepo(options{LocalDirectory: dst})
+	if err != nil {
+		t.Fatalf("could not create local repo: %s", err)
+	}
+	defer repo.Close()
+
+	path := filepath.Join(src, "b1_2023-01-02T15:04:05Z.dump")
+	if err := os.WriteFile(path, []byte("some data"), 0600); err != nil {
+		t.Fatalf("could not create test file: %s", err)
+	}
+
+	target := "b1_2023-01-02T15:04:05Z.dump"
+	if err := repo.Upload(path, target); err != nil {
+		t.Fatalf("upload failed: %s", err)
+	}
+
+	if err := verifyUpload(repo, path, target, "sha256"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	if err := verifyUpload(corruptRepo{repo}, path, target, "xxh3"); err == nil {
+		t.Errorf("expected an error on a corrupted upload")
+	}
+
+	// The downloaded copies must not be left behind
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the source file in %s, got %d entries", src, len(entries))
+	}
+}
+
+func TestSFTPUploadRename(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("testing on windows")
+	}
+
+	dir := t.TempDir()
+	local := t.TempDir()
+
+	c1, c2 := net.Pipe()
+	server, err := sftp.NewServer(c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	defer server.Close()
+
+	client, err := sftp.NewClientPipe(c2, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	repo := &sftpRepo{baseDir: dir, client: client}
+
+	path := filepath.Join(local, "db_2023-01-02T03:04:05Z.dump")
+	for _, content := range []string{"first", "second"} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// An existing file is replaced
+		if err := repo.Upload(path, "db/db_2023-01-02T03:04:05Z.dump"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		got, err := os.ReadFile(filepath.Join(dir, "db", "db_2023-01-02T03:04:05Z.dump"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != content {
+			t.Errorf("got %q, want %q", got, content)
+		}
+	}
+
+	// Leftovers of an interrupted upload are not listed
+	if err := os.WriteFile(filepath.Join(dir, "db", "db_2023-01-03T03:04:05Z.dump"+sftpPartSuffix), []byte("trunc"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := repo.List("db/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if len(items) != 1 || items[0].key != "db/db_2023-01-02T03:04:05Z.dump" {
+		t.Errorf("unexpected list of files: %v", items)
+	}
+}
+
+// fakeS3List serves the keys starting with the prefix like ListObjectsV2,
+// pageSize at a time. Without tokens, truncated results have no
+// continuation token, like on some S3 compatible services.
+func fakeS3List(keys []string, pageSize int, tokens bool) func(*s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return func(in *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+		matching := make([]string, 0)
+		for _, k := range keys {
+			if strings.HasPrefix(k, aws.StringValue(in.Prefix)) {
+				matching = append(matching, k)
+			}
+		}
+		slices.Sort(matching)
+
+		start := 0
+		if in.ContinuationToken != nil {
+			start, _ = strconv.Atoi(*in.ContinuationToken)
+		} else if in.StartAfter != nil {
+			start, _ = slices.BinarySearch(matching, *in.StartAfter)
+			if start < len(matching) && matching[start] == *in.StartAfter {
+				start++
+			}
+		}
+
+		end := min(start+pageSize, len(matching))
+		out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(end < len(matching))}
+		for _, k := range matching[start:end] {
+			out.Contents = append(out.Contents, &s3.Object{Key: aws.String(k), LastModified: aws.Time(time.Time{})})
+		}
+
+		if tokens && end < len(matching) {
+			out.NextContinuationToken = aws.String(strconv.Itoa(end))
+		}
+
+		return out, nil
+	}
+}
+
+func TestListS3Objects(t *testing.T) {
+	keys := []string{
+		"backups/db_2023-05-01T10:00:00Z.dump",
+		"backups/db_2023-05-01T10:00:00Z.dump.sha256",
+		"backups/db_2023-05-02T10:00:00Z.dump",
+		"backups/pg_globals_2023-05-01T10:00:00Z.sql",
+		"backups/pg_globals_2023-05-02T10:00:00Z.sql",
+		"other/db_2023-05-01T10:00:00Z.dump",
+	}
+
+	var tests = []struct {
+		prefix   string
+		pageSize int
+		tokens   bool
+		want     int
+	}{
+		{"", 1000, true, 6},
+		{"", 2, true, 6},
+		{"", 2, false, 6},
+		{"backups/", 1, false, 5},
+		{filepath.Join("backups", "pg_globals"), 1, true, 2},
+		{"none", 2, false, 0},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			items, err := listS3Objects(fakeS3List(keys, st.pageSize, st.tokens), "bucket", st.prefix)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			got := make([]string, 0, len(items))
+			for _, i := range items {
+				got = append(got, i.key)
+			}
+
+			if len(got) != st.want || !slices.IsSorted(got) || len(slices.Compact(got)) != st.want {
+				t.Errorf("got %v, want %d distinct keys", got, st.want)
+			}
+		})
+	}
+
+	// A truncated empty page without token must not loop forever
+	empty := func(in *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+		return &s3.ListObjectsV2Output{IsTruncated: aws.Bool(true)}, nil
+	}
+	if _, err := listS3Objects(empty, "bucket", ""); err == nil {
+		t.Errorf("expected an error on a truncated result without continuation")
+	}
+
+	// Some services do not set the truncated flag on the last page
+	noFlag := func(in *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+		return &s3.ListObjectsV2Output{Contents: []*s3.Object{{Key: aws.String("k")}}}, nil
+	}
+	if items, err := listS3Objects(noFlag, "bucket", ""); err != nil || len(items) != 1 {
+		t.Errorf("got %v and %v, want one item", items, err)
+	}
+
+	failing := func(in *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+		return nil, errors.New("access denied")
+	}
+	if _, err := listS3Objects(failing, "bucket", ""); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+// memRepo is a remote keeping its files in memory, keyed by their target
+// with forward slashes, to test uploads and purges without network access
+type memRepo struct {
+	mu    sync.Mutex
+	files map[string]memFile
+}
+
+type memFile struct {
+	data    []byte
+	modtime time.Time
+}
+
+func newMemRepo() *memRepo {
+	return &memRepo{files: make(map[string]memFile)}
+}
+
+// put stores a file on the remote as if it was uploaded at modtime
+func (r *memRepo) put(key string, data []byte, modtime time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.files[forwardSlashes(key)] = memFile{data: data, modtime: modtime}
+}
+
+// keys gives the sorted keys of the files on the remote
+func (r *memRepo) keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]string, 0, len(r.files))
+	for k := range r.files {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func (r *memRepo) Upload(path string, target string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	r.put(target, data, time.Now())
+	return nil
+}
+
+func (r *memRepo) Download(target string, path string) error {
+	r.mu.Lock()
+	f, ok := r.files[forwardSlashes(target)]
+	r.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("could not download %s: %w", target, os.ErrNotExist)
+	}
+
+	return os.WriteFile(path, f.data, 0600)
+}
+
+func (r *memRepo) List(prefix string) ([]Item, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	items := make([]Item, 0)
+	for k, f := range r.files {
+		if strings.HasPrefix(k, forwardSlashes(prefix)) {
+			items = append(items, Item{key: k, modtime: f.modtime})
+		}
+	}
+
+	slices.SortFunc(items, func(a, b Item) int {
+		return strings.Compare(a.key, b.key)
+	})
+
+	return items, nil
+}
+
+func (r *memRepo) Remove(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.files[forwardSlashes(path)]; !ok {
+		return fmt.Errorf("could not remove %s: %w", path, os.ErrNotExist)
+	}
+
+	delete(r.files, forwardSlashes(path))
+	return nil
+}
+
+func (r *memRepo) Close() error {
+	return nil
+}
+
+// brokenRepo is a remote refusing uploads
+type brokenRepo struct {
+	*memRepo
+}
+
+func (r brokenRepo) Upload(path string, target string) error {
+	return errors.New("connection reset by peer")
+}
+
+func TestS3RepoAssumeRole(t *testing.T) {
+	// STS requests go to the custom endpoint of the session, it answers
+	// AssumeRole with the credentials of the role
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("could not parse request: %s", err)
+		}
+		form = r.PostForm
+		fmt.Fprint(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>rolekey</AccessKeyId>
+      <SecretAccessKey>rolesecret</SecretAccessKey>
+      <SessionToken>roletoken</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`)
+	}))
+	defer srv.Close()
+
+	var tests = []struct {
+		conf     string
+		wantKey  string
+		wantName string
+	}{
+		{"", "static", ""},
+		{"s3_role_arn = arn:aws:iam::123456789012:role/backup\n", "rolekey", "pg_back"},
+		{"s3_role_arn = arn:aws:iam::123456789012:role/backup\ns3_role_session_name = nightly\n", "rolekey", "nightly"},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			form = nil
+			cfg := filepath.Join(t.TempDir(), "pg_back.conf")
+			content := fmt.Sprintf("s3_region = us-east-1\ns3_bucket = bucket\ns3_key_id = static\ns3_secret = secret\ns3_endpoint = %s\n%s", srv.URL, st.conf)
+			if err := os.WriteFile(cfg, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			opts, err := loadConfigurationFile(cfg, "")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			r, err := NewS3Repo(opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			creds, err := r.session.Config.Credentials.Get()
+			if err != nil {
+				t.Fatalf("could not get credentials: %s", err)
+			}
+			if creds.AccessKeyID != st.wantKey {
+				t.Errorf("got key %s, want %s", creds.AccessKeyID, st.wantKey)
+			}
+
+			if st.wantName == "" {
+				if form != nil {
+					t.Errorf("unexpected STS request: %v", form)
+				}
+				return
+			}
+
+			if form.Get("Action") != "AssumeRole" || form.Get("RoleArn") != opts.S3RoleARN || form.Get("RoleSessionName") != st.wantName {
+				t.Errorf("unexpected STS request: %v", form)
+			}
+		})
+	}
+}
+
+func TestAbortS3Uploads(t *testing.T) {
+	uploads := []*s3.MultipartUpload{
+		{Key: aws.String("db.dump"), UploadId: aws.String("1")},
+		{Key: aws.String("db.dump.sha256"), UploadId: aws.String("2")},
+		{Key: aws.String("db.dump"), UploadId: aws.String("3")},
+	}
+
+	// One upload per page
+	list := func(in *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
+		start := 0
+		if in.UploadIdMarker != nil {
+			start, _ = strconv.Atoi(*in.UploadIdMarker)
+		}
+
+		out := &s3.ListMultipartUploadsOutput{Uploads: uploads[start : start+1]}
+		if start+1 < len(uploads) {
+			out.IsTruncated = aws.Bool(true)
+			out.NextKeyMarker = uploads[start].Key
+			out.NextUploadIdMarker = aws.String(strconv.Itoa(start + 1))
+		}
+
+		return out, nil
+	}
+
+	aborted := make([]string, 0)
+	abort := func(in *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+		aborted = append(aborted, *in.Key+"/"+*in.UploadId)
+		return &s3.AbortMultipartUploadOutput{}, nil
+	}
+
+	if err := abortS3Uploads(list, abort, "bucket", "db.dump"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if diff := cmp.Diff([]string{"db.dump/1", "db.dump/3"}, aborted); diff != "" {
+		t.Errorf("abortS3Uploads() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestS3RepoUploadRetries(t *testing.T) {
+	// The fake S3 service has no incomplete upload and refuses the
+	// first uploads
+	var (
+		mu   sync.Mutex
+		puts int
+		body string
+	)
+	failures := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.URL.Query()["uploads"]; ok && r.Method == http.MethodGet {
+			fmt.Fprint(w, `<ListMultipartUploadsResult><Bucket>bucket</Bucket><IsTruncated>false</IsTruncated></ListMultipartUploadsResult>`)
+			return
+		}
+
+		if r.Method != http.MethodPut {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		puts++
+		if puts <= failures {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<Error><Code>InvalidArgument</Code><Message>refused</Message></Error>`)
+			return
+		}
+
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "db.dump")
+	if err := os.WriteFile(path, []byte("dump contents"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		failures int
+		retries  int
+		fails    bool
+	}{
+		{0, 0, false},
+		{1, 0, true},
+		{2, 2, false},
+		{3, 2, true},
+	}
+
+	for i, st := range tests {
+		t.Run(fmt.Sprintf("%v", i), func(t *testing.T) {
+			mu.Lock()
+			puts, failures, body = 0, st.failures, ""
+			mu.Unlock()
+
+			opts := defaultOptions()
+			opts.S3Region = "us-east-1"
+			opts.S3Bucket = "bucket"
+			opts.S3KeyID = "key"
+			opts.S3Secret = "secret"
+			opts.S3EndPoint = srv.URL
+			opts.S3ForcePath = true
+			opts.S3Retries = st.retries
+
+			r, err := NewS3Repo(opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			err = r.Upload(path, "db.dump")
+			if st.fails {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			// The whole file is sent again on retry
+			mu.Lock()
+			defer mu.Unlock()
+			if body != "dump contents" {
+				t.Errorf("got %q uploaded", body)
+			}
+		})
+	}
+}
+
+func TestMemRepo(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "db_2023-05-01T10:00:00Z.dump")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := newMemRepo()
+	if err := repo.Upload(path, filepath.Join("backups", "db_2023-05-01T10:00:00Z.dump")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	repo.put("other/db_2023-05-01T10:00:00Z.dump", []byte("other"), time.Now())
+
+	items, err := repo.List("backups/")
+	if err != nil || len(items) != 1 || items[0].key != "backups/db_2023-05-01T10:00:00Z.dump" {
+		t.Errorf("got %v and %v, want the uploaded file", items, err)
+	}
+
+	copyPath := filepath.Join(dir, "copy")
+	if err := repo.Download("backups/db_2023-05-01T10:00:00Z.dump", copyPath); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if data, _ := os.ReadFile(copyPath); string(data) != "data" {
+		t.Errorf("got %q, want %q", string(data), "data")
+	}
+
+	if err := repo.Remove("backups/db_2023-05-01T10:00:00Z.dump"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := repo.Remove("backups/db_2023-05-01T10:00:00Z.dump"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want a not exist error", err)
+	}
+	if err := repo.Download("missing", copyPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want a not exist error", err)
+	}
+
+	if diff := cmp.Diff([]string{"other/db_2023-05-01T10:00:00Z.dump"}, repo.keys()); diff != "" {
+		t.Errorf("keys mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompressOnUpload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pg_globals_2023-05-01T10:00:00Z.sql")
+	data := strings.Repeat("CREATE ROLE r;\n", 100)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	src, suffix, err := uploadSource(path, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if src == path || suffix != ".gz" {
+		t.Fatalf("got %s and %q, want a compressed copy", src, suffix)
+	}
+	if filepath.Dir(src) == dir {
+		t.Errorf("compressed copy %s written in the backup directory", src)
+	}
+
+	// The compressed copy is downloaded as the remote file
+	downloaded := filepath.Join(t.TempDir(), "pg_globals_2023-05-01T10:00:00Z.sql.gz")
+	if err := os.Rename(src, downloaded); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decompressDownload(downloaded)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got != strings.TrimSuffix(downloaded, ".gz") {
+		t.Errorf("got %s, want the path without .gz", got)
+	}
+	if b, _ := os.ReadFile(got); string(b) != data {
+		t.Errorf("decompressed file does not match the original")
+	}
+	if _, err := os.Stat(downloaded); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("compressed download left behind: %v", err)
+	}
+
+	// Already compressed or encrypted files are sent as is
+	for _, name := range []string{"db.sql.gz", "db.tar.zst", "db.dump.age"} {
+		if src, suffix, err := uploadSource(filepath.Join(dir, name), true); err != nil || src != filepath.Join(dir, name) || suffix != "" {
+			t.Errorf("%s: got %s, %q and %v, want the file itself", name, src, suffix, err)
+		}
+	}
+
+	if src, suffix, err := uploadSource(path, false); err != nil || src != path || suffix != "" {
+		t.Errorf("got %s, %q and %v, want the file itself", src, suffix, err)
+	}
+
+	// Files compressed by pg_dump are not decompressed
+	pgdump := filepath.Join(dir, "db_2023-05-01T10:00:00Z.sql.gz")
+	f, err := os.Create(pgdump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte("select 1;"))
+	gz.Close()
+	f.Close()
+
+	if got, err := decompressDownload(pgdump); err != nil || got != pgdump {
+		t.Errorf("got %s and %v, want %s untouched", got, err, pgdump)
+	}
+}
@@ -0,0 +1,87 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+)
+
+// workerPool limits the total number of pg_dump processes running at the
+// same time, the parallel jobs of directory format dumps included. Each free
+// worker is a token in the channel, a nil pool has no limit.
+type workerPool chan struct{}
+
+func newWorkerPool(size int) workerPool {
+	if size <= 0 {
+		return nil
+	}
+
+	p := make(workerPool, size)
+	for i := 0; i < size; i++ {
+		p <- struct{}{}
+	}
+
+	return p
+}
+
+// acquire takes up to n workers from the pool, waiting for at least one to
+// be free. Fewer workers than requested are given when the pool is busy,
+// instead of waiting for all of them. It returns the number of workers
+// taken, that must be given back with release.
+func (p workerPool) acquire(ctx context.Context, n int) (int, error) {
+	if p == nil {
+		return n, nil
+	}
+
+	select {
+	case <-p:
+	case <-ctx.Done():
+		return 0, context.Cause(ctx)
+	}
+
+	got := 1
+	for got < n {
+		select {
+		case <-p:
+			got++
+		default:
+			return got, nil
+		}
+	}
+
+	return got, nil
+}
+
+// release gives back n workers to the pool
+func (p workerPool) release(n int) {
+	if p == nil {
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		p <- struct{}{}
+	}
+}
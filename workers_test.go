@@ -0,0 +1,79 @@
+// pg_back
+//
+// Copyright 2011-2021 Nicolas Thauvin and contributors. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+//
+//  1. Redistributions of source code must retain the above copyright
+//     notice, this list of conditions and the following disclaimer.
+//  2. Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE AUTHORS ``AS IS'' AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES
+// OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED.
+// IN NO EVENT SHALL THE AUTHORS OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+// INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND
+// ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF
+// THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	// A nil pool gives all the workers asked for
+	var nilPool workerPool
+	if n, err := nilPool.acquire(context.Background(), 4); n != 4 || err != nil {
+		t.Errorf("expected 4 workers from a nil pool, got %d, %v", n, err)
+	}
+	nilPool.release(4)
+
+	p := newWorkerPool(3)
+
+	n, err := p.acquire(context.Background(), 2)
+	if n != 2 || err != nil {
+		t.Fatalf("expected 2 workers, got %d, %v", n, err)
+	}
+
+	// Only one worker is left, it is given instead of waiting for more
+	m, err := p.acquire(context.Background(), 4)
+	if m != 1 || err != nil {
+		t.Fatalf("expected 1 worker, got %d, %v", m, err)
+	}
+
+	// The pool is empty, acquire waits until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.acquire(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline exceeded error, got %v", err)
+	}
+
+	// Released workers can be taken again
+	done := make(chan int)
+	go func() {
+		n, _ := p.acquire(context.Background(), 3)
+		done <- n
+	}()
+
+	p.release(n)
+	select {
+	case got := <-done:
+		if got < 1 || got > 2 {
+			t.Errorf("expected 1 or 2 workers, got %d", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("acquire did not return after release")
+	}
+}